@@ -0,0 +1,471 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/build"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const (
+	checkText  = "text"
+	checkJUnit = "junit"
+	checkSARIF = "sarif"
+
+	// ruleSQL and ruleHTTP are the callees of rules forbidding SQL queries
+	// and HTTP client requests.
+	ruleSQL  = "sql"
+	ruleHTTP = "http"
+)
+
+type CheckOptions struct {
+	format     string
+	output     string
+	appmapPath string
+	filter     files.Filter
+}
+
+// validateRules checks the rules of appmap.yml can be evaluated.
+func validateRules(rules []config.AppMapRule) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("no rules to check")
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		switch {
+		case rule.Name == "":
+			return fmt.Errorf("rule %d has no name", i+1)
+		case names[rule.Name]:
+			return fmt.Errorf("rule %s is defined twice", rule.Name)
+		case rule.Caller == "" || rule.Callee == "":
+			return fmt.Errorf("rule %s needs a caller and a callee", rule.Name)
+		case rule.Caller == ruleSQL || rule.Caller == ruleHTTP:
+			return fmt.Errorf("rule %s: %s doesn't call anything", rule.Name, rule.Caller)
+		}
+		names[rule.Name] = true
+	}
+	return nil
+}
+
+// ruleMatches reports whether a call is of the code a rule refers to. Code is
+// matched like the packages of appmap.yml, by class name or by path.
+func ruleMatches(pattern string, e *appmap.Event) bool {
+	switch pattern {
+	case ruleSQL:
+		return e.SQLQuery != nil
+	case ruleHTTP:
+		return e.HTTPClientRequest != nil
+	}
+	if !e.IsFunctionCall() {
+		return false
+	}
+	i, _ := findPackage([]config.AppMapPackage{{Path: pattern}}, e.DefinedClass, e.Path)
+	return i >= 0
+}
+
+// ruleViolation is a call a rule forbids.
+type ruleViolation struct {
+	rule    *config.AppMapRule
+	file    string
+	eventID int
+	// callPath is the calls leading to the forbidden call, and the call itself.
+	callPath []string
+	// path and lineno locate the caller, if they're known.
+	path   string
+	lineno int
+}
+
+func (v *ruleViolation) describe() string {
+	if v.rule.Description != "" {
+		return v.rule.Name + ": " + v.rule.Description
+	}
+	return v.rule.Name
+}
+
+func (v *ruleViolation) describeCallPath() string {
+	calls := make([]string, len(v.callPath))
+	for i, call := range v.callPath {
+		calls[i] = messageLabel(call)
+	}
+	return strings.Join(calls, " -> ")
+}
+
+// ruleChecker evaluates rules against the call tree of an AppMap, as it's
+// read. The value of the frame of a call is its event.
+type ruleChecker struct {
+	rules      []config.AppMapRule
+	file       string
+	violations []ruleViolation
+}
+
+func newRuleChecker(rules []config.AppMapRule, file string) *ruleChecker {
+	return &ruleChecker{rules: rules, file: file}
+}
+
+// caller finds the call on the stack a rule forbids from making a call: the
+// function making it, or any function beneath which it's made if the rule is
+// transitive.
+func caller(stack []appmap.Frame, rule *config.AppMapRule) *appmap.Event {
+	for j := len(stack) - 1; j >= 0; j-- {
+		e := stack[j].Value.(*appmap.Event)
+		if !e.IsFunctionCall() {
+			continue
+		}
+		if ruleMatches(rule.Caller, e) {
+			return e
+		}
+		if !rule.Transitive {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *ruleChecker) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	for i := range c.rules {
+		rule := &c.rules[i]
+		if !ruleMatches(rule.Callee, e) {
+			continue
+		}
+		from := caller(stack, rule)
+		if from == nil {
+			continue
+		}
+
+		v := ruleViolation{rule: rule, file: c.file, eventID: e.ID, path: from.Path, lineno: from.Lineno}
+		for _, frame := range stack {
+			v.callPath = append(v.callPath, callName(frame.Value.(*appmap.Event)))
+		}
+		v.callPath = append(v.callPath, callName(e))
+		c.violations = append(c.violations, v)
+	}
+	return e
+}
+
+func (c *ruleChecker) Return(ret *appmap.Event, call *appmap.Frame) {}
+
+// checkAppmap evaluates rules against an AppMap.
+func checkAppmap(fname string, rules []config.AppMapRule) ([]ruleViolation, error) {
+	f, err := files.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %w", fname, err)
+	}
+	defer f.Close()
+
+	c := newRuleChecker(rules, fname)
+	if _, err := appmap.StreamCalls(f, c); err != nil {
+		return nil, fmt.Errorf("failed decoding %s: %w", fname, err)
+	}
+	return c.violations, nil
+}
+
+// checkReport is the outcome of checking rules against AppMaps.
+type checkReport struct {
+	rules      []config.AppMapRule
+	files      []string
+	violations []ruleViolation
+}
+
+// violatingFiles is the number of AppMaps with violations.
+func (r *checkReport) violatingFiles() int {
+	files := make(map[string]bool)
+	for _, v := range r.violations {
+		files[v.file] = true
+	}
+	return len(files)
+}
+
+func writeCheckText(w io.Writer, r *checkReport) {
+	for _, v := range r.violations {
+		fmt.Fprintf(w, "%s: event %d: %s\n", v.file, v.eventID, v.describe())
+		fmt.Fprintf(w, "  %s\n", v.describeCallPath())
+	}
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeCheckJUnit writes a test suite for each rule, made of a test case for
+// each AppMap, which fails if the AppMap violates the rule.
+func writeCheckJUnit(w io.Writer, r *checkReport) error {
+	type ruleFile struct {
+		rule *config.AppMapRule
+		file string
+	}
+	details := make(map[ruleFile][]string)
+	for _, v := range r.violations {
+		key := ruleFile{v.rule, v.file}
+		details[key] = append(details[key], fmt.Sprintf("event %d: %s", v.eventID, v.describeCallPath()))
+	}
+
+	suites := junitTestSuites{Name: "appland check"}
+	for i := range r.rules {
+		rule := &r.rules[i]
+		suite := junitTestSuite{Name: rule.Name}
+		for _, file := range r.files {
+			testCase := junitTestCase{Name: file, ClassName: rule.Name}
+			if details := details[ruleFile{rule, file}]; len(details) > 0 {
+				message := rule.Name
+				if rule.Description != "" {
+					message = rule.Description
+				}
+				testCase.Failure = &junitFailure{
+					Message: fmt.Sprintf("%s (%d violation(s))", message, len(details)),
+					Type:    rule.Name,
+					Text:    strings.Join(details, "\n"),
+				}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Tests = len(suite.Cases)
+
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	RuleIndex  int                    `json:"ruleIndex"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeCheckSARIF writes the violations as SARIF results, located at the
+// code making the forbidden calls when it's known, and at the AppMap
+// otherwise.
+func writeCheckSARIF(w io.Writer, r *checkReport) error {
+	driver := sarifDriver{
+		Name:           "appland",
+		Version:        build.Version,
+		InformationURI: "https://github.com/applandinc/appland-cli",
+		Rules:          []sarifRule{},
+	}
+	ruleIndex := make(map[*config.AppMapRule]int)
+	for i := range r.rules {
+		rule := &r.rules[i]
+		description := rule.Description
+		if description == "" {
+			description = rule.Name
+		}
+		ruleIndex[rule] = i
+		driver.Rules = append(driver.Rules, sarifRule{ID: rule.Name, ShortDescription: sarifMessage{description}})
+	}
+
+	results := []sarifResult{}
+	for _, v := range r.violations {
+		location := sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: v.file}}
+		if v.path != "" {
+			location.ArtifactLocation.URI = v.path
+			if v.lineno > 0 {
+				location.Region = &sarifRegion{StartLine: v.lineno}
+			}
+		}
+
+		results = append(results, sarifResult{
+			RuleID:    v.rule.Name,
+			RuleIndex: ruleIndex[v.rule],
+			Level:     "error",
+			Message:   sarifMessage{fmt.Sprintf("%s, called as %s in %s (event %d)", v.describe(), v.describeCallPath(), v.file, v.eventID)},
+			Locations: []sarifLocation{{location}},
+			Properties: map[string]interface{}{
+				"appmap":   v.file,
+				"event_id": v.eventID,
+			},
+		})
+	}
+
+	log := sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{{Tool: sarifTool{driver}, Results: results}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
+
+func NewCheckCommand(options *CheckOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check [files, directories]",
+		Short: "Check AppMaps against the architecture rules of appmap.yml",
+		Long: `Check AppMaps against the architecture rules of appmap.yml
+
+Each rule of the rules section of appmap.yml forbids code from calling other
+code, SQL queries or HTTP requests. Each call a rule forbids is reported with
+the AppMap, the id of its event and the calls leading to it, as text, JUnit XML
+or SARIF. Exits with a non-zero status if any rule is violated.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if options.format != checkText && options.format != checkJUnit && options.format != checkSARIF {
+				return fmt.Errorf("invalid format %q, must be %s, %s or %s", options.format, checkText, checkJUnit, checkSARIF)
+			}
+			cmd.SilenceUsage = true
+
+			appmapConfig, err := config.LoadAppmapConfig(options.appmapPath, files.Origin(args[0]))
+			if err != nil {
+				return fmt.Errorf("failed loading rules: %w", err)
+			}
+			if err := validateRules(appmapConfig.Rules); err != nil {
+				return fmt.Errorf("%s: %w", appmapConfig.Path(), err)
+			}
+
+			fnames, err := files.Find(args, options.filter)
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+
+			report := &checkReport{rules: appmapConfig.Rules, files: fnames}
+			for _, fname := range fnames {
+				violations, err := checkAppmap(fname, report.rules)
+				if err != nil {
+					return err
+				}
+				report.violations = append(report.violations, violations...)
+			}
+
+			var buf bytes.Buffer
+			switch options.format {
+			case checkJUnit:
+				err = writeCheckJUnit(&buf, report)
+			case checkSARIF:
+				err = writeCheckSARIF(&buf, report)
+			default:
+				writeCheckText(&buf, report)
+			}
+			if err != nil {
+				return err
+			}
+
+			if options.output == "" {
+				if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+					return err
+				}
+			} else if err := afero.WriteFile(config.GetFS(), options.output, buf.Bytes(), 0644); err != nil {
+				return err
+			}
+
+			if len(report.violations) > 0 {
+				return fmt.Errorf("%d violation(s) of the rules in %d of %d AppMaps", len(report.violations), report.violatingFiles(), len(fnames))
+			}
+			if options.format == checkText {
+				fmt.Printf("%d AppMaps follow the %d rule(s)\n", len(fnames), len(report.rules))
+			}
+			return nil
+		},
+	}
+}
+
+func init() {
+	var (
+		options  = &CheckOptions{}
+		checkCmd = NewCheckCommand(options)
+	)
+
+	f := checkCmd.Flags()
+	f.StringVar(&options.format, "format", checkText, "Output format, text, junit or sarif")
+	f.StringVarP(&options.output, "output", "o", "", "Write the results to this file instead of stdout")
+	f.StringVar(&options.appmapPath, "appmap-config", "", "Path of the appmap.yml defining the rules")
+	addFilterFlags(f, &options.filter)
+
+	rootCmd.AddCommand(checkCmd)
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const checkTestAppmap = `{"events":[
+	{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/users"}},
+	{"id":2,"event":"call","thread_id":1,"defined_class":"UsersController","method_id":"index","path":"app/controllers/users_controller.rb","lineno":3,"static":false},
+	{"id":3,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM users"}},
+	{"id":4,"event":"return","thread_id":1,"parent_id":3},
+	{"id":5,"event":"call","thread_id":1,"defined_class":"User","method_id":"all","path":"app/models/user.rb","lineno":7,"static":true},
+	{"id":6,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM users"}},
+	{"id":7,"event":"return","thread_id":1,"parent_id":6},
+	{"id":8,"event":"call","thread_id":1,"defined_class":"Billing::Client","method_id":"charge","path":"lib/billing/client.rb","lineno":12,"static":false},
+	{"id":9,"event":"call","thread_id":1,"http_client_request":{"request_method":"POST","url":"https://pay.example.com/charges"}},
+	{"id":10,"event":"return","thread_id":1,"parent_id":9},
+	{"id":11,"event":"return","thread_id":1,"parent_id":5},
+	{"id":12,"event":"call","thread_id":1,"defined_class":"Billing::Client","method_id":"refund","path":"lib/billing/client.rb","lineno":20,"static":false},
+	{"id":13,"event":"return","thread_id":1,"parent_id":12},
+	{"id":14,"event":"call","thread_id":2,"defined_class":"Billing::Client","method_id":"charge","path":"lib/billing/client.rb","lineno":12,"static":false},
+	{"id":15,"event":"return","thread_id":2,"parent_id":14},
+	{"id":16,"event":"return","thread_id":1,"parent_id":2},
+	{"id":17,"event":"return","thread_id":1,"parent_id":1}
+]}`
+
+const checkAppmapConfig = `name: example
+packages:
+- path: app
+rules:
+- name: no-sql-in-controllers
+  description: Controllers may not query the database directly
+  caller: app/controllers
+  callee: sql
+- name: no-billing-from-controllers
+  caller: app/controllers
+  callee: lib/billing
+  transitive: true
+- name: no-billing-from-models
+  caller: User
+  callee: Billing
+- name: no-http-from-models
+  caller: app/models
+  callee: http
+  transitive: true
+`
+
+func writeCheckFiles(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "appmap.yml", []byte(checkAppmapConfig), 0644))
+	require.Nil(t, afero.WriteFile(fs, "users.appmap.json", []byte(checkTestAppmap), 0644))
+	return fs
+}
+
+func TestCheckRules(t *testing.T) {
+	writeCheckFiles(t)
+	appmapConfig, err := config.LoadAppmapConfig("appmap.yml", "")
+	require.Nil(t, err)
+	require.Nil(t, validateRules(appmapConfig.Rules))
+
+	violations, err := checkAppmap("users.appmap.json", appmapConfig.Rules)
+	require.Nil(t, err)
+
+	// The query made by the model isn't made by the controller itself. The
+	// charge made by the model is missing its return, the refund is still
+	// made by the controller. Nothing calls the charge of the other thread.
+	buf := new(bytes.Buffer)
+	writeCheckText(buf, &checkReport{violations: violations})
+	assert.Equal(t, `users.appmap.json: event 3: no-sql-in-controllers: Controllers may not query the database directly
+  GET /users -> UsersController#index -> SELECT * FROM users
+users.appmap.json: event 8: no-billing-from-controllers
+  GET /users -> UsersController#index -> User.all -> Billing::Client#charge
+users.appmap.json: event 8: no-billing-from-models
+  GET /users -> UsersController#index -> User.all -> Billing::Client#charge
+users.appmap.json: event 9: no-http-from-models
+  GET /users -> UsersController#index -> User.all -> Billing::Client#charge -> POST https://pay.example.com/charges
+users.appmap.json: event 12: no-billing-from-controllers
+  GET /users -> UsersController#index -> Billing::Client#refund
+`, buf.String())
+
+	// Violations are located at the caller the rule forbids
+	assert.Equal(t, "app/controllers/users_controller.rb", violations[1].path)
+	assert.Equal(t, 3, violations[1].lineno)
+	assert.Equal(t, "app/models/user.rb", violations[3].path)
+	assert.Equal(t, 7, violations[3].lineno)
+}
+
+func TestValidateRules(t *testing.T) {
+	for _, rules := range [][]config.AppMapRule{
+		nil,
+		{{Caller: "app", Callee: "lib"}},
+		{{Name: "a", Caller: "app", Callee: "lib"}, {Name: "a", Caller: "lib", Callee: "app"}},
+		{{Name: "a", Caller: "app"}},
+		{{Name: "queries", Caller: "sql", Callee: "app"}},
+		{{Name: "requests", Caller: "http", Callee: "app"}},
+	} {
+		assert.NotNil(t, validateRules(rules), "%v", rules)
+	}
+	assert.Nil(t, validateRules([]config.AppMapRule{{Name: "a", Caller: "app", Callee: "sql"}}))
+}
+
+// checkTestReport is a report of a violation in one of two AppMaps, made by a
+// caller which is located, and one by a caller which isn't.
+func checkTestReport() *checkReport {
+	rules := []config.AppMapRule{
+		{Name: "no-sql", Description: "No queries from views", Caller: "app/views", Callee: "sql"},
+		{Name: "no-http", Caller: "app/views", Callee: "http"},
+	}
+	return &checkReport{
+		rules: rules,
+		files: []string{"a.appmap.json", "b.appmap.json"},
+		violations: []ruleViolation{
+			{rule: &rules[0], file: "a.appmap.json", eventID: 4, callPath: []string{"View#render", "SELECT ?"}, path: "app/views/view.rb", lineno: 2},
+			{rule: &rules[0], file: "a.appmap.json", eventID: 6, callPath: []string{"View#render", "SELECT ?"}},
+		},
+	}
+}
+
+func TestCheckJUnit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.Nil(t, writeCheckJUnit(buf, checkTestReport()))
+
+	// A test case for each rule and AppMap, which fails with all of the
+	// violations of the rule in the AppMap
+	var suites junitTestSuites
+	require.Nil(t, xml.Unmarshal(buf.Bytes(), &suites))
+	assert.Equal(t, 4, suites.Tests)
+	assert.Equal(t, 1, suites.Failures)
+	require.Len(t, suites.Suites, 2)
+	cases := suites.Suites[0].Cases
+	require.NotNil(t, cases[0].Failure)
+	assert.Equal(t, "No queries from views (2 violation(s))", cases[0].Failure.Message)
+	assert.Equal(t, "event 4: View#render -> SELECT ?\nevent 6: View#render -> SELECT ?", cases[0].Failure.Text)
+	assert.Nil(t, cases[1].Failure)
+	assert.Equal(t, 0, suites.Suites[1].Failures)
+}
+
+func TestCheckSARIF(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.Nil(t, writeCheckSARIF(buf, checkTestReport()))
+
+	var log sarifLog
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &log))
+	require.Len(t, log.Runs, 1)
+	assert.Equal(t, []sarifRule{{"no-sql", sarifMessage{"No queries from views"}}, {"no-http", sarifMessage{"no-http"}}}, log.Runs[0].Tool.Driver.Rules)
+	require.Len(t, log.Runs[0].Results, 2)
+
+	// Violations are located at their caller if it's known, and at the
+	// AppMap otherwise
+	located := log.Runs[0].Results[0].Locations[0].PhysicalLocation
+	assert.Equal(t, "app/views/view.rb", located.ArtifactLocation.URI)
+	assert.Equal(t, &sarifRegion{StartLine: 2}, located.Region)
+	unlocated := log.Runs[0].Results[1].Locations[0].PhysicalLocation
+	assert.Equal(t, "a.appmap.json", unlocated.ArtifactLocation.URI)
+	assert.Nil(t, unlocated.Region)
+	assert.Equal(t, "no-sql: No queries from views, called as View#render -> SELECT ? in a.appmap.json (event 6)", log.Runs[0].Results[1].Message.Text)
+}
+
+func TestCheckCommand(t *testing.T) {
+	fs := writeCheckFiles(t)
+	require.Nil(t, afero.WriteFile(fs, "clean.appmap.json", []byte(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"User","method_id":"all","path":"app/models/user.rb","static":true},
+		{"id":2,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM users"}}
+	]}`), 0644))
+	require.Nil(t, afero.WriteFile(fs, "truncated.appmap.json", []byte(`{"events":[{"id":1,`), 0644))
+
+	cmd := NewCheckCommand(&CheckOptions{format: checkJUnit, appmapPath: "appmap.yml", output: "check.xml"})
+	err := cmd.RunE(cmd, []string{"users.appmap.json", "clean.appmap.json"})
+	require.NotNil(t, err)
+	assert.Equal(t, "5 violation(s) of the rules in 1 of 2 AppMaps", err.Error())
+
+	out, err := afero.ReadFile(fs, "check.xml")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "<?xml"))
+
+	require.Nil(t, cmd.RunE(cmd, []string{"clean.appmap.json"}))
+	assert.NotNil(t, cmd.RunE(cmd, []string{"truncated.appmap.json"}))
+
+	require.Nil(t, afero.WriteFile(fs, "appmap.yml", []byte("name: example\n"), 0644))
+	err = cmd.RunE(cmd, []string{"clean.appmap.json"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no rules to check")
+
+	cmd = NewCheckCommand(&CheckOptions{format: "html", appmapPath: "appmap.yml"})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"users.appmap.json"}))
+}
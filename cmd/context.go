@@ -57,7 +57,9 @@ func init() {
 Available variables:
 - url
 - api_key
-- name`,
+- name
+- retries
+- gzip`,
 			Args: cobra.ExactArgs(2),
 			Run: func(cmd *cobra.Command, args []string) {
 				key := args[0]
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	sortByCalls = "calls"
+	sortByTotal = "total"
+	sortBySelf  = "self"
+	sortByMean  = "mean"
+)
+
+var statsSortKeys = []string{sortByCalls, sortByTotal, sortBySelf, sortByMean}
+
+// callTime is the time spent in a call, in seconds.
+type callTime struct {
+	elapsed float64
+	// self excludes the time spent in the calls made by this one.
+	self float64
+}
+
+// timingSummary summarizes the elapsed time of the calls of a method, in
+// seconds.
+type timingSummary struct {
+	Total float64 `json:"total_time"`
+	Self  float64 `json:"self_time"`
+	Mean  float64 `json:"mean_time"`
+	P50   float64 `json:"p50_time"`
+	P95   float64 `json:"p95_time"`
+	Max   float64 `json:"max_time"`
+}
+
+// timeDistribution holds the elapsed times of calls, in seconds, to
+// summarize them by percentile. The times themselves are kept for the first
+// maxTrackedValues calls, beyond that they're counted in buckets of
+// exponentially growing width, so that percentiles are still within
+// timeSketchAccuracy of the actual times (a DDSketch).
+type timeDistribution struct {
+	Count int
+	Max   float64
+	times []float64
+	// buckets counts the times t with ceil(log(t)/log(timeSketchGamma)) = i,
+	// by i, and zeros those which are zero or less.
+	buckets map[int]int
+	zeros   int
+}
+
+const (
+	timeSketchAccuracy = 0.01
+	timeSketchGamma    = (1 + timeSketchAccuracy) / (1 - timeSketchAccuracy)
+)
+
+func (d *timeDistribution) add(t float64) {
+	if d.Count == 0 || t > d.Max {
+		d.Max = t
+	}
+	d.Count++
+
+	if d.buckets == nil && len(d.times) < maxTrackedValues {
+		d.times = append(d.times, t)
+		return
+	}
+
+	if d.buckets == nil {
+		d.buckets = make(map[int]int)
+		for _, tracked := range d.times {
+			d.count(tracked, 1)
+		}
+		d.times = nil
+	}
+	d.count(t, 1)
+}
+
+func (d *timeDistribution) count(t float64, n int) {
+	if t <= 0 {
+		d.zeros += n
+		return
+	}
+	d.buckets[int(math.Ceil(math.Log(t)/math.Log(timeSketchGamma)))] += n
+}
+
+// merge adds the times of other.
+func (d *timeDistribution) merge(other *timeDistribution) {
+	for _, t := range other.times {
+		d.add(t)
+	}
+	if other.buckets == nil {
+		return
+	}
+
+	if d.Count == 0 || other.Max > d.Max {
+		d.Max = other.Max
+	}
+	d.Count += other.zeros
+	for _, n := range other.buckets {
+		d.Count += n
+	}
+	if d.buckets == nil {
+		d.buckets = make(map[int]int)
+		for _, tracked := range d.times {
+			d.count(tracked, 1)
+		}
+		d.times = nil
+	}
+	d.zeros += other.zeros
+	for i, n := range other.buckets {
+		d.buckets[i] += n
+	}
+}
+
+// percentile returns the nearest-rank percentile p, between 0 and 1, of the
+// times.
+func (d *timeDistribution) percentile(p float64) float64 {
+	if d.Count == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(d.Count))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	if d.buckets == nil {
+		sorted := append([]float64{}, d.times...)
+		sort.Float64s(sorted)
+		return sorted[rank]
+	}
+
+	if rank < d.zeros {
+		return 0
+	}
+	rank -= d.zeros
+
+	indexes := make([]int, 0, len(d.buckets))
+	for i := range d.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		if rank < d.buckets[i] {
+			// The middle of the bucket, relative to its width
+			t := 2 * math.Pow(timeSketchGamma, float64(i)) / (timeSketchGamma + 1)
+			return math.Min(t, d.Max)
+		}
+		rank -= d.buckets[i]
+	}
+	return d.Max
+}
+
+// mean is the mean time, given their total.
+func (d *timeDistribution) mean(total float64) float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	return total / float64(d.Count)
+}
+
+// summarizeTimes summarizes the elapsed times of calls, or returns nil if
+// there are none.
+func summarizeTimes(elapsed *timeDistribution, total float64, self float64) *timingSummary {
+	if elapsed.Count == 0 {
+		return nil
+	}
+
+	return &timingSummary{
+		Total: roundSeconds(total),
+		Self:  roundSeconds(self),
+		Mean:  roundSeconds(elapsed.mean(total)),
+		P50:   elapsed.percentile(0.5),
+		P95:   elapsed.percentile(0.95),
+		Max:   elapsed.Max,
+	}
+}
+
+// timing summarizes the elapsed time of the method's calls, or returns nil
+// if none of them were timed.
+func (s Stats) timing() *timingSummary {
+	return summarizeTimes(&s.Elapsed, s.TotalTime, s.SelfTime)
+}
+
+// roundSeconds rounds sums of times to nanoseconds, dropping the error
+// accumulated by adding them up.
+func roundSeconds(seconds float64) float64 {
+	return math.Round(seconds*1e9) / 1e9
+}
+
+// sortValue is the value methods are sorted by, in descending order.
+func (s Stats) sortValue(by string) float64 {
+	switch by {
+	case sortByTotal:
+		return s.TotalTime
+	case sortBySelf:
+		return s.SelfTime
+	case sortByMean:
+		return s.Elapsed.mean(s.TotalTime)
+	default:
+		return float64(s.Calls)
+	}
+}
+
+func validateSortKey(by string) error {
+	if by == "" {
+		return nil
+	}
+	for _, key := range statsSortKeys {
+		if by == key {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid sort key %q, must be one of %v", by, statsSortKeys)
+}
+
+// formatSeconds formats a time in seconds for display, e.g. 12.5ms.
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Microsecond).String()
+}
+
+func (t *timingSummary) String() string {
+	return fmt.Sprintf("total %s, self %s, mean %s, p50 %s, p95 %s, max %s",
+		formatSeconds(t.Total), formatSeconds(t.Self), formatSeconds(t.Mean),
+		formatSeconds(t.P50), formatSeconds(t.P95), formatSeconds(t.Max))
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/config"
+)
+
+const (
+	defaultMinCallShare     = 0.01
+	defaultMaxDistinctRatio = 0.1
+)
+
+// excludeSuggestion is a class or package which accounts for a large share of
+// the calls in a set of AppMaps, while being called with few distinct
+// parameters. Code like that is usually noise.
+type excludeSuggestion struct {
+	Name          string  `json:"name"`
+	Package       string  `json:"package,omitempty"`
+	Exclude       string  `json:"exclude,omitempty"`
+	Calls         int     `json:"calls"`
+	CallShare     float64 `json:"call_share"`
+	DistinctRatio float64 `json:"distinct_ratio"`
+
+	// path is the file defining the class, or the directory holding the
+	// package, if it's known.
+	path     string
+	pkg      int
+	distinct int
+	classes  []*excludeSuggestion
+}
+
+func (s *excludeSuggestion) add(calls, distinct int) {
+	s.Calls += calls
+	s.distinct += distinct
+}
+
+func (s *excludeSuggestion) computeRatios(totalCalls uint64) {
+	s.CallShare = float64(s.Calls) / float64(totalCalls)
+	s.DistinctRatio = float64(s.distinct) / float64(s.Calls)
+}
+
+func (p StatsProcessor) isNoisy(s *excludeSuggestion) bool {
+	return s.CallShare >= p.minCallShare && s.DistinctRatio <= p.maxDistinctRatio
+}
+
+// parentName returns the package or module enclosing a class, e.g.
+// com.example for com.example.Main, or JSON::Ext for JSON::Ext::Parser.
+func parentName(class string) string {
+	i := strings.LastIndex(class, "::")
+	j := strings.LastIndex(class, ".")
+	switch {
+	case i > j:
+		return class[:i]
+	case j >= 0:
+		return class[:j]
+	}
+	return ""
+}
+
+// suggestExcludes finds the noisiest classes. If all of the classes recorded
+// in a package are noisy, the package is suggested instead.
+func (p StatsProcessor) suggestExcludes(totalCalls uint64, methodStats map[string]Stats) []*excludeSuggestion {
+	if totalCalls == 0 {
+		return []*excludeSuggestion{}
+	}
+
+	classes := map[string]*excludeSuggestion{}
+	for _, stats := range methodStats {
+		class, ok := classes[stats.Class]
+		if !ok {
+			class = &excludeSuggestion{Name: stats.Class, path: stats.Path}
+			classes[stats.Class] = class
+		}
+		class.add(stats.Calls, stats.distinctParams())
+	}
+
+	packages := map[string]*excludeSuggestion{}
+	for _, class := range classes {
+		class.computeRatios(totalCalls)
+
+		name := parentName(class.Name)
+		if name == "" {
+			continue
+		}
+
+		pkg, ok := packages[name]
+		if !ok {
+			pkg = &excludeSuggestion{Name: name, path: filepath.Dir(class.path)}
+			packages[name] = pkg
+		}
+		pkg.add(class.Calls, class.distinct)
+		pkg.classes = append(pkg.classes, class)
+		if pkg.path != filepath.Dir(class.path) {
+			pkg.path = ""
+		}
+	}
+
+	suggestions := []*excludeSuggestion{}
+	suggested := map[*excludeSuggestion]bool{}
+	for _, pkg := range packages {
+		if len(pkg.classes) < 2 {
+			continue
+		}
+
+		pkg.computeRatios(totalCalls)
+		allNoisy := true
+		for _, class := range pkg.classes {
+			allNoisy = allNoisy && p.isNoisy(class)
+		}
+		if !allNoisy {
+			continue
+		}
+
+		suggestions = append(suggestions, pkg)
+		for _, class := range pkg.classes {
+			suggested[class] = true
+		}
+	}
+
+	for _, class := range classes {
+		if !suggested[class] && p.isNoisy(class) {
+			suggestions = append(suggestions, class)
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Calls != suggestions[j].Calls {
+			return suggestions[i].Calls > suggestions[j].Calls
+		}
+		return suggestions[i].Name < suggestions[j].Name
+	})
+
+	return suggestions
+}
+
+// matchPackage finds the appmap.yml package a suggestion belongs to, and the
+// exclude entry for it. It returns -1 if no package matches.
+func matchPackage(packages []config.AppMapPackage, s *excludeSuggestion) (int, string) {
+	return findPackage(packages, s.Name, s.path)
+}
+
+// findPackage finds the appmap.yml package code belongs to, given the name of
+// a class or package and the file or directory defining it, if it's known.
+// Java packages are matched by name, Ruby packages by path. It returns -1 if
+// no package matches, and the exclude entry for the code otherwise.
+func findPackage(packages []config.AppMapPackage, name string, path string) (int, string) {
+	match, matchLength, exclude := -1, 0, ""
+	for i, pkg := range packages {
+		if pkg.Path == "" || len(pkg.Path) <= matchLength {
+			continue
+		}
+
+		switch {
+		case name == pkg.Path ||
+			strings.HasPrefix(name, pkg.Path+".") ||
+			strings.HasPrefix(name, pkg.Path+"::"):
+			exclude = name
+		case path != "" && strings.HasPrefix(path, pkg.Path+"/"):
+			exclude = strings.TrimSuffix(path, filepath.Ext(path))
+		default:
+			continue
+		}
+
+		match, matchLength = i, len(pkg.Path)
+	}
+
+	return match, exclude
+}
+
+// addExclude adds an entry to the exclude list of a package, unless it's
+// already there.
+func addExclude(pkg *config.AppMapPackage, exclude string) bool {
+	for _, e := range pkg.Exclude {
+		if e == exclude {
+			return false
+		}
+	}
+	pkg.Exclude = append(pkg.Exclude, exclude)
+	return true
+}
+
+// excludesSection is the suggested exclusions, by package of appmap.yml if
+// it was found.
+type excludesSection struct {
+	appmapConfig *config.AppMapConfig
+	suggestions  []*excludeSuggestion
+}
+
+func (s *excludesSection) value() interface{} {
+	return s.suggestions
+}
+
+func (s *excludesSection) text(w io.Writer) {
+	if len(s.suggestions) == 0 {
+		fmt.Fprintln(w, "No exclusions to suggest")
+		return
+	}
+
+	describe := func(s *excludeSuggestion) string {
+		return fmt.Sprintf("%d calls (%.1f%%), %.2f distinct parameters per call", s.Calls, s.CallShare*100, s.DistinctRatio)
+	}
+
+	fmt.Fprintf(w, "%d suggested exclusion(s)\n", len(s.suggestions))
+	if s.appmapConfig != nil {
+		header := "packages:"
+		for i, pkg := range s.appmapConfig.Packages {
+			var matched []*excludeSuggestion
+			for _, suggestion := range s.suggestions {
+				if suggestion.Package != "" && suggestion.pkg == i {
+					matched = append(matched, suggestion)
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+
+			if header != "" {
+				fmt.Fprintln(w, header)
+				header = ""
+			}
+			fmt.Fprintf(w, "- path: %s\n  exclude:\n", pkg.Path)
+			for _, suggestion := range matched {
+				fmt.Fprintf(w, "  - %s # %s\n", suggestion.Exclude, describe(suggestion))
+			}
+		}
+	}
+
+	unmatched := false
+	for _, suggestion := range s.suggestions {
+		if suggestion.Package != "" {
+			continue
+		}
+		if !unmatched {
+			fmt.Fprintln(w, "Not in any package of appmap.yml:")
+			unmatched = true
+		}
+		fmt.Fprintf(w, "  %s # %s\n", suggestion.Name, describe(suggestion))
+	}
+}
+
+func (s *excludesSection) tables() []statsTable {
+	table := statsTable{
+		Title:   "Suggested exclusions",
+		Columns: []string{"Name", "Package", "Exclude", "Calls", "Call share", "Distinct parameters per call"},
+	}
+	for _, suggestion := range s.suggestions {
+		table.Rows = append(table.Rows, []statsCell{
+			textCell(suggestion.Name), textCell(suggestion.Package), textCell(suggestion.Exclude), intCell(suggestion.Calls),
+			floatCell(suggestion.CallShare, "%.3f"), floatCell(suggestion.DistinctRatio, "%.2f"),
+		})
+	}
+	return []statsTable{table}
+}
+
+// excludesSection suggests exclusions for the appmap.yml found for path.
+func (p StatsProcessor) excludesSection(path string, totalCalls uint64, methodStats map[string]Stats) (*excludesSection, error) {
+	suggestions := p.suggestExcludes(totalCalls, methodStats)
+
+	appmapConfig, err := config.LoadAppmapConfig("", path)
+	if err != nil {
+		if p.writeExcludes {
+			return nil, err
+		}
+		warn(err)
+		appmapConfig = nil
+	}
+
+	if appmapConfig != nil {
+		for _, s := range suggestions {
+			i, exclude := matchPackage(appmapConfig.Packages, s)
+			s.pkg = i
+			if i >= 0 {
+				s.Package = appmapConfig.Packages[i].Path
+				s.Exclude = exclude
+			}
+		}
+	}
+
+	return &excludesSection{appmapConfig: appmapConfig, suggestions: suggestions}, nil
+}
+
+// write adds the suggested exclusions to appmap.yml.
+func (s *excludesSection) write() error {
+	added := 0
+	for _, suggestion := range s.suggestions {
+		if suggestion.Package == "" {
+			continue
+		}
+		if addExclude(&s.appmapConfig.Packages[suggestion.pkg], suggestion.Exclude) {
+			added++
+		}
+	}
+
+	if added == 0 {
+		fmt.Fprintf(os.Stderr, "%s is up to date\n", s.appmapConfig.Path())
+		return nil
+	}
+
+	if err := s.appmapConfig.SaveExcludes(); err != nil {
+		return fmt.Errorf("failed updating %s: %w", s.appmapConfig.Path(), err)
+	}
+	fmt.Fprintf(os.Stderr, "Added %d exclusion(s) to %s\n", added, s.appmapConfig.Path())
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const (
+	flamegraphFolded = "folded"
+	flamegraphSVG    = "svg"
+
+	weightElapsed = "elapsed"
+	weightCalls   = "calls"
+
+	flameWidth       = 1200
+	flameFrameHeight = 16
+	flameMargin      = 10
+	flameTitleHeight = 30
+	flameCharWidth   = 7
+	// flameMinWidth is the width of the narrowest frame drawn, in pixels.
+	flameMinWidth = 0.1
+)
+
+type FlamegraphOptions struct {
+	format string
+	weight string
+	output string
+	title  string
+	filter files.Filter
+}
+
+// callNode is a frame of a call tree: the calls made with the same stack.
+// self is the weight of the calls themselves, excluding the calls they made,
+// in seconds or calls.
+type callNode struct {
+	name     string
+	self     float64
+	total    float64
+	children map[string]*callNode
+}
+
+func newCallNode(name string) *callNode {
+	return &callNode{name: name, children: make(map[string]*callNode)}
+}
+
+func (n *callNode) child(name string) *callNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = newCallNode(name)
+		n.children[name] = c
+	}
+	return c
+}
+
+// sumTotals computes the total weight of each node, its own and that of its
+// children.
+func (n *callNode) sumTotals() float64 {
+	n.total = n.self
+	for _, c := range n.children {
+		n.total += c.sumTotals()
+	}
+	return n.total
+}
+
+// sortedChildren returns the children of the node by name, the order of
+// flame graphs.
+func (n *callNode) sortedChildren() []*callNode {
+	children := make([]*callNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+// frameName names a call in a stack. Stacks are separated by ; in folded
+// stacks, and end with their weight after a space, so neither can be
+// mistaken for part of a frame.
+var frameName = strings.NewReplacer(";", ",", "\n", " ", "\r", " ", "\t", " ")
+
+// callTreeBuilder reconstructs the call tree of AppMaps from their calls. The
+// calls of all of the threads are merged together. The value of the frame of
+// a call is its node.
+type callTreeBuilder struct {
+	weight string
+	root   *callNode
+}
+
+func newCallTreeBuilder(weight string) *callTreeBuilder {
+	return &callTreeBuilder{weight: weight, root: newCallNode("all")}
+}
+
+func (b *callTreeBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	parent := b.root
+	if len(stack) > 0 {
+		parent = stack[len(stack)-1].Value.(*callNode)
+	}
+	node := parent.child(frameName.Replace(callName(e)))
+	if b.weight == weightCalls {
+		node.self++
+	}
+	return node
+}
+
+func (b *callTreeBuilder) Return(ret *appmap.Event, call *appmap.Frame) {
+	if ret == nil || ret.Elapsed == nil || b.weight != weightElapsed {
+		return
+	}
+	call.Value.(*callNode).self += call.SelfTime(*ret.Elapsed)
+}
+
+// streamCallTree adds the calls of an AppMap to the tree.
+func (b *callTreeBuilder) streamCallTree(fname string) error {
+	f, err := files.Open(fname)
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %w", fname, err)
+	}
+	defer f.Close()
+
+	if _, err := appmap.StreamCalls(f, b); err != nil {
+		return fmt.Errorf("failed decoding %s: %w", fname, err)
+	}
+	return nil
+}
+
+// foldedWeight is the weight of a stack in folded stacks, which are integers:
+// microseconds or calls.
+func foldedWeight(weight string, value float64) int64 {
+	if weight == weightElapsed {
+		value *= 1e6
+	}
+	return int64(math.Round(value))
+}
+
+// writeFolded writes the stacks of the call tree in the folded format of
+// flamegraph.pl, which speedscope reads too: a line per stack, made of its
+// frames separated by ; and its weight.
+func writeFolded(w io.Writer, root *callNode, weight string) {
+	var walk func(n *callNode, stack []string)
+	walk = func(n *callNode, stack []string) {
+		stack = append(stack, n.name)
+		if value := foldedWeight(weight, n.self); value > 0 {
+			fmt.Fprintf(w, "%s %d\n", strings.Join(stack, ";"), value)
+		}
+		for _, c := range n.sortedChildren() {
+			walk(c, stack)
+		}
+	}
+
+	for _, c := range root.sortedChildren() {
+		walk(c, nil)
+	}
+}
+
+// frameColor picks a warm color for a frame, the same for the same name.
+func frameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	x := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+x%50, (x>>8)%230, (x>>16)%55)
+}
+
+func describeWeight(weight string, value float64) string {
+	if weight == weightElapsed {
+		return formatSeconds(value)
+	}
+	return fmt.Sprintf("%.0f calls", value)
+}
+
+// writeSVG draws the call tree as a self-contained flame graph, with the
+// callers below the calls they made. Each frame is described by its tooltip.
+func writeSVG(w io.Writer, root *callNode, weight string, title string) {
+	var depth func(n *callNode) int
+	depth = func(n *callNode) int {
+		deepest := 0
+		for _, c := range n.children {
+			if d := depth(c); d > deepest {
+				deepest = d
+			}
+		}
+		return deepest + 1
+	}
+
+	var (
+		levels = depth(root)
+		height = flameTitleHeight + levels*flameFrameHeight + flameMargin
+		scale  = 0.0
+	)
+	if root.total > 0 {
+		scale = float64(flameWidth-2*flameMargin) / root.total
+	}
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">
+<style>
+text { font-family: monospace; font-size: 12px; fill: #000; }
+.title { font-family: sans-serif; font-size: 16px; }
+rect { stroke: #fff; stroke-width: 0.5; }
+</style>
+<rect x="0" y="0" width="%d" height="%d" fill="#fdfdf8" stroke="none"/>
+<text class="title" x="%d" y="20" text-anchor="middle">%s</text>
+`, flameWidth, height, flameWidth, height, flameWidth, height, flameWidth/2, html.EscapeString(title))
+
+	var draw func(n *callNode, x float64, level int)
+	draw = func(n *callNode, x float64, level int) {
+		width := n.total * scale
+		if width < flameMinWidth {
+			return
+		}
+
+		y := height - flameMargin - (level+1)*flameFrameHeight
+		label := ""
+		if chars := int(width-6) / flameCharWidth; chars >= 3 {
+			label = n.name
+			if name := []rune(label); len(name) > chars {
+				label = string(name[:chars-2]) + ".."
+			}
+		}
+
+		share := 100 * n.total / root.total
+		fmt.Fprintf(w, `<g><title>%s (%s, %.2f%%)</title><rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"/>`,
+			html.EscapeString(n.name), describeWeight(weight, n.total), share, x, y, width, flameFrameHeight-1, frameColor(n.name))
+		if label != "" {
+			fmt.Fprintf(w, `<text x="%.1f" y="%d">%s</text>`, x+3, y+flameFrameHeight-4, html.EscapeString(label))
+		}
+		fmt.Fprintln(w, "</g>")
+
+		for _, c := range n.sortedChildren() {
+			draw(c, x, level+1)
+			x += c.total * scale
+		}
+	}
+	if root.total > 0 {
+		draw(root, flameMargin, 0)
+	}
+
+	fmt.Fprintln(w, "</svg>")
+}
+
+func NewFlamegraphCommand(options *FlamegraphOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "flamegraph [files, directories]",
+		Short: "Export the call tree of AppMaps as a flame graph",
+		Long: `Export the call tree of AppMaps as a flame graph
+
+The call tree is reconstructed from the call and return events, and weighted by
+the time spent in each call or by the number of calls. It's written as folded
+stacks, which flamegraph.pl and speedscope read, or as an SVG image. The calls
+of all of the AppMaps, and of all of their threads, are merged together.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if options.format != flamegraphFolded && options.format != flamegraphSVG {
+				return fmt.Errorf("invalid format %q, must be %s or %s", options.format, flamegraphFolded, flamegraphSVG)
+			}
+			if options.weight != weightElapsed && options.weight != weightCalls {
+				return fmt.Errorf("invalid weight %q, must be %s or %s", options.weight, weightElapsed, weightCalls)
+			}
+			cmd.SilenceUsage = true
+
+			fnames, err := files.Find(args, options.filter)
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+
+			b := newCallTreeBuilder(options.weight)
+			for _, fname := range fnames {
+				if err := b.streamCallTree(fname); err != nil {
+					warn(err)
+				}
+			}
+			b.root.sumTotals()
+
+			var buf bytes.Buffer
+			if options.format == flamegraphSVG {
+				title := options.title
+				if title == "" {
+					title = strings.Join(args, ", ")
+				}
+				writeSVG(&buf, b.root, options.weight, title)
+			} else {
+				writeFolded(&buf, b.root, options.weight)
+			}
+
+			if options.output == "" {
+				_, err = os.Stdout.Write(buf.Bytes())
+				return err
+			}
+			return afero.WriteFile(config.GetFS(), options.output, buf.Bytes(), 0644)
+		},
+	}
+}
+
+func init() {
+	var (
+		options       = FlamegraphOptions{}
+		flamegraphCmd = NewFlamegraphCommand(&options)
+	)
+
+	f := flamegraphCmd.Flags()
+	f.StringVar(&options.format, "format", flamegraphFolded, "Output format, folded (stacks) or svg")
+	f.StringVar(&options.weight, "weight", weightElapsed, "Weigh calls by their elapsed time, or count calls")
+	f.StringVarP(&options.output, "output", "o", "", "Write the flame graph to this file instead of stdout")
+	f.StringVar(&options.title, "title", "", "Title of the SVG image (defaults to the AppMaps given)")
+	addFilterFlags(f, &options.filter)
+
+	rootCmd.AddCommand(flamegraphCmd)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallTree(t *testing.T) {
+	m, err := appmap.Decode(strings.NewReader(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/users"}},
+		{"id":2,"event":"call","thread_id":1,"defined_class":"Users","method_id":"index","static":false},
+		{"id":3,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM users WHERE id = 1; -- first"}},
+		{"id":4,"event":"return","thread_id":1,"parent_id":3,"elapsed":0.001},
+		{"id":5,"event":"call","thread_id":1,"defined_class":"Cache","method_id":"fetch","static":false},
+		{"id":6,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT 2"}},
+		{"id":7,"event":"return","thread_id":1,"parent_id":6,"elapsed":0.002},
+		{"id":8,"event":"return","thread_id":1,"parent_id":2,"elapsed":0.01},
+		{"id":9,"event":"return","thread_id":1,"parent_id":1,"elapsed":0.008},
+		{"id":10,"event":"call","thread_id":2,"defined_class":"Job","method_id":"perform","static":true},
+		{"id":11,"event":"call","thread_id":3,"http_server_request":{"request_method":"GET","path_info":"/users"}},
+		{"id":12,"event":"call","thread_id":3,"defined_class":"Users","method_id":"index","static":false},
+		{"id":13,"event":"return","thread_id":3,"parent_id":12,"elapsed":0.004},
+		{"id":14,"event":"return","thread_id":3,"parent_id":11,"elapsed":0.005},
+		{"id":15,"event":"return","thread_id":2,"parent_id":10,"elapsed":0.5}
+	]}`))
+	require.Nil(t, err)
+
+	tree := func(weight string) string {
+		b := newCallTreeBuilder(weight)
+		visitCalls(m, b)
+		buf := new(bytes.Buffer)
+		writeFolded(buf, b.root, weight)
+		return buf.String()
+	}
+
+	// Cache#fetch never returned, so its time is unknown, and the time of the
+	// query it made isn't taken from Users#index. The first request appears
+	// to take less time than Users#index, so it has no time of its own. The
+	// requests of different threads are merged.
+	assert.Equal(t, `GET /users 1000
+GET /users;Users#index 13000
+GET /users;Users#index;Cache#fetch;SELECT ? 2000
+GET /users;Users#index;SELECT * FROM users WHERE id = ?, 1000
+Job.perform 500000
+`, tree(weightElapsed))
+
+	assert.Equal(t, `GET /users 2
+GET /users;Users#index 2
+GET /users;Users#index;Cache#fetch 1
+GET /users;Users#index;Cache#fetch;SELECT ? 1
+GET /users;Users#index;SELECT * FROM users WHERE id = ?, 1
+Job.perform 1
+`, tree(weightCalls))
+}
+
+func TestFlamegraphSVG(t *testing.T) {
+	root := newCallNode("all")
+	root.child(`Users#<index>`).self = 1
+	root.child("Users#show").self = 1e-6
+	root.sumTotals()
+
+	buf := new(bytes.Buffer)
+	writeSVG(buf, root, weightElapsed, `AppMaps <"test">`)
+
+	// The image is well formed, whatever the names of the frames
+	dec := xml.NewDecoder(bytes.NewReader(buf.Bytes()))
+	var titles []string
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "title" {
+			var title string
+			require.Nil(t, dec.DecodeElement(&title, &start))
+			titles = append(titles, title)
+		}
+	}
+
+	// Frames too narrow to be seen aren't drawn
+	assert.Equal(t, []string{"all (1.000001s, 100.00%)", "Users#<index> (1s, 100.00%)"}, titles)
+	assert.Contains(t, buf.String(), "AppMaps &lt;&#34;test&#34;&gt;")
+
+	// An empty tree is an empty image
+	buf.Reset()
+	writeSVG(buf, newCallNode("all"), weightCalls, "empty")
+	assert.NotContains(t, buf.String(), "<g>")
+}
+
+func TestFlamegraphCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "tmp/a.appmap.json", []byte(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"A","method_id":"interrupted","static":false}
+	]}`), 0644))
+	require.Nil(t, afero.WriteFile(fs, "tmp/b.appmap.json", []byte(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"B","method_id":"run","static":false},
+		{"id":2,"event":"return","thread_id":1,"parent_id":1,"elapsed":1}
+	]}`), 0644))
+	require.Nil(t, afero.WriteFile(fs, "tmp/c.appmap.json", []byte(`{"events":[`), 0644))
+
+	cmd := NewFlamegraphCommand(&FlamegraphOptions{format: flamegraphFolded, weight: weightCalls, output: "out.folded"})
+	require.Nil(t, cmd.RunE(cmd, []string{"tmp/a.appmap.json", "tmp/b.appmap.json", "tmp/c.appmap.json"}))
+
+	// Calls still open at the end of an AppMap aren't the callers of the next
+	// one's, and invalid AppMaps are skipped
+	out, err := afero.ReadFile(fs, "out.folded")
+	require.Nil(t, err)
+	assert.Equal(t, "A#interrupted 1\nB#run 1\n", string(out))
+
+	cmd = NewFlamegraphCommand(&FlamegraphOptions{format: "png", weight: weightCalls})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp/a.appmap.json"}))
+	cmd = NewFlamegraphCommand(&FlamegraphOptions{format: flamegraphFolded, weight: "bytes"})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp/a.appmap.json"}))
+}
@@ -0,0 +1,449 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const (
+	graphDOT     = "dot"
+	graphGraphML = "graphml"
+)
+
+type GraphOptions struct {
+	format     string
+	all        bool
+	cycles     bool
+	output     string
+	appmapPath string
+	filter     files.Filter
+}
+
+// classEdge is a dependency of a class on another, which it called.
+type classEdge struct {
+	from, to string
+}
+
+// dependencyGraph is the classes called in AppMaps, by the package they belong
+// to, and how many times they called each other.
+type dependencyGraph struct {
+	classes map[string]string
+	edges   map[classEdge]int
+}
+
+func newDependencyGraph() *dependencyGraph {
+	return &dependencyGraph{classes: make(map[string]string), edges: make(map[classEdge]int)}
+}
+
+// sortedClasses returns the classes of the graph by name.
+func (g *dependencyGraph) sortedClasses() []string {
+	classes := make([]string, 0, len(g.classes))
+	for class := range g.classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// sortedEdges returns the edges of the graph by caller, then callee.
+func (g *dependencyGraph) sortedEdges() []classEdge {
+	edges := make([]classEdge, 0, len(g.edges))
+	for edge := range g.edges {
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		return edges[i].to < edges[j].to
+	})
+	return edges
+}
+
+// graphBuilder adds the calls between classes of AppMaps to a dependency
+// graph. Calls of classes left out of the graph are skipped over, so the
+// classes calling them depend on the classes they call in turn. The value of
+// the frame of a call is its class, or empty if it isn't in the graph.
+type graphBuilder struct {
+	packages []config.AppMapPackage
+	graph    *dependencyGraph
+}
+
+func newGraphBuilder(packages []config.AppMapPackage) *graphBuilder {
+	return &graphBuilder{packages: packages, graph: newDependencyGraph()}
+}
+
+// classPackage is the package a class called belongs to: the appmap.yml
+// package if packages are given, and its enclosing package otherwise, or the
+// class itself at the top level. ok is false if the class is outside of the
+// packages given.
+func (b *graphBuilder) classPackage(e *appmap.Event) (pkg string, ok bool) {
+	if len(b.packages) == 0 {
+		if pkg = parentName(e.DefinedClass); pkg == "" {
+			pkg = e.DefinedClass
+		}
+		return pkg, true
+	}
+	if i, _ := findPackage(b.packages, e.DefinedClass, e.Path); i >= 0 {
+		return b.packages[i].Path, true
+	}
+	return "", false
+}
+
+func (b *graphBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	if !e.IsFunctionCall() {
+		return ""
+	}
+	pkg, ok := b.classPackage(e)
+	if !ok {
+		return ""
+	}
+
+	class := e.DefinedClass
+	b.graph.classes[class] = pkg
+	for j := len(stack) - 1; j >= 0; j-- {
+		if caller := stack[j].Value.(string); caller != "" {
+			if caller != class {
+				b.graph.edges[classEdge{caller, class}]++
+			}
+			break
+		}
+	}
+	return class
+}
+
+func (b *graphBuilder) Return(ret *appmap.Event, call *appmap.Frame) {}
+
+// streamGraph adds the calls of an AppMap to the graph.
+func (b *graphBuilder) streamGraph(fname string) error {
+	f, err := files.Open(fname)
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %w", fname, err)
+	}
+	defer f.Close()
+
+	if _, err := appmap.StreamCalls(f, b); err != nil {
+		return fmt.Errorf("failed decoding %s: %w", fname, err)
+	}
+	return nil
+}
+
+// packageCycles finds the groups of packages which depend on each other,
+// directly or not, returning a cycle through each group. Packages within a
+// cycle can't be layered.
+func (g *dependencyGraph) packageCycles() [][]string {
+	deps := make(map[string]map[string]bool)
+	for edge := range g.edges {
+		from, to := g.classes[edge.from], g.classes[edge.to]
+		if from == to {
+			continue
+		}
+		if deps[from] == nil {
+			deps[from] = make(map[string]bool)
+		}
+		deps[from][to] = true
+	}
+
+	var cycles [][]string
+	for _, component := range stronglyConnected(deps) {
+		if len(component) > 1 {
+			cycles = append(cycles, shortestCycle(deps, component))
+		}
+	}
+	return cycles
+}
+
+// sortedKeys returns the keys of a set by name.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stronglyConnected finds the strongly connected components of a graph with
+// Tarjan's algorithm, each sorted by name. The components are in the order of
+// their first node.
+func stronglyConnected(deps map[string]map[string]bool) [][]string {
+	nodes := make(map[string]bool)
+	for from, tos := range deps {
+		nodes[from] = true
+		for to := range tos {
+			nodes[to] = true
+		}
+	}
+
+	var (
+		index      = make(map[string]int)
+		lowlink    = make(map[string]int)
+		onStack    = make(map[string]bool)
+		stack      []string
+		components [][]string
+		visit      func(n string)
+	)
+	visit = func(n string) {
+		index[n] = len(index)
+		lowlink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+
+		for _, m := range sortedKeys(deps[n]) {
+			if _, seen := index[m]; !seen {
+				visit(m)
+				if lowlink[m] < lowlink[n] {
+					lowlink[n] = lowlink[m]
+				}
+			} else if onStack[m] && index[m] < lowlink[n] {
+				lowlink[n] = index[m]
+			}
+		}
+
+		if lowlink[n] != index[n] {
+			return
+		}
+		var component []string
+		for {
+			m := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[m] = false
+			component = append(component, m)
+			if m == n {
+				break
+			}
+		}
+		sort.Strings(component)
+		components = append(components, component)
+	}
+
+	for _, n := range sortedKeys(nodes) {
+		if _, seen := index[n]; !seen {
+			visit(n)
+		}
+	}
+
+	sort.Slice(components, func(i, j int) bool {
+		return components[i][0] < components[j][0]
+	})
+	return components
+}
+
+// shortestCycle finds the shortest cycle through the first node of a
+// strongly connected component, which is one of the cycles it's made of.
+func shortestCycle(deps map[string]map[string]bool, component []string) []string {
+	inComponent := make(map[string]bool, len(component))
+	for _, n := range component {
+		inComponent[n] = true
+	}
+
+	start := component[0]
+	previous := map[string]string{}
+	queue := []string{start}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, m := range sortedKeys(deps[n]) {
+			if !inComponent[m] {
+				continue
+			}
+			if m == start {
+				cycle := []string{start}
+				for ; n != start; n = previous[n] {
+					cycle = append([]string{n}, cycle...)
+				}
+				return append([]string{start}, cycle...)
+			}
+			if _, seen := previous[m]; !seen {
+				previous[m] = n
+				queue = append(queue, m)
+			}
+		}
+	}
+	return component
+}
+
+// cycleEdges are the edges between classes of different packages of the
+// cycles, which would need to go to layer the packages.
+func (g *dependencyGraph) cycleEdges(cycles [][]string) map[classEdge]bool {
+	inCycle := make(map[string]int)
+	for i, cycle := range cycles {
+		for _, pkg := range cycle {
+			inCycle[pkg] = i + 1
+		}
+	}
+
+	edges := make(map[classEdge]bool)
+	for edge := range g.edges {
+		from, to := g.classes[edge.from], g.classes[edge.to]
+		if from != to && inCycle[from] != 0 && inCycle[from] == inCycle[to] {
+			edges[edge] = true
+		}
+	}
+	return edges
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotID(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// writeDOT writes the graph in the DOT language of Graphviz, with the classes
+// of each package in a cluster. Edges are labelled with the number of calls,
+// and drawn in red if they're part of a cycle between packages.
+func writeDOT(w io.Writer, g *dependencyGraph, cycleEdges map[classEdge]bool) {
+	byPackage := make(map[string][]string)
+	for _, class := range g.sortedClasses() {
+		pkg := g.classes[class]
+		byPackage[pkg] = append(byPackage[pkg], class)
+	}
+	packages := make([]string, 0, len(byPackage))
+	for pkg := range byPackage {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+
+	fmt.Fprintln(w, "digraph appmap {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for i, pkg := range packages {
+		fmt.Fprintf(w, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "    label=%s;\n", dotID(pkg))
+		for _, class := range byPackage[pkg] {
+			fmt.Fprintf(w, "    %s;\n", dotID(class))
+		}
+		fmt.Fprintln(w, "  }")
+	}
+	for _, edge := range g.sortedEdges() {
+		calls := g.edges[edge]
+		attrs := fmt.Sprintf("label=\"%d\", weight=%d", calls, calls)
+		if cycleEdges[edge] {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(w, "  %s -> %s [%s];\n", dotID(edge.from), dotID(edge.to), attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// writeGraphML writes the graph in GraphML, with the package of each class and
+// the number of calls of each edge as data.
+func writeGraphML(w io.Writer, g *dependencyGraph, cycleEdges map[classEdge]bool) {
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="package" for="node" attr.name="package" attr.type="string"/>
+  <key id="calls" for="edge" attr.name="calls" attr.type="int"/>
+  <key id="cycle" for="edge" attr.name="cycle" attr.type="boolean"><default>false</default></key>
+  <graph id="appmap" edgedefault="directed">
+`)
+	for _, class := range g.sortedClasses() {
+		fmt.Fprintf(w, "    <node id=\"%s\"><data key=\"package\">%s</data></node>\n", xmlText(class), xmlText(g.classes[class]))
+	}
+	for i, edge := range g.sortedEdges() {
+		fmt.Fprintf(w, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\"><data key=\"calls\">%d</data>", i, xmlText(edge.from), xmlText(edge.to), g.edges[edge])
+		if cycleEdges[edge] {
+			fmt.Fprint(w, `<data key="cycle">true</data>`)
+		}
+		fmt.Fprintln(w, "</edge>")
+	}
+	fmt.Fprint(w, "  </graph>\n</graphml>\n")
+}
+
+func NewGraphCommand(options *GraphOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "graph [files, directories]",
+		Short: "Export the dependencies between classes called in AppMaps",
+		Long: `Export the dependencies between classes called in AppMaps, as a graph
+
+An edge goes from a class to each class it called, weighted by the number of
+calls, across all of the AppMaps. Only the classes of the packages of appmap.yml
+are included, unless --all is given. The graph is written in the DOT language of
+Graphviz, or in GraphML.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if options.format != graphDOT && options.format != graphGraphML {
+				return fmt.Errorf("invalid format %q, must be %s or %s", options.format, graphDOT, graphGraphML)
+			}
+			cmd.SilenceUsage = true
+
+			var packages []config.AppMapPackage
+			if !options.all {
+				appmapConfig, err := config.LoadAppmapConfig(options.appmapPath, files.Origin(args[0]))
+				if err != nil {
+					warn(fmt.Errorf("%w, including all classes", err))
+				} else {
+					packages = appmapConfig.Packages
+				}
+			}
+
+			fnames, err := files.Find(args, options.filter)
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+
+			b := newGraphBuilder(packages)
+			for _, fname := range fnames {
+				if err := b.streamGraph(fname); err != nil {
+					warn(err)
+				}
+			}
+
+			var cycleEdges map[classEdge]bool
+			if options.cycles {
+				cycles := b.graph.packageCycles()
+				fmt.Fprintf(os.Stderr, "Found %d dependency cycle(s) between packages\n", len(cycles))
+				for _, cycle := range cycles {
+					fmt.Fprintf(os.Stderr, "  %s\n", strings.Join(cycle, " -> "))
+				}
+				cycleEdges = b.graph.cycleEdges(cycles)
+			}
+
+			var buf bytes.Buffer
+			if options.format == graphGraphML {
+				writeGraphML(&buf, b.graph, cycleEdges)
+			} else {
+				writeDOT(&buf, b.graph, cycleEdges)
+			}
+
+			if options.output == "" {
+				_, err = os.Stdout.Write(buf.Bytes())
+				return err
+			}
+			return afero.WriteFile(config.GetFS(), options.output, buf.Bytes(), 0644)
+		},
+	}
+}
+
+func init() {
+	var (
+		options  = GraphOptions{}
+		graphCmd = NewGraphCommand(&options)
+	)
+
+	f := graphCmd.Flags()
+	f.StringVar(&options.format, "format", graphDOT, "Output format, dot or graphml")
+	f.BoolVar(&options.all, "all", false, "Include all of the classes called, not only those of the packages of appmap.yml")
+	f.BoolVar(&options.cycles, "cycles", false, "Report dependency cycles between packages, and highlight the calls making them")
+	f.StringVarP(&options.output, "output", "o", "", "Write the graph to this file instead of stdout")
+	f.StringVar(&options.appmapPath, "appmap-config", "", "Path of the appmap.yml whose packages are included")
+	addFilterFlags(f, &options.filter)
+
+	rootCmd.AddCommand(graphCmd)
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const graphAppmap = `{"events":[
+	{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/users"}},
+	{"id":2,"event":"call","thread_id":1,"defined_class":"com.example.web.UsersController","method_id":"index","static":false},
+	{"id":3,"event":"call","thread_id":1,"defined_class":"com.example.web.UsersController","method_id":"authorize","static":false},
+	{"id":4,"event":"return","thread_id":1,"parent_id":3},
+	{"id":5,"event":"call","thread_id":1,"defined_class":"org.lib.Cache","method_id":"fetch","static":false},
+	{"id":6,"event":"call","thread_id":1,"defined_class":"com.example.service.UserService","method_id":"find","static":false},
+	{"id":7,"event":"return","thread_id":1,"parent_id":5},
+	{"id":8,"event":"call","thread_id":1,"defined_class":"com.example.model.User","method_id":"name","static":false},
+	{"id":9,"event":"call","thread_id":2,"defined_class":"com.example.model.User","method_id":"save","static":false},
+	{"id":10,"event":"return","thread_id":2,"parent_id":9},
+	{"id":11,"event":"return","thread_id":1,"parent_id":8},
+	{"id":12,"event":"return","thread_id":1,"parent_id":2},
+	{"id":13,"event":"return","thread_id":1,"parent_id":1}
+]}`
+
+func TestGraphBuilder(t *testing.T) {
+	build := func(packages []config.AppMapPackage) *dependencyGraph {
+		b := newGraphBuilder(packages)
+		_, err := appmap.StreamCalls(strings.NewReader(graphAppmap), b)
+		require.Nil(t, err)
+		return b.graph
+	}
+
+	// The cache is outside of the packages, the controller depends on what it
+	// calls instead. UserService is missing its return, it isn't the caller of
+	// User. Calls within a class, and calls of other threads, aren't
+	// dependencies.
+	g := build([]config.AppMapPackage{{Path: "com.example.web"}, {Path: "com.example.service"}, {Path: "com.example.model"}})
+	assert.Equal(t, map[string]string{
+		"com.example.web.UsersController": "com.example.web",
+		"com.example.service.UserService": "com.example.service",
+		"com.example.model.User":          "com.example.model",
+	}, g.classes)
+	assert.Equal(t, map[classEdge]int{
+		{"com.example.web.UsersController", "com.example.service.UserService"}: 1,
+		{"com.example.web.UsersController", "com.example.model.User"}:          1,
+	}, g.edges)
+
+	// Without packages, classes are grouped by the package enclosing them
+	g = build(nil)
+	assert.Equal(t, "org.lib", g.classes["org.lib.Cache"])
+	assert.Equal(t, map[classEdge]int{
+		{"com.example.web.UsersController", "org.lib.Cache"}:          1,
+		{"org.lib.Cache", "com.example.service.UserService"}:          1,
+		{"com.example.web.UsersController", "com.example.model.User"}: 1,
+	}, g.edges)
+}
+
+// edgeGraph builds a graph of classes from their edges, each class in the
+// package enclosing it.
+func edgeGraph(edges ...classEdge) *dependencyGraph {
+	g := newDependencyGraph()
+	for _, edge := range edges {
+		g.classes[edge.from] = parentName(edge.from)
+		g.classes[edge.to] = parentName(edge.to)
+		g.edges[edge]++
+	}
+	return g
+}
+
+func TestPackageCycles(t *testing.T) {
+	g := edgeGraph(
+		classEdge{"x.A", "x.B"},
+		classEdge{"x.A", "y.A"},
+		classEdge{"y.A", "z.A"},
+		classEdge{"z.A", "x.B"},
+		classEdge{"y.A", "x.B"},
+		classEdge{"z.A", "w.A"},
+		classEdge{"w.A", "v.A"},
+		classEdge{"v.A", "w.B"},
+	)
+
+	// The shortest of the cycles between x, y and z is reported along with
+	// that of v and w, and only its edges are marked. Edges within a package
+	// aren't part of cycles.
+	cycles := g.packageCycles()
+	assert.Equal(t, [][]string{{"v", "w", "v"}, {"x", "y", "x"}}, cycles)
+	assert.Equal(t, map[classEdge]bool{
+		{"x.A", "y.A"}: true,
+		{"y.A", "x.B"}: true,
+		{"w.A", "v.A"}: true,
+		{"v.A", "w.B"}: true,
+	}, g.cycleEdges(cycles))
+
+	assert.Empty(t, edgeGraph(classEdge{"x.A", "y.A"}, classEdge{"y.A", "z.A"}).packageCycles())
+}
+
+func TestGraphFormats(t *testing.T) {
+	g := edgeGraph(classEdge{`app.Weird"Name\`, "app.List<T>"}, classEdge{"app.List<T>", "lib.Util"}, classEdge{"app.List<T>", "lib.Util"})
+	cycleEdges := map[classEdge]bool{{"app.List<T>", "lib.Util"}: true}
+
+	buf := new(bytes.Buffer)
+	writeDOT(buf, g, cycleEdges)
+	assert.Equal(t, `digraph appmap {
+  rankdir=LR;
+  node [shape=box];
+  subgraph cluster_0 {
+    label="app";
+    "app.List<T>";
+    "app.Weird\"Name\\";
+  }
+  subgraph cluster_1 {
+    label="lib";
+    "lib.Util";
+  }
+  "app.List<T>" -> "lib.Util" [label="2", weight=2, color=red];
+  "app.Weird\"Name\\" -> "app.List<T>" [label="1", weight=1];
+}
+`, buf.String())
+
+	buf.Reset()
+	writeGraphML(buf, g, cycleEdges)
+	var graphML struct {
+		Nodes []struct {
+			ID      string `xml:"id,attr"`
+			Package string `xml:"data"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+			Data   []struct {
+				Key   string `xml:"key,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	require.Nil(t, xml.Unmarshal(buf.Bytes(), &graphML))
+	require.Len(t, graphML.Nodes, 3)
+	assert.Equal(t, `app.Weird"Name\`, graphML.Nodes[1].ID)
+	assert.Equal(t, "lib", graphML.Nodes[2].Package)
+	require.Len(t, graphML.Edges, 2)
+	assert.Equal(t, "app.List<T>", graphML.Edges[0].Source)
+	assert.Len(t, graphML.Edges[0].Data, 2)
+	assert.Len(t, graphML.Edges[1].Data, 1)
+}
+
+func TestGraphCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "a.appmap.json", []byte(graphAppmap), 0644))
+	require.Nil(t, afero.WriteFile(fs, "b.appmap.json", []byte(graphAppmap), 0644))
+
+	// Without appmap.yml, all of the classes are included
+	cmd := NewGraphCommand(&GraphOptions{format: graphDOT, appmapPath: "appmap.yml", output: "out.dot"})
+	require.Nil(t, cmd.RunE(cmd, []string{"a.appmap.json", "b.appmap.json"}))
+	out, err := afero.ReadFile(fs, "out.dot")
+	require.Nil(t, err)
+	assert.Contains(t, string(out), `"org.lib.Cache" -> "com.example.service.UserService" [label="2", weight=2];`)
+
+	require.Nil(t, afero.WriteFile(fs, "appmap.yml", []byte(`name: example
+packages:
+- path: com.example.web
+- path: com.example.service
+`), 0644))
+	require.Nil(t, cmd.RunE(cmd, []string{"a.appmap.json", "b.appmap.json"}))
+	out, err = afero.ReadFile(fs, "out.dot")
+	require.Nil(t, err)
+	assert.Contains(t, string(out), `"com.example.web.UsersController" -> "com.example.service.UserService" [label="2", weight=2];`)
+	assert.NotContains(t, string(out), "com.example.model")
+
+	cmd = NewGraphCommand(&GraphOptions{format: "svg"})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"a.appmap.json"}))
+}
@@ -0,0 +1,415 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+)
+
+// defaultTopMethods is how many of the methods called beneath each route are
+// shown.
+const defaultTopMethods = 5
+
+var (
+	numericSegment = regexp.MustCompile(`^\d+$`)
+	uuidSegment    = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	hashSegment    = regexp.MustCompile(`^(?i)[0-9a-f]{16,}$`)
+)
+
+// pathTemplate replaces the segments of a path which look like identifiers
+// by placeholders, for requests recorded without a normalized path.
+func pathTemplate(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case numericSegment.MatchString(segment):
+			segments[i] = ":id"
+		case uuidSegment.MatchString(segment):
+			segments[i] = ":uuid"
+		case hashSegment.MatchString(segment):
+			segments[i] = ":hash"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// serverRoute is the route of a server request, its normalized path if it
+// was recorded.
+func serverRoute(r *appmap.HTTPServerRequest) string {
+	if r.NormalizedPathInfo != "" {
+		return r.NormalizedPathInfo
+	}
+	return pathTemplate(r.PathInfo)
+}
+
+// clientRoute is the host and path template of a client request.
+func clientRoute(r *appmap.HTTPClientRequest) string {
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Host == "" {
+		return pathTemplate(r.URL)
+	}
+	return u.Host + pathTemplate(u.EscapedPath())
+}
+
+// routeStats holds the statistics of the requests to a route.
+type routeStats struct {
+	Method string
+	Route  string
+	// Status is only set for server requests, which are told apart by
+	// status.
+	Status    int
+	Calls     int
+	Elapsed   timeDistribution
+	TotalTime float64
+	// Statuses counts the responses by status, for client requests.
+	Statuses map[int]int
+	// Methods counts the methods called while handling server requests.
+	Methods map[string]int
+
+	topMethods int
+}
+
+func newRouteStats(method string, route string, status int) *routeStats {
+	return &routeStats{Method: method, Route: route, Status: status, Statuses: make(map[int]int), Methods: make(map[string]int)}
+}
+
+func (s *routeStats) name() string {
+	name := s.Route
+	if s.Method != "" {
+		name = s.Method + " " + name
+	}
+	if s.Status != 0 {
+		name += " " + strconv.Itoa(s.Status)
+	}
+	return name
+}
+
+func (s *routeStats) timing() *timingSummary {
+	return summarizeTimes(&s.Elapsed, s.TotalTime, s.TotalTime)
+}
+
+type methodCount struct {
+	Method string `json:"method"`
+	Calls  int    `json:"calls"`
+}
+
+// methods returns the methods called most frequently beneath the route.
+func (s *routeStats) methods() []methodCount {
+	methods := make([]methodCount, 0, len(s.Methods))
+	for method, calls := range s.Methods {
+		methods = append(methods, methodCount{method, calls})
+	}
+
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].Calls != methods[j].Calls {
+			return methods[i].Calls > methods[j].Calls
+		}
+		return methods[i].Method < methods[j].Method
+	})
+
+	if s.topMethods > 0 && len(methods) > s.topMethods {
+		methods = methods[:s.topMethods]
+	}
+	return methods
+}
+
+// statuses returns the statuses of the responses, in order.
+func (s *routeStats) statuses() []int {
+	statuses := make([]int, 0, len(s.Statuses))
+	for status := range s.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	return statuses
+}
+
+// statusCounts describes the number of responses with each status.
+func (s *routeStats) statusCounts() string {
+	statuses := make([]string, 0, len(s.Statuses))
+	for _, status := range s.statuses() {
+		statuses = append(statuses, fmt.Sprintf("%d: %d", status, s.Statuses[status]))
+	}
+	return strings.Join(statuses, ", ")
+}
+
+func (s *routeStats) MarshalJSON() ([]byte, error) {
+	var v struct {
+		Method   string         `json:"method,omitempty"`
+		Route    string         `json:"route"`
+		Status   int            `json:"status,omitempty"`
+		Calls    int            `json:"calls"`
+		Statuses map[string]int `json:"statuses,omitempty"`
+		*timingSummary
+		Methods []methodCount `json:"top_methods,omitempty"`
+	}
+
+	v.Method = s.Method
+	v.Route = s.Route
+	v.Status = s.Status
+	v.Calls = s.Calls
+	if len(s.Statuses) > 0 {
+		v.Statuses = make(map[string]int, len(s.Statuses))
+		for status, count := range s.Statuses {
+			v.Statuses[strconv.Itoa(status)] = count
+		}
+	}
+	v.timingSummary = s.timing()
+	v.Methods = s.methods()
+
+	return json.Marshal(v)
+}
+
+func (s *routeStats) sortValue(by string) float64 {
+	switch by {
+	case sortByTotal, sortBySelf:
+		return s.TotalTime
+	case sortByMean:
+		return s.Elapsed.mean(s.TotalTime)
+	default:
+		return float64(s.Calls)
+	}
+}
+
+// merge adds the requests of other, the same route in another AppMap.
+func (s *routeStats) merge(other *routeStats) {
+	s.Calls += other.Calls
+	s.Elapsed.merge(&other.Elapsed)
+	s.TotalTime += other.TotalTime
+	for status, count := range other.Statuses {
+		s.Statuses[status] += count
+	}
+	for method, calls := range other.Methods {
+		s.Methods[method] += calls
+	}
+}
+
+// httpStats holds the statistics of server and client requests, by route.
+type httpStats struct {
+	server map[string]*routeStats
+	client map[string]*routeStats
+}
+
+func newHTTPStats() *httpStats {
+	return &httpStats{server: make(map[string]*routeStats), client: make(map[string]*routeStats)}
+}
+
+func mergeRoutes(into map[string]*routeStats, from map[string]*routeStats) {
+	for key, stats := range from {
+		existing, ok := into[key]
+		if !ok {
+			existing = newRouteStats(stats.Method, stats.Route, stats.Status)
+			into[key] = existing
+		}
+		existing.merge(stats)
+	}
+}
+
+func (h *httpStats) merge(other *httpStats) {
+	mergeRoutes(h.server, other.server)
+	mergeRoutes(h.client, other.client)
+}
+
+// httpFrame is a call which hasn't returned yet. The methods called beneath
+// a server request are counted until it returns, since its route depends on
+// the status of its response.
+type httpFrame struct {
+	// request is set for server and client requests.
+	request *appmap.Event
+	methods map[string]int
+	// server is the innermost server request the call was made beneath, if
+	// there's one, which may be the call itself.
+	server *httpFrame
+}
+
+// httpStatsBuilder computes the statistics of the HTTP requests of an AppMap
+// from its calls.
+type httpStatsBuilder struct {
+	stats *httpStats
+}
+
+func newHTTPStatsBuilder() *httpStatsBuilder {
+	return &httpStatsBuilder{stats: newHTTPStats()}
+}
+
+func (b *httpStatsBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	frame := &httpFrame{}
+	if len(stack) > 0 {
+		frame.server = stack[len(stack)-1].Value.(*httpFrame).server
+	}
+
+	switch {
+	case e.HTTPServerRequest != nil:
+		frame.request = e
+		frame.methods = make(map[string]int)
+		frame.server = frame
+	case e.HTTPClientRequest != nil:
+		frame.request = e
+	case e.IsFunctionCall() && frame.server != nil:
+		frame.server.methods[e.FunctionName()]++
+	}
+	return frame
+}
+
+func (b *httpStatsBuilder) Return(ret *appmap.Event, call *appmap.Frame) {
+	frame := call.Value.(*httpFrame)
+	if frame.request == nil {
+		return
+	}
+
+	var s *routeStats
+	if r := frame.request.HTTPServerRequest; r != nil {
+		status := 0
+		if ret != nil && ret.HTTPServerResponse != nil {
+			status = ret.HTTPServerResponse.Status
+		}
+		method, route := r.RequestMethod, serverRoute(r)
+		key := fmt.Sprintf("%s %s %d", method, route, status)
+		if s = b.stats.server[key]; s == nil {
+			s = newRouteStats(method, route, status)
+			b.stats.server[key] = s
+		}
+		for method, calls := range frame.methods {
+			s.Methods[method] += calls
+		}
+	} else {
+		key := clientRoute(frame.request.HTTPClientRequest)
+		if s = b.stats.client[key]; s == nil {
+			s = newRouteStats("", key, 0)
+			b.stats.client[key] = s
+		}
+		if ret != nil && ret.HTTPClientResponse != nil {
+			s.Statuses[ret.HTTPClientResponse.Status]++
+		}
+	}
+
+	s.Calls++
+	if ret != nil && ret.Elapsed != nil {
+		s.Elapsed.add(*ret.Elapsed)
+		s.TotalTime += *ret.Elapsed
+	}
+}
+
+// HTTPStats counts the server requests in an AppMap by method, route and
+// status, and the client requests by host and path. The methods called
+// beneath each server request are counted too.
+func (p StatsProcessor) HTTPStats(m *appmap.AppMap) *httpStats {
+	b := newHTTPStatsBuilder()
+	visitCalls(m, b)
+	return b.stats
+}
+
+func (p StatsProcessor) sortRoutes(routes map[string]*routeStats) ([]*routeStats, int) {
+	totals := make([]*routeStats, 0, len(routes))
+	requests := 0
+	for _, s := range routes {
+		s.topMethods = p.topMethods
+		if s.topMethods == 0 {
+			s.topMethods = defaultTopMethods
+		}
+		totals = append(totals, s)
+		requests += s.Calls
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		vi, vj := totals[i].sortValue(p.sortBy), totals[j].sortValue(p.sortBy)
+		if vi != vj {
+			return vi > vj
+		}
+		return totals[i].name() < totals[j].name()
+	})
+
+	if p.limit > 0 && len(totals) > p.limit {
+		totals = totals[:p.limit]
+	}
+	return totals, requests
+}
+
+// httpSection is the statistics of the routes requested most, in order.
+type httpSection struct {
+	server, client                 []*routeStats
+	serverRequests, clientRequests int
+	serverRoutes, clientRoutes     int
+}
+
+func (p StatsProcessor) httpSection(stats *httpStats) *httpSection {
+	section := &httpSection{serverRoutes: len(stats.server), clientRoutes: len(stats.client)}
+	section.server, section.serverRequests = p.sortRoutes(stats.server)
+	section.client, section.clientRequests = p.sortRoutes(stats.client)
+	return section
+}
+
+func (s *httpSection) value() interface{} {
+	return struct {
+		Server []*routeStats `json:"server"`
+		Client []*routeStats `json:"client"`
+	}{s.server, s.client}
+}
+
+func renderRoutes(w io.Writer, kind string, totals []*routeStats, requests int, distinct int) {
+	fmt.Fprintf(w, "%d %s requests, top %d of %d routes\n", requests, kind, len(totals), distinct)
+	for _, s := range totals {
+		name := s.name()
+		if len(s.Statuses) > 0 {
+			name += " (" + s.statusCounts() + ")"
+		}
+
+		if timing := s.timing(); timing != nil {
+			fmt.Fprintf(w, "  %s: %d, total %s, mean %s, p50 %s, p95 %s, max %s\n", name, s.Calls,
+				formatSeconds(timing.Total), formatSeconds(timing.Mean), formatSeconds(timing.P50),
+				formatSeconds(timing.P95), formatSeconds(timing.Max))
+		} else {
+			fmt.Fprintf(w, "  %s: %d\n", name, s.Calls)
+		}
+
+		for _, method := range s.methods() {
+			fmt.Fprintf(w, "    %s: %d\n", method.Method, method.Calls)
+		}
+	}
+}
+
+func (s *httpSection) text(w io.Writer) {
+	renderRoutes(w, "server", s.server, s.serverRequests, s.serverRoutes)
+	renderRoutes(w, "client", s.client, s.clientRequests, s.clientRoutes)
+}
+
+func (s *httpSection) tables() []statsTable {
+	server := statsTable{
+		Title:   fmt.Sprintf("HTTP server requests (%d requests, %d routes)", s.serverRequests, s.serverRoutes),
+		Columns: append(append([]string{"Method", "Route", "Status", "Requests"}, timingColumns...), "Top methods"),
+	}
+	for _, r := range s.server {
+		methods := make([]string, 0, len(r.Methods))
+		for _, m := range r.methods() {
+			methods = append(methods, fmt.Sprintf("%s: %d", m.Method, m.Calls))
+		}
+
+		row := append([]statsCell{textCell(r.Method), textCell(r.Route), intCell(r.Status), intCell(r.Calls)}, timingCells(r.timing())...)
+		server.Rows = append(server.Rows, append(row, textCell(strings.Join(methods, "; "))))
+	}
+
+	client := statsTable{
+		Title:   fmt.Sprintf("HTTP client requests (%d requests, %d routes)", s.clientRequests, s.clientRoutes),
+		Columns: append([]string{"Route", "Requests", "Statuses"}, timingColumns...),
+	}
+	for _, r := range s.client {
+		row := []statsCell{textCell(r.Route), intCell(r.Calls), textCell(r.statusCounts())}
+		client.Rows = append(client.Rows, append(row, timingCells(r.timing())...))
+	}
+
+	return []statsTable{server, client}
+}
+
+func (p StatsProcessor) RenderHTTPStats(w io.Writer, stats *httpStats) {
+	p.renderSection(w, p.httpSection(stats))
+}
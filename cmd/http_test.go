@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathTemplate(t *testing.T) {
+	assert.Equal(t, "/orgs/:id/apps/:uuid", pathTemplate("/orgs/12/apps/3ac5f7a0-53fc-423f-b776-4571e44aa0b1?tab=1"))
+	assert.Equal(t, "/blobs/:hash/raw", pathTemplate("/blobs/c300eeef64aa2b0dcd284b14cfeca788/raw"))
+	assert.Equal(t, "/users/new", pathTemplate("/users/new"))
+
+	assert.Equal(t, "api.example.com/repos/:id", clientRoute(&appmap.HTTPClientRequest{URL: "https://api.example.com/repos/42?page=2"}))
+}
+
+const httpAppmap = `{"events":[
+	{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/orgs/1","normalized_path_info":"/orgs/:id"}},
+	{"id":2,"event":"call","thread_id":1,"defined_class":"OrgsController","method_id":"show","static":false,"parameters":[]},
+	{"id":3,"event":"call","thread_id":1,"defined_class":"Org","method_id":"find","static":true,"parameters":[]},
+	{"id":4,"event":"return","thread_id":1,"parent_id":3},
+	{"id":5,"event":"call","thread_id":1,"http_client_request":{"request_method":"GET","url":"https://api.example.com/orgs/1"}},
+	{"id":6,"event":"return","thread_id":1,"parent_id":5,"elapsed":0.25,"http_client_response":{"status":404}},
+	{"id":7,"event":"return","thread_id":1,"parent_id":2},
+	{"id":8,"event":"return","thread_id":1,"parent_id":1,"elapsed":1,"http_server_response":{"status":200}},
+	{"id":9,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/orgs/2"}},
+	{"id":10,"event":"return","thread_id":1,"parent_id":9,"elapsed":0.5,"http_server_response":{"status":500}},
+	{"id":11,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/orgs/3","normalized_path_info":"/orgs/:id"}},
+	{"id":12,"event":"call","thread_id":1,"defined_class":"OrgsController","method_id":"show","static":false,"parameters":[]},
+	{"id":13,"event":"return","thread_id":1,"parent_id":12},
+	{"id":14,"event":"return","thread_id":1,"parent_id":11,"elapsed":3,"http_server_response":{"status":200}},
+	{"id":15,"event":"call","thread_id":1,"defined_class":"Job","method_id":"perform","static":false,"parameters":[]},
+	{"id":16,"event":"call","thread_id":1,"http_client_request":{"request_method":"POST","url":"https://api.example.com/orgs/2"}},
+	{"id":17,"event":"return","thread_id":1,"parent_id":16,"elapsed":0.75,"http_client_response":{"status":200}},
+	{"id":18,"event":"return","thread_id":1,"parent_id":15}
+]}`
+
+func TestHTTPStats(t *testing.T) {
+	m, err := appmap.Decode(strings.NewReader(httpAppmap))
+	require.Nil(t, err)
+
+	p := StatsProcessor{}
+	stats := p.HTTPStats(m)
+
+	require.Len(t, stats.server, 2)
+	ok := stats.server["GET /orgs/:id 200"]
+	assert.Equal(t, 2, ok.Calls)
+	assert.Equal(t, 4.0, ok.TotalTime)
+	assert.Equal(t, map[string]int{"OrgsController#show": 2, "Org.find": 1}, ok.Methods)
+	assert.Equal(t, 1, stats.server["GET /orgs/:id 500"].Calls)
+
+	require.Len(t, stats.client, 1)
+	client := stats.client["api.example.com/orgs/:id"]
+	assert.Equal(t, 2, client.Calls)
+	assert.Equal(t, map[int]int{200: 1, 404: 1}, client.Statuses)
+
+	// Streaming the AppMap rather than decoding it
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "orgs.appmap.json", []byte(httpAppmap), 0644))
+	streamed := StatsProcessor{http: true}.fileStats("orgs.appmap.json")
+	require.Nil(t, streamed.err)
+	assert.Equal(t, stats, streamed.routes)
+
+	// Merging another AppMap
+	global := newHTTPStats()
+	global.merge(stats)
+	global.merge(p.HTTPStats(m))
+	assert.Equal(t, 4, global.server["GET /orgs/:id 200"].Calls)
+	assert.Equal(t, 4, global.server["GET /orgs/:id 200"].Methods["OrgsController#show"])
+
+	buf := new(bytes.Buffer)
+	p = StatsProcessor{json: true, topMethods: 1}
+	p.RenderHTTPStats(buf, global)
+
+	var out struct {
+		Server []map[string]interface{} `json:"server"`
+		Client []map[string]interface{} `json:"client"`
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out.Server, 2)
+	assert.Equal(t, "/orgs/:id", out.Server[0]["route"])
+	assert.Equal(t, 200.0, out.Server[0]["status"])
+	assert.Equal(t, 1.0, out.Server[0]["p50_time"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"method": "OrgsController#show", "calls": 4.0}}, out.Server[0]["top_methods"])
+	assert.Equal(t, map[string]interface{}{"200": 2.0, "404": 2.0}, out.Client[0]["statuses"])
+
+	buf.Reset()
+	p.json = false
+	p.RenderHTTPStats(buf, global)
+	assert.Contains(t, buf.String(), "6 server requests, top 2 of 2 routes\n  GET /orgs/:id 200: 4")
+	assert.Contains(t, buf.String(), "  api.example.com/orgs/:id (200: 2, 404: 2): 4")
+}
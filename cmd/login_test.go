@@ -5,12 +5,15 @@ import (
 	"testing"
 
 	"github.com/applandinc/appland-cli/internal/appland"
+	"github.com/applandinc/appland-cli/internal/config"
 	"github.com/stretchr/testify/mock"
 )
 
 type MockClient struct {
 	mock.Mock
 	appland.Client
+	gzip    bool
+	context *config.Context
 }
 
 func (m *MockClient) Login(login string, password string) error {
@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+)
+
+const (
+	// maxValueLength is the length parameter values are truncated to.
+	maxValueLength = 100
+	// maxTrackedValues is how many distinct values of a parameter are counted
+	// individually, beyond that only their number is estimated.
+	maxTrackedValues = 1000
+	// defaultTopValues is how many of the most frequent values are shown.
+	defaultTopValues = 10
+
+	sketchPrecision = 10
+	sketchRegisters = 1 << sketchPrecision
+)
+
+// formatValue formats a parameter value of any JSON type, truncating long
+// values.
+func formatValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		s = "<nil>"
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = strconv.FormatBool(v)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			s = fmt.Sprint(v)
+		} else {
+			s = string(data)
+		}
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	s, _ = truncateString(s, maxValueLength)
+	return s
+}
+
+// cardinalitySketch estimates the number of distinct values added to it, in
+// constant space (a HyperLogLog).
+type cardinalitySketch [sketchRegisters]uint8
+
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+
+	// FNV doesn't mix its high bits well enough on its own.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (s *cardinalitySketch) add(value string) {
+	x := hashValue(value)
+	register := x >> (64 - sketchPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > s[register] {
+		s[register] = rank
+	}
+}
+
+func (s *cardinalitySketch) merge(other *cardinalitySketch) {
+	for i, rank := range other {
+		if rank > s[i] {
+			s[i] = rank
+		}
+	}
+}
+
+func (s *cardinalitySketch) estimate() int {
+	m := float64(sketchRegisters)
+	sum, zeros := 0.0, 0
+	for _, rank := range s {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(e + 0.5)
+}
+
+// paramBucket is a value of a parameter, of a given class.
+type paramBucket struct {
+	class string
+	value string
+}
+
+func (b paramBucket) key() string {
+	return b.class + "\x00" + b.value
+}
+
+// paramDistribution counts the values of a parameter of a method, by class
+// and value.
+type paramDistribution struct {
+	Name  string
+	Calls int
+	// Counts holds the number of calls with each value, for the first
+	// maxTrackedValues distinct values.
+	Counts map[paramBucket]int
+	// sketch is only needed once more than maxTrackedValues distinct values
+	// have been seen.
+	sketch *cardinalitySketch
+}
+
+func newParamDistribution(name string) *paramDistribution {
+	return &paramDistribution{Name: name, Counts: make(map[paramBucket]int)}
+}
+
+// track counts calls with a value, if it's one of those counted
+// individually, or adds it to the sketch otherwise.
+func (d *paramDistribution) track(bucket paramBucket, count int) {
+	if _, ok := d.Counts[bucket]; ok || len(d.Counts) < maxTrackedValues {
+		d.Counts[bucket] += count
+		if d.sketch != nil {
+			d.sketch.add(bucket.key())
+		}
+		return
+	}
+
+	if d.sketch == nil {
+		d.sketch = &cardinalitySketch{}
+		for tracked := range d.Counts {
+			d.sketch.add(tracked.key())
+		}
+	}
+	d.sketch.add(bucket.key())
+}
+
+// add counts a call with param.
+func (d *paramDistribution) add(param *appmap.Parameter) {
+	d.Calls++
+	d.track(paramBucket{class: param.Class, value: formatValue(param.Value)}, 1)
+}
+
+// merge adds the calls of other, the same parameter in another AppMap.
+func (d *paramDistribution) merge(other *paramDistribution) {
+	if other.sketch != nil && d.sketch == nil {
+		d.sketch = &cardinalitySketch{}
+		for tracked := range d.Counts {
+			d.sketch.add(tracked.key())
+		}
+	}
+
+	d.Calls += other.Calls
+	for bucket, count := range other.Counts {
+		d.track(bucket, count)
+	}
+	if other.sketch != nil {
+		d.sketch.merge(other.sketch)
+	}
+}
+
+// paramValue is the number of calls with a value of a parameter.
+type paramValue struct {
+	Class string `json:"class,omitempty"`
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// paramSummary summarizes the values of a parameter by the most frequent
+// ones.
+type paramSummary struct {
+	Name string `json:"name"`
+	// Distinct is the number of distinct values, which is an estimate if
+	// Estimated is set.
+	Distinct  int          `json:"distinct"`
+	Estimated bool         `json:"estimated,omitempty"`
+	Values    []paramValue `json:"values"`
+	// Other is the number of calls with values which aren't listed.
+	Other int `json:"other"`
+}
+
+func (d *paramDistribution) summary(top int) paramSummary {
+	summary := paramSummary{Name: d.Name, Distinct: len(d.Counts), Values: make([]paramValue, 0, len(d.Counts))}
+	if d.sketch != nil {
+		summary.Estimated = true
+		if estimate := d.sketch.estimate(); estimate > summary.Distinct {
+			summary.Distinct = estimate
+		}
+	}
+
+	for bucket, count := range d.Counts {
+		summary.Values = append(summary.Values, paramValue{Class: bucket.class, Value: bucket.value, Count: count})
+	}
+	sort.Slice(summary.Values, func(i, j int) bool {
+		a, b := summary.Values[i], summary.Values[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Class < b.Class
+	})
+
+	if top > 0 && len(summary.Values) > top {
+		summary.Values = summary.Values[:top]
+	}
+
+	summary.Other = d.Calls
+	for _, v := range summary.Values {
+		summary.Other -= v.Count
+	}
+	return summary
+}
+
+// signatureCount is the number of calls with the same values of all of the
+// parameters of a method.
+type signatureCount struct {
+	Params string `json:"params"`
+	Count  int    `json:"count"`
+}
+
+// topSignatures returns the most frequent values of the parameters, and the
+// number of the calls with other values, including those which weren't
+// counted individually.
+func topSignatures(counts map[string]int, calls int, top int) ([]signatureCount, int) {
+	signatures := make([]signatureCount, 0, len(counts))
+	for params, count := range counts {
+		signatures = append(signatures, signatureCount{params, count})
+	}
+	sort.Slice(signatures, func(i, j int) bool {
+		if signatures[i].Count != signatures[j].Count {
+			return signatures[i].Count > signatures[j].Count
+		}
+		return signatures[i].Params < signatures[j].Params
+	})
+
+	if top > 0 && len(signatures) > top {
+		signatures = signatures[:top]
+	}
+
+	other := calls
+	for _, s := range signatures {
+		other -= s.Count
+	}
+	return signatures, other
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "<nil>", formatValue(nil))
+	assert.Equal(t, "42", formatValue(json.Number("42")))
+	assert.Equal(t, "true", formatValue(true))
+	assert.Equal(t, `{"a":[1,"b"]}`, formatValue(map[string]interface{}{"a": []interface{}{json.Number("1"), "b"}}))
+	assert.Equal(t, strings.Repeat("x", maxValueLength)+"...", formatValue(strings.Repeat("x", 2*maxValueLength)))
+}
+
+func TestParamStats(t *testing.T) {
+	events := []string{}
+	values := []string{`"1"`, `1`, `1`, `{"id":1}`, `[1,2]`, `true`, `null`}
+	classes := []string{"String", "Integer", "Integer", "Hash", "Array", "TrueClass", "NilClass"}
+	for i := range values {
+		events = append(events, fmt.Sprintf(`{"id":%d,"event":"call","defined_class":"A","method_id":"m","static":false,"parameters":[{"name":"x","class":"%s","value":%s}]}`, i+1, classes[i], values[i]))
+	}
+
+	m, err := appmap.Decode(strings.NewReader(`{"events":[` + strings.Join(events, ",") + `]}`))
+	require.Nil(t, err)
+
+	p := StatsProcessor{params: true, topValues: 2}
+	stats, _ := p.MethodStats(m)
+	s := stats["A#m:0"]
+
+	// The string "1" and the number 1 are the same value, but not the same
+	// class
+	assert.Equal(t, 3, s.ParamCounts["1"])
+	require.Len(t, s.Params, 1)
+	summary := s.Params[0].summary(2)
+	assert.Equal(t, paramSummary{
+		Name:     "x",
+		Distinct: 6,
+		Values:   []paramValue{{"Integer", "1", 2}, {"String", "1", 1}},
+		Other:    4,
+	}, summary)
+
+	buf := new(bytes.Buffer)
+	p.RenderStats(buf, 7, stats)
+	assert.Contains(t, buf.String(), "    3: 1\n    1: <nil>\n    3: (other values)\n")
+	assert.Contains(t, buf.String(), "   x: 6 distinct values\n    2: 1 (Integer)\n    1: 1 (String)\n    4: (other values)\n")
+
+	buf.Reset()
+	p.json = true
+	p.RenderStats(buf, 7, stats)
+
+	var out []struct {
+		ParamCounts map[string]int `json:"param_counts"`
+		Params      []paramSummary `json:"params"`
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, 3, out[0].ParamCounts["1"])
+	assert.Equal(t, 1, out[0].ParamCounts[`{"id":1}`])
+	assert.Equal(t, []paramSummary{summary}, out[0].Params)
+}
+
+func TestParamCardinality(t *testing.T) {
+	d := newParamDistribution("id")
+	other := newParamDistribution("id")
+	for i := 0; i < 10000; i++ {
+		d.add(&appmap.Parameter{Class: "Integer", Value: json.Number(fmt.Sprint(i))})
+		other.add(&appmap.Parameter{Class: "Integer", Value: json.Number(fmt.Sprint(i + 5000))})
+	}
+
+	assert.Len(t, d.Counts, maxTrackedValues)
+	summary := d.summary(defaultTopValues)
+	assert.True(t, summary.Estimated)
+	assert.InEpsilon(t, 10000, summary.Distinct, 0.1)
+	assert.Equal(t, 10000, d.Calls)
+
+	d.merge(other)
+	summary = d.summary(defaultTopValues)
+	assert.InEpsilon(t, 15000, summary.Distinct, 0.1)
+	assert.Equal(t, 20000, d.Calls)
+	assert.Equal(t, 20000-defaultTopValues, summary.Other)
+}
+
+func TestParamSignatureCardinality(t *testing.T) {
+	stats := Stats{ParamCounts: make(map[string]int)}
+	other := Stats{ParamCounts: make(map[string]int)}
+	for i := 0; i < 10000; i++ {
+		stats.Calls++
+		stats.addParams([]appmap.Parameter{{Name: "id", Value: json.Number(fmt.Sprint(i))}})
+		other.Calls++
+		other.addParams([]appmap.Parameter{{Name: "id", Value: json.Number(fmt.Sprint(i + 5000))}})
+	}
+
+	assert.Len(t, stats.ParamCounts, maxTrackedValues)
+	assert.InEpsilon(t, 10000, stats.distinctParams(), 0.1)
+
+	merged := Stats{ParamCounts: make(map[string]int)}
+	merged.merge(stats)
+	merged.merge(other)
+	assert.Len(t, merged.ParamCounts, maxTrackedValues)
+	assert.InEpsilon(t, 15000, merged.distinctParams(), 0.1)
+
+	// The calls with values which weren't counted are still other values
+	signatures, rest := topSignatures(merged.ParamCounts, merged.Calls, defaultTopValues)
+	assert.Len(t, signatures, defaultTopValues)
+	assert.Equal(t, 20000-defaultTopValues, rest)
+}
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const defaultPrunedValueLength = 100
+
+type PruneOptions struct {
+	targetSize  int
+	valueLength int
+	output      string
+}
+
+type prunedMethod struct {
+	Method string `json:"method"`
+	Calls  int    `json:"calls"`
+}
+
+// pruneReport describes what was removed from an AppMap by pruneAppmap.
+type pruneReport struct {
+	OriginalSize    int            `json:"original_size"`
+	PrunedSize      int            `json:"pruned_size"`
+	TruncatedValues int            `json:"truncated_values"`
+	RemovedMethods  []prunedMethod `json:"removed_methods"`
+	RemovedClassMap int            `json:"removed_class_map_entries"`
+}
+
+func (r *pruneReport) print(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s: %d KiB -> %d KiB\n", name, r.OriginalSize/1024, r.PrunedSize/1024)
+	if r.TruncatedValues > 0 {
+		fmt.Fprintf(w, "  truncated %d value(s)\n", r.TruncatedValues)
+	}
+	for _, m := range r.RemovedMethods {
+		fmt.Fprintf(w, "  removed %s: %d call(s)\n", m.Method, m.Calls)
+	}
+	if r.RemovedClassMap > 0 {
+		fmt.Fprintf(w, "  removed %d classMap entries\n", r.RemovedClassMap)
+	}
+}
+
+// prunable is an AppMap being pruned, along with an estimate of its encoded
+// size, which is kept up to date as events are changed or removed.
+type prunable struct {
+	appmap  *appmap.AppMap
+	sizes   []int
+	removed []bool
+	size    int
+}
+
+func newPrunable(m *appmap.AppMap) (*prunable, error) {
+	p := &prunable{
+		appmap:  m,
+		sizes:   make([]int, len(m.Events)),
+		removed: make([]bool, len(m.Events)),
+	}
+
+	// The size of everything but the events, the events are accounted for
+	// individually.
+	rest := *m
+	rest.Events = []appmap.Event{}
+	data, err := rest.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	p.size = len(data)
+
+	for i := range m.Events {
+		if err := p.updateSize(i); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			p.size++ // comma
+		}
+	}
+
+	return p, nil
+}
+
+func (p *prunable) updateSize(i int) error {
+	data, err := p.appmap.Events[i].MarshalJSON()
+	if err != nil {
+		return err
+	}
+	p.size += len(data) - p.sizes[i]
+	p.sizes[i] = len(data)
+	return nil
+}
+
+func (p *prunable) remove(i int) {
+	if p.removed[i] {
+		return
+	}
+	p.removed[i] = true
+	p.size -= p.sizes[i] + 1
+}
+
+// truncateString shortens s to length runes, returning whether it was
+// changed.
+func truncateString(s string, length int) (string, bool) {
+	if len(s) <= length {
+		return s, false
+	}
+
+	r := []rune(s)
+	if len(r) <= length {
+		return s, false
+	}
+	return string(r[:length]) + "...", true
+}
+
+// truncate shortens a string value, returning whether it was changed.
+func truncate(param *appmap.Parameter, length int) bool {
+	s, ok := param.Value.(string)
+	if !ok {
+		return false
+	}
+
+	s, changed := truncateString(s, length)
+	param.Value = s
+	return changed
+}
+
+// truncateValues shortens parameter and return values longer than length.
+func (p *prunable) truncateValues(length int) (int, error) {
+	count := 0
+	for i := range p.appmap.Events {
+		e := &p.appmap.Events[i]
+		changed := false
+
+		for j := range e.Parameters {
+			if truncate(&e.Parameters[j], length) {
+				changed = true
+				count++
+			}
+		}
+
+		if e.ReturnValue != nil && truncate(e.ReturnValue, length) {
+			changed = true
+			count++
+		}
+
+		if changed {
+			if err := p.updateSize(i); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// removeMethods drops the call and return events of the most frequently
+// called methods until the AppMap fits targetSize. Methods called with the
+// fewest distinct parameters go first when call counts are equal, since
+// they're the least informative. Methods called only once are never removed.
+// It returns the removed methods and the locations of the functions whose
+// events are all gone.
+func (p *prunable) removeMethods(targetSize int) ([]prunedMethod, map[string]bool) {
+	processor := StatsProcessor{}
+	stats, _ := processor.MethodStats(p.appmap)
+
+	totals := processor.sortStatsByCount(stats)
+	sort.SliceStable(totals, func(i, j int) bool {
+		if totals[i].Stats.Calls != totals[j].Stats.Calls {
+			return totals[i].Stats.Calls > totals[j].Stats.Calls
+		}
+		return totals[i].Stats.distinctParams() < totals[j].Stats.distinctParams()
+	})
+
+	events := p.appmap.Events
+	calls := map[string][]int{}
+	returns := map[int]int{}
+	for i := range events {
+		e := &events[i]
+		switch {
+		case e.IsFunctionCall():
+			id := statsID(e)
+			calls[id] = append(calls[id], i)
+		case e.IsReturn():
+			returns[e.ParentID] = i
+		}
+	}
+
+	removed := []prunedMethod{}
+	locations := map[string]bool{}
+	for _, t := range totals {
+		if p.size <= targetSize || t.Stats.Calls <= 1 {
+			break
+		}
+
+		for _, i := range calls[t.Method] {
+			p.remove(i)
+			if r, ok := returns[events[i].ID]; ok {
+				p.remove(r)
+			}
+		}
+
+		e := events[calls[t.Method][0]]
+		locations[fmt.Sprintf("%s:%d#%s", e.Path, e.Lineno, e.MethodID)] = true
+		removed = append(removed, prunedMethod{Method: t.Stats.Method, Calls: t.Stats.Calls})
+	}
+
+	return removed, locations
+}
+
+// pruneClassMap removes the functions in locations from the class map, as
+// well as any packages and classes left empty. It returns the number of
+// entries removed.
+func pruneClassMap(entries []appmap.ClassMapEntry, locations map[string]bool) ([]appmap.ClassMapEntry, int) {
+	count := 0
+	kept := make([]appmap.ClassMapEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type == appmap.FunctionType && locations[entry.Location+"#"+entry.Name] {
+			count++
+			continue
+		}
+
+		if len(entry.Children) > 0 {
+			children, n := pruneClassMap(entry.Children, locations)
+			count += n
+			if len(children) == 0 {
+				count++
+				continue
+			}
+			entry.Children = children
+		}
+
+		kept = append(kept, entry)
+	}
+	return kept, count
+}
+
+func (p *prunable) encode() ([]byte, error) {
+	m := *p.appmap
+	m.Events = make([]appmap.Event, 0, len(p.appmap.Events))
+	for i, e := range p.appmap.Events {
+		if !p.removed[i] {
+			m.Events = append(m.Events, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := appmap.Encode(&buf, &m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pruneAppmap reduces an AppMap to targetSize bytes, if possible. Parameter
+// and return values are truncated to valueLength first, and if that's not
+// enough the most frequently called methods are removed. The result may
+// still be over targetSize.
+func pruneAppmap(data []byte, targetSize int, valueLength int) ([]byte, *pruneReport, error) {
+	report := &pruneReport{OriginalSize: len(data), PrunedSize: len(data), RemovedMethods: []prunedMethod{}}
+	if len(data) <= targetSize {
+		return data, report, nil
+	}
+
+	m, err := appmap.Decode(bytes.NewReader(data))
+	if m == nil {
+		return nil, nil, err
+	}
+
+	p, err := newPrunable(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.size > targetSize && valueLength > 0 {
+		report.TruncatedValues, err = p.truncateValues(valueLength)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if p.size > targetSize {
+		var locations map[string]bool
+		report.RemovedMethods, locations = p.removeMethods(targetSize)
+		if len(locations) > 0 {
+			m.ClassMap, report.RemovedClassMap = pruneClassMap(m.ClassMap, locations)
+		}
+	}
+
+	pruned, err := p.encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	report.PrunedSize = len(pruned)
+
+	return pruned, report, nil
+}
+
+func NewPruneCommand(options *PruneOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "prune [file]",
+		Short: "Reduce the size of an AppMap by removing its least interesting events",
+		Long: `Reduce the size of an AppMap by removing its least interesting events
+
+Long parameter and return values are truncated first. If the AppMap is still
+over the target size, the events of the most frequently called methods are
+removed, along with their classMap entries.
+
+The AppMap may also be given by its path in an archive, or read from stdin
+with -.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			found, err := files.FindAppMaps(args)
+			if err != nil {
+				return fmt.Errorf("failed finding %s: %w", args[0], err)
+			}
+			if len(found) != 1 {
+				return fmt.Errorf("%s holds %d AppMaps, only one can be pruned at a time", args[0], len(found))
+			}
+
+			fname := found[0]
+			data, err := files.ReadFile(fname)
+			if err != nil {
+				return fmt.Errorf("failed reading %s: %w", fname, err)
+			}
+
+			targetSize := options.targetSize * 1024
+			pruned, report, err := pruneAppmap(data, targetSize, options.valueLength)
+			if err != nil {
+				return fmt.Errorf("failed pruning %s: %w", fname, err)
+			}
+
+			report.print(os.Stderr, fname)
+			if report.PrunedSize > targetSize {
+				warn(fmt.Errorf("%s is still over the target size of %d KiB", fname, options.targetSize))
+			}
+
+			if options.output == "" {
+				_, err = os.Stdout.Write(pruned)
+				return err
+			}
+
+			return afero.WriteFile(config.GetFS(), options.output, pruned, 0644)
+		},
+	}
+}
+
+func init() {
+	var (
+		options  = &PruneOptions{}
+		pruneCmd = NewPruneCommand(options)
+	)
+
+	f := pruneCmd.Flags()
+	f.IntVarP(&options.targetSize, "size", "s", fileSizeLimit/1024, "Target size in KiB")
+	f.IntVar(&options.valueLength, "value-length", defaultPrunedValueLength, "Truncate parameter and return values longer than this")
+	f.StringVarP(&options.output, "output", "o", "", "Write the pruned AppMap to this file instead of stdout")
+
+	rootCmd.AddCommand(pruneCmd)
+}
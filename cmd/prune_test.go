@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneUnderTarget(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	pruned, report, err := pruneAppmap(data, len(data), defaultPrunedValueLength)
+	require.Nil(t, err)
+
+	assert.Equal(t, data, pruned)
+	assert.Empty(t, report.RemovedMethods)
+}
+
+func TestPrune(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	targetSize := 20 * 1024
+	pruned, report, err := pruneAppmap(data, targetSize, 20)
+	require.Nil(t, err)
+
+	assert.LessOrEqual(t, len(pruned), targetSize)
+	assert.Equal(t, len(pruned), report.PrunedSize)
+	assert.Greater(t, report.TruncatedValues, 0)
+	assert.NotEmpty(t, report.RemovedMethods)
+	assert.Greater(t, report.RemovedClassMap, 0)
+
+	m, err := appmap.Decode(bytes.NewReader(pruned))
+	require.Nil(t, err)
+
+	// Every remaining return must belong to a remaining call, and no removed
+	// method may have any calls left.
+	calls := map[int]bool{}
+	for _, e := range m.Events {
+		if e.Event == "call" {
+			calls[e.ID] = true
+		}
+	}
+
+	removed := map[string]bool{}
+	for _, method := range report.RemovedMethods {
+		removed[method.Method] = true
+	}
+
+	for _, e := range m.Events {
+		switch e.Event {
+		case "call":
+			assert.False(t, removed[e.FunctionName()], "%s should have been removed", e.FunctionName())
+		case "return":
+			assert.True(t, calls[e.ParentID], "return %d has no call", e.ID)
+		}
+	}
+}
+
+func TestPruneCommand(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	fs.MkdirAll("tmp", 0755)
+	require.Nil(t, afero.WriteFile(fs, "tmp/a.appmap.json", data, 0644))
+	require.Nil(t, afero.WriteFile(fs, "tmp/b.appmap.json", data, 0644))
+
+	// AppMaps read from stdin are pruned like those on disk
+	stdin := files.Stdin
+	defer func() { files.Stdin = stdin }()
+	files.Stdin = bytes.NewReader(data)
+
+	cmd := NewPruneCommand(&PruneOptions{targetSize: 20, valueLength: 20, output: "pruned.appmap.json"})
+	require.Nil(t, cmd.RunE(cmd, []string{files.StdinPath}))
+	pruned, err := afero.ReadFile(fs, "pruned.appmap.json")
+	require.Nil(t, err)
+	assert.LessOrEqual(t, len(pruned), 20*1024)
+
+	cmd = NewPruneCommand(&PruneOptions{targetSize: 20, valueLength: 20, output: "pruned.appmap.json"})
+	err = cmd.RunE(cmd, []string{"tmp"})
+	require.NotNil(t, err)
+	assert.Equal(t, "tmp holds 2 AppMaps, only one can be pruned at a time", err.Error())
+}
@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+var statsFormats = []string{formatText, formatJSON, formatCSV, formatMarkdown, formatHTML}
+
+// statsCell is a cell of a table of statistics. Text is shown to people, Value
+// is for machines, e.g. a time in seconds rather than formatted.
+type statsCell struct {
+	Text  string
+	Value string
+}
+
+func textCell(text string) statsCell {
+	return statsCell{Text: text, Value: text}
+}
+
+func intCell(n int) statsCell {
+	return textCell(strconv.Itoa(n))
+}
+
+func floatCell(f float64, format string) statsCell {
+	return statsCell{Text: fmt.Sprintf(format, f), Value: strconv.FormatFloat(f, 'f', -1, 64)}
+}
+
+func secondsCell(seconds float64) statsCell {
+	return statsCell{Text: formatSeconds(seconds), Value: strconv.FormatFloat(seconds, 'f', -1, 64)}
+}
+
+var timingColumns = []string{"Total time", "Mean time", "P50 time", "P95 time", "Max time"}
+
+// timingCells are the cells of timingColumns, or empty cells if nothing was
+// timed.
+func timingCells(t *timingSummary) []statsCell {
+	if t == nil {
+		return make([]statsCell, len(timingColumns))
+	}
+	return []statsCell{secondsCell(t.Total), secondsCell(t.Mean), secondsCell(t.P50), secondsCell(t.P95), secondsCell(t.Max)}
+}
+
+// statsTable lays out statistics for the formats which are made of tables.
+type statsTable struct {
+	Title   string
+	Columns []string
+	Rows    [][]statsCell
+}
+
+// statsSection is a kind of statistics, of all of the AppMaps or of one of
+// them, ready to be rendered.
+type statsSection interface {
+	// text renders the section in the layout meant for terminals.
+	text(w io.Writer)
+	// value is what the section is encoded as in JSON.
+	value() interface{}
+	tables() []statsTable
+}
+
+// fileSection is the statistics of a single AppMap.
+type fileSection struct {
+	Name    string
+	Section statsSection
+}
+
+// statsReport is everything stats shows: the statistics of each AppMap, if
+// requested, and those of all of them.
+type statsReport struct {
+	showFiles bool
+	Files     []fileSection
+	// TotalsName is the key of the totals in JSON.
+	TotalsName string
+	Totals     statsSection
+}
+
+func (r *statsReport) MarshalJSON() ([]byte, error) {
+	type fileJSON struct {
+		Name   string      `json:"name"`
+		Totals interface{} `json:"totals"`
+	}
+
+	v := make(map[string]interface{})
+	if r.showFiles {
+		files := make([]fileJSON, len(r.Files))
+		for i, f := range r.Files {
+			files[i] = fileJSON{f.Name, f.Section.value()}
+		}
+		v["files"] = files
+	}
+
+	name := r.TotalsName
+	if name == "" {
+		name = "totals"
+	}
+	v[name] = r.Totals.value()
+
+	return json.Marshal(v)
+}
+
+// statsRenderer renders statistics in one of statsFormats.
+type statsRenderer interface {
+	// renderSection renders statistics on their own.
+	renderSection(w io.Writer, section statsSection) error
+	renderReport(w io.Writer, report *statsReport) error
+}
+
+func newStatsRenderer(format string) (statsRenderer, error) {
+	switch format {
+	case formatText, "":
+		return textRenderer{}, nil
+	case formatJSON:
+		return jsonRenderer{}, nil
+	case formatCSV:
+		return csvRenderer{}, nil
+	case formatMarkdown:
+		return markdownRenderer{}, nil
+	case formatHTML:
+		return htmlRenderer{}, nil
+	}
+	return nil, fmt.Errorf("invalid format %q, must be one of %v", format, statsFormats)
+}
+
+type textRenderer struct{}
+
+func (textRenderer) renderSection(w io.Writer, section statsSection) error {
+	section.text(w)
+	return nil
+}
+
+func (textRenderer) renderReport(w io.Writer, report *statsReport) error {
+	for _, f := range report.Files {
+		fmt.Fprint(w, f.Name+": ")
+		f.Section.text(w)
+	}
+	if report.showFiles {
+		fmt.Fprint(w, "\n\n")
+	}
+	report.Totals.text(w)
+	return nil
+}
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) renderSection(w io.Writer, section statsSection) error {
+	j, err := json.Marshal(section.value())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(j)
+	return err
+}
+
+func (jsonRenderer) renderReport(w io.Writer, report *statsReport) error {
+	j, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(j)
+	return err
+}
+
+// csvRenderer writes each table after the other, separated by a blank line.
+// The tables of each AppMap are combined, with the name of the AppMap in the
+// first column.
+type csvRenderer struct{}
+
+// writeCSVTable writes the rows of a table, preceded by file if it's set.
+func writeCSVTable(cw *csv.Writer, table statsTable, file string, header bool) {
+	var prefix []string
+	if file != "" {
+		prefix = []string{file}
+	}
+
+	if header {
+		columns := table.Columns
+		if file != "" {
+			columns = append([]string{"File"}, columns...)
+		}
+		cw.Write(columns)
+	}
+	for _, row := range table.Rows {
+		record := append([]string{}, prefix...)
+		for _, cell := range row {
+			record = append(record, cell.Value)
+		}
+		cw.Write(record)
+	}
+}
+
+func (r csvRenderer) renderSection(w io.Writer, section statsSection) error {
+	return r.renderReport(w, &statsReport{Totals: section})
+}
+
+func (csvRenderer) renderReport(w io.Writer, report *statsReport) error {
+	cw := csv.NewWriter(w)
+	written := 0
+	writeTable := func(write func()) {
+		if written > 0 {
+			cw.Flush()
+			fmt.Fprintln(w)
+		}
+		write()
+		written++
+	}
+
+	fileTables := make([][]statsTable, len(report.Files))
+	for i, f := range report.Files {
+		fileTables[i] = f.Section.tables()
+	}
+	if len(fileTables) > 0 {
+		for i := range fileTables[0] {
+			writeTable(func() {
+				for j, f := range report.Files {
+					writeCSVTable(cw, fileTables[j][i], f.Name, j == 0)
+				}
+			})
+		}
+	}
+
+	for _, table := range report.Totals.tables() {
+		table := table
+		writeTable(func() { writeCSVTable(cw, table, "", true) })
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+type markdownRenderer struct{}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\n", " ", "\r", "")
+
+func writeMarkdownTables(w io.Writer, tables []statsTable, level string) {
+	for _, table := range tables {
+		fmt.Fprintf(w, "%s %s\n\n", level, markdownEscaper.Replace(table.Title))
+		fmt.Fprintf(w, "| %s |\n", strings.Join(table.Columns, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(table.Columns)))
+		for _, row := range table.Rows {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				cells[i] = markdownEscaper.Replace(cell.Text)
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func (markdownRenderer) renderSection(w io.Writer, section statsSection) error {
+	writeMarkdownTables(w, section.tables(), "##")
+	return nil
+}
+
+func (markdownRenderer) renderReport(w io.Writer, report *statsReport) error {
+	if !report.showFiles {
+		writeMarkdownTables(w, report.Totals.tables(), "##")
+		return nil
+	}
+
+	for _, f := range report.Files {
+		fmt.Fprintf(w, "## %s\n\n", markdownEscaper.Replace(f.Name))
+		writeMarkdownTables(w, f.Section.tables(), "###")
+	}
+	fmt.Fprint(w, "## All AppMaps\n\n")
+	writeMarkdownTables(w, report.Totals.tables(), "###")
+	return nil
+}
+
+// htmlRenderer renders a self-contained page, whose tables can be sorted by
+// clicking on their headings. The statistics of each AppMap are folded away.
+type htmlRenderer struct{}
+
+type htmlFile struct {
+	Name   string
+	Tables []statsTable
+}
+
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>AppMap statistics</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; cursor: pointer; user-select: none; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+tr:nth-child(even) td { background: #fafafa; }
+details { margin-bottom: 1em; }
+summary { cursor: pointer; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>AppMap statistics</h1>
+{{- if .Files}}
+<h2>AppMaps</h2>
+{{- range .Files}}
+<details>
+<summary>{{.Name}}</summary>
+{{template "tables" .Tables}}
+</details>
+{{- end}}
+<h2>All AppMaps</h2>
+{{- end}}
+{{template "tables" .Totals}}
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table"), body = table.tBodies[0], index = th.cellIndex;
+    var desc = !th.classList.contains("desc");
+    table.querySelectorAll("th").forEach(function (other) { other.classList.remove("asc", "desc"); });
+    th.classList.add(desc ? "desc" : "asc");
+    var value = function (row) { return row.cells[index].getAttribute("data-value"); };
+    Array.from(body.rows).sort(function (a, b) {
+      var va = value(a), vb = value(b), na = parseFloat(va), nb = parseFloat(vb);
+      var order = !isNaN(na) && !isNaN(nb) ? na - nb : va.localeCompare(vb);
+      return desc ? -order : order;
+    }).forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+{{define "tables"}}
+{{- range .}}
+<h3>{{.Title}}</h3>
+<table class="sortable">
+<thead><tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr>{{range .}}<td data-value="{{.Value}}">{{.Text}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+{{- end}}
+`))
+
+func (r htmlRenderer) renderSection(w io.Writer, section statsSection) error {
+	return r.renderReport(w, &statsReport{Totals: section})
+}
+
+func (htmlRenderer) renderReport(w io.Writer, report *statsReport) error {
+	var v struct {
+		Files  []htmlFile
+		Totals []statsTable
+	}
+	for _, f := range report.Files {
+		v.Files = append(v.Files, htmlFile{f.Name, f.Section.tables()})
+	}
+	v.Totals = report.Totals.tables()
+	return htmlReport.Execute(w, v)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReport(t *testing.T, p StatsProcessor) *statsReport {
+	m, err := appmap.Decode(strings.NewReader(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"A","method_id":"b|c","static":false,"path":"a.rb","lineno":3,"parameters":[]},
+		{"id":2,"event":"return","thread_id":1,"parent_id":1,"elapsed":0.5},
+		{"id":3,"event":"call","thread_id":1,"defined_class":"A","method_id":"<script>","static":true,"path":"a.rb","lineno":7,"parameters":[]}
+	]}`))
+	require.Nil(t, err)
+
+	stats, calls := p.MethodStats(m)
+	return &statsReport{
+		showFiles: true,
+		Files:     []fileSection{{`a "quoted" <name>.appmap.json`, p.methodsSection(calls, stats)}, {"b.appmap.json", p.methodsSection(calls, stats)}},
+		Totals:    p.methodsSection(2*calls, stats),
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	p := StatsProcessor{}
+	buf := new(bytes.Buffer)
+	require.Nil(t, jsonRenderer{}.renderReport(buf, testReport(t, p)))
+
+	var out struct {
+		Files []struct {
+			Name   string                   `json:"name"`
+			Totals []map[string]interface{} `json:"totals"`
+		} `json:"files"`
+		Totals []map[string]interface{} `json:"totals"`
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out.Files, 2)
+	assert.Equal(t, `a "quoted" <name>.appmap.json`, out.Files[0].Name)
+	assert.Equal(t, "A#b|c", out.Totals[0]["method"])
+}
+
+func TestRenderCSV(t *testing.T) {
+	p := StatsProcessor{}
+	buf := new(bytes.Buffer)
+	require.Nil(t, csvRenderer{}.renderReport(buf, testReport(t, p)))
+
+	tables := strings.Split(buf.String(), "\n\n")
+	require.Len(t, tables, 2)
+
+	files, err := csv.NewReader(strings.NewReader(tables[0])).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, files, 5)
+	assert.Equal(t, []string{"File", "Method", "Path", "Line", "Calls", "Distinct parameters", "Self time", "Total time", "Mean time", "P50 time", "P95 time", "Max time"}, files[0])
+	assert.Equal(t, []string{`a "quoted" <name>.appmap.json`, "A#b|c", "a.rb", "3", "1", "1", "0.5", "0.5", "0.5", "0.5", "0.5", "0.5"}, files[1])
+	assert.Equal(t, []string{`a "quoted" <name>.appmap.json`, "A.<script>", "a.rb", "7", "1", "1", "", "", "", "", "", ""}, files[2])
+	assert.Equal(t, "b.appmap.json", files[3][0])
+
+	totals, err := csv.NewReader(strings.NewReader(tables[1])).ReadAll()
+	require.Nil(t, err)
+	require.Len(t, totals, 3)
+	assert.Equal(t, "Method", totals[0][0])
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	p := StatsProcessor{}
+	buf := new(bytes.Buffer)
+	require.Nil(t, markdownRenderer{}.renderReport(buf, testReport(t, p)))
+
+	out := buf.String()
+	assert.Contains(t, out, "## b.appmap.json\n\n### Methods (2 calls)\n\n| Method | Path |")
+	assert.Contains(t, out, "| A#b\\|c | a.rb | 3 | 1 | 1 | 500ms | 500ms |")
+	assert.Contains(t, out, "## All AppMaps\n\n### Methods (4 calls)")
+}
+
+func TestRenderHTML(t *testing.T) {
+	p := StatsProcessor{}
+	buf := new(bytes.Buffer)
+	require.Nil(t, htmlRenderer{}.renderReport(buf, testReport(t, p)))
+
+	out := buf.String()
+	assert.Contains(t, out, "<summary>a &#34;quoted&#34; &lt;name&gt;.appmap.json</summary>")
+	assert.Contains(t, out, `<td data-value="0.5">500ms</td>`)
+	assert.Contains(t, out, "A.&lt;script&gt;")
+	assert.NotContains(t, out, "A.<script>")
+	assert.Equal(t, 3, strings.Count(out, `<table class="sortable">`))
+}
+
+func TestStatsFormat(t *testing.T) {
+	_, err := newStatsRenderer("xml")
+	assert.NotNil(t, err)
+
+	_, fname := setup(validAppmap)
+	cmd := NewStatsCommand(&StatsProcessor{format: "xml"})
+	assert.NotNil(t, cmd.RunE(cmd, []string{fname}))
+
+	cmd = NewStatsCommand(&StatsProcessor{json: true, format: formatCSV})
+	assert.NotNil(t, cmd.RunE(cmd, []string{fname}))
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/applandinc/appland-cli/internal/appland"
 	"github.com/applandinc/appland-cli/internal/build"
 	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -36,6 +38,13 @@ func warn(err error) {
 	fmt.Fprintf(os.Stderr, "warn: %v\n", err)
 }
 
+// addFilterFlags adds the flags selecting which AppMaps are found in
+// directories.
+func addFilterFlags(flags *pflag.FlagSet, filter *files.Filter) {
+	flags.StringSliceVar(&filter.Include, "include", nil, "Only find AppMaps whose paths match these glob patterns")
+	flags.StringSliceVar(&filter.Exclude, "exclude", nil, "Skip AppMaps and directories matching these glob patterns")
+}
+
 type Connecter func() appland.Client
 
 var DefaultConnecter = func() appland.Client {
@@ -48,7 +57,11 @@ var DefaultConnecter = func() appland.Client {
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	if cerr := files.Cleanup(); cerr != nil {
+		warn(cerr)
+	}
+	if err != nil {
 		fail(err)
 	}
 
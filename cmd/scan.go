@@ -0,0 +1,515 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/applandinc/appland-cli/internal/metadata"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/spf13/cobra"
+)
+
+const (
+	scanBlock  = "block"
+	scanRedact = "redact"
+)
+
+type ScanOptions struct {
+	json       bool
+	appmapPath string
+	filter     files.Filter
+}
+
+// secretRule finds secrets in the values recorded in AppMaps: the matches of
+// value, or whole values named after name. If both are set, both must match.
+type secretRule struct {
+	id          string
+	description string
+	value       *regexp.Regexp
+	name        *regexp.Regexp
+	// luhn requires the digits of matches to pass the Luhn check, like those
+	// of card numbers.
+	luhn bool
+	// personal rules find personal data rather than secrets, and are only
+	// applied when they're enabled.
+	personal bool
+}
+
+var defaultSecretRules = []*secretRule{
+	{id: "aws-access-key", description: "AWS access key", value: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{id: "private-key", description: "Private key", value: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{id: "api-key", description: "GitHub, Slack or Stripe API key", value: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|xox[abposr]-[A-Za-z0-9-]{10,}|[rs]k_live_[A-Za-z0-9]{24,})\b`)},
+	{id: "jwt", description: "JSON Web Token", value: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]+`)},
+	{id: "secret-parameter", description: "Password or secret parameter", name: regexp.MustCompile(`(?i)passw(?:or)?d|^pwd$|secret|token|api_?key`)},
+	{id: "password-in-text", description: "Password in text", value: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd)\s*[=:]\s*(?:'[^']+'|"[^"]+")`)},
+	{id: "auth-header", description: "Credentials header", name: regexp.MustCompile(`(?i)^(?:authorization|proxy-authorization|cookie|set-cookie|x-api-key|x-auth-token)$`)},
+	// Card numbers start with the prefix of a known network: Visa, Mastercard,
+	// American Express, Diners Club, Discover or JCB.
+	{id: "credit-card", description: "Credit card number", value: regexp.MustCompile(`\b(?:4\d{3}|5[1-5]\d{2}|2(?:22[1-9]|2[3-9]\d|[3-6]\d{2}|7[01]\d|720)|3[47]\d{2}|3(?:0[0-5]|[689]\d)\d|6(?:011|5\d{2}|4[4-9]\d)|35(?:2[89]|[3-8]\d))(?:[ -]?\d){9,15}\b`), luhn: true, personal: true},
+	{id: "email", description: "Email address", value: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`), personal: true},
+}
+
+// luhnValid reports whether the digits of s pass the Luhn check.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// secretScanner finds secrets with the built-in rules and those of appmap.yml.
+type secretScanner struct {
+	rules     []*secretRule
+	allowlist []*regexp.Regexp
+	// redact is whether upload redacts secrets, rather than skipping the
+	// AppMaps which contain them.
+	redact bool
+}
+
+func newSecretScanner(scan config.AppMapScan) (*secretScanner, error) {
+	s := &secretScanner{}
+	switch scan.Action {
+	case "", scanBlock:
+	case scanRedact:
+		s.redact = true
+	default:
+		return nil, fmt.Errorf("invalid scan action %q, must be %s or %s", scan.Action, scanBlock, scanRedact)
+	}
+
+	builtin := make(map[string]bool)
+	for _, rule := range defaultSecretRules {
+		builtin[rule.id] = true
+	}
+	enabled := make(map[string]bool)
+	for _, id := range scan.Enable {
+		if !builtin[id] {
+			return nil, fmt.Errorf("unknown built-in scan rule %s", id)
+		}
+		enabled[id] = true
+	}
+	disabled := make(map[string]bool)
+	for _, id := range scan.Disable {
+		disabled[id] = true
+	}
+	for _, rule := range defaultSecretRules {
+		if !disabled[rule.id] && (!rule.personal || enabled[rule.id]) {
+			s.rules = append(s.rules, rule)
+		}
+	}
+
+	for i, r := range scan.Rules {
+		if r.ID == "" {
+			return nil, fmt.Errorf("scan rule %d has no id", i+1)
+		}
+		if r.Value == "" && r.Name == "" {
+			return nil, fmt.Errorf("scan rule %s needs a value or a name pattern", r.ID)
+		}
+
+		rule := &secretRule{id: r.ID, description: r.Description}
+		var err error
+		if r.Value != "" {
+			if rule.value, err = regexp.Compile(r.Value); err != nil {
+				return nil, fmt.Errorf("scan rule %s: %w", r.ID, err)
+			}
+		}
+		if r.Name != "" {
+			if rule.name, err = regexp.Compile(r.Name); err != nil {
+				return nil, fmt.Errorf("scan rule %s: %w", r.ID, err)
+			}
+		}
+		s.rules = append(s.rules, rule)
+	}
+
+	for _, pattern := range scan.Allowlist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist pattern %q: %w", pattern, err)
+		}
+		s.allowlist = append(s.allowlist, re)
+	}
+
+	return s, nil
+}
+
+func (s *secretScanner) allowed(secret string) bool {
+	for _, re := range s.allowlist {
+		if re.MatchString(secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretSpan is where a rule found a secret in a value.
+type secretSpan struct {
+	start, end int
+	rule       *secretRule
+}
+
+// transformedValue matches the values replaced by redaction or by the redact
+// and hash transformers of upload, which aren't secret anymore.
+var transformedValue = regexp.MustCompile(`^(?:\[REDACTED(?::[^\]]+)?\]|sha256:[0-9a-f]{64})$`)
+
+// scanValue finds the secrets in a value, recorded under name if it has one.
+// The spans returned are in order, and don't overlap.
+func (s *secretScanner) scanValue(name string, value string) []secretSpan {
+	if value == "" || transformedValue.MatchString(value) {
+		return nil
+	}
+
+	var spans []secretSpan
+	for _, rule := range s.rules {
+		if rule.name != nil && (name == "" || !rule.name.MatchString(name)) {
+			continue
+		}
+
+		if rule.value == nil {
+			if !s.allowed(value) {
+				spans = append(spans, secretSpan{0, len(value), rule})
+			}
+			continue
+		}
+
+		for _, loc := range rule.value.FindAllStringIndex(value, -1) {
+			secret := value[loc[0]:loc[1]]
+			if (rule.luhn && !luhnValid(secret)) || s.allowed(secret) {
+				continue
+			}
+			spans = append(spans, secretSpan{loc[0], loc[1], rule})
+		}
+	}
+
+	// Of overlapping secrets, the first and longest is kept
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+	kept := spans[:0]
+	for _, span := range spans {
+		if len(kept) > 0 && span.start < kept[len(kept)-1].end {
+			continue
+		}
+		kept = append(kept, span)
+	}
+	return kept
+}
+
+// redactSpans replaces the secrets found in a value by the rule which found
+// them.
+func redactSpans(value string, spans []secretSpan) string {
+	var b strings.Builder
+	last := 0
+	for _, span := range spans {
+		b.WriteString(value[last:span.start])
+		b.WriteString("[REDACTED:" + span.rule.id + "]")
+		last = span.end
+	}
+	b.WriteString(value[last:])
+	return b.String()
+}
+
+// maskSecret hides most of a secret, so it can be reported without being
+// leaked again.
+func maskSecret(secret string) string {
+	r := []rune(secret)
+	if len(r) <= 8 {
+		return strings.Repeat("*", len(r))
+	}
+	return string(r[:2]) + strings.Repeat("*", 6) + string(r[len(r)-2:])
+}
+
+// valueText is the text of a parameter value of any JSON type, which is
+// scanned for secrets.
+func valueText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// secretFinding is a secret found in an event. Match is the secret, masked.
+type secretFinding struct {
+	EventID  int    `json:"event_id"`
+	Rule     string `json:"rule"`
+	Location string `json:"location"`
+	Match    string `json:"match"`
+}
+
+// scanEvent finds the secrets in the parameters, return value, HTTP request
+// headers and SQL query of the event at index in the events of an AppMap,
+// along with the patch which redacts them.
+func (s *secretScanner) scanEvent(index int, e *appmap.Event) ([]secretFinding, jsonpatch.Patch, error) {
+	var (
+		findings []secretFinding
+		patch    jsonpatch.Patch
+	)
+	scan := func(name string, location string, pointer string, value string) error {
+		spans := s.scanValue(name, value)
+		if len(spans) == 0 {
+			return nil
+		}
+
+		for _, span := range spans {
+			findings = append(findings, secretFinding{
+				EventID:  e.ID,
+				Rule:     span.rule.id,
+				Location: location,
+				Match:    maskSecret(value[span.start:span.end]),
+			})
+		}
+		op, err := metadata.Operation("replace", fmt.Sprintf("/events/%d%s", index, pointer), redactSpans(value, spans))
+		if err != nil {
+			return err
+		}
+		patch = append(patch, op)
+		return nil
+	}
+
+	parameters := func(field string, params []appmap.Parameter) error {
+		for j, p := range params {
+			location := fmt.Sprintf("%s[%d]", field, j)
+			if p.Name != "" {
+				location = field + "." + p.Name
+			}
+			if err := scan(p.Name, location, fmt.Sprintf("/%s/%d/value", field, j), valueText(p.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := parameters("parameters", e.Parameters); err != nil {
+		return nil, nil, err
+	}
+	if err := parameters("message", e.Message); err != nil {
+		return nil, nil, err
+	}
+
+	if e.ReturnValue != nil {
+		if err := scan(e.ReturnValue.Name, "return_value", "/return_value/value", valueText(e.ReturnValue.Value)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if e.HTTPServerRequest != nil {
+		headers := make([]string, 0, len(e.HTTPServerRequest.Headers))
+		for name := range e.HTTPServerRequest.Headers {
+			headers = append(headers, name)
+		}
+		sort.Strings(headers)
+		for _, name := range headers {
+			pointer := "/http_server_request/headers/" + metadata.EscapePointer(name)
+			if err := scan(name, "http_server_request.headers."+name, pointer, e.HTTPServerRequest.Headers[name]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if e.SQLQuery != nil {
+		if err := scan("", "sql_query.sql", "/sql_query/sql", e.SQLQuery.SQL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return findings, patch, nil
+}
+
+// scanAppmap finds the secrets in the events of the AppMap read from r, along
+// with the patch which redacts them, if there are any. The secrets found
+// before an error are returned along with it.
+func (s *secretScanner) scanAppmap(r io.Reader) ([]secretFinding, *jsonpatch.Patch, error) {
+	var (
+		findings []secretFinding
+		patch    jsonpatch.Patch
+		index    int
+	)
+	_, err := appmap.Stream(r, func(e *appmap.Event) error {
+		f, p, err := s.scanEvent(index, e)
+		if err != nil {
+			return err
+		}
+		index++
+		findings = append(findings, f...)
+		patch = append(patch, p...)
+		return nil
+	})
+
+	if len(patch) == 0 {
+		return findings, nil, err
+	}
+	return findings, &patch, err
+}
+
+func (s *secretScanner) scanFile(fname string) ([]secretFinding, *jsonpatch.Patch, error) {
+	f, err := files.Open(fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening %s: %w", fname, err)
+	}
+	defer f.Close()
+
+	findings, patch, err := s.scanAppmap(f)
+	if err != nil {
+		err = fmt.Errorf("failed scanning %s: %w", fname, err)
+	}
+	return findings, patch, err
+}
+
+// secretsFoundError is returned by readScenario if secrets are found in a
+// file, and they aren't to be redacted.
+type secretsFoundError struct {
+	path     string
+	findings []secretFinding
+}
+
+func (e *secretsFoundError) Error() string {
+	rules := make(map[string]bool)
+	for _, f := range e.findings {
+		rules[f.Rule] = true
+	}
+	return fmt.Sprintf("file %s contains %d secret(s) (%s), see the scan command", e.path, len(e.findings), strings.Join(sortedKeys(rules), ", "))
+}
+
+type scanResult struct {
+	File     string          `json:"file"`
+	Findings []secretFinding `json:"findings"`
+}
+
+func renderScan(w io.Writer, asJSON bool, results []scanResult) {
+	if asJSON {
+		j, err := json.Marshal(results)
+		if err == nil {
+			fmt.Fprintln(w, string(j))
+		} else {
+			warn(err)
+		}
+		return
+	}
+
+	for _, result := range results {
+		if len(result.Findings) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s:\n", result.File)
+		for _, f := range result.Findings {
+			fmt.Fprintf(w, "  event %d: %s in %s (%s)\n", f.EventID, f.Rule, f.Location, f.Match)
+		}
+	}
+}
+
+func NewScanCommand(options *ScanOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "scan [files, directories]",
+		Short: "Scan AppMaps for secrets and personal data",
+		Long: `Scan AppMaps for secrets and personal data
+
+Parameters, return values, HTTP request headers and SQL queries are scanned for
+secrets by default: API keys, private keys, passwords and JSON Web Tokens. The
+personal data rules, credit-card and email, only run when they're listed under
+scan.enable in appmap.yml, along with the rules of its scan section. upload
+scans AppMaps the same way before uploading them. Exits with a non-zero status
+if any secret is found, or if an AppMap is invalid and couldn't be scanned in
+full.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var scanConfig config.AppMapScan
+			if appmapConfig, err := config.LoadAppmapConfig(options.appmapPath, files.Origin(args[0])); err == nil {
+				scanConfig = appmapConfig.Scan
+			} else if options.appmapPath != "" {
+				return err
+			}
+
+			scanner, err := newSecretScanner(scanConfig)
+			if err != nil {
+				return fmt.Errorf("invalid scan configuration: %w", err)
+			}
+
+			fnames, err := files.Find(args, options.filter)
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+
+			cmd.SilenceUsage = true
+
+			results := make([]scanResult, 0, len(fnames))
+			found, affected, unscanned := 0, 0, 0
+			for _, fname := range fnames {
+				// Scanning stops at the first invalid event, so the rest of the
+				// AppMap may contain secrets
+				findings, _, err := scanner.scanFile(fname)
+				var errs appmap.ValidationErrors
+				if errors.As(err, &errs) {
+					warn(err)
+					unscanned++
+				} else if err != nil {
+					return err
+				}
+
+				if findings == nil {
+					findings = []secretFinding{}
+				} else {
+					found += len(findings)
+					affected++
+				}
+				results = append(results, scanResult{File: fname, Findings: findings})
+			}
+
+			renderScan(os.Stdout, options.json, results)
+
+			if found > 0 {
+				return fmt.Errorf("found %d secret(s) in %d of %d AppMaps", found, affected, len(fnames))
+			}
+			if unscanned > 0 {
+				return fmt.Errorf("%d of %d AppMaps are invalid and couldn't be scanned in full, see the validate command", unscanned, len(fnames))
+			}
+
+			if !options.json {
+				fmt.Printf("No secrets found in %d AppMaps\n", len(fnames))
+			}
+			return nil
+		},
+	}
+}
+
+func init() {
+	var (
+		options = &ScanOptions{}
+		scanCmd = NewScanCommand(options)
+	)
+
+	f := scanCmd.Flags()
+	f.BoolVarP(&options.json, "json", "j", false, "Format results as JSON")
+	f.StringVar(&options.appmapPath, "appmap-config", "", "Path of the appmap.yml configuring the scan")
+	addFilterFlags(f, &options.filter)
+
+	rootCmd.AddCommand(scanCmd)
+}
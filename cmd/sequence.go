@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const (
+	sequencePlantUML = "plantuml"
+	sequenceMermaid  = "mermaid"
+
+	groupByClass   = "class"
+	groupByPackage = "package"
+
+	// clientParticipant makes the calls at the top of each thread.
+	clientParticipant   = "Client"
+	serverParticipant   = "HTTP server"
+	databaseParticipant = "Database"
+
+	maxMessageLength = 80
+)
+
+type SequenceOptions struct {
+	format     string
+	group      string
+	collapse   bool
+	maxDepth   int
+	output     string
+	appmapPath string
+}
+
+// seqMessage is a call from one participant to another, along with the calls
+// made while handling it.
+type seqMessage struct {
+	from, to string
+	label    string
+	children []*seqMessage
+}
+
+// seqFrame is the value of the frame of a call. Calls within a participant
+// aren't messages, the calls they make are sent by the participant as part of
+// the message which reached it.
+type seqFrame struct {
+	participant string
+	message     *seqMessage
+}
+
+// sequenceBuilder reconstructs the messages between participants from the
+// calls of an AppMap.
+type sequenceBuilder struct {
+	group    string
+	packages []config.AppMapPackage
+	root     *seqMessage
+}
+
+func newSequenceBuilder(group string, appmapConfig *config.AppMapConfig) *sequenceBuilder {
+	b := &sequenceBuilder{group: group, root: &seqMessage{to: clientParticipant}}
+	if appmapConfig != nil {
+		b.packages = appmapConfig.Packages
+	}
+	return b
+}
+
+// participant is who handles a call, and label describes the call.
+func (b *sequenceBuilder) participant(e *appmap.Event) (participant string, label string) {
+	switch {
+	case e.HTTPServerRequest != nil:
+		return serverParticipant, e.HTTPServerRequest.RequestMethod + " " + serverRoute(e.HTTPServerRequest)
+	case e.SQLQuery != nil:
+		return databaseParticipant, normalizeSQL(e.SQLQuery.SQL)
+	case e.HTTPClientRequest != nil:
+		r := e.HTTPClientRequest
+		if u, err := url.Parse(r.URL); err == nil && u.Host != "" {
+			return u.Host, r.RequestMethod + " " + pathTemplate(u.EscapedPath())
+		}
+		return "HTTP", r.RequestMethod + " " + pathTemplate(r.URL)
+	}
+
+	if b.group != groupByPackage {
+		return e.DefinedClass, e.MethodID
+	}
+
+	// Code outside of the packages of appmap.yml is grouped by the package
+	// or module enclosing its class.
+	participant = parentName(e.DefinedClass)
+	if i, _ := findPackage(b.packages, e.DefinedClass, e.Path); i >= 0 {
+		participant = b.packages[i].Path
+	}
+	if participant == "" {
+		participant = e.DefinedClass
+	}
+	return participant, e.FunctionName()
+}
+
+func (b *sequenceBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	caller := seqFrame{participant: clientParticipant, message: b.root}
+	if len(stack) > 0 {
+		caller = stack[len(stack)-1].Value.(seqFrame)
+	}
+
+	participant, label := b.participant(e)
+	if participant == "" {
+		participant = "(unknown)"
+	}
+	frame := seqFrame{participant: participant, message: caller.message}
+	if participant != caller.participant || len(stack) == 0 {
+		message := &seqMessage{from: caller.participant, to: participant, label: label}
+		caller.message.children = append(caller.message.children, message)
+		frame.message = message
+	}
+	return frame
+}
+
+func (b *sequenceBuilder) Return(ret *appmap.Event, call *appmap.Frame) {}
+
+// seqStep is a line of a sequence diagram: a message, the return from one, or
+// the start or end of a loop.
+type seqStep struct {
+	kind     string
+	from, to string
+	label    string
+	count    int
+}
+
+const (
+	stepMessage = "message"
+	stepReturn  = "return"
+	stepLoop    = "loop"
+	stepEnd     = "end"
+)
+
+// sequenceDiagram is the steps of a diagram, and its participants in order
+// of appearance.
+type sequenceDiagram struct {
+	participants []string
+	steps        []seqStep
+}
+
+// signature identifies a message and the messages shown beneath it, to tell
+// repeated messages apart.
+func (m *seqMessage) signature(depth int, maxDepth int) string {
+	var b strings.Builder
+	b.WriteString(m.to + "\x00" + m.label + "(")
+	if maxDepth == 0 || depth < maxDepth {
+		for _, c := range m.children {
+			b.WriteString(c.signature(depth+1, maxDepth))
+		}
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// layout lays out the messages as the steps of a diagram, down to maxDepth
+// messages deep if it's set, collapsing repeated messages into loops if
+// requested.
+func layout(root *seqMessage, maxDepth int, collapse bool) *sequenceDiagram {
+	var (
+		d    = &sequenceDiagram{}
+		seen = make(map[string]bool)
+	)
+	appear := func(participant string) {
+		if !seen[participant] {
+			seen[participant] = true
+			d.participants = append(d.participants, participant)
+		}
+	}
+	appear(clientParticipant)
+
+	var walk func(messages []*seqMessage, depth int)
+	walk = func(messages []*seqMessage, depth int) {
+		for i := 0; i < len(messages); {
+			m := messages[i]
+			count := 1
+			if collapse {
+				signature := m.signature(depth, maxDepth)
+				for i+count < len(messages) && messages[i+count].signature(depth, maxDepth) == signature {
+					count++
+				}
+			}
+			i += count
+
+			appear(m.from)
+			appear(m.to)
+			if count > 1 {
+				d.steps = append(d.steps, seqStep{kind: stepLoop, count: count})
+			}
+			d.steps = append(d.steps, seqStep{kind: stepMessage, from: m.from, to: m.to, label: m.label})
+			if maxDepth == 0 || depth < maxDepth {
+				walk(m.children, depth+1)
+			}
+			d.steps = append(d.steps, seqStep{kind: stepReturn, from: m.to, to: m.from})
+			if count > 1 {
+				d.steps = append(d.steps, seqStep{kind: stepEnd})
+			}
+		}
+	}
+	walk(root.children, 1)
+
+	return d
+}
+
+// participantIDs are the aliases of the participants in a diagram.
+func (d *sequenceDiagram) participantIDs() map[string]string {
+	ids := make(map[string]string, len(d.participants))
+	for i, p := range d.participants {
+		ids[p] = fmt.Sprintf("p%d", i)
+	}
+	return ids
+}
+
+func messageLabel(label string) string {
+	label = strings.Join(strings.Fields(label), " ")
+	label, _ = truncateString(label, maxMessageLength)
+	return label
+}
+
+var (
+	plantUMLEscaper = strings.NewReplacer(`"`, `'`)
+	mermaidEscaper  = strings.NewReplacer("#", "#35;", ";", "#59;")
+)
+
+func writePlantUML(w io.Writer, d *sequenceDiagram) {
+	ids := d.participantIDs()
+	fmt.Fprintln(w, "@startuml")
+	for _, p := range d.participants {
+		kind := "participant"
+		switch p {
+		case clientParticipant:
+			kind = "actor"
+		case databaseParticipant:
+			kind = "database"
+		}
+		fmt.Fprintf(w, "%s \"%s\" as %s\n", kind, plantUMLEscaper.Replace(p), ids[p])
+	}
+
+	for _, step := range d.steps {
+		switch step.kind {
+		case stepLoop:
+			fmt.Fprintf(w, "loop %d times\n", step.count)
+		case stepEnd:
+			fmt.Fprintln(w, "end")
+		case stepMessage:
+			fmt.Fprintf(w, "%s -> %s : %s\n", ids[step.from], ids[step.to], messageLabel(step.label))
+			fmt.Fprintf(w, "activate %s\n", ids[step.to])
+		case stepReturn:
+			fmt.Fprintf(w, "deactivate %s\n", ids[step.from])
+		}
+	}
+	fmt.Fprintln(w, "@enduml")
+}
+
+func writeMermaid(w io.Writer, d *sequenceDiagram) {
+	ids := d.participantIDs()
+	fmt.Fprintln(w, "sequenceDiagram")
+	for _, p := range d.participants {
+		kind := "participant"
+		if p == clientParticipant {
+			kind = "actor"
+		}
+		fmt.Fprintf(w, "  %s %s as %s\n", kind, ids[p], mermaidEscaper.Replace(p))
+	}
+
+	indent := "  "
+	for _, step := range d.steps {
+		switch step.kind {
+		case stepLoop:
+			fmt.Fprintf(w, "%sloop %d times\n", indent, step.count)
+			indent += "  "
+		case stepEnd:
+			indent = indent[2:]
+			fmt.Fprintf(w, "%send\n", indent)
+		case stepMessage:
+			fmt.Fprintf(w, "%s%s->>%s: %s\n", indent, ids[step.from], ids[step.to], mermaidEscaper.Replace(messageLabel(step.label)))
+			fmt.Fprintf(w, "%sactivate %s\n", indent, ids[step.to])
+		case stepReturn:
+			fmt.Fprintf(w, "%sdeactivate %s\n", indent, ids[step.from])
+		}
+	}
+}
+
+func NewSequenceCommand(options *SequenceOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "sequence [file]",
+		Short: "Draw a sequence diagram of an AppMap",
+		Long: `Draw a sequence diagram of an AppMap, in PlantUML or Mermaid
+
+The participants are the classes called, or the packages of appmap.yml they
+belong to, along with the HTTP server, the database and the hosts of HTTP
+client requests. Calls within a participant are left out, the calls they make
+are sent by the participant.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if options.format != sequencePlantUML && options.format != sequenceMermaid {
+				return fmt.Errorf("invalid format %q, must be %s or %s", options.format, sequencePlantUML, sequenceMermaid)
+			}
+			if options.group != groupByClass && options.group != groupByPackage {
+				return fmt.Errorf("invalid grouping %q, must be %s or %s", options.group, groupByClass, groupByPackage)
+			}
+			cmd.SilenceUsage = true
+
+			fnames, err := files.Find(args, files.Filter{})
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+			if len(fnames) != 1 {
+				return fmt.Errorf("found %d AppMaps in %s, sequence diagrams are drawn for a single AppMap", len(fnames), args[0])
+			}
+			fname := fnames[0]
+
+			var appmapConfig *config.AppMapConfig
+			if options.group == groupByPackage {
+				if appmapConfig, err = config.LoadAppmapConfig(options.appmapPath, files.Origin(fname)); err != nil {
+					warn(err)
+				}
+			}
+
+			f, err := files.Open(fname)
+			if err != nil {
+				return fmt.Errorf("failed opening %s: %w", fname, err)
+			}
+			b := newSequenceBuilder(options.group, appmapConfig)
+			_, err = appmap.StreamCalls(f, b)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed decoding %s: %w", fname, err)
+			}
+			d := layout(b.root, options.maxDepth, options.collapse)
+
+			var buf bytes.Buffer
+			if options.format == sequenceMermaid {
+				writeMermaid(&buf, d)
+			} else {
+				writePlantUML(&buf, d)
+			}
+
+			if options.output == "" {
+				_, err = os.Stdout.Write(buf.Bytes())
+				return err
+			}
+			return afero.WriteFile(config.GetFS(), options.output, buf.Bytes(), 0644)
+		},
+	}
+}
+
+func init() {
+	var (
+		options     = SequenceOptions{}
+		sequenceCmd = NewSequenceCommand(&options)
+	)
+
+	f := sequenceCmd.Flags()
+	f.StringVar(&options.format, "format", sequencePlantUML, "Output format, plantuml or mermaid")
+	f.StringVar(&options.group, "group", groupByClass, "Group calls into participants by class, or by package of appmap.yml")
+	f.BoolVar(&options.collapse, "collapse", false, "Collapse repeated calls into loops")
+	f.IntVar(&options.maxDepth, "max-depth", 0, "Show calls this many levels deep at most (0 for no limit)")
+	f.StringVarP(&options.output, "output", "o", "", "Write the diagram to this file instead of stdout")
+	f.StringVar(&options.appmapPath, "appmap-config", "", "Path of the appmap.yml whose packages calls are grouped by (found like stats --suggest-excludes by default)")
+
+	rootCmd.AddCommand(sequenceCmd)
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeSequence(t *testing.T, events string, group string, appmapConfig *config.AppMapConfig) *seqMessage {
+	b := newSequenceBuilder(group, appmapConfig)
+	_, err := appmap.StreamCalls(strings.NewReader(`{"events":[`+events+`]}`), b)
+	require.Nil(t, err)
+	return b.root
+}
+
+func TestSequenceMessages(t *testing.T) {
+	root := decodeSequence(t, `
+		{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/users/1"}},
+		{"id":2,"event":"call","thread_id":1,"defined_class":"UsersController","method_id":"show","static":false},
+		{"id":3,"event":"call","thread_id":1,"defined_class":"UsersController","method_id":"authorize","static":false},
+		{"id":4,"event":"call","thread_id":1,"defined_class":"Session","method_id":"current_user","static":false},
+		{"id":5,"event":"return","thread_id":1,"parent_id":3},
+		{"id":6,"event":"call","thread_id":1,"defined_class":"User","method_id":"find","static":true},
+		{"id":7,"event":"return","thread_id":1,"parent_id":6},
+		{"id":8,"event":"call","thread_id":2,"defined_class":"Job","method_id":"perform","static":false},
+		{"id":9,"event":"call","thread_id":2,"method_id":"anonymous"},
+		{"id":10,"event":"return","thread_id":2,"parent_id":9},
+		{"id":11,"event":"return","thread_id":2,"parent_id":8},
+		{"id":12,"event":"return","thread_id":1,"parent_id":2},
+		{"id":13,"event":"return","thread_id":1,"parent_id":1}`, groupByClass, nil)
+
+	// authorize is called within the controller, so the calls it makes are
+	// sent by the controller. current_user is missing its return, find is
+	// still called by the controller rather than by the session. Each thread
+	// starts from the client.
+	buf := new(bytes.Buffer)
+	writePlantUML(buf, layout(root, 0, false))
+	assert.Equal(t, `@startuml
+actor "Client" as p0
+participant "HTTP server" as p1
+participant "UsersController" as p2
+participant "Session" as p3
+participant "User" as p4
+participant "Job" as p5
+participant "(unknown)" as p6
+p0 -> p1 : GET /users/:id
+activate p1
+p1 -> p2 : show
+activate p2
+p2 -> p3 : current_user
+activate p3
+deactivate p3
+p2 -> p4 : find
+activate p4
+deactivate p4
+deactivate p2
+deactivate p1
+p0 -> p5 : perform
+activate p5
+p5 -> p6 : anonymous
+activate p6
+deactivate p6
+deactivate p5
+@enduml
+`, buf.String())
+}
+
+func TestSequenceLayout(t *testing.T) {
+	find := func(children ...*seqMessage) *seqMessage {
+		return &seqMessage{from: "Controller", to: "User", label: "find", children: children}
+	}
+	query := func(label string) *seqMessage {
+		return &seqMessage{from: "User", to: databaseParticipant, label: label}
+	}
+	root := &seqMessage{children: []*seqMessage{
+		{from: clientParticipant, to: "Controller", label: "index", children: []*seqMessage{
+			find(query("SELECT ?")),
+			find(query("SELECT ?")),
+			find(),
+			find(query("UPDATE ?")),
+		}},
+	}}
+
+	labels := func(d *sequenceDiagram) []string {
+		var labels []string
+		for _, step := range d.steps {
+			switch step.kind {
+			case stepMessage:
+				labels = append(labels, step.label)
+			case stepLoop:
+				labels = append(labels, fmt.Sprintf("loop %d", step.count))
+			case stepEnd:
+				labels = append(labels, "end")
+			}
+		}
+		return labels
+	}
+
+	// Only calls which make the same calls are repeated
+	assert.Equal(t, []string{"index", "loop 2", "find", "SELECT ?", "end", "find", "find", "UPDATE ?"}, labels(layout(root, 0, true)))
+	assert.Equal(t, []string{"index", "find", "SELECT ?", "find", "SELECT ?", "find", "find", "UPDATE ?"}, labels(layout(root, 0, false)))
+
+	// Calls beneath the deepest shown are neither shown nor compared
+	d := layout(root, 2, true)
+	assert.Equal(t, []string{"index", "loop 4", "find", "end"}, labels(d))
+	assert.Equal(t, []string{clientParticipant, "Controller", "User"}, d.participants)
+}
+
+func TestSequenceMermaid(t *testing.T) {
+	appmapConfig := &config.AppMapConfig{Packages: []config.AppMapPackage{{Path: "com.example.model"}}}
+	root := decodeSequence(t, `
+		{"id":1,"event":"call","thread_id":1,"defined_class":"com.example.web.UsersController","method_id":"index","path":"src/main/java/com/example/web/UsersController.java","static":false},
+		{"id":2,"event":"call","thread_id":1,"defined_class":"com.example.model.User","method_id":"find","path":"src/main/java/com/example/model/User.java","static":true},
+		{"id":3,"event":"call","thread_id":1,"defined_class":"com.example.model.Account","method_id":"load","path":"src/main/java/com/example/model/Account.java","static":true},
+		{"id":4,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT id, name, email, created_at, updated_at FROM users WHERE organization_id = 1 ORDER BY name;"}},
+		{"id":5,"event":"return","thread_id":1,"parent_id":4},
+		{"id":6,"event":"return","thread_id":1,"parent_id":3},
+		{"id":7,"event":"return","thread_id":1,"parent_id":2},
+		{"id":8,"event":"call","thread_id":1,"defined_class":"Main","method_id":"log","static":true},
+		{"id":9,"event":"return","thread_id":1,"parent_id":8},
+		{"id":10,"event":"call","thread_id":1,"defined_class":"Main","method_id":"log","static":true},
+		{"id":11,"event":"return","thread_id":1,"parent_id":10},
+		{"id":12,"event":"return","thread_id":1,"parent_id":1}`, groupByPackage, appmapConfig)
+
+	// Classes outside of the packages are grouped by the package enclosing
+	// them, if they have one. Calls within the model package aren't messages.
+	// Labels are escaped and truncated.
+	buf := new(bytes.Buffer)
+	writeMermaid(buf, layout(root, 0, true))
+	assert.Equal(t, `sequenceDiagram
+  actor p0 as Client
+  participant p1 as com.example.web
+  participant p2 as com.example.model
+  participant p3 as Database
+  participant p4 as Main
+  p0->>p1: com.example.web.UsersController#35;index
+  activate p1
+  p1->>p2: com.example.model.User.find
+  activate p2
+  p2->>p3: SELECT id, name, email, created_at, updated_at FROM users WHERE organization_id ...
+  activate p3
+  deactivate p3
+  deactivate p2
+  loop 2 times
+    p1->>p4: Main.log
+    activate p4
+    deactivate p4
+  end
+  deactivate p1
+`, buf.String())
+}
+
+func TestSequenceCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "a.appmap.json", []byte(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"Main","method_id":"run","static":true}
+	]}`), 0644))
+	require.Nil(t, afero.WriteFile(fs, "truncated.appmap.json", []byte(`{"events":[{"id":1,`), 0644))
+
+	cmd := NewSequenceCommand(&SequenceOptions{format: sequenceMermaid, group: groupByClass, output: "out.mmd"})
+	require.Nil(t, cmd.RunE(cmd, []string{"a.appmap.json"}))
+	out, err := afero.ReadFile(fs, "out.mmd")
+	require.Nil(t, err)
+	assert.Contains(t, string(out), "p0->>p1: run\n")
+
+	assert.NotNil(t, cmd.RunE(cmd, []string{"truncated.appmap.json"}))
+
+	// A diagram is drawn for a single AppMap
+	require.Nil(t, fs.Mkdir("appmaps", 0755))
+	require.Nil(t, afero.WriteFile(fs, "appmaps/a.appmap.json", []byte(`{"events":[]}`), 0644))
+	require.Nil(t, afero.WriteFile(fs, "appmaps/b.appmap.json", []byte(`{"events":[]}`), 0644))
+	assert.NotNil(t, cmd.RunE(cmd, []string{"appmaps"}))
+
+	cmd = NewSequenceCommand(&SequenceOptions{format: "svg", group: groupByClass})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"a.appmap.json"}))
+	cmd = NewSequenceCommand(&SequenceOptions{format: sequencePlantUML, group: "module"})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"a.appmap.json"}))
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+)
+
+// defaultMinRepeats is how many times a query must be issued by a single
+// call to be reported as an N+1 query.
+const defaultMinRepeats = 3
+
+var (
+	inListPattern = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valuesPattern = regexp.MustCompile(`(?i)\bVALUES\s*` + valuesTuple + `(?:\s*,\s*` + valuesTuple + `)*`)
+)
+
+const valuesTuple = `\(\s*(?:\?|NULL|DEFAULT)(?:\s*,\s*(?:\?|NULL|DEFAULT))*\s*\)`
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// skipQuoted returns the index after the quoted string starting at i. Quotes
+// are escaped by doubling them, or with a backslash.
+func skipQuoted(sql string, i int) int {
+	quote := sql[i]
+	for i++; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+// normalizeSQL replaces the literals in a query by ?, collapses lists of
+// values and whitespace, and removes comments, so that queries which only
+// differ by their values are the same.
+func normalizeSQL(sql string) string {
+	var b strings.Builder
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		var next byte
+		if i+1 < len(sql) {
+			next = sql[i+1]
+		}
+
+		switch {
+		case c == '\'':
+			i = skipQuoted(sql, i)
+			b.WriteByte('?')
+		case c == '"' || c == '`':
+			// Quoted identifiers are kept
+			j := skipQuoted(sql, i)
+			b.WriteString(sql[i:j])
+			i = j
+		case c == '-' && next == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && next == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case c == '$' && isDigit(next), c == ':' && isIdentifierByte(next) && (i == 0 || sql[i-1] != ':'):
+			// Bind parameters
+			for i++; i < len(sql) && isIdentifierByte(sql[i]); i++ {
+			}
+			b.WriteByte('?')
+		case isDigit(c) && (i == 0 || !isIdentifierByte(sql[i-1])):
+			for i < len(sql) && (isIdentifierByte(sql[i]) || sql[i] == '.') {
+				i++
+			}
+			b.WriteByte('?')
+		case isSpace(c):
+			for i < len(sql) && isSpace(sql[i]) {
+				i++
+			}
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	normalized := strings.TrimSpace(b.String())
+	normalized = inListPattern.ReplaceAllString(normalized, "IN (...)")
+	normalized = valuesPattern.ReplaceAllString(normalized, "VALUES (...)")
+	return normalized
+}
+
+// callName describes a call, for reporting the caller of a query.
+func callName(e *appmap.Event) string {
+	switch {
+	case e == nil:
+		return "(top level)"
+	case e.HTTPServerRequest != nil:
+		path := e.HTTPServerRequest.NormalizedPathInfo
+		if path == "" {
+			path = e.HTTPServerRequest.PathInfo
+		}
+		return e.HTTPServerRequest.RequestMethod + " " + path
+	case e.HTTPClientRequest != nil:
+		return e.HTTPClientRequest.RequestMethod + " " + e.HTTPClientRequest.URL
+	case e.SQLQuery != nil:
+		return normalizeSQL(e.SQLQuery.SQL)
+	default:
+		return e.FunctionName()
+	}
+}
+
+// nPlusOne describes a query issued repeatedly by calls of the same method.
+type nPlusOne struct {
+	Caller string `json:"caller"`
+	// Occurrences is the number of calls which issued the query repeatedly.
+	Occurrences int `json:"occurrences"`
+	MaxRepeats  int `json:"max_repeats"`
+}
+
+// queryStats holds the statistics of a normalized SQL query.
+type queryStats struct {
+	Query     string
+	Calls     int
+	Elapsed   timeDistribution
+	TotalTime float64
+	// NPlusOne holds the callers which issued the query repeatedly, by name.
+	NPlusOne map[string]*nPlusOne
+}
+
+func (s *queryStats) timing() *timingSummary {
+	// All of the time spent in a query is its own.
+	return summarizeTimes(&s.Elapsed, s.TotalTime, s.TotalTime)
+}
+
+// nPlusOnes returns the callers which issued the query repeatedly, the most
+// frequent first.
+func (s *queryStats) nPlusOnes() []nPlusOne {
+	callers := make([]nPlusOne, 0, len(s.NPlusOne))
+	for _, n := range s.NPlusOne {
+		callers = append(callers, *n)
+	}
+
+	sort.Slice(callers, func(i, j int) bool {
+		if callers[i].Occurrences != callers[j].Occurrences {
+			return callers[i].Occurrences > callers[j].Occurrences
+		}
+		return callers[i].Caller < callers[j].Caller
+	})
+	return callers
+}
+
+func (s *queryStats) MarshalJSON() ([]byte, error) {
+	var v struct {
+		Query string `json:"query"`
+		Calls int    `json:"calls"`
+		*timingSummary
+		NPlusOne []nPlusOne `json:"n_plus_one,omitempty"`
+	}
+
+	v.Query = s.Query
+	v.Calls = s.Calls
+	v.timingSummary = s.timing()
+	v.NPlusOne = s.nPlusOnes()
+
+	return json.Marshal(v)
+}
+
+func (s *queryStats) sortValue(by string) float64 {
+	switch by {
+	case sortByTotal, sortBySelf:
+		return s.TotalTime
+	case sortByMean:
+		return s.Elapsed.mean(s.TotalTime)
+	default:
+		return float64(s.Calls)
+	}
+}
+
+// merge adds the calls of other, the same query in another AppMap.
+func (s *queryStats) merge(other *queryStats) {
+	s.Calls += other.Calls
+	s.Elapsed.merge(&other.Elapsed)
+	s.TotalTime += other.TotalTime
+
+	for caller, n := range other.NPlusOne {
+		existing, ok := s.NPlusOne[caller]
+		if !ok {
+			existing = &nPlusOne{Caller: caller}
+			s.NPlusOne[caller] = existing
+		}
+		existing.Occurrences += n.Occurrences
+		if n.MaxRepeats > existing.MaxRepeats {
+			existing.MaxRepeats = n.MaxRepeats
+		}
+	}
+}
+
+func mergeQueryStats(into map[string]*queryStats, from map[string]*queryStats) {
+	for query, stats := range from {
+		existing, ok := into[query]
+		if !ok {
+			existing = &queryStats{Query: query, NPlusOne: make(map[string]*nPlusOne)}
+			into[query] = existing
+		}
+		existing.merge(stats)
+	}
+}
+
+// sqlFrame is a call which hasn't returned yet, with the number of times it
+// issued each query.
+type sqlFrame struct {
+	call    *appmap.Event
+	query   *queryStats
+	repeats map[string]int
+}
+
+// sqlStatsBuilder computes the statistics of the SQL queries of an AppMap
+// from its calls. The repeated queries of a call are counted until it
+// returns.
+type sqlStatsBuilder struct {
+	minRepeats int
+	stats      map[string]*queryStats
+	// top counts the queries issued at the top of a thread.
+	top map[string]int
+}
+
+func (p StatsProcessor) newSQLStatsBuilder() *sqlStatsBuilder {
+	minRepeats := p.minRepeats
+	if minRepeats == 0 {
+		minRepeats = defaultMinRepeats
+	}
+	return &sqlStatsBuilder{minRepeats: minRepeats, stats: make(map[string]*queryStats), top: make(map[string]int)}
+}
+
+func (b *sqlStatsBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	frame := &sqlFrame{call: e}
+	if e.SQLQuery == nil {
+		return frame
+	}
+
+	query := normalizeSQL(e.SQLQuery.SQL)
+	s, ok := b.stats[query]
+	if !ok {
+		s = &queryStats{Query: query, NPlusOne: make(map[string]*nPlusOne)}
+		b.stats[query] = s
+	}
+	s.Calls++
+	frame.query = s
+
+	repeats := b.top
+	if len(stack) > 0 {
+		caller := stack[len(stack)-1].Value.(*sqlFrame)
+		if caller.repeats == nil {
+			caller.repeats = make(map[string]int)
+		}
+		repeats = caller.repeats
+	}
+	repeats[query]++
+	return frame
+}
+
+func (b *sqlStatsBuilder) Return(ret *appmap.Event, call *appmap.Frame) {
+	frame := call.Value.(*sqlFrame)
+	if frame.query != nil && ret != nil && ret.Elapsed != nil {
+		frame.query.Elapsed.add(*ret.Elapsed)
+		frame.query.TotalTime += *ret.Elapsed
+	}
+	b.addRepeats(callName(frame.call), frame.repeats)
+}
+
+// addRepeats reports the queries a call issued at least minRepeats times as
+// N+1 queries of the call.
+func (b *sqlStatsBuilder) addRepeats(caller string, repeats map[string]int) {
+	for query, count := range repeats {
+		if count < b.minRepeats {
+			continue
+		}
+
+		s := b.stats[query]
+		n, ok := s.NPlusOne[caller]
+		if !ok {
+			n = &nPlusOne{Caller: caller}
+			s.NPlusOne[caller] = n
+		}
+		n.Occurrences++
+		if count > n.MaxRepeats {
+			n.MaxRepeats = count
+		}
+	}
+}
+
+// finish returns the statistics, once the calls have all returned.
+func (b *sqlStatsBuilder) finish() map[string]*queryStats {
+	b.addRepeats(callName(nil), b.top)
+	b.top = make(map[string]int)
+	return b.stats
+}
+
+// SQLStats counts the SQL queries in an AppMap by normalized query. Queries
+// issued at least minRepeats times by the same call are reported as N+1
+// queries of the method or request which made the call.
+func (p StatsProcessor) SQLStats(m *appmap.AppMap) map[string]*queryStats {
+	b := p.newSQLStatsBuilder()
+	visitCalls(m, b)
+	return b.finish()
+}
+
+// sqlSection is the statistics of the queries issued most, in order.
+type sqlSection struct {
+	queries  int
+	distinct int
+	totals   []*queryStats
+}
+
+func (p StatsProcessor) sqlSection(stats map[string]*queryStats) *sqlSection {
+	section := &sqlSection{totals: make([]*queryStats, 0, len(stats)), distinct: len(stats)}
+	for _, s := range stats {
+		section.totals = append(section.totals, s)
+		section.queries += s.Calls
+	}
+
+	totals := section.totals
+	sort.Slice(totals, func(i, j int) bool {
+		vi, vj := totals[i].sortValue(p.sortBy), totals[j].sortValue(p.sortBy)
+		if vi != vj {
+			return vi > vj
+		}
+		return totals[i].Query < totals[j].Query
+	})
+
+	if p.limit > 0 && len(totals) > p.limit {
+		section.totals = totals[:p.limit]
+	}
+	return section
+}
+
+func (s *sqlSection) value() interface{} {
+	return s.totals
+}
+
+func (s *sqlSection) text(w io.Writer) {
+	fmt.Fprintf(w, "%d queries, top %d of %d distinct\n", s.queries, len(s.totals), s.distinct)
+	for _, q := range s.totals {
+		if timing := q.timing(); timing != nil {
+			fmt.Fprintf(w, "  %s: %d, total %s, mean %s, p50 %s, p95 %s, max %s\n", q.Query, q.Calls,
+				formatSeconds(timing.Total), formatSeconds(timing.Mean), formatSeconds(timing.P50),
+				formatSeconds(timing.P95), formatSeconds(timing.Max))
+		} else {
+			fmt.Fprintf(w, "  %s: %d\n", q.Query, q.Calls)
+		}
+
+		for _, n := range q.nPlusOnes() {
+			fmt.Fprintf(w, "   N+1: issued up to %d times by %s (%d calls)\n", n.MaxRepeats, n.Caller, n.Occurrences)
+		}
+	}
+}
+
+func (s *sqlSection) tables() []statsTable {
+	table := statsTable{
+		Title:   fmt.Sprintf("SQL queries (%d queries, %d distinct)", s.queries, s.distinct),
+		Columns: append(append([]string{"Query", "Calls"}, timingColumns...), "N+1"),
+	}
+	for _, q := range s.totals {
+		var nPlusOnes []string
+		for _, n := range q.nPlusOnes() {
+			nPlusOnes = append(nPlusOnes, fmt.Sprintf("%s (up to %d times, %d calls)", n.Caller, n.MaxRepeats, n.Occurrences))
+		}
+
+		row := append([]statsCell{textCell(q.Query), intCell(q.Calls)}, timingCells(q.timing())...)
+		table.Rows = append(table.Rows, append(row, textCell(strings.Join(nPlusOnes, "; "))))
+	}
+	return []statsTable{table}
+}
+
+func (p StatsProcessor) RenderSQLStats(w io.Writer, stats map[string]*queryStats) {
+	p.renderSection(w, p.sqlSection(stats))
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	tests := []struct {
+		sql        string
+		normalized string
+	}{
+		{`SELECT * FROM "users" WHERE ("id" = 42) LIMIT 1`, `SELECT * FROM "users" WHERE ("id" = ?) LIMIT ?`},
+		{"SELECT *\n  FROM users\n  WHERE name = 'O''Brien' AND score > 1.5e3", "SELECT * FROM users WHERE name = ? AND score > ?"},
+		{`SELECT * FROM t2 WHERE id IN (1, 2, 3) OR id IN ('a')`, `SELECT * FROM t2 WHERE id IN (...) OR id IN (...)`},
+		{`INSERT INTO "logs" ("a", "b") VALUES (1, 'x'), (2, NULL) RETURNING "id"`, `INSERT INTO "logs" ("a", "b") VALUES (...) RETURNING "id"`},
+		{`SELECT * FROM users WHERE id = $1 AND org = :org_id AND created::date = now()`, `SELECT * FROM users WHERE id = ? AND org = ? AND created::date = now()`},
+		{`/* app:web */ SELECT 1 -- trailing`, `SELECT ?`},
+		{`SELECT "col1", x FROM t WHERE s = 'it\'s'`, `SELECT "col1", x FROM t WHERE s = ?`},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.normalized, normalizeSQL(test.sql), test.sql)
+	}
+}
+
+func TestSQLStats(t *testing.T) {
+	events := []string{
+		`{"id":1,"event":"call","thread_id":1,"http_server_request":{"request_method":"GET","path_info":"/orgs/1","normalized_path_info":"/orgs/:id"}}`,
+		`{"id":2,"event":"call","thread_id":1,"defined_class":"OrgsController","method_id":"show","static":false,"parameters":[]}`,
+	}
+	id := 3
+	for i := 0; i < 4; i++ {
+		events = append(events,
+			fmt.Sprintf(`{"id":%d,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM users WHERE id = %d","database_type":"postgres"}}`, id, i),
+			fmt.Sprintf(`{"id":%d,"event":"return","thread_id":1,"parent_id":%d,"elapsed":0.5}`, id+1, id))
+		id += 2
+	}
+	events = append(events,
+		`{"id":11,"event":"return","thread_id":1,"parent_id":2,"elapsed":3}`,
+		`{"id":12,"event":"call","thread_id":1,"sql_query":{"sql":"SELECT * FROM orgs WHERE id = 1","database_type":"postgres"}}`,
+		`{"id":13,"event":"return","thread_id":1,"parent_id":12}`,
+		`{"id":14,"event":"return","thread_id":1,"parent_id":1,"elapsed":4}`,
+	)
+
+	m, err := appmap.Decode(strings.NewReader(`{"events":[` + strings.Join(events, ",") + `]}`))
+	require.Nil(t, err)
+
+	p := StatsProcessor{}
+	stats := p.SQLStats(m)
+	require.Len(t, stats, 2)
+
+	users := stats["SELECT * FROM users WHERE id = ?"]
+	assert.Equal(t, 4, users.Calls)
+	assert.Equal(t, 2.0, users.TotalTime)
+	assert.Equal(t, []nPlusOne{{Caller: "OrgsController#show", Occurrences: 1, MaxRepeats: 4}}, users.nPlusOnes())
+
+	orgs := stats["SELECT * FROM orgs WHERE id = ?"]
+	assert.Equal(t, 1, orgs.Calls)
+	assert.Nil(t, orgs.timing())
+	assert.Empty(t, orgs.nPlusOnes())
+
+	// Merging another AppMap
+	global := make(map[string]*queryStats)
+	mergeQueryStats(global, stats)
+	mergeQueryStats(global, p.SQLStats(m))
+	assert.Equal(t, 8, global["SELECT * FROM users WHERE id = ?"].Calls)
+	assert.Equal(t, []nPlusOne{{Caller: "OrgsController#show", Occurrences: 2, MaxRepeats: 4}}, global["SELECT * FROM users WHERE id = ?"].nPlusOnes())
+
+	p.minRepeats = 5
+	assert.Empty(t, p.SQLStats(m)["SELECT * FROM users WHERE id = ?"].nPlusOnes())
+
+	// Streaming the AppMap rather than decoding it
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	require.Nil(t, afero.WriteFile(fs, "orgs.appmap.json", []byte(`{"events":[`+strings.Join(events, ",")+`]}`), 0644))
+	p = StatsProcessor{sql: true}
+	streamed := p.fileStats("orgs.appmap.json")
+	require.Nil(t, streamed.err)
+	assert.Equal(t, stats, streamed.queries)
+
+	buf := new(bytes.Buffer)
+	p = StatsProcessor{json: true, sortBy: sortByTotal}
+	p.RenderSQLStats(buf, global)
+
+	var out []map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out, 2)
+	assert.Equal(t, "SELECT * FROM users WHERE id = ?", out[0]["query"])
+	assert.Equal(t, 4.0, out[0]["total_time"])
+	assert.Len(t, out[0]["n_plus_one"], 1)
+	assert.NotContains(t, out[1], "n_plus_one")
+
+	buf.Reset()
+	p.json = false
+	p.RenderSQLStats(buf, global)
+	assert.Contains(t, buf.String(), "10 queries, top 2 of 2 distinct")
+	assert.Contains(t, buf.String(), "N+1: issued up to 4 times by OrgsController#show (2 calls)")
+}
@@ -5,54 +5,154 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"sort"
+	"strings"
 
-	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/appmap"
 	"github.com/applandinc/appland-cli/internal/files"
 	"github.com/spf13/cobra"
 )
 
 type StatsProcessor struct {
-	verbose bool
-	files   bool
-	params  bool
-	limit   int
-	json    bool
+	verbose          bool
+	files            bool
+	params           bool
+	limit            int
+	json             bool
+	suggest          bool
+	writeExcludes    bool
+	minCallShare     float64
+	maxDistinctRatio float64
+	filter           files.Filter
+	sortBy           string
+	sql              bool
+	minRepeats       int
+	http             bool
+	topMethods       int
+	topValues        int
+	concurrency      int
+	format           string
 }
 
-type param struct {
-	Name  string      `json:"name"`
-	Value interface{} `json:"value"`
+// statsID is the key of the method in the results of MethodStats.
+func statsID(e *appmap.Event) string {
+	return fmt.Sprintf("%s:%d", e.FunctionName(), e.Lineno)
 }
 
-type sqlQuery struct {
-	SQL          string `json:"sql"`
-	DatabaseType string `json:"database_type"`
+type Stats struct {
+	processor StatsProcessor
+	Class     string `json:"-"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Lineno    int    `json:"lineno"`
+	Calls     int    `json:"calls"`
+	NumParams int    `json:"num_params"`
+	// ParamCounts holds the number of calls with each combination of values
+	// of the parameters, for the first maxTrackedValues distinct ones.
+	ParamCounts map[string]int `json:"param_counts"`
+	// paramSketch is only needed once more than maxTrackedValues distinct
+	// combinations have been seen.
+	paramSketch *cardinalitySketch
+	// Params holds the distribution of the values of each parameter.
+	Params []*paramDistribution `json:"-"`
+	// Elapsed holds the elapsed times of the calls which returned.
+	Elapsed   timeDistribution `json:"-"`
+	TotalTime float64          `json:"-"`
+	SelfTime  float64          `json:"-"`
 }
 
-type event struct {
-	Event        string   `json:"event"`
-	DefinedClass string   `json:"defined_class"`
-	MethodID     string   `json:"method_id"`
-	Static       bool     `json:"static"`
-	Path         string   `json:"path"`
-	Lineno       int      `json:"lineno"`
-	Parameters   []param  `json:"parameters"`
-	SQLQuery     sqlQuery `json:"sql_query"`
+// addTime adds the time spent in a call of the method which returned.
+func (s *Stats) addTime(t callTime) {
+	s.Elapsed.add(t.elapsed)
+	s.TotalTime += t.elapsed
+	s.SelfTime += t.self
 }
 
-type Appmap struct {
-	Events []event `json:"events"`
+// addParams counts the values of the parameters of a call of the method.
+func (s *Stats) addParams(params []appmap.Parameter) {
+	values := make([]string, len(params))
+	for i := range params {
+		param := &params[i]
+		values[i] = formatValue(param.Value)
+
+		if i == len(s.Params) {
+			s.Params = append(s.Params, newParamDistribution(param.Name))
+		}
+		s.Params[i].add(param)
+	}
+	s.trackParams(strings.Join(values, ","), 1)
 }
 
-type Stats struct {
-	processor   StatsProcessor
-	Method      string         `json:"method"`
-	Path        string         `json:"path"`
-	Lineno      int            `json:"lineno"`
-	Calls       int            `json:"calls"`
-	NumParams   int            `json:"num_params"`
-	ParamCounts map[string]int `json:"param_counts"`
+// trackParams counts calls with values of the parameters, if they're among
+// those counted individually, or adds them to the sketch otherwise.
+func (s *Stats) trackParams(values string, count int) {
+	if _, ok := s.ParamCounts[values]; ok || len(s.ParamCounts) < maxTrackedValues {
+		s.ParamCounts[values] += count
+		if s.paramSketch != nil {
+			s.paramSketch.add(values)
+		}
+		return
+	}
+
+	if s.paramSketch == nil {
+		s.paramSketch = &cardinalitySketch{}
+		for tracked := range s.ParamCounts {
+			s.paramSketch.add(tracked)
+		}
+	}
+	s.paramSketch.add(values)
+}
+
+// distinctParams is the number of distinct combinations of values of the
+// parameters, which is an estimate beyond maxTrackedValues.
+func (s Stats) distinctParams() int {
+	distinct := len(s.ParamCounts)
+	if s.paramSketch != nil {
+		if estimate := s.paramSketch.estimate(); estimate > distinct {
+			distinct = estimate
+		}
+	}
+	return distinct
+}
+
+// merge adds the calls of other, the same method in another AppMap.
+func (s *Stats) merge(other Stats) {
+	if other.paramSketch != nil && s.paramSketch == nil {
+		s.paramSketch = &cardinalitySketch{}
+		for tracked := range s.ParamCounts {
+			s.paramSketch.add(tracked)
+		}
+	}
+
+	s.Calls += other.Calls
+	for values, count := range other.ParamCounts {
+		s.trackParams(values, count)
+	}
+	if other.paramSketch != nil {
+		s.paramSketch.merge(other.paramSketch)
+	}
+	for i, d := range other.Params {
+		if i == len(s.Params) {
+			s.Params = append(s.Params, newParamDistribution(d.Name))
+		}
+		s.Params[i].merge(d)
+	}
+	s.Elapsed.merge(&other.Elapsed)
+	s.TotalTime += other.TotalTime
+	s.SelfTime += other.SelfTime
+}
+
+func (s Stats) paramSummaries(top int) []paramSummary {
+	if top == 0 {
+		top = defaultTopValues
+	}
+
+	summaries := make([]paramSummary, len(s.Params))
+	for i, d := range s.Params {
+		summaries[i] = d.summary(top)
+	}
+	return summaries
 }
 
 type total struct {
@@ -68,6 +168,8 @@ func (t total) MarshalJSON() ([]byte, error) {
 		Calls       int             `json:"calls"`
 		NumParams   *int            `json:"num_params,omitempty"`
 		ParamCounts *map[string]int `json:"param_counts,omitempty"`
+		Params      []paramSummary  `json:"params,omitempty"`
+		*timingSummary
 	}
 
 	v.Method = t.Stats.Method
@@ -77,22 +179,31 @@ func (t total) MarshalJSON() ([]byte, error) {
 	if t.processor.params {
 		v.NumParams = &t.Stats.NumParams
 		v.ParamCounts = &t.Stats.ParamCounts
+		v.Params = t.Stats.paramSummaries(t.processor.topValues)
 	}
+	v.timingSummary = t.Stats.timing()
 
 	return json.Marshal(v)
 }
 
 func (p StatsProcessor) sortStatsByCount(stats map[string]Stats) []total {
+	return p.sortStats(stats, sortByCalls)
+}
+
+// sortStats sorts methods by one of statsSortKeys, in descending order.
+func (p StatsProcessor) sortStats(stats map[string]Stats, by string) []total {
 	t := []total{}
 	for k, v := range stats {
-		t = append(t, total{k, Stats{processor: p, Path: v.Path, Method: v.Method, Lineno: v.Lineno, Calls: v.Calls, NumParams: v.NumParams, ParamCounts: v.ParamCounts}})
+		v.processor = p
+		t = append(t, total{k, v})
 	}
 
 	sort.Slice(t, func(i, j int) bool {
-		// Sort by number of calls
-		ret := t[i].Stats.Calls > t[j].Stats.Calls
+		// Sort by the chosen value
+		vi, vj := t[i].Stats.sortValue(by), t[j].Stats.sortValue(by)
+		ret := vi > vj
 		// then by method name
-		if t[i].Stats.Calls == t[j].Stats.Calls {
+		if vi == vj {
 			ret = t[i].Method < t[j].Method
 		}
 		return ret
@@ -101,131 +212,382 @@ func (p StatsProcessor) sortStatsByCount(stats map[string]Stats) []total {
 	return t
 }
 
-func countEvents(appmap Appmap) int {
-	if appmap.Events != nil {
-		return len(appmap.Events)
+func countEvents(m *appmap.AppMap) int {
+	if m.Events != nil {
+		return len(m.Events)
 	}
 
 	return 0
 }
 
-func (p StatsProcessor) ReadAppmap(fname string) (Appmap, error) {
-	fs := config.GetFS()
-	f, err := fs.Open(fname)
+// ReadAppmap decodes an AppMap. AppMaps which aren't valid are still
+// returned, as long as they could be decoded.
+func (p StatsProcessor) ReadAppmap(fname string) (*appmap.AppMap, error) {
+	f, err := files.Open(fname)
 	if err != nil {
-		return Appmap{}, fmt.Errorf("Failed opening %s: %w", fname, err)
+		return nil, fmt.Errorf("Failed opening %s: %w", fname, err)
 	} else if p.verbose {
 		fmt.Fprintf(os.Stderr, "Processing %s\n", fname)
 	}
 
-	dec := json.NewDecoder(f)
-	var appmap Appmap
-	err = dec.Decode(&appmap)
+	m, err := appmap.Decode(f)
 
 	f.Close()
+	if m == nil {
+		return nil, fmt.Errorf(">>> Failed decoding %s, %w", fname, err)
+	}
+
+	if p.verbose {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid: %v\n", fname, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d event(s)\n", fname, countEvents(m))
+	}
+
+	return m, nil
+}
+
+// methodStatsBuilder computes the statistics of methods from the calls of an
+// AppMap. The value of the frame of a call is its statsID, or empty if it
+// isn't a function call.
+type methodStatsBuilder struct {
+	processor StatsProcessor
+	stats     map[string]Stats
+	calls     uint64
+}
+
+func (p StatsProcessor) newMethodStatsBuilder() *methodStatsBuilder {
+	return &methodStatsBuilder{processor: p, stats: make(map[string]Stats)}
+}
+
+func (b *methodStatsBuilder) Call(e *appmap.Event, stack []appmap.Frame) interface{} {
+	if !e.IsFunctionCall() {
+		return ""
+	}
+
+	method := statsID(e)
+	stats, ok := b.stats[method]
+	if !ok {
+		stats = Stats{processor: b.processor, Class: e.DefinedClass, Method: e.FunctionName(), Path: e.Path, Lineno: e.Lineno, NumParams: len(e.Parameters), ParamCounts: make(map[string]int)}
+	}
+	stats.Calls++
+	stats.addParams(e.Parameters)
+	b.stats[method] = stats
+	b.calls++
+	return method
+}
+
+func (b *methodStatsBuilder) Return(ret *appmap.Event, call *appmap.Frame) {
+	method := call.Value.(string)
+	if method == "" || ret == nil || ret.Elapsed == nil {
+		return
+	}
+
+	stats := b.stats[method]
+	stats.addTime(callTime{elapsed: *ret.Elapsed, self: call.SelfTime(*ret.Elapsed)})
+	b.stats[method] = stats
+}
+
+// visitCalls notifies visitor of the calls and returns of a decoded AppMap.
+func visitCalls(m *appmap.AppMap, visitor appmap.CallVisitor) {
+	s := appmap.NewCallStacks(visitor)
+	for i := range m.Events {
+		s.Add(&m.Events[i])
+	}
+	s.Finish()
+}
+
+// MethodStats computes the statistics of the methods called in an AppMap,
+// returning them by statsID along with the number of calls.
+func (p StatsProcessor) MethodStats(m *appmap.AppMap) (map[string]Stats, uint64) {
+	b := p.newMethodStatsBuilder()
+	visitCalls(m, b)
+	return b.stats, b.calls
+}
+
+// streamCalls notifies visitor of the calls and returns of an AppMap, reading
+// its events one at a time rather than decoding the whole AppMap, and returns
+// the number of events.
+func (p StatsProcessor) streamCalls(fname string, visitor appmap.CallVisitor) (int, error) {
+	f, err := files.Open(fname)
 	if err != nil {
-		return Appmap{}, fmt.Errorf(">>> Failed decoding %s, %w", fname, err)
+		return 0, fmt.Errorf("Failed opening %s: %w", fname, err)
+	} else if p.verbose {
+		fmt.Fprintf(os.Stderr, "Processing %s\n", fname)
 	}
+	defer f.Close()
+
+	var (
+		s      = appmap.NewCallStacks(visitor)
+		events = 0
+	)
+	_, err = appmap.Stream(f, func(e *appmap.Event) error {
+		events++
+		s.Add(e)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf(">>> Failed decoding %s, %w", fname, err)
+	}
+	s.Finish()
 
 	if p.verbose {
-		fmt.Fprintf(os.Stderr, "%s: %d event(s)\n", fname, countEvents(appmap))
+		fmt.Fprintf(os.Stderr, "%s: %d event(s)\n", fname, events)
+	}
+	return events, nil
+}
+
+// StreamMethodStats computes the statistics of the methods called in an
+// AppMap like MethodStats, reading its events one at a time rather than
+// decoding the whole AppMap.
+func (p StatsProcessor) StreamMethodStats(fname string) (map[string]Stats, uint64, error) {
+	b := p.newMethodStatsBuilder()
+	if _, err := p.streamCalls(fname, b); err != nil {
+		return nil, 0, err
+	}
+	return b.stats, b.calls, nil
+}
+
+// mergeMethodStats adds the statistics of methods in an AppMap to those of
+// all of the AppMaps.
+func (p StatsProcessor) mergeMethodStats(into map[string]Stats, from map[string]Stats) {
+	for id, stats := range from {
+		existing, ok := into[id]
+		if !ok {
+			existing = Stats{processor: p, Class: stats.Class, Method: stats.Method, Path: stats.Path, Lineno: stats.Lineno, NumParams: stats.NumParams, ParamCounts: make(map[string]int)}
+		}
+		existing.merge(stats)
+		into[id] = existing
 	}
+}
 
-	return appmap, nil
+// methodsSection is the statistics of the methods called most, in order.
+type methodsSection struct {
+	processor StatsProcessor
+	calls     uint64
+	totals    []total
 }
 
-func (p StatsProcessor) MethodStats(appmap Appmap) (map[string]Stats, uint64) {
-	stats := make(map[string]Stats)
-	if countEvents(appmap) == 0 {
-		return stats, 0
+func (p StatsProcessor) methodsSection(calls uint64, methodStats map[string]Stats) *methodsSection {
+	sortBy := p.sortBy
+	if sortBy == "" {
+		sortBy = sortByCalls
 	}
+	totals := p.sortStats(methodStats, sortBy)
 
-	var total uint64
+	if p.limit > 0 && len(totals) > p.limit {
+		totals = totals[0:p.limit]
+	}
+	return &methodsSection{processor: p, calls: calls, totals: totals}
+}
+
+func (s *methodsSection) value() interface{} {
+	return s.totals
+}
 
-	for _, event := range appmap.Events {
-		if event.Event != "call" || event.DefinedClass == "" {
-			continue
+func (s *methodsSection) text(w io.Writer) {
+	fmt.Fprintf(w, "%d calls, top %d methods\n", s.calls, len(s.totals))
+	for _, t := range s.totals {
+		distinct := t.distinctParams()
+		if timing := t.timing(); timing != nil {
+			fmt.Fprintf(w, "  %s: %d (%d distinct), %v\n", t.Method, t.Calls, distinct, timing)
+		} else {
+			fmt.Fprintf(w, "  %s: %d (%d distinct)\n", t.Method, t.Calls, distinct)
 		}
-		sep := "#"
-		if event.Static {
-			sep = "."
+		if s.processor.params {
+			s.processor.renderParams(w, t.Stats)
 		}
-		// id := strings.Join([]string{event.DefinedClass, sep, event.MethodID}, "")
-		method := fmt.Sprintf("%s%s%s", event.DefinedClass, sep, event.MethodID)
-		id := fmt.Sprintf("%s:%d", method, event.Lineno)
-		params := event.Parameters
-		var (
-			paramId  string
-			paramSep string
-		)
-
-		for _, param := range params {
-			var v string
-			if param.Value != nil {
-				v = param.Value.(string)
-			} else {
-				v = "<nil>"
-			}
-			paramId += paramSep + v
-			paramSep = ","
+	}
+}
+
+func (s *methodsSection) tables() []statsTable {
+	table := statsTable{
+		Title:   fmt.Sprintf("Methods (%d calls)", s.calls),
+		Columns: append([]string{"Method", "Path", "Line", "Calls", "Distinct parameters", "Self time"}, timingColumns...),
+	}
+	if s.processor.params {
+		table.Columns = append(table.Columns, "Top parameters")
+	}
+
+	top := s.processor.topValues
+	if top == 0 {
+		top = defaultTopValues
+	}
+
+	for _, t := range s.totals {
+		row := []statsCell{textCell(t.Stats.Method), textCell(t.Path), intCell(t.Lineno), intCell(t.Calls), intCell(t.distinctParams())}
+		timing := t.timing()
+		if timing != nil {
+			row = append(row, secondsCell(timing.Self))
+		} else {
+			row = append(row, statsCell{})
 		}
+		row = append(row, timingCells(timing)...)
 
-		if _, ok := stats[id]; !ok {
-			stats[id] = Stats{processor: p, Method: method, Path: event.Path, Lineno: event.Lineno, NumParams: len(params), ParamCounts: make(map[string]int)}
+		if s.processor.params {
+			signatures, _ := topSignatures(t.ParamCounts, t.Calls, top)
+			values := make([]string, len(signatures))
+			for i, signature := range signatures {
+				values[i] = fmt.Sprintf("%d: %s", signature.Count, signature.Params)
+			}
+			row = append(row, textCell(strings.Join(values, "; ")))
 		}
-		newStats := stats[id]
-		newStats.Calls++
-		stats[id] = newStats
-		stats[id].ParamCounts[paramId]++
-		total++
+		table.Rows = append(table.Rows, row)
 	}
+	return []statsTable{table}
+}
 
-	return stats, total
+// outputFormat is the format results are rendered in, one of statsFormats.
+func (p StatsProcessor) outputFormat() string {
+	if p.json {
+		return formatJSON
+	}
+	if p.format == "" {
+		return formatText
+	}
+	return p.format
+}
+
+// renderSection renders statistics on their own, in the chosen format.
+func (p StatsProcessor) renderSection(w io.Writer, section statsSection) {
+	renderer, err := newStatsRenderer(p.outputFormat())
+	if err == nil {
+		err = renderer.renderSection(w, section)
+	}
+	if err != nil {
+		warn(err)
+	}
 }
 
 func (p StatsProcessor) RenderStats(w io.Writer, calls uint64, methodStats map[string]Stats) {
-	totals := p.sortStatsByCount(methodStats)
+	p.renderSection(w, p.methodsSection(calls, methodStats))
+}
 
-	max := len(totals)
-	if p.limit > 0 {
-		max = p.limit
-		if len(totals) < max {
-			max = len(totals)
-		}
-		totals = totals[0:max]
+// renderParams shows the most frequent values of a method's parameters, both
+// together and for each parameter.
+func (p StatsProcessor) renderParams(w io.Writer, stat Stats) {
+	if stat.NumParams == 0 {
+		fmt.Fprintln(w, "   no parameters")
+		return
 	}
 
-	if p.json {
-		j, err := json.Marshal(totals)
-		if err == nil {
-			fmt.Fprint(w, string(j))
-		} else {
-			warn(err)
+	top := p.topValues
+	if top == 0 {
+		top = defaultTopValues
+	}
+
+	fmt.Fprintln(w, "   has parameters")
+	signatures, other := topSignatures(stat.ParamCounts, stat.Calls, top)
+	for _, s := range signatures {
+		fmt.Fprintf(w, "    %d: %s\n", s.Count, s.Params)
+	}
+	if other > 0 {
+		fmt.Fprintf(w, "    %d: (other values)\n", other)
+	}
+
+	for _, summary := range stat.paramSummaries(top) {
+		approximately := ""
+		if summary.Estimated {
+			approximately = "~"
 		}
-	} else {
-		fmt.Fprintf(w, "%d calls, top %d methods\n", calls, max)
-		for _, t := range totals {
-			key := t.Method
-			stat := methodStats[key]
-			distinct := len(stat.ParamCounts)
-			fmt.Fprintf(w, "  %s: %d (%d distinct)\n", key, t.Calls, distinct)
-			if p.params {
-				hasParams := stat.NumParams > 0
-				if hasParams {
-					fmt.Fprintln(w, "   has parameters")
-					for params, _ := range stat.ParamCounts {
-						fmt.Fprintf(w, "    %v\n", params)
-					}
-				} else {
-					fmt.Fprintln(w, "   no parameters")
-				}
+		fmt.Fprintf(w, "   %s: %s%d distinct values\n", summary.Name, approximately, summary.Distinct)
+		for _, v := range summary.Values {
+			if v.Class != "" {
+				fmt.Fprintf(w, "    %d: %s (%s)\n", v.Count, v.Value, v.Class)
+			} else {
+				fmt.Fprintf(w, "    %d: %s\n", v.Count, v.Value)
 			}
 		}
+		if summary.Other > 0 {
+			fmt.Fprintf(w, "    %d: (other values)\n", summary.Other)
+		}
+	}
+}
+
+// fileStats are the statistics of a single AppMap, of methods, SQL queries or
+// HTTP requests depending on the options.
+type fileStats struct {
+	methods map[string]Stats
+	calls   uint64
+	queries map[string]*queryStats
+	routes  *httpStats
+	// skipped is set for AppMaps without events, which are left out of the
+	// statistics of queries and requests.
+	skipped bool
+	err     error
+}
+
+func (p StatsProcessor) fileStats(fname string) fileStats {
+	if !p.sql && !p.http {
+		methods, calls, err := p.StreamMethodStats(fname)
+		return fileStats{methods: methods, calls: calls, err: err}
+	}
+
+	var (
+		queries *sqlStatsBuilder
+		routes  *httpStatsBuilder
+		visitor appmap.CallVisitor
+	)
+	if p.sql {
+		queries = p.newSQLStatsBuilder()
+		visitor = queries
+	} else {
+		routes = newHTTPStatsBuilder()
+		visitor = routes
+	}
+
+	events, err := p.streamCalls(fname, visitor)
+	switch {
+	case err != nil:
+		return fileStats{err: err}
+	case events == 0:
+		return fileStats{skipped: true}
+	case p.sql:
+		return fileStats{queries: queries.finish()}
+	default:
+		return fileStats{routes: routes.stats}
 	}
 }
 
-func (p StatsProcessor) printStats(calls uint64, methodStats map[string]Stats) {
-	p.RenderStats(os.Stdout, calls, methodStats)
+// processFiles computes the statistics of AppMaps concurrently, calling fn with
+// those of each AppMap in the order given. Workers only get so far ahead of fn,
+// so that the statistics of few AppMaps are held at once.
+func (p StatsProcessor) processFiles(fnames []string, fn func(fname string, stats fileStats)) {
+	concurrency := p.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		results = make([]chan fileStats, len(fnames))
+		jobs    = make(chan int)
+		pending = make(chan struct{}, 2*concurrency)
+	)
+	for i := range results {
+		results[i] = make(chan fileStats, 1)
+	}
+
+	go func() {
+		for i := range fnames {
+			pending <- struct{}{}
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- p.fileStats(fnames[i])
+			}
+		}()
+	}
+
+	for i, fname := range fnames {
+		fn(fname, <-results[i])
+		results[i] = nil
+		<-pending
+	}
 }
 
 func NewStatsCommand(p *StatsProcessor) *cobra.Command {
@@ -234,7 +596,24 @@ func NewStatsCommand(p *StatsProcessor) *cobra.Command {
 		Short: "Show statistics for AppMap files",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fnames, err := files.FindAppMaps(args)
+			if err := validateSortKey(p.sortBy); err != nil {
+				return err
+			}
+			if p.sql && p.http {
+				return fmt.Errorf("--sql can't be combined with --http")
+			}
+			if (p.sql || p.http) && p.suggest {
+				return fmt.Errorf("--suggest-excludes can't be combined with --sql or --http")
+			}
+			if p.json && p.format != "" && p.format != formatText && p.format != formatJSON {
+				return fmt.Errorf("--json can't be combined with --format %s", p.format)
+			}
+			renderer, err := newStatsRenderer(p.outputFormat())
+			if err != nil {
+				return err
+			}
+
+			fnames, err := files.Find(args, p.filter)
 			if err != nil {
 				return fmt.Errorf("Failed finding AppMaps: %w", err)
 			}
@@ -242,83 +621,71 @@ func NewStatsCommand(p *StatsProcessor) *cobra.Command {
 			var (
 				totalMethodCalls   uint64 = 0
 				globalMethodCounts        = make(map[string]Stats)
-				comma                     = ""
+				globalQueries             = make(map[string]*queryStats)
+				globalRoutes              = newHTTPStats()
+				report                    = &statsReport{showFiles: p.files}
 			)
 
 			if p.verbose {
 				fmt.Fprintf(os.Stderr, "Found %d appmap(s)\n", len(fnames))
 			}
 
-			if p.json {
-				fmt.Print("{")
-				if p.files {
-					fmt.Print(`"files":[`)
+			p.processFiles(fnames, func(fname string, stats fileStats) {
+				if stats.err != nil {
+					warn(stats.err)
+					return
 				}
-			}
 
-			for _, fname := range fnames {
-				appmap, err := p.ReadAppmap(fname)
-				if err != nil {
-					warn(err)
-					continue
-				}
-
-				if appmap.Events == nil {
+				var section statsSection
+				switch {
+				case stats.skipped:
 					if p.verbose {
-						fmt.Fprintf(os.Stderr, "%s, events is nil\n", fname)
-					}
-					continue
-				}
-
-				methodStats, calls := p.MethodStats(appmap)
-				if calls == 0 {
-					warn(fmt.Errorf("No events in %s", fname))
-				}
-
-				if p.files {
-					if p.json {
-						fmt.Print(comma + `{"name":"` + fname + `","totals":`)
-						comma = ","
-					} else {
-						fmt.Print(fname + ": ")
+						fmt.Fprintf(os.Stderr, "%s has no events\n", fname)
 					}
-					p.printStats(calls, methodStats)
-					if p.json {
-						fmt.Print("}")
+					return
+				case p.sql:
+					section = p.sqlSection(stats.queries)
+					mergeQueryStats(globalQueries, stats.queries)
+				case p.http:
+					section = p.httpSection(stats.routes)
+					globalRoutes.merge(stats.routes)
+				default:
+					if stats.calls == 0 {
+						warn(fmt.Errorf("No events in %s", fname))
 					}
+					section = p.methodsSection(stats.calls, stats.methods)
+					p.mergeMethodStats(globalMethodCounts, stats.methods)
+					totalMethodCalls += stats.calls
 				}
 
-				for id, stats := range methodStats {
-					if _, ok := globalMethodCounts[id]; !ok {
-						globalMethodCounts[id] = Stats{processor: *p, Method: stats.Method, Path: stats.Path, Lineno: stats.Lineno, NumParams: stats.NumParams, ParamCounts: make(map[string]int)}
-					}
-					newStats := globalMethodCounts[id]
-					newStats.Calls += stats.Calls
-					for param, count := range stats.ParamCounts {
-						newStats.ParamCounts[param] += count
-					}
-					globalMethodCounts[id] = newStats
+				if p.files {
+					report.Files = append(report.Files, fileSection{fname, section})
 				}
-				totalMethodCalls += calls
-			}
-
-			if p.files {
-				if p.json {
-					fmt.Print("],")
-				} else {
-					fmt.Print("\n\n")
+			})
+
+			var excludes *excludesSection
+			switch {
+			case p.sql:
+				report.Totals = p.sqlSection(globalQueries)
+			case p.http:
+				report.Totals = p.httpSection(globalRoutes)
+			case p.suggest:
+				if excludes, err = p.excludesSection(args[0], totalMethodCalls, globalMethodCounts); err != nil {
+					return err
 				}
+				report.TotalsName = "suggested_excludes"
+				report.Totals = excludes
+			default:
+				report.Totals = p.methodsSection(totalMethodCalls, globalMethodCounts)
 			}
 
-			if p.json {
-				fmt.Print(`"totals":`)
+			if err := renderer.renderReport(os.Stdout, report); err != nil {
+				return err
 			}
-			p.printStats(totalMethodCalls, globalMethodCounts)
 
-			if p.json {
-				fmt.Print("}")
+			if excludes != nil && p.writeExcludes {
+				return excludes.write()
 			}
-
 			return nil
 		},
 	}
@@ -335,7 +702,34 @@ func init() {
 	flags.BoolVarP(&processor.files, "files", "f", false, "show statistics for each file")
 	flags.BoolVarP(&processor.params, "params", "p", false, "show distinct parameters for each method")
 	flags.IntVarP(&processor.limit, "limit", "l", 20, "limit the number of methods displayed")
-	flags.BoolVarP(&processor.json, "json", "j", false, "format results as JSON")
+	flags.IntVar(&processor.topValues, "top-values", defaultTopValues, "number of the most frequent parameter values displayed with --params")
+	flags.BoolVarP(&processor.json, "json", "j", false, "format results as JSON, the same as --format json")
+	flags.StringVar(&processor.format, "format", formatText, "format results as text, json, csv, markdown or html")
+	flags.StringVar(&processor.sortBy, "sort", sortByCalls, "sort methods by calls, total (elapsed time), self (elapsed time excluding calls made) or mean (elapsed time)")
+	flags.BoolVar(&processor.suggest, "suggest-excludes", false, "suggest classes and packages to exclude in appmap.yml")
+	flags.BoolVar(&processor.writeExcludes, "write", false, "add the suggested exclusions to appmap.yml")
+	flags.Float64Var(&processor.minCallShare, "min-call-share", defaultMinCallShare, "suggest excluding code accounting for at least this share of calls")
+	flags.Float64Var(&processor.maxDistinctRatio, "max-distinct-ratio", defaultMaxDistinctRatio, "suggest excluding code with at most this many distinct parameters per call")
+	flags.BoolVar(&processor.sql, "sql", false, "show statistics for SQL queries instead of methods, flagging N+1 queries")
+	flags.IntVar(&processor.minRepeats, "min-repeats", defaultMinRepeats, "flag SQL queries issued at least this many times by a single call as N+1 queries")
+	flags.BoolVar(&processor.http, "http", false, "show statistics for HTTP server and client requests instead of methods")
+	flags.IntVar(&processor.topMethods, "top-methods", defaultTopMethods, "number of methods called beneath each HTTP route to show")
+	flags.IntVarP(&processor.concurrency, "concurrency", "c", runtime.NumCPU(), "number of AppMaps to process concurrently")
+	addFilterFlags(flags, &processor.filter)
+
+	var (
+		diffProcessor = StatsProcessor{}
+		diffCmd       = NewStatsDiffCommand(&diffProcessor)
+	)
+
+	flags = diffCmd.Flags()
+	flags.BoolVarP(&diffProcessor.verbose, "verbose", "v", false, "be verbose while processing")
+	flags.IntVarP(&diffProcessor.limit, "limit", "l", 20, "limit the number of methods displayed")
+	flags.BoolVarP(&diffProcessor.json, "json", "j", false, "format results as JSON")
+	flags.StringVar(&diffProcessor.sortBy, "sort", sortByCalls, "sort methods by the absolute change in calls, total (elapsed time), self (elapsed time excluding calls made) or mean (elapsed time)")
+	flags.IntVarP(&diffProcessor.concurrency, "concurrency", "c", runtime.NumCPU(), "number of AppMaps to process concurrently")
+	addFilterFlags(flags, &diffProcessor.filter)
 
+	statsCmd.AddCommand(diffCmd)
 	rootCmd.AddCommand(statsCmd)
 }
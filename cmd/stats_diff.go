@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/cobra"
+)
+
+const (
+	methodAdded   = "added"
+	methodRemoved = "removed"
+	methodChanged = "changed"
+)
+
+// methodTotals computes the statistics of the methods called in the AppMaps
+// found in paths, across all of them.
+func (p StatsProcessor) methodTotals(paths []string) (map[string]Stats, uint64, error) {
+	fnames, err := files.Find(paths, p.filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed finding AppMaps: %w", err)
+	}
+	if p.verbose {
+		fmt.Fprintf(os.Stderr, "Found %d appmap(s) in %v\n", len(fnames), paths)
+	}
+
+	var (
+		totals = make(map[string]Stats)
+		calls  uint64
+	)
+	p.processFiles(fnames, func(fname string, stats fileStats) {
+		if stats.err != nil {
+			warn(stats.err)
+			return
+		}
+		p.mergeMethodStats(totals, stats.methods)
+		calls += stats.calls
+	})
+	return totals, calls, nil
+}
+
+// statsByMethod combines the statistics of methods by name. Refactoring moves
+// methods around, so they're compared by name rather than by line.
+func (p StatsProcessor) statsByMethod(stats map[string]Stats) map[string]Stats {
+	byMethod := make(map[string]Stats)
+	for _, s := range stats {
+		existing, ok := byMethod[s.Method]
+		if !ok {
+			existing = Stats{processor: p, Class: s.Class, Method: s.Method, Path: s.Path, Lineno: s.Lineno, NumParams: s.NumParams, ParamCounts: make(map[string]int)}
+		}
+		existing.merge(s)
+		byMethod[s.Method] = existing
+	}
+	return byMethod
+}
+
+// methodDiff is the change in the statistics of a method between two sets of
+// AppMaps. Times are in seconds.
+type methodDiff struct {
+	Method         string  `json:"method"`
+	Path           string  `json:"path"`
+	Lineno         int     `json:"lineno"`
+	Status         string  `json:"status"`
+	CallsBefore    int     `json:"calls_before"`
+	CallsAfter     int     `json:"calls_after"`
+	CallsChange    int     `json:"calls_change"`
+	DistinctBefore int     `json:"distinct_before"`
+	DistinctAfter  int     `json:"distinct_after"`
+	DistinctChange int     `json:"distinct_change"`
+	TimeBefore     float64 `json:"total_time_before"`
+	TimeAfter      float64 `json:"total_time_after"`
+	TimeChange     float64 `json:"total_time_change"`
+
+	before, after Stats
+}
+
+func newMethodDiff(before Stats, after Stats) *methodDiff {
+	d := &methodDiff{before: before, after: after, Status: methodChanged}
+
+	s := after
+	switch {
+	case before.Calls == 0:
+		d.Status = methodAdded
+	case after.Calls == 0:
+		d.Status = methodRemoved
+		s = before
+	}
+	d.Method, d.Path, d.Lineno = s.Method, s.Path, s.Lineno
+
+	d.CallsBefore, d.CallsAfter = before.Calls, after.Calls
+	d.CallsChange = d.CallsAfter - d.CallsBefore
+	d.DistinctBefore, d.DistinctAfter = before.distinctParams(), after.distinctParams()
+	d.DistinctChange = d.DistinctAfter - d.DistinctBefore
+	d.TimeBefore, d.TimeAfter = roundSeconds(before.TotalTime), roundSeconds(after.TotalTime)
+	d.TimeChange = roundSeconds(after.TotalTime - before.TotalTime)
+	return d
+}
+
+// unchanged reports whether nothing about the method changed.
+func (d *methodDiff) unchanged() bool {
+	return d.CallsChange == 0 && d.DistinctChange == 0 && d.TimeChange == 0
+}
+
+// change is the absolute change in the value methods are sorted by.
+func (d *methodDiff) change(by string) float64 {
+	return math.Abs(d.after.sortValue(by) - d.before.sortValue(by))
+}
+
+// statsDiff is the change in the statistics of methods between two sets of
+// AppMaps.
+type statsDiff struct {
+	CallsBefore uint64 `json:"calls_before"`
+	CallsAfter  uint64 `json:"calls_after"`
+	// Changed is the number of methods which changed, some of which may not
+	// be listed in Methods.
+	Changed int           `json:"changed"`
+	Methods []*methodDiff `json:"methods"`
+}
+
+// DiffStats compares the statistics of methods before and after a change,
+// listing the methods which changed the most first.
+func (p StatsProcessor) DiffStats(before map[string]Stats, callsBefore uint64, after map[string]Stats, callsAfter uint64) *statsDiff {
+	sortBy := p.sortBy
+	if sortBy == "" {
+		sortBy = sortByCalls
+	}
+
+	before, after = p.statsByMethod(before), p.statsByMethod(after)
+	diff := &statsDiff{CallsBefore: callsBefore, CallsAfter: callsAfter, Methods: []*methodDiff{}}
+	for method, s := range after {
+		if d := newMethodDiff(before[method], s); !d.unchanged() {
+			diff.Methods = append(diff.Methods, d)
+		}
+	}
+	for method, s := range before {
+		if _, ok := after[method]; !ok {
+			diff.Methods = append(diff.Methods, newMethodDiff(s, Stats{}))
+		}
+	}
+
+	sort.Slice(diff.Methods, func(i, j int) bool {
+		ci, cj := diff.Methods[i].change(sortBy), diff.Methods[j].change(sortBy)
+		if ci != cj {
+			return ci > cj
+		}
+		return diff.Methods[i].Method < diff.Methods[j].Method
+	})
+
+	diff.Changed = len(diff.Methods)
+	if p.limit > 0 && len(diff.Methods) > p.limit {
+		diff.Methods = diff.Methods[:p.limit]
+	}
+	return diff
+}
+
+// formatSecondsChange formats a change in time, with its sign.
+func formatSecondsChange(seconds float64) string {
+	if seconds < 0 {
+		return formatSeconds(seconds)
+	}
+	return "+" + formatSeconds(seconds)
+}
+
+func (p StatsProcessor) RenderStatsDiff(w io.Writer, diff *statsDiff) {
+	if p.json {
+		j, err := json.Marshal(diff)
+		if err == nil {
+			fmt.Fprint(w, string(j))
+		} else {
+			warn(err)
+		}
+		return
+	}
+
+	fmt.Fprintf(w, "%d calls before, %d calls after (%+d), top %d of %d changed methods\n",
+		diff.CallsBefore, diff.CallsAfter, int64(diff.CallsAfter)-int64(diff.CallsBefore), len(diff.Methods), diff.Changed)
+	for _, d := range diff.Methods {
+		switch d.Status {
+		case methodAdded:
+			fmt.Fprintf(w, "  + %s: %d calls (%d distinct), total %s\n", d.Method, d.CallsAfter, d.DistinctAfter, formatSeconds(d.TimeAfter))
+		case methodRemoved:
+			fmt.Fprintf(w, "  - %s: %d calls (%d distinct), total %s\n", d.Method, d.CallsBefore, d.DistinctBefore, formatSeconds(d.TimeBefore))
+		default:
+			fmt.Fprintf(w, "  ~ %s: %d -> %d calls (%+d), %d -> %d distinct (%+d), total %s -> %s (%s)\n", d.Method,
+				d.CallsBefore, d.CallsAfter, d.CallsChange,
+				d.DistinctBefore, d.DistinctAfter, d.DistinctChange,
+				formatSeconds(d.TimeBefore), formatSeconds(d.TimeAfter), formatSecondsChange(d.TimeChange))
+		}
+	}
+}
+
+func NewStatsDiffCommand(p *StatsProcessor) *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff <before> <after>",
+		Short: "Compare the statistics of two sets of AppMaps",
+		Long: `Compare the statistics of the methods called in two sets of AppMaps, e.g.
+recorded before and after changing appmap.yml or refactoring. Each set is a file,
+directory or archive. Methods are compared by name.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateSortKey(p.sortBy); err != nil {
+				return err
+			}
+
+			before, callsBefore, err := p.methodTotals(args[:1])
+			if err != nil {
+				return err
+			}
+			after, callsAfter, err := p.methodTotals(args[1:])
+			if err != nil {
+				return err
+			}
+
+			p.RenderStatsDiff(os.Stdout, p.DiffStats(before, callsBefore, after, callsAfter))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffStats(t *testing.T) {
+	decode := func(events string) *appmap.AppMap {
+		m, err := appmap.Decode(strings.NewReader(`{"events":[` + events + `]}`))
+		require.Nil(t, err)
+		return m
+	}
+
+	p := StatsProcessor{}
+	before, callsBefore := p.MethodStats(decode(`
+		{"id":1,"event":"call","thread_id":1,"defined_class":"A","method_id":"kept","static":false,"lineno":10,"parameters":[{"name":"x","value":"1"}]},
+		{"id":2,"event":"return","thread_id":1,"parent_id":1,"elapsed":1},
+		{"id":3,"event":"call","thread_id":1,"defined_class":"A","method_id":"removed","static":false,"parameters":[]},
+		{"id":4,"event":"call","thread_id":1,"defined_class":"A","method_id":"same","static":false,"parameters":[]}
+	`))
+	after, callsAfter := p.MethodStats(decode(`
+		{"id":1,"event":"call","thread_id":1,"defined_class":"A","method_id":"kept","static":false,"lineno":20,"parameters":[{"name":"x","value":"1"}]},
+		{"id":2,"event":"return","thread_id":1,"parent_id":1,"elapsed":0.5},
+		{"id":3,"event":"call","thread_id":1,"defined_class":"A","method_id":"kept","static":false,"lineno":20,"parameters":[{"name":"x","value":"2"}]},
+		{"id":4,"event":"call","thread_id":1,"defined_class":"A","method_id":"added","static":false,"parameters":[]},
+		{"id":5,"event":"call","thread_id":1,"defined_class":"A","method_id":"added","static":false,"parameters":[]},
+		{"id":6,"event":"call","thread_id":1,"defined_class":"A","method_id":"added","static":false,"parameters":[]},
+		{"id":7,"event":"call","thread_id":1,"defined_class":"A","method_id":"same","static":false,"parameters":[]}
+	`))
+
+	diff := p.DiffStats(before, callsBefore, after, callsAfter)
+	assert.Equal(t, uint64(3), diff.CallsBefore)
+	assert.Equal(t, uint64(6), diff.CallsAfter)
+	require.Equal(t, 3, diff.Changed)
+
+	// Methods are matched by name even though they moved, and sorted by the
+	// absolute change in calls
+	added, kept, removed := diff.Methods[0], diff.Methods[1], diff.Methods[2]
+	assert.Equal(t, "A#added", added.Method)
+	assert.Equal(t, methodAdded, added.Status)
+	assert.Equal(t, 3, added.CallsChange)
+
+	assert.Equal(t, "A#kept", kept.Method)
+	assert.Equal(t, methodChanged, kept.Status)
+	assert.Equal(t, 20, kept.Lineno)
+	assert.Equal(t, 1, kept.CallsChange)
+	assert.Equal(t, 1, kept.DistinctChange)
+	assert.Equal(t, -0.5, kept.TimeChange)
+
+	assert.Equal(t, "A#removed", removed.Method)
+	assert.Equal(t, methodRemoved, removed.Status)
+	assert.Equal(t, -1, removed.CallsChange)
+
+	p.sortBy = sortByTotal
+	p.limit = 1
+	diff = p.DiffStats(before, callsBefore, after, callsAfter)
+	assert.Equal(t, 3, diff.Changed)
+	require.Len(t, diff.Methods, 1)
+	assert.Equal(t, "A#kept", diff.Methods[0].Method)
+
+	buf := new(bytes.Buffer)
+	p.RenderStatsDiff(buf, diff)
+	assert.Equal(t, "3 calls before, 6 calls after (+3), top 1 of 3 changed methods\n"+
+		"  ~ A#kept: 1 -> 2 calls (+1), 1 -> 2 distinct (+1), total 1s -> 500ms (-500ms)\n", buf.String())
+
+	buf.Reset()
+	p.json = true
+	p.RenderStatsDiff(buf, diff)
+	var out map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, 3.0, out["changed"])
+	methods := out["methods"].([]interface{})
+	assert.Equal(t, "changed", methods[0].(map[string]interface{})["status"])
+	assert.Equal(t, -0.5, methods[0].(map[string]interface{})["total_time_change"])
+}
@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/applandinc/appland-cli/internal/appmap"
 	"github.com/applandinc/appland-cli/internal/config"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -95,3 +99,169 @@ func TestJSON(t *testing.T) {
 	}
 	assert.Nil(t, err)
 }
+
+func TestSuggestExcludes(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	cwd, err := os.Getwd()
+	require.Nil(t, err)
+	appmapConfigPath := filepath.Join(cwd, "appmap.yml")
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "tmp/test.appmap.json", data, 0644)
+	afero.WriteFile(fs, appmapConfigPath, []byte("name: test\n# Ruby code\npackages:\n- path: app/models\n- path: JSON\n"), 0644)
+
+	p := &StatsProcessor{suggest: true, writeExcludes: true, minCallShare: 0.03, maxDistinctRatio: 0.34}
+	cmd := NewStatsCommand(p)
+	require.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+
+	appmapConfig, err := config.LoadAppmapConfig(appmapConfigPath, "")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"app/models/api_key"}, appmapConfig.Packages[0].Exclude)
+	assert.Equal(t, []string{"JSON::Ext::Parser"}, appmapConfig.Packages[1].Exclude)
+
+	written, err := afero.ReadFile(fs, appmapConfigPath)
+	require.Nil(t, err)
+	assert.Contains(t, string(written), "# Ruby code")
+}
+
+func TestCallTimes(t *testing.T) {
+	m, err := appmap.Decode(strings.NewReader(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"defined_class":"A","method_id":"outer","static":false,"parameters":[]},
+		{"id":2,"event":"call","thread_id":1,"defined_class":"A","method_id":"inner","static":false,"parameters":[]},
+		{"id":3,"event":"call","thread_id":2,"defined_class":"B","method_id":"other","static":false,"parameters":[]},
+		{"id":4,"event":"return","thread_id":1,"parent_id":2,"elapsed":0.25},
+		{"id":5,"event":"call","thread_id":1,"defined_class":"A","method_id":"unreturned","static":false,"parameters":[]},
+		{"id":6,"event":"call","thread_id":1,"defined_class":"A","method_id":"inner","static":false,"parameters":[]},
+		{"id":7,"event":"return","thread_id":1,"parent_id":6,"elapsed":0.5},
+		{"id":8,"event":"return","thread_id":2,"parent_id":3,"elapsed":2},
+		{"id":9,"event":"return","thread_id":1,"parent_id":1,"elapsed":1}
+	]}`))
+	require.Nil(t, err)
+
+	p := StatsProcessor{}
+	stats, calls := p.MethodStats(m)
+	assert.Equal(t, uint64(5), calls)
+	assert.Equal(t, &timingSummary{Total: 1, Self: 0.75, Mean: 1, P50: 1, P95: 1, Max: 1}, stats["A#outer:0"].timing())
+	assert.Equal(t, &timingSummary{Total: 2, Self: 2, Mean: 2, P50: 2, P95: 2, Max: 2}, stats["B#other:0"].timing())
+
+	inner := stats["A#inner:0"]
+	assert.Equal(t, 2, inner.Calls)
+	assert.Equal(t, &timingSummary{Total: 0.75, Self: 0.75, Mean: 0.375, P50: 0.25, P95: 0.5, Max: 0.5}, inner.timing())
+	assert.Nil(t, stats["A#unreturned:0"].timing())
+
+	bySelf := p.sortStats(stats, sortBySelf)
+	assert.Equal(t, "B#other:0", bySelf[0].Method)
+	assert.Equal(t, "A#inner:0", bySelf[1].Method)
+	assert.Equal(t, "A#outer:0", bySelf[2].Method)
+
+	byMean := p.sortStats(stats, sortByMean)
+	assert.Equal(t, "B#other:0", byMean[0].Method)
+	assert.Equal(t, "A#outer:0", byMean[1].Method)
+
+	buf := new(bytes.Buffer)
+	p.json = true
+	p.RenderStats(buf, calls, stats)
+
+	var out []map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, "A#inner", out[0]["method"])
+	assert.Equal(t, 0.375, out[0]["mean_time"])
+	assert.Equal(t, "A#unreturned", out[2]["method"])
+	assert.NotContains(t, out[2], "total_time")
+}
+
+func TestTimeDistribution(t *testing.T) {
+	times := func(n int) *timeDistribution {
+		d := &timeDistribution{}
+		for i := 1; i <= n; i++ {
+			d.add(float64(i) / 1000)
+		}
+		return d
+	}
+
+	exact := times(maxTrackedValues)
+	assert.Equal(t, 0.5, exact.percentile(0.5))
+	assert.Equal(t, 0.95, exact.percentile(0.95))
+	assert.Equal(t, 1.0, exact.Max)
+
+	// Beyond maxTrackedValues, times are only kept by bucket
+	sketched := times(100000)
+	assert.Nil(t, sketched.times)
+	assert.Equal(t, 100000, sketched.Count)
+	assert.InEpsilon(t, 50, sketched.percentile(0.5), timeSketchAccuracy)
+	assert.InEpsilon(t, 95, sketched.percentile(0.95), timeSketchAccuracy)
+	assert.Equal(t, 100.0, sketched.percentile(1))
+
+	exact.merge(sketched)
+	sketched = times(100000)
+	sketched.merge(times(maxTrackedValues))
+	for _, d := range []*timeDistribution{exact, sketched} {
+		assert.Nil(t, d.times)
+		assert.Equal(t, 101000, d.Count)
+		assert.Equal(t, 100.0, d.Max)
+		assert.InEpsilon(t, 49.5, d.percentile(0.5), timeSketchAccuracy)
+	}
+}
+
+func TestStreamMethodStats(t *testing.T) {
+	config.SetFileSystem(afero.NewOsFs())
+	p := StatsProcessor{params: true}
+	m, err := p.ReadAppmap("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	expected, expectedCalls := p.MethodStats(m)
+	stats, calls, err := p.StreamMethodStats("testdata/test.appmap.json")
+	require.Nil(t, err)
+	assert.Equal(t, expectedCalls, calls)
+	assert.Equal(t, expected, stats)
+
+	_, _, err = p.StreamMethodStats("testdata/missing.appmap.json")
+	assert.NotNil(t, err)
+}
+
+func TestProcessFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	var fnames []string
+	for i := 0; i < 10; i++ {
+		fname := fmt.Sprintf("%d.appmap.json", i)
+		content := data
+		if i == 3 {
+			content = []byte(invalidAppmap)
+		}
+		require.Nil(t, afero.WriteFile(fs, fname, content, 0644))
+		fnames = append(fnames, fname)
+	}
+
+	p := StatsProcessor{concurrency: 4}
+	var (
+		processed []string
+		failed    []string
+		total     = make(map[string]Stats)
+		calls     uint64
+	)
+	p.processFiles(fnames, func(fname string, stats fileStats) {
+		processed = append(processed, fname)
+		if stats.err != nil {
+			failed = append(failed, fname)
+			return
+		}
+		p.mergeMethodStats(total, stats.methods)
+		calls += stats.calls
+	})
+
+	// Results come in the order of the files, whichever finishes first
+	assert.Equal(t, fnames, processed)
+	assert.Equal(t, []string{"3.appmap.json"}, failed)
+	assert.Equal(t, uint64(9*60), calls)
+	assert.Equal(t, 9*8, total["Net::HTTP#request:1468"].Calls)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/metadata"
+)
+
+const (
+	transformRedact      = "redact"
+	transformHash        = "hash"
+	transformDropHeaders = "drop-headers"
+	transformStripPaths  = "strip-paths"
+)
+
+// newTransformers builds the transformers configured in appmap.yml or a
+// context, in order.
+func newTransformers(transforms []config.Transform) ([]metadata.Transformer, error) {
+	transformers := make([]metadata.Transformer, 0, len(transforms))
+	for i, t := range transforms {
+		var transformer metadata.Transformer
+		switch t.Type {
+		case transformRedact, transformHash:
+			if t.Class == "" && t.Name == "" {
+				return nil, fmt.Errorf("transform %d: %s needs a class or a name pattern", i+1, t.Type)
+			}
+
+			var (
+				selector metadata.ParameterSelector
+				err      error
+			)
+			if t.Class != "" {
+				if selector.Class, err = regexp.Compile(t.Class); err != nil {
+					return nil, fmt.Errorf("transform %d: %w", i+1, err)
+				}
+			}
+			if t.Name != "" {
+				if selector.Name, err = regexp.Compile(t.Name); err != nil {
+					return nil, fmt.Errorf("transform %d: %w", i+1, err)
+				}
+			}
+
+			if t.Type == transformRedact {
+				transformer = &metadata.ValueRedactor{ParameterSelector: selector}
+				break
+			}
+
+			// Unsalted hashes of passwords or email addresses can be reversed
+			// by hashing likely values
+			salt := config.ResolveValue(t.Salt)
+			if salt == "" {
+				if config.IsEnvironmentVariable(t.Salt) {
+					return nil, fmt.Errorf("transform %d: hash salt %s is not set", i+1, t.Salt)
+				}
+				return nil, fmt.Errorf("transform %d: hash needs a salt", i+1)
+			}
+			transformer = &metadata.ValueHasher{ParameterSelector: selector, Salt: []byte(salt)}
+		case transformDropHeaders:
+			transformer = &metadata.HeaderDropper{Headers: t.Headers}
+		case transformStripPaths:
+			prefix := t.Prefix
+			if prefix == "" {
+				dir, err := os.Getwd()
+				if err != nil {
+					return nil, fmt.Errorf("transform %d: %w", i+1, err)
+				}
+				prefix = dir
+			}
+			transformer = &metadata.PathStripper{Prefix: prefix}
+		default:
+			return nil, fmt.Errorf("transform %d: unknown type %q, must be %s, %s, %s or %s", i+1, t.Type, transformRedact, transformHash, transformDropHeaders, transformStripPaths)
+		}
+		transformers = append(transformers, transformer)
+	}
+	return transformers, nil
+}
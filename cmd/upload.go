@@ -2,39 +2,515 @@ package cmd
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/applandinc/appland-cli/internal/appland"
+	"github.com/applandinc/appland-cli/internal/appmap"
 	"github.com/applandinc/appland-cli/internal/config"
 	"github.com/applandinc/appland-cli/internal/files"
 	"github.com/applandinc/appland-cli/internal/metadata"
 	"github.com/applandinc/appland-cli/internal/util"
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/pkg/browser"
 	progressbar "github.com/schollz/progressbar/v3"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
 const fileSizeLimit = 1024 * 1024 * 2
 
-func checkSize(info os.FileInfo) error {
-	if info.Size() > fileSizeLimit {
-		return fmt.Errorf("file %s size is %d KiB, which is greater than the size limit of %d KiB, use --force if you want to upload it anyway", info.Name(), info.Size()/1024, fileSizeLimit/1024)
+// sizeLimitError is returned by readScenario if a file is over the size
+// limit, and still is when compressed or pruned if that's enabled.
+type sizeLimitError struct {
+	path string
+	kind string
+	size int64
+}
+
+func (e *sizeLimitError) Error() string {
+	if e.kind == "" {
+		return fmt.Sprintf("file %s size is %d KiB, which is greater than the size limit of %d KiB, use --force if you want to upload it anyway", e.path, e.size/1024, fileSizeLimit/1024)
 	}
-	return nil
+	return fmt.Sprintf("file %s %s size is %d KiB, which is greater than the size limit of %d KiB, use --force if you want to upload it anyway", e.path, e.kind, e.size/1024, fileSizeLimit/1024)
+}
+
+// invalidAppMapError is returned by readScenario if validation is enabled and
+// a file isn't a valid AppMap.
+type invalidAppMapError struct {
+	path string
+	errs appmap.ValidationErrors
+}
+
+func (e *invalidAppMapError) Error() string {
+	return fmt.Sprintf("file %s is not a valid AppMap: %v", e.path, e.errs)
+}
+
+// unscannableError is returned by readScenario if a file can't be scanned for
+// secrets in full, since streaming its events stopped at an invalid one.
+type unscannableError struct {
+	path string
+	errs appmap.ValidationErrors
+}
+
+func (e *unscannableError) Error() string {
+	return fmt.Sprintf("file %s can't be scanned for secrets, it is not a valid AppMap: %v", e.path, e.errs)
+}
+
+// isSkipped reports whether readScenario failed because of the file, which is
+// then skipped, rather than because of an error which fails the upload.
+func isSkipped(err error) bool {
+	var (
+		sizeErr        *sizeLimitError
+		invalidErr     *invalidAppMapError
+		unscannableErr *unscannableError
+		secretsErr     *secretsFoundError
+	)
+	return errors.As(err, &sizeErr) || errors.As(err, &invalidErr) || errors.As(err, &unscannableErr) || errors.As(err, &secretsErr)
 }
 
 type UploadOptions struct {
 	bench           bool
+	concurrency     int
 	branch          string
 	environment     string
 	application     string
 	appmapPath      string
 	force           bool
+	prune           bool
+	validate        bool
+	gzip            bool
 	version         string
 	dontOpenBrowser bool
 	mapsetId        uint64
+	resume          bool
+	strict          bool
+	maxFailures     int
+	reportPath      string
+	scanAction      string
+	dryRun          bool
+	filter          files.Filter
+}
+
+// allowedFailures returns how many scenarios may fail to upload, or be
+// skipped, before the command fails, or -1 if there's no limit.
+func (options *UploadOptions) allowedFailures() int {
+	if options.strict {
+		return 0
+	}
+	if options.maxFailures > 0 {
+		return options.maxFailures
+	}
+	return -1
+}
+
+// uploadResult is the outcome of uploading a single file. Status and Response
+// are only set when the server rejected the file.
+type uploadResult struct {
+	File     string `json:"file"`
+	UUID     string `json:"uuid,omitempty"`
+	Resumed  bool   `json:"resumed,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Response string `json:"response,omitempty"`
+
+	Size           int64 `json:"size,omitempty"`
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+
+	skipped bool
+}
+
+func failedUploadResult(file string, err error) uploadResult {
+	result := uploadResult{File: file, Error: err.Error()}
+
+	var httpError *appland.HttpError
+	if errors.As(err, &httpError) {
+		result.Status = httpError.Status
+		result.Error = http.StatusText(httpError.Status)
+		result.Response = httpError.Body
+	}
+
+	return result
+}
+
+type uploadReport struct {
+	Application string         `json:"app"`
+	MapSetID    uint32         `json:"mapset_id,omitempty"`
+	Uploaded    []uploadResult `json:"uploaded"`
+	Failed      []uploadResult `json:"failed"`
+	Skipped     []uploadResult `json:"skipped"`
+}
+
+func (report *uploadReport) write(path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(config.GetFS(), path, data, 0644)
+}
+
+func (report *uploadReport) printSizes() {
+	fmt.Println("sizes:")
+	for _, result := range report.Uploaded {
+		switch {
+		case result.Resumed:
+			fmt.Printf("  %s: previously uploaded\n", result.File)
+		case result.CompressedSize > 0:
+			fmt.Printf("  %s: %d bytes, %d bytes compressed (%.1f%%)\n", result.File, result.Size, result.CompressedSize, 100*float64(result.CompressedSize)/float64(result.Size))
+		default:
+			fmt.Printf("  %s: %d bytes\n", result.File, result.Size)
+		}
+	}
+}
+
+func (report *uploadReport) printFailures(w io.Writer) {
+	if len(report.Failed) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%d AppMap(s) failed to upload:\n", len(report.Failed))
+	for _, failure := range report.Failed {
+		if failure.Status == 0 {
+			fmt.Fprintf(w, "  %s: %s\n", failure.File, failure.Error)
+			continue
+		}
+
+		fmt.Fprintf(w, "  %s: status %d (%s)\n", failure.File, failure.Status, failure.Error)
+		if failure.Response != "" {
+			fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(strings.TrimSpace(failure.Response), "\n", "\n    "))
+		}
+	}
+}
+
+// scenario is an AppMap ready for upload. hash identifies the content of the
+// file, before any patches were applied. The patches are applied while the
+// file is being uploaded, so the AppMap is never held in memory, unless it
+// had to be pruned, in which case the pruned AppMap is kept in data.
+type scenario struct {
+	path    string
+	hash    string
+	data    []byte
+	patches []*jsonpatch.Patch
+	git     *metadata.Git
+}
+
+// reader opens the AppMap, before any patches are applied.
+func (s *scenario) reader() (io.ReadCloser, error) {
+	if s.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(s.data)), nil
+	}
+
+	file, err := files.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %w", s.path, err)
+	}
+	return file, nil
+}
+
+// transform adds the patch of the transformers to the scenario. AppMaps which
+// can't be decoded can't be transformed, so they're invalid.
+func (s *scenario) transform(transformers []metadata.Transformer) error {
+	r, err := s.reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	patch, err := metadata.Transform(r, transformers)
+	var errs appmap.ValidationErrors
+	if errors.As(err, &errs) {
+		return &invalidAppMapError{path: s.path, errs: errs}
+	} else if err != nil {
+		return fmt.Errorf("failed transforming %s: %w", s.path, err)
+	}
+
+	if patch != nil {
+		s.patches = append(s.patches, patch)
+	}
+	return nil
+}
+
+// scan finds the secrets in the AppMap, as it will be uploaded. Secrets are
+// redacted by adding the patch redacting them to the scenario, if scanner is
+// set to. AppMaps which can't be decoded in full can't be cleared of secrets,
+// so they're skipped.
+func (s *scenario) scan(scanner *secretScanner) error {
+	r, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	findings, patch, err := scanner.scanAppmap(r)
+	var errs appmap.ValidationErrors
+	if errors.As(err, &errs) {
+		return &unscannableError{path: s.path, errs: errs}
+	} else if err != nil {
+		return fmt.Errorf("failed scanning %s: %w", s.path, err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	if !scanner.redact {
+		return &secretsFoundError{path: s.path, findings: findings}
+	}
+	s.patches = append(s.patches, patch)
+	fmt.Fprintf(os.Stderr, "%s: redacted %d secret(s)\n", s.path, len(findings))
+	return nil
+}
+
+// scenarioReader streams a patched AppMap. Reopen allows the client to read
+// it again if an upload is retried.
+type scenarioReader struct {
+	*io.PipeReader
+	scenario *scenario
+}
+
+func (s *scenario) open() (*scenarioReader, error) {
+	r := &scenarioReader{scenario: s}
+	if err := r.Reopen(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *scenarioReader) Reopen() error {
+	if r.PipeReader != nil {
+		r.PipeReader.Close()
+	}
+
+	file, err := r.scenario.reader()
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := metadata.Rewrite(file, pw, r.scenario.patches)
+		file.Close()
+		if err != nil {
+			err = fmt.Errorf("failed patching %s: %w", r.scenario.path, err)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r.PipeReader = pr
+	return nil
+}
+
+// sizeLimit describes how readScenario handles files over the size limit.
+type sizeLimit struct {
+	// limit is the size limit in bytes, or 0 if there's no limit.
+	limit int64
+	// compressed means the limit applies to the compressed size.
+	compressed bool
+	// prune means files over the limit are pruned to fit.
+	prune bool
+}
+
+// readScenario hashes an AppMap, passes it through the transformers, scans it
+// for secrets and collects the patches of each of the metadata providers. If
+// one of the providers resolved Git metadata, it is returned with the
+// scenario.
+//
+// Files over the size limit are compressed to find out whether they'd still
+// be over the limit when uploaded, if the limit applies to the compressed
+// size, and then pruned if that's enabled.
+func readScenario(scenarioFile string, fileTiming util.Timing, metadataProviders []metadata.Provider, branch string, limit sizeLimit, validate bool, transformers []metadata.Transformer, scanner *secretScanner) (*scenario, error) {
+	s := &scenario{path: scenarioFile}
+
+	if validate {
+		fileTiming.Start("validating")
+		errs, err := validateAppmap(scenarioFile, "")
+		if err != nil {
+			return nil, err
+		}
+		if errs != nil {
+			return nil, &invalidAppMapError{path: scenarioFile, errs: errs}
+		}
+	}
+
+	file, err := files.Open(scenarioFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %w", scenarioFile, err)
+	}
+	defer file.Close()
+
+	fileTiming.Start("reading")
+
+	var (
+		hash                 = sha256.New()
+		w          io.Writer = hash
+		compressed *countingWriter
+		gz         *gzip.Writer
+	)
+
+	overLimit := false
+	if limit.limit > 0 {
+		if fi, err := files.Stat(scenarioFile); err == nil && fi.Size() > limit.limit {
+			overLimit = true
+			switch {
+			case limit.compressed:
+				compressed = &countingWriter{Writer: ioutil.Discard}
+				gz = gzip.NewWriter(compressed)
+				w = io.MultiWriter(hash, gz)
+			case !limit.prune:
+				return nil, &sizeLimitError{path: scenarioFile, size: fi.Size()}
+			}
+		}
+	}
+
+	if _, err := io.Copy(w, file); err != nil {
+		return nil, fmt.Errorf("failed reading %s: %w", scenarioFile, err)
+	}
+	s.hash = fmt.Sprintf("%x", hash.Sum(nil))
+
+	if gz != nil {
+		gz.Close()
+		overLimit = compressed.count > limit.limit
+		if overLimit && !limit.prune {
+			return nil, &sizeLimitError{path: scenarioFile, kind: "compressed", size: compressed.count}
+		}
+	}
+
+	if overLimit && limit.prune {
+		fileTiming.Start("pruning")
+		if err := s.prune(limit.limit); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(transformers) > 0 {
+		fileTiming.Start("transforming")
+		if err := s.transform(transformers); err != nil {
+			return nil, err
+		}
+	}
+
+	fileTiming.Start("scanning")
+	if err := s.scan(scanner); err != nil {
+		return nil, err
+	}
+
+	fileTiming.Start("patching")
+	for _, provider := range metadataProviders {
+		m, err := provider.Get(files.Origin(scenarioFile))
+		if err != nil {
+			util.Debugf("%w", err)
+		}
+
+		if gitMetadata, ok := m.(*metadata.Git); ok {
+			if branch != "" {
+				gitMetadata.Branch = branch
+			}
+
+			s.git = gitMetadata
+		}
+
+		if err == nil && m.IsValid() {
+			patch, err := m.AsPatch()
+			if err != nil {
+				return nil, fmt.Errorf("failed patching %s: %w", scenarioFile, err)
+			}
+
+			s.patches = append(s.patches, patch)
+		}
+	}
+
+	return s, nil
+}
+
+// printPatch writes the operations of the patches of the scenario, one per
+// line, for --dry-run.
+func (s *scenario) printPatch(w io.Writer) error {
+	fmt.Fprintf(w, "%s:\n", s.path)
+	if s.data != nil {
+		fmt.Fprintf(w, "  (pruned to %d bytes)\n", len(s.data))
+	}
+
+	n := 0
+	for _, patch := range s.patches {
+		for _, op := range *patch {
+			data, err := json.Marshal(op)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  %s\n", data)
+			n++
+		}
+	}
+	if n == 0 && s.data == nil {
+		fmt.Fprintln(w, "  (unchanged)")
+	}
+	return nil
+}
+
+// prune replaces the scenario's data by a pruned copy of its file, which is
+// at most limit bytes.
+func (s *scenario) prune(limit int64) error {
+	data, err := files.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed reading %s: %w", s.path, err)
+	}
+
+	pruned, report, err := pruneAppmap(data, int(limit), defaultPrunedValueLength)
+	if err != nil {
+		return fmt.Errorf("failed pruning %s: %w", s.path, err)
+	}
+
+	report.print(os.Stderr, s.path)
+
+	if int64(len(pruned)) > limit {
+		return &sizeLimitError{path: s.path, kind: "pruned", size: int64(len(pruned))}
+	}
+
+	s.data = pruned
+	return nil
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// checkResumedParameters rejects the flags given along with --resume which
+// differ from those the interrupted upload was started with, since the mapset
+// is created with the latter. Flags which aren't given are resumed.
+func checkResumedParameters(given, resumed config.MapSetParameters) error {
+	for _, flag := range []struct {
+		name           string
+		given, resumed string
+	}{
+		{"--branch", given.Branch, resumed.Branch},
+		{"--version", given.Version, resumed.Version},
+		{"--environment", given.Environment, resumed.Environment},
+	} {
+		if flag.given != "" && flag.given != flag.resumed {
+			return fmt.Errorf("%s %s conflicts with the upload being resumed, which had %q\nRun again without --resume to start a new upload", flag.name, flag.given, flag.resumed)
+		}
+	}
+
+	if given.MapsetID != 0 && given.MapsetID != resumed.MapsetID {
+		return fmt.Errorf("--mapset %d conflicts with the upload being resumed, which had %d\nRun again without --resume to start a new upload", given.MapsetID, resumed.MapsetID)
+	}
+	return nil
 }
 
 func NewUploadCommand(options *UploadOptions, metadataProviders []metadata.Provider) *cobra.Command {
@@ -43,16 +519,110 @@ func NewUploadCommand(options *UploadOptions, metadataProviders []metadata.Provi
 		Short: "Upload AppMap files to AppLand",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			application := options.application
-			if application == "" {
-				appmapConfig, err := config.LoadAppmapConfig(options.appmapPath, args[0])
+			var (
+				journal *config.UploadJournal
+				params  config.MapSetParameters
+				err     error
+			)
+
+			// Secrets are scanned for with the rules of appmap.yml, if there is
+			// one.
+			appmapConfig, appmapErr := config.LoadAppmapConfig(options.appmapPath, files.Origin(args[0]))
+			var scanConfig config.AppMapScan
+			if appmapErr == nil {
+				scanConfig = appmapConfig.Scan
+			}
+			if options.scanAction != "" {
+				scanConfig.Action = options.scanAction
+			}
+			scanner, err := newSecretScanner(scanConfig)
+			if err != nil {
+				return fmt.Errorf("invalid scan configuration: %w", err)
+			}
+
+			// The transformers of appmap.yml apply to the AppMaps of the project,
+			// those of the context to every AppMap uploaded with it.
+			var transforms []config.Transform
+			if appmapErr == nil {
+				transforms = append(transforms, appmapConfig.Transform...)
+			}
+			if context := api.Context(); context != nil {
+				transforms = append(transforms, context.Transform...)
+			}
+			transformers, err := newTransformers(transforms)
+			if err != nil {
+				return fmt.Errorf("invalid transform configuration: %w", err)
+			}
+
+			if f := cmd.Flags().Lookup("gzip"); f != nil && f.Changed {
+				api.UseGzip(options.gzip)
+			}
+
+			// When compressing or pruning, the size limit is checked once the
+			// file is read.
+			compress := api.GzipEnabled()
+			limit := sizeLimit{compressed: compress, prune: options.prune}
+			if !options.force {
+				limit.limit = fileSizeLimit
+			}
+
+			if options.dryRun {
+				cmd.SilenceUsage = true
+
+				scenarioFiles, err := files.Find(args, options.filter)
 				if err != nil {
+					return fmt.Errorf("failed finding AppMaps: %w", err)
+				}
+
+				for _, scenarioFile := range scenarioFiles {
+					s, err := readScenario(scenarioFile, util.NewTiming(scenarioFile), metadataProviders, options.branch, limit, options.validate, transformers, scanner)
+					if isSkipped(err) {
+						warn(err)
+						continue
+					}
+					if err != nil {
+						return err
+					}
+
+					if err := s.printPatch(os.Stdout); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			params = config.MapSetParameters{
+				Application: options.application,
+				MapsetID:    options.mapsetId,
+				Branch:      options.branch,
+				Version:     options.version,
+				Environment: options.environment,
+			}
+
+			if params.Application == "" {
+				if appmapErr != nil {
 					return fmt.Errorf("an appmap.yml should exist in the target repository or the --app / -a flag specified")
 				}
 
-				application = appmapConfig.Application
+				params.Application = appmapConfig.Application
 			}
 
+			journalKey := config.UploadJournalKey(params.Application, args)
+			if options.resume {
+				journal, err = config.ResumeUploadJournal(journalKey)
+				if err != nil {
+					return err
+				}
+				if err := checkResumedParameters(params, journal.Parameters); err != nil {
+					journal.Close()
+					return err
+				}
+				params = journal.Parameters
+			} else {
+				journal = config.CreateUploadJournal(journalKey, params)
+			}
+			defer journal.Close()
+
 			// If we encounter a usage related error later on we can disable this flag
 			// We don't want to report the usage for errors which are unrelated to
 			// command line arguments
@@ -65,93 +635,166 @@ func NewUploadCommand(options *UploadOptions, metadataProviders []metadata.Provi
 			// single mapset.
 			var git *metadata.Git
 
-			validator := func(fi os.FileInfo) bool {
-				if !options.force {
-					if err := checkSize(fi); err != nil {
-						warn(err)
-						return false
-					}
-				}
-				return true
-			}
-
-			scenarioFiles, err := files.FindAppMaps(args, validator)
+			scenarioFiles, err := files.Find(args, options.filter)
 			if err != nil {
 				return fmt.Errorf("failed finding AppMaps: %w", err)
 			}
 
-			scenarioUUIDs := make([]string, 0, len(scenarioFiles))
 			progressBar := progressbar.New(len(scenarioFiles) + 1)
 			progressBar.RenderBlank()
 
 			timing := util.NewTiming("total")
 
-			for _, scenarioFile := range scenarioFiles {
-				fileTiming := timing.Start(scenarioFile)
-
-				file, err := config.GetFS().Open(scenarioFile)
-				if err != nil {
-					return fmt.Errorf("failed opening %s: %w", scenarioFile, err)
-				}
-
-				fileTiming.Start("reading")
-
-				data, err := ioutil.ReadAll(file)
-				if err != nil {
-					return fmt.Errorf("failed reading %s: %w", scenarioFile, err)
-				}
-				file.Close()
-
-				fileTiming.Start("patching")
-				for _, provider := range metadataProviders {
-					m, err := provider.Get(scenarioFile)
-					if err != nil {
-						util.Debugf("%w", err)
-					}
+			// Concurrent uploads need forked timings, since they run alongside
+			// each other.
+			concurrency := options.concurrency
+			startFile := timing.Start
+			if concurrency > 1 {
+				startFile = timing.Fork
+			} else {
+				concurrency = 1
+			}
 
-					if gitMetadata, ok := m.(*metadata.Git); ok {
-						if options.branch != "" {
-							gitMetadata.Branch = options.branch
+			var (
+				results   = make([]uploadResult, len(scenarioFiles))
+				jobs      = make(chan int)
+				done      = make(chan struct{})
+				wg        sync.WaitGroup
+				mutex     sync.Mutex
+				uploadErr error
+			)
+
+			for w := 0; w < concurrency; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range jobs {
+						scenarioFile := scenarioFiles[i]
+
+						fileTiming := startFile(scenarioFile)
+
+						s, err := readScenario(scenarioFile, fileTiming, metadataProviders, params.Branch, limit, options.validate, transformers, scanner)
+						if isSkipped(err) {
+							warn(err)
+							results[i] = uploadResult{File: scenarioFile, Error: err.Error(), skipped: true}
+							progressBar.Add(1)
+							fileTiming.Finish()
+							continue
+						}
+						if err != nil {
+							mutex.Lock()
+							if uploadErr == nil {
+								uploadErr = err
+								close(done)
+							}
+							mutex.Unlock()
+							fileTiming.Finish()
+							continue
 						}
 
-						git = gitMetadata
-					}
+						if s.git != nil {
+							mutex.Lock()
+							git = s.git
+							mutex.Unlock()
+						}
 
-					if err == nil && m.IsValid() {
-						patch, err := m.AsPatch()
-						if err != nil {
-							return fmt.Errorf("failed patching %s: %w", scenarioFile, err)
+						if uuid, ok := journal.Lookup(scenarioFile, s.hash); ok {
+							results[i] = uploadResult{File: scenarioFile, UUID: uuid, Resumed: true}
+							progressBar.Add(1)
+							fileTiming.Finish()
+							continue
 						}
 
-						data, err = patch.Apply(data)
+						uploading := fileTiming.Start("uploading")
+						var resp *appland.ScenarioResponse
+						r, err := s.open()
+						if err == nil {
+							resp, err = api.CreateScenario(params.Application, params.MapsetID, r, uploading)
+							r.Close()
+						}
 						if err != nil {
-							return fmt.Errorf("failed patching %s: %w", scenarioFile, err)
+							fmt.Fprintf(os.Stderr, "warning, failed uploading %s: %s\n", scenarioFile, err)
+							results[i] = failedUploadResult(scenarioFile, err)
+						} else {
+							results[i] = uploadResult{
+								File:           scenarioFile,
+								UUID:           resp.UUID,
+								Size:           resp.DataSize,
+								CompressedSize: resp.CompressedSize,
+							}
+							if err := journal.Record(scenarioFile, s.hash, resp.UUID); err != nil {
+								warn(err)
+							}
 						}
+						progressBar.Add(1)
+
+						fileTiming.Finish()
 					}
+				}()
+			}
+
+		enqueue:
+			for i := range scenarioFiles {
+				select {
+				case jobs <- i:
+				case <-done:
+					break enqueue
 				}
+			}
+			close(jobs)
+			wg.Wait()
 
-				fileTiming.Start("uploading")
-				resp, err := api.CreateScenario(application, options.mapsetId, bytes.NewReader(data))
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "warning, failed uploading %s: %s\n", scenarioFile, err)
-				} else {
-					scenarioUUIDs = append(scenarioUUIDs, resp.UUID)
+			if uploadErr != nil {
+				return uploadErr
+			}
+
+			// Keep the scenarios in the same order as the files they came from,
+			// regardless of the order in which the uploads completed.
+			report := &uploadReport{
+				Application: params.Application,
+				Uploaded:    []uploadResult{},
+				Failed:      []uploadResult{},
+				Skipped:     []uploadResult{},
+			}
+			scenarioUUIDs := make([]string, 0, len(scenarioFiles))
+			for _, result := range results {
+				switch {
+				case result.UUID != "":
+					scenarioUUIDs = append(scenarioUUIDs, result.UUID)
+					report.Uploaded = append(report.Uploaded, result)
+				case result.skipped:
+					report.Skipped = append(report.Skipped, result)
+				default:
+					report.Failed = append(report.Failed, result)
 				}
-				progressBar.Add(1)
+			}
 
-				fileTiming.Finish()
+			if options.reportPath != "" {
+				defer func() {
+					if err := report.write(options.reportPath); err != nil {
+						warn(fmt.Errorf("failed writing report: %w", err))
+					}
+				}()
 			}
 
 			timing.Finish()
 
-			if len(scenarioFiles) == 0 {
+			if len(report.Skipped) == len(scenarioFiles) {
 				return fmt.Errorf("no valid appmaps to upload")
 			}
 
+			// Skipped AppMaps are missing from the mapset just like those which
+			// failed to upload
+			report.printFailures(os.Stderr)
+			if allowed := options.allowedFailures(); allowed >= 0 && len(report.Failed)+len(report.Skipped) > allowed {
+				progressBar.Clear()
+				return fmt.Errorf("%d AppMap(s) failed to upload and %d were skipped, the mapset was not created\nRun again with --resume to retry the failed AppMaps", len(report.Failed), len(report.Skipped))
+			}
+
 			// either both commit and branch are specified or both are unspecified
 			// fail otherwise
 			commitProvided := bool(git != nil && git.Commit != "")
-			branchProvided := bool((git != nil && git.Branch != "") || options.branch != "")
+			branchProvided := bool((git != nil && git.Branch != "") || params.Branch != "")
 			if commitProvided != branchProvided {
 				cmd.SilenceUsage = false
 				progressBar.Clear()
@@ -161,17 +804,28 @@ func NewUploadCommand(options *UploadOptions, metadataProviders []metadata.Provi
 				return fmt.Errorf("The --branch or -b flag can only be provided when uploading appmaps from within a Git repository")
 			}
 
-			if options.mapsetId == 0 {
-				mapSet := appland.BuildMapSet(application, scenarioUUIDs).
-					SetVersion(options.version).
-					SetEnvironment(options.environment).
-					WithGitMetadata(git).
-					SetBranch(options.branch)
+			if params.MapsetID == 0 {
+				// The upload being resumed may have been interrupted after
+				// creating the mapset
+				res := &appland.CreateMapSetResponse{}
+				if journal.MapSet != nil {
+					res.ID, res.AppID = journal.MapSet.ID, journal.MapSet.AppID
+				} else {
+					mapSet := appland.BuildMapSet(params.Application, scenarioUUIDs).
+						SetVersion(params.Version).
+						SetEnvironment(params.Environment).
+						WithGitMetadata(git).
+						SetBranch(params.Branch)
 
-				res, err := api.CreateMapSet(mapSet)
-				if err != nil {
-					return fmt.Errorf("Failed creating mapset, %w", err)
+					res, err = api.CreateMapSet(mapSet)
+					if err != nil {
+						return fmt.Errorf("Failed creating mapset, %w", err)
+					}
+					if err := journal.RecordMapSet(res.ID, res.AppID); err != nil {
+						warn(err)
+					}
 				}
+				report.MapSetID = res.ID
 
 				url := api.BuildUrl("applications", fmt.Sprintf("%d?mapset=%d", res.AppID, res.ID))
 				if options.dontOpenBrowser {
@@ -181,14 +835,19 @@ func NewUploadCommand(options *UploadOptions, metadataProviders []metadata.Provi
 				}
 			}
 
+			if err := config.RemoveUploadJournal(journalKey); err != nil {
+				warn(err)
+			}
+
 			progressBar.Finish()
 
 			if options.bench {
 				fmt.Println()
 				timing.Print()
+				report.printSizes()
 			}
 
-			fmt.Printf("\n\nSuccess! %s has been updated with %d AppMaps.\n", application, len(scenarioUUIDs))
+			fmt.Printf("\n\nSuccess! %s has been updated with %d AppMaps.\n", params.Application, len(scenarioUUIDs))
 
 			return nil
 		},
@@ -208,12 +867,24 @@ func init() {
 	f.BoolVar(&options.dontOpenBrowser, "no-open", false, "Do not open the browser after a successful upload")
 	f.BoolVarP(&options.force, "force", "f", false, "Force uploading a file over size limit")
 	f.BoolVarP(&options.bench, "bench", "", false, "Show a detailed breakdown of time spent uploading")
+	f.BoolVar(&options.prune, "prune", false, "Prune AppMaps over the size limit instead of skipping them, see the prune command")
+	f.BoolVar(&options.validate, "validate", false, "Skip AppMaps which aren't valid, see the validate command")
+	f.BoolVar(&options.gzip, "gzip", false, "Compress AppMaps when uploading, the size limit then applies to the compressed size (defaults to the context's gzip setting)")
+	f.IntVarP(&options.concurrency, "concurrency", "c", 1, "Number of AppMaps to upload concurrently")
 	f.StringVarP(&options.application, "app", "a", "", "Override the owning application")
 	f.StringVar(&options.appmapPath, "f", "", "Specify an appmap.yml path")
 	f.StringVarP(&options.branch, "branch", "b", "", "Set the mapset branch if it's otherwise unavailable from Git")
 	f.StringVarP(&options.version, "version", "v", "", "Set the mapset version")
 	f.StringVarP(&options.environment, "environment", "e", "", "Set the mapset environment")
 	f.Uint64VarP(&options.mapsetId, "mapset", "m", 0, "An existing mapset ID to append appmaps to")
+	f.BoolVar(&options.resume, "resume", false, "Resume an interrupted upload of the same AppMaps to the same application, skipping those which have already been uploaded")
+	f.BoolVar(&options.strict, "strict", false, "Fail without creating the mapset if any AppMap fails to upload or is skipped")
+	f.IntVar(&options.maxFailures, "max-failures", 0, "Fail without creating the mapset if more than this many AppMaps fail to upload or are skipped (0 for no limit)")
+	f.StringVar(&options.reportPath, "report", "", "Write a JSON report of uploaded and failed AppMaps to this path")
+	f.BoolVar(&options.dryRun, "dry-run", false, "Show the patch each AppMap would be uploaded with, without uploading anything")
+	f.StringVar(&options.scanAction, "scan-action", "", "Skip AppMaps containing secrets (block) or redact them (redact), see the scan command (defaults to the scan action of appmap.yml, or block)")
+
+	addFilterFlags(f, &options.filter)
 
 	rootCmd.AddCommand(uploadCmd)
 }
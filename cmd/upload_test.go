@@ -1,18 +1,30 @@
 package cmd
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/applandinc/appland-cli/internal/appland"
 	"github.com/applandinc/appland-cli/internal/config"
 	"github.com/applandinc/appland-cli/internal/metadata"
+	"github.com/applandinc/appland-cli/internal/util"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"gopkg.in/h2non/gock.v1"
 )
 
 const (
@@ -45,21 +57,46 @@ func (m *MockClient) CreateMapSet(mapset *appland.MapSet) (*appland.CreateMapSet
 	return resp, args.Error(1)
 }
 
-func (m *MockClient) CreateScenario(app string, mapsetId uint64, scenarioData io.Reader) (*appland.ScenarioResponse, error) {
-	args := m.Called(app, mapsetId, scenarioData)
+// CreateScenario passes the scenario data to the mock as a string, match it
+// with jsonMatching.
+func (m *MockClient) CreateScenario(app string, mapsetId uint64, scenarioData io.Reader, timing util.Timing) (*appland.ScenarioResponse, error) {
+	data, err := ioutil.ReadAll(scenarioData)
+	if err != nil {
+		return nil, err
+	}
+
+	args := m.Called(app, mapsetId, string(data))
 	resp, _ := args.Get(0).(*appland.ScenarioResponse)
 	return resp, args.Error(1)
 }
 
+func (m *MockClient) UseGzip(enabled bool) {
+	m.gzip = enabled
+}
+
+func (m *MockClient) GzipEnabled() bool {
+	return m.gzip
+}
+
+// jsonMatching matches a JSON string which is equivalent to expected,
+// regardless of formatting and key order.
+func jsonMatching(expected string) interface{} {
+	return mock.MatchedBy(func(actual string) bool {
+		var e, a interface{}
+		if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal([]byte(actual), &a) != nil {
+			return false
+		}
+		return reflect.DeepEqual(e, a)
+	})
+}
+
 func (m *MockClient) BuildUrl(paths ...interface{}) string {
 	args := m.Called(paths)
 	return args.String(0)
 }
 
 func (m *MockClient) Context() *config.Context {
-	args := m.Called()
-	context, _ := args.Get(0).(*config.Context)
-	return context
+	return m.context
 }
 
 func TestUploadSingleAppMap(t *testing.T) {
@@ -74,7 +111,7 @@ func TestUploadSingleAppMap(t *testing.T) {
 	api = mockClient
 
 	mockClient.
-		On("CreateScenario", "myorg/myapp", (uint64)(0), bytes.NewReader([]byte(validAppmap))).
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmap)).
 		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil)
 
 	mockClient.
@@ -98,10 +135,14 @@ func TestUploadTooLargeAppMap(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// A valid AppMap, since AppMaps which can't be scanned for secrets are
+	// skipped
+	file.Write([]byte(`{"metadata":{"padding":"`))
 	z1k := []byte(strings.Repeat("0", 1024*2))
 	for i := 0; i < 1025; i++ {
 		file.Write(z1k)
 	}
+	file.Write([]byte(`"},"events":[]}`))
 	file.Close()
 
 	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
@@ -110,8 +151,17 @@ func TestUploadTooLargeAppMap(t *testing.T) {
 	api = mockClient
 	// no expectations set, client shouldn't be touched because the file should get skipped
 
-	cmd := NewUploadCommand(&UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true}, []metadata.Provider{})
+	cmd := NewUploadCommand(&UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, reportPath: "report.json"}, []metadata.Provider{})
 	assert.NotNil(t, cmd.RunE(cmd, []string{fileName}))
+
+	// The file is reported, like other skipped files
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	if assert.Len(t, report.Skipped, 1) {
+		assert.Contains(t, report.Skipped[0].Error, "greater than the size limit")
+	}
 }
 
 func TestUploadForcedTooLargeAppMap(t *testing.T) {
@@ -123,10 +173,14 @@ func TestUploadForcedTooLargeAppMap(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// A valid AppMap, since AppMaps which can't be scanned for secrets are
+	// skipped
+	file.Write([]byte(`{"metadata":{"padding":"`))
 	z1k := []byte(strings.Repeat("0", 1024*2))
 	for i := 0; i < 1025; i++ {
 		file.Write(z1k)
 	}
+	file.Write([]byte(`"},"events":[]}`))
 	file.Close()
 
 	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
@@ -135,7 +189,7 @@ func TestUploadForcedTooLargeAppMap(t *testing.T) {
 	api = mockClient
 
 	mockClient.
-		On("CreateScenario", "myorg/myapp", (uint64)(0), mock.AnythingOfType("*bytes.Reader")).
+		On("CreateScenario", "myorg/myapp", (uint64)(0), mock.AnythingOfType("string")).
 		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil)
 
 	mockClient.
@@ -172,7 +226,7 @@ func TestUploadWithGitMetadata(t *testing.T) {
 
 	mockClient := &MockClient{}
 	mockClient.
-		On("CreateScenario", "myorg/myapp", (uint64)(0), bytes.NewReader([]byte(validAppmapWithMetadata))).
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmapWithMetadata)).
 		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil)
 
 	mockClient.
@@ -217,7 +271,7 @@ func TestUploadWithBranchOverride(t *testing.T) {
 
 	mockClient := &MockClient{}
 	mockClient.
-		On("CreateScenario", "myorg/myapp", (uint64)(0), bytes.NewReader([]byte(validAppmapWithBranchOverride))).
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmapWithBranchOverride)).
 		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil)
 
 	branchOverride := "my-branch"
@@ -245,3 +299,618 @@ func TestUploadWithBranchOverride(t *testing.T) {
 	cmd := NewUploadCommand(options, providers)
 	assert.Nil(t, cmd.RunE(cmd, []string{fileName}))
 }
+
+func TestUploadConcurrently(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+	fs.MkdirAll("tmp", 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	expectedUUIDs := []string{}
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf(`{"classMap":[],"events":[],"metadata":{"name":"%d"}}`, i)
+		afero.WriteFile(fs, fmt.Sprintf("tmp/%d.appmap.json", i), []byte(data), 0755)
+
+		uuid := fmt.Sprintf("uuid-%d", i)
+		expectedUUIDs = append(expectedUUIDs, uuid)
+		mockClient.
+			On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(data)).
+			Return(&appland.ScenarioResponse{UUID: uuid}, nil)
+	}
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: expectedUUIDs}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	cmd := NewUploadCommand(&UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, concurrency: 4}, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 10)
+}
+
+func TestUploadConcurrentlyTimesRetries(t *testing.T) {
+	defer gock.Off()
+
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+	fs.MkdirAll("tmp", 0755)
+	for i := 0; i < 2; i++ {
+		afero.WriteFile(fs, fmt.Sprintf("tmp/%d.appmap.json", i), []byte(validAppmap), 0755)
+	}
+
+	// Whichever AppMap is posted first is asked to retry
+	gock.New("http://example").
+		Post("/api/scenarios").
+		Reply(http.StatusServiceUnavailable).
+		SetHeader("Retry-After", "0")
+	gock.New("http://example").
+		Post("/api/scenarios").
+		Times(2).
+		Reply(http.StatusCreated).
+		JSON(map[string]string{"uuid": "uuid"})
+	gock.New("http://example").
+		Post("/api/mapsets").
+		Reply(http.StatusCreated).
+		JSON(map[string]int{"id": 1, "app_id": 1})
+	api = appland.MakeTestClient()
+
+	// The timings are printed with --bench
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if !assert.Nil(t, err) {
+		return
+	}
+	os.Stdout = w
+	cmd := NewUploadCommand(&UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, concurrency: 2, bench: true}, []metadata.Provider{})
+	err = cmd.RunE(cmd, []string{"tmp"})
+	w.Close()
+	os.Stdout = stdout
+
+	out, _ := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, gock.IsDone())
+	assert.Contains(t, string(out), "retry 1, status 503")
+}
+
+func TestUploadResume(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	uploaded := `{"classMap":[],"events":[],"metadata":{"name":"uploaded"}}`
+	pending := `{"classMap":[],"events":[],"metadata":{"name":"pending"}}`
+	afero.WriteFile(fs, "tmp/a.appmap.json", []byte(uploaded), 0755)
+	afero.WriteFile(fs, "tmp/b.appmap.json", []byte(pending), 0755)
+
+	// Simulate an interrupted upload which had created the first scenario
+	key := config.UploadJournalKey("myorg/myapp", []string{"tmp"})
+	journal := config.CreateUploadJournal(key, config.MapSetParameters{Application: "myorg/myapp", Version: "1.0"})
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(uploaded)))
+	assert.Nil(t, journal.Record("tmp/a.appmap.json", hash, "uuid-a"))
+	journal.Close()
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(pending)).
+		Return(&appland.ScenarioResponse{UUID: "uuid-b"}, nil)
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Version: "1.0", Scenarios: []string{"uuid-a", "uuid-b"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	// Only the upload of the same AppMaps to the same application is resumed,
+	// with the same parameters
+	cmd := NewUploadCommand(&UploadOptions{application: "myorg/other", dontOpenBrowser: true, resume: true}, []metadata.Provider{})
+	err := cmd.RunE(cmd, []string{"tmp"})
+	assert.NotNil(t, err)
+	cmd = NewUploadCommand(&UploadOptions{application: "myorg/myapp", dontOpenBrowser: true, resume: true}, []metadata.Provider{})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp/a.appmap.json"}))
+	cmd = NewUploadCommand(&UploadOptions{application: "myorg/myapp", version: "2.0", dontOpenBrowser: true, resume: true}, []metadata.Provider{})
+	err = cmd.RunE(cmd, []string{"tmp"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `--version 2.0 conflicts with the upload being resumed, which had "1.0"`)
+	mockClient.AssertNotCalled(t, "CreateScenario", mock.Anything, mock.Anything, mock.Anything)
+
+	cmd = NewUploadCommand(&UploadOptions{application: "myorg/myapp", version: "1.0", dontOpenBrowser: true, resume: true}, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+
+	exists, _ := afero.Exists(fs, config.UploadJournalPath(key))
+	assert.False(t, exists)
+}
+
+func TestUploadResumeCreatedMapSet(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "tmp/a.appmap.json", []byte(validAppmap), 0755)
+
+	// Uploads which fail before recording anything leave no journal behind
+	key := config.UploadJournalKey("myorg/myapp", []string{"tmp"})
+	cmd := NewUploadCommand(&UploadOptions{application: "myorg/myapp", dontOpenBrowser: true, branch: "master"}, []metadata.Provider{})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp/missing"}))
+	exists, _ := afero.Exists(fs, config.UploadJournalPath(key))
+	assert.False(t, exists)
+
+	// Simulate an upload which was interrupted after creating the mapset
+	journal := config.CreateUploadJournal(key, config.MapSetParameters{Application: "myorg/myapp"})
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(validAppmap)))
+	assert.Nil(t, journal.Record("tmp/a.appmap.json", hash, "uuid-a"))
+	assert.Nil(t, journal.RecordMapSet(2, 1))
+	journal.Close()
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=2"}).
+		Return("http://example/applications/1?mapset=2")
+
+	cmd = NewUploadCommand(&UploadOptions{application: "myorg/myapp", dontOpenBrowser: true, resume: true}, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNotCalled(t, "CreateScenario", mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "CreateMapSet", mock.Anything)
+
+	exists, _ = afero.Exists(fs, config.UploadJournalPath(key))
+	assert.False(t, exists)
+}
+
+func TestUploadStrictWithFailures(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	good := `{"classMap":[],"events":[],"metadata":{"name":"good"}}`
+	bad := `{"classMap":[],"events":[],"metadata":{"name":"bad"}}`
+	afero.WriteFile(fs, "tmp/a.appmap.json", []byte(good), 0755)
+	afero.WriteFile(fs, "tmp/b.appmap.json", []byte(bad), 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(good)).
+		Return(&appland.ScenarioResponse{UUID: "uuid-a"}, nil)
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(bad)).
+		Return(nil, &appland.HttpError{Status: 422, URL: "http://example/api/scenarios", Body: `{"error":"invalid"}`})
+
+	// no CreateMapSet expectation, the mapset shouldn't be created
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, strict: true, reportPath: "report.json"}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp"}))
+
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Equal(t, []uploadResult{{File: "tmp/a.appmap.json", UUID: "uuid-a"}}, report.Uploaded)
+	assert.Equal(t, []uploadResult{{File: "tmp/b.appmap.json", Status: 422, Error: "Unprocessable Entity", Response: `{"error":"invalid"}`}}, report.Failed)
+}
+
+func TestUploadMaxFailures(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fileName := "example.appmap.json"
+	afero.WriteFile(fs, fileName, []byte(validAppmap), 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmap)).
+		Return(nil, &appland.HttpError{Status: 503})
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	// A single failure is within the threshold
+	cmd := NewUploadCommand(&UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, maxFailures: 1}, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{fileName}))
+}
+
+func TestUploadGzipSizeLimit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+
+	// Over the size limit, but compresses well
+	compressible := `{"events":[` + strings.Repeat(`{"event":"call","defined_class":"Example"},`, 60000) + `{}]}`
+	afero.WriteFile(fs, "tmp/compressible.appmap.json", []byte(compressible), 0755)
+
+	// Over the size limit, even when compressed
+	incompressible := make([]byte, fileSizeLimit+1024)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	afero.WriteFile(fs, "tmp/incompressible.appmap.json", incompressible, 0755)
+
+	mockClient := &MockClient{gzip: true}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), mock.AnythingOfType("string")).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, maxFailures: 1, reportPath: "report.json"}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Len(t, report.Skipped, 1)
+	assert.Equal(t, "tmp/incompressible.appmap.json", report.Skipped[0].File)
+}
+
+func TestUploadPrune(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+
+	// Over the size limit, mostly due to a single frequently called method
+	var events []string
+	for i := 1; i <= 20000; i += 2 {
+		events = append(events,
+			fmt.Sprintf(`{"id":%d,"event":"call","defined_class":"Example","method_id":"noisy","path":"example.rb","lineno":1}`, i),
+			fmt.Sprintf(`{"id":%d,"event":"return","parent_id":%d,"return_value":{"class":"String","value":"%s"}}`, i+1, i, strings.Repeat("x", 100)))
+	}
+	oversized := `{"metadata":{},"events":[` + strings.Join(events, ",") + `]}`
+	afero.WriteFile(fs, "tmp/oversized.appmap.json", []byte(oversized), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), mock.MatchedBy(func(data string) bool {
+			return len(data) <= fileSizeLimit && !strings.Contains(data, `"noisy"`)
+		})).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, strict: true, prune: true}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+}
+
+func TestUploadValidate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+	afero.WriteFile(fs, "tmp/valid.appmap.json", []byte(validAppmap), 0755)
+	afero.WriteFile(fs, "tmp/truncated.appmap.json", []byte(`{"events":[{"id":1,"event":"call"`), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmap)).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	// Skipped AppMaps are missing from the mapset, so they fail a strict
+	// upload
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, strict: true, validate: true, reportPath: "report.json"}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	err := cmd.RunE(cmd, []string{"tmp"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "0 AppMap(s) failed to upload and 1 were skipped")
+	mockClient.AssertNotCalled(t, "CreateMapSet", mock.Anything)
+
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Len(t, report.Skipped, 1)
+	assert.Equal(t, "tmp/truncated.appmap.json", report.Skipped[0].File)
+	assert.Contains(t, report.Skipped[0].Error, "truncated")
+}
+
+func TestUploadScanBlock(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+	afero.WriteFile(fs, "tmp/valid.appmap.json", []byte(validAppmap), 0755)
+	afero.WriteFile(fs, "tmp/login.appmap.json", []byte(scanTestAppmap), 0755)
+	// Streaming stops at the invalid lineno, the password after it is never
+	// scanned for
+	afero.WriteFile(fs, "tmp/malformed.appmap.json", []byte(`{"events":[
+		{"id":1,"event":"call","defined_class":"Session","method_id":"create","lineno":"12"},
+		{"id":2,"event":"call","defined_class":"Session","method_id":"login","parameters":[{"name":"password","class":"String","value":"hunter2"}]}
+	]}`), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmap)).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, maxFailures: 2, reportPath: "report.json"}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Len(t, report.Skipped, 2)
+	assert.Equal(t, "tmp/login.appmap.json", report.Skipped[0].File)
+	assert.Contains(t, report.Skipped[0].Error, "contains 3 secret(s)")
+	assert.Equal(t, "tmp/malformed.appmap.json", report.Skipped[1].File)
+	assert.Contains(t, report.Skipped[1].Error, "can't be scanned for secrets")
+
+	options = &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, scanAction: "warn"}
+	cmd = NewUploadCommand(options, []metadata.Provider{})
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp"}))
+}
+
+func TestUploadScanRedact(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml+`
+scan:
+  action: redact
+  disable: [aws-access-key]
+`), 0755)
+	afero.WriteFile(fs, "tmp/login.appmap.json", []byte(scanTestAppmap), 0755)
+
+	redacted := strings.NewReplacer(
+		`"Bearer abc123"`, `"[REDACTED:auth-header]"`,
+		`"hunter2"`, `"[REDACTED:secret-parameter]"`,
+	).Replace(scanTestAppmap)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(redacted)).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, strict: true}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+}
+
+const transformAppmapYml = appmapYml + `
+scan:
+  disable: [aws-access-key]
+transform:
+- type: drop-headers
+  headers: [authorization]
+- type: redact
+  name: ^password$
+`
+
+func TestUploadTransform(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(transformAppmapYml), 0755)
+	afero.WriteFile(fs, "tmp/login.appmap.json", []byte(scanTestAppmap), 0755)
+
+	// The password is redacted before it's scanned for, so it isn't blocked
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte("jane@example.com"))
+	transformed := strings.NewReplacer(
+		`"Authorization":"Bearer abc123",`, ``,
+		`"hunter2"`, `"[REDACTED]"`,
+		`"jane@example.com"`, fmt.Sprintf(`"sha256:%x"`, mac.Sum(nil)),
+	).Replace(scanTestAppmap)
+
+	mockClient := &MockClient{context: &config.Context{
+		Transform: []config.Transform{{Type: "hash", Name: "^email$", Salt: "salt"}},
+	}}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(transformed)).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, strict: true}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNumberOfCalls(t, "CreateScenario", 1)
+
+	mockClient.context = &config.Context{Transform: []config.Transform{{Type: "hash"}}}
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.context = &config.Context{Transform: []config.Transform{{Type: "encrypt"}}}
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp"}))
+
+	// Hashes must be salted
+	mockClient.context = &config.Context{Transform: []config.Transform{{Type: "hash", Name: "^email$"}}}
+	assert.NotNil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.context = &config.Context{Transform: []config.Transform{{Type: "hash", Name: "^email$", Salt: "$APPLAND_TEST_UNSET_SALT"}}}
+	err := cmd.RunE(cmd, []string{"tmp"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "hash salt $APPLAND_TEST_UNSET_SALT is not set")
+}
+
+func TestUploadDryRun(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "appmap.yml", []byte(transformAppmapYml), 0755)
+	afero.WriteFile(fs, "tmp/login.appmap.json", []byte(scanTestAppmap), 0755)
+	afero.WriteFile(fs, "tmp/valid.appmap.json", []byte(validAppmap), 0755)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	// Nothing is uploaded
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, dryRun: true}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp"}))
+	mockClient.AssertNotCalled(t, "CreateScenario", mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "CreateMapSet", mock.Anything)
+
+	appmapConfig, err := config.LoadAppmapConfig("appmap.yml", "")
+	assert.Nil(t, err)
+	transformers, err := newTransformers(appmapConfig.Transform)
+	assert.Nil(t, err)
+	scanner, err := newSecretScanner(appmapConfig.Scan)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	for _, file := range []string{"tmp/login.appmap.json", "tmp/valid.appmap.json"} {
+		s, err := readScenario(file, util.NewTiming(file), nil, "", sizeLimit{}, false, transformers, scanner)
+		assert.Nil(t, err)
+		assert.Nil(t, s.printPatch(&out))
+	}
+	assert.Equal(t, `tmp/login.appmap.json:
+  {"op":"remove","path":"/events/0/http_server_request/headers/Authorization"}
+  {"op":"replace","path":"/events/1/parameters/0/value","value":"[REDACTED]"}
+tmp/valid.appmap.json:
+  (unchanged)
+`, out.String())
+}
+
+func TestUploadArchive(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"tmp/appmap/minitest/valid.appmap.json":  validAppmap,
+		"tmp/appmap/rspec/truncated.appmap.json": `{"events":[{"id":1,"event":"call"`,
+		"tmp/appmap/rspec/log.txt":               "",
+	} {
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+
+	afero.WriteFile(fs, "appmap.yml", []byte(appmapYml), 0755)
+	afero.WriteFile(fs, "appmaps.tar.gz", archive.Bytes(), 0644)
+
+	mockClient := &MockClient{}
+	api = mockClient
+
+	mockClient.
+		On("CreateScenario", "myorg/myapp", (uint64)(0), jsonMatching(validAppmap)).
+		Return(&appland.ScenarioResponse{UUID: "uuid"}, nil).
+		Once()
+
+	mockClient.
+		On("CreateMapSet", &appland.MapSet{Application: "myorg/myapp", Scenarios: []string{"uuid"}}).
+		Return(&appland.CreateMapSetResponse{ID: 1, AppID: 1}, nil)
+
+	mockClient.
+		On("BuildUrl", []interface{}{"applications", "1?mapset=1"}).
+		Return("http://example/applications/1?mapset=1")
+
+	options := &UploadOptions{appmapPath: "appmap.yml", dontOpenBrowser: true, validate: true, reportPath: "report.json"}
+	cmd := NewUploadCommand(options, []metadata.Provider{})
+	assert.Nil(t, cmd.RunE(cmd, []string{"appmaps.tar.gz"}))
+
+	data, err := afero.ReadFile(fs, "report.json")
+	assert.Nil(t, err)
+
+	report := uploadReport{}
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Len(t, report.Uploaded, 1)
+	assert.Equal(t, "appmaps.tar.gz!/tmp/appmap/minitest/valid.appmap.json", report.Uploaded[0].File)
+	assert.Len(t, report.Skipped, 1)
+	assert.Equal(t, "appmaps.tar.gz!/tmp/appmap/rspec/truncated.appmap.json", report.Skipped[0].File)
+}
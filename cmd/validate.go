@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/applandinc/appland-cli/internal/files"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+type ValidateOptions struct {
+	json          bool
+	root          string
+	skipLocations bool
+	filter        files.Filter
+}
+
+type validationResult struct {
+	File   string                  `json:"file"`
+	Errors appmap.ValidationErrors `json:"errors"`
+}
+
+// locationPattern matches class map locations which refer to a file, as
+// opposed to e.g. native Ruby methods, which are located by name.
+var locationPattern = regexp.MustCompile(`^(.+):(\d+)$`)
+
+// validateLocations reports functions in the class map whose location is a
+// file missing from root. Absolute locations are usually libraries installed
+// on the machine which made the recording, so they're not checked.
+func validateLocations(entries []appmap.ClassMapEntry, path string, root string, errs *appmap.ValidationErrors) {
+	for i := range entries {
+		entry := &entries[i]
+		entryPath := fmt.Sprintf("%s[%d]", path, i)
+
+		if entry.Type == appmap.FunctionType {
+			if match := locationPattern.FindStringSubmatch(entry.Location); match != nil && !filepath.IsAbs(match[1]) {
+				if ok, _ := afero.Exists(config.GetFS(), filepath.Join(root, match[1])); !ok {
+					*errs = append(*errs, &appmap.ValidationError{
+						Path:    entryPath + ".location",
+						Message: fmt.Sprintf("%s doesn't exist", match[1]),
+					})
+				}
+			}
+		}
+
+		validateLocations(entry.Children, entryPath+".children", root, errs)
+	}
+}
+
+// validateAppmap validates the AppMap in fname as it's read, without holding
+// its events in memory. If root is set, class map locations are checked to
+// exist beneath it. The error is only set if the file couldn't be read.
+func validateAppmap(fname string, root string) (appmap.ValidationErrors, error) {
+	f, err := files.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %w", fname, err)
+	}
+	defer f.Close()
+
+	m, err := appmap.ValidateStream(f)
+
+	var errs appmap.ValidationErrors
+	if err != nil && !errors.As(err, &errs) {
+		return nil, fmt.Errorf("failed reading %s: %w", fname, err)
+	}
+
+	if m != nil && root != "" {
+		validateLocations(m.ClassMap, "classMap", root, &errs)
+	}
+
+	return errs, nil
+}
+
+// validationRoot is the directory class map locations are relative to, the
+// directory of appmap.yml if there is one.
+func validationRoot(appmapConfigPath string, fallbackPath string) string {
+	if appmapConfig, err := config.LoadAppmapConfig(appmapConfigPath, fallbackPath); err == nil {
+		return filepath.Dir(appmapConfig.Path())
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		return cwd
+	}
+	return "."
+}
+
+func renderValidation(w io.Writer, asJSON bool, results []validationResult) {
+	if asJSON {
+		j, err := json.Marshal(results)
+		if err == nil {
+			fmt.Fprintln(w, string(j))
+		} else {
+			warn(err)
+		}
+		return
+	}
+
+	for _, result := range results {
+		if len(result.Errors) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s:\n", result.File)
+		for _, err := range result.Errors {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+	}
+}
+
+func NewValidateCommand(options *ValidateOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate [files, directories]",
+		Short: "Check AppMap files for structural errors",
+		Long: `Check AppMap files for structural errors
+
+Reports truncated or malformed JSON, returns without a matching call, duplicate
+event ids, malformed class map entries and class map locations which refer to
+missing files. Errors are reported with the JSON path and event id concerned.
+Exits with a non-zero status if any AppMap is invalid.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fnames, err := files.Find(args, options.filter)
+			if err != nil {
+				return fmt.Errorf("failed finding AppMaps: %w", err)
+			}
+
+			cmd.SilenceUsage = true
+
+			root := ""
+			if !options.skipLocations {
+				root = options.root
+				if root == "" {
+					root = validationRoot("", args[0])
+				}
+			}
+
+			results := make([]validationResult, 0, len(fnames))
+			invalid := 0
+			for _, fname := range fnames {
+				errs, err := validateAppmap(fname, root)
+				if err != nil {
+					return err
+				}
+
+				if errs == nil {
+					errs = appmap.ValidationErrors{}
+				} else {
+					invalid++
+				}
+				results = append(results, validationResult{File: fname, Errors: errs})
+			}
+
+			renderValidation(os.Stdout, options.json, results)
+
+			if invalid > 0 {
+				return fmt.Errorf("%d of %d AppMaps are invalid", invalid, len(fnames))
+			}
+
+			if !options.json {
+				fmt.Printf("%d AppMaps are valid\n", len(fnames))
+			}
+			return nil
+		},
+	}
+}
+
+func init() {
+	var (
+		options     = &ValidateOptions{}
+		validateCmd = NewValidateCommand(options)
+	)
+
+	f := validateCmd.Flags()
+	f.BoolVarP(&options.json, "json", "j", false, "Format results as JSON")
+	f.StringVar(&options.root, "root", "", "Directory class map locations are relative to (defaults to the directory of appmap.yml)")
+	f.BoolVar(&options.skipLocations, "skip-locations", false, "Don't check that class map locations exist")
+	addFilterFlags(f, &options.filter)
+
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateLocations(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+	afero.WriteFile(fs, "test.appmap.json", data, 0644)
+
+	for _, source := range []string{"api_key.rb", "user.rb", "configuration.rb", "org.rb"} {
+		afero.WriteFile(fs, "app/models/"+source, []byte{}, 0644)
+	}
+
+	errs, err := validateAppmap("test.appmap.json", ".")
+	require.Nil(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "classMap[4].children[0].children[0].location", errs[0].Path)
+	assert.Contains(t, errs[0].Message, "app/controllers/users_controller.rb")
+
+	errs, err = validateAppmap("test.appmap.json", "")
+	require.Nil(t, err)
+	assert.Nil(t, errs)
+}
+
+func TestValidateCommand(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	fs.MkdirAll("tmp", 0755)
+	afero.WriteFile(fs, "tmp/valid.appmap.json", []byte(validAppmap), 0644)
+	afero.WriteFile(fs, "tmp/truncated.appmap.json", []byte(`{"events":[{"id":1,"event":"call"`), 0644)
+	afero.WriteFile(fs, "tmp/orphaned.appmap.json", []byte(`{"events":[{"id":1,"event":"return","parent_id":7}]}`), 0644)
+
+	cmd := NewValidateCommand(&ValidateOptions{skipLocations: true})
+	err := cmd.RunE(cmd, []string{"tmp"})
+	require.NotNil(t, err)
+	assert.Equal(t, "2 of 3 AppMaps are invalid", err.Error())
+
+	cmd = NewValidateCommand(&ValidateOptions{skipLocations: true})
+	assert.Nil(t, cmd.RunE(cmd, []string{"tmp/valid.appmap.json"}))
+}
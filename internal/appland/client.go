@@ -2,6 +2,7 @@ package appland
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,20 +10,33 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptrace"
 	"net/textproto"
 	"os"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/applandinc/appland-cli/internal/config"
 	"github.com/applandinc/appland-cli/internal/metadata"
 	"github.com/applandinc/appland-cli/internal/util"
 )
 
+// HttpError is returned when the server responds with an unexpected status.
+// URL and Body are set when the response is worth reporting in full.
 type HttpError struct {
 	Status int
+	URL    string
+	Body   string
+}
+
+func (e *HttpError) Error() string {
+	if e.URL == "" {
+		return http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("%s, got status %d:\n%s", e.URL, e.Status, e.Body)
 }
 
-func (e *HttpError) Error() string { return http.StatusText(e.Status) }
 func (e *HttpError) Is(target error) bool {
 	t, ok := target.(*HttpError)
 	if !ok {
@@ -35,17 +49,22 @@ type Client interface {
 	BuildUrl(paths ...interface{}) string
 	Context() *config.Context
 	CreateMapSet(mapset *MapSet) (*CreateMapSetResponse, error)
-	CreateScenario(org string, mapsetId uint64, scenarioData io.Reader) (*ScenarioResponse, error)
+	CreateScenario(org string, mapsetId uint64, scenarioData io.Reader, timing util.Timing) (*ScenarioResponse, error)
 	GetScenario(id int) (*ScenarioResponse, error)
 	DeleteAPIKey() error
 	Login(login string, password string) error
 	TestAPIKey(apiKey string) (bool, error)
+	UseGzip(enabled bool)
+	GzipEnabled() bool
 }
 
 type clientImpl struct {
 	context    *config.Context
 	httpClient *http.Client
 	timing     util.Timing
+	retry      RetryPolicy
+	sleep      func(time.Duration)
+	gzip       bool
 }
 
 func (client *clientImpl) Context() *config.Context {
@@ -106,29 +125,70 @@ func (mapset *MapSet) WithGitMetadata(git *metadata.Git) *MapSet {
 
 type ScenarioResponse struct {
 	UUID string
+
+	// DataSize is the size of the scenario data, CompressedSize the number of
+	// bytes actually sent if it was compressed.
+	DataSize       int64 `json:"-"`
+	CompressedSize int64 `json:"-"`
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
 }
 
 type benchReader struct {
 	io.Reader
+	timing util.Timing
 }
 
 func (r benchReader) Close() error {
-	util.Time("waiting")
+	timeStep(r.timing, "waiting")
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
 // Note return type of this needs to be the interface.
 // If it's *benchReader and body is nil, a segfault occurs
 // in http for some reason. GO figure.
-func makeBenchReader(body io.Reader) io.Reader {
+func makeBenchReader(body io.Reader, timing util.Timing) io.Reader {
 	if body == nil {
 		return nil
 	}
-	return &benchReader{body}
+	return &benchReader{body, timing}
+}
+
+// timeStep starts a step of timing, or of the current timing through
+// util.Time if it's nil.
+func timeStep(timing util.Timing, name string) {
+	if timing == nil {
+		util.Time(name)
+		return
+	}
+	timing.Start(name)
 }
 
-func newBenchRequest(method, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, makeBenchReader(body))
+func newBenchRequest(method, url string, body io.Reader, timing util.Timing) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, makeBenchReader(body, timing))
 	if err != nil {
 		return nil, err
 	}
@@ -144,8 +204,8 @@ func newBenchRequest(method, url string, body io.Reader) (*http.Request, error)
 	return req, nil
 }
 
-func (client *clientImpl) newAuthRequest(method, url string, body io.Reader) (*http.Request, error) {
-	req, err := newBenchRequest(method, url, body)
+func (client *clientImpl) newAuthRequest(method, url string, body io.Reader, timing util.Timing) (*http.Request, error) {
+	req, err := newBenchRequest(method, url, body, timing)
 	if err != nil {
 		return nil, err
 	}
@@ -156,40 +216,98 @@ func (client *clientImpl) newAuthRequest(method, url string, body io.Reader) (*h
 	return req, nil
 }
 
-func (client *clientImpl) post(url string, body io.Reader) (*http.Response, error) {
-	req, err := client.newAuthRequest(http.MethodPost, url, body)
-	if err != nil {
-		return nil, err
-	}
+// do sends the request built by newRequest, retrying according to the
+// client's RetryPolicy. newRequest is called once per attempt, so it must
+// produce a fresh body each time. Retries are recorded as steps of timing,
+// or of the current timing if it's nil.
+func (client *clientImpl) do(timing util.Timing, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		// Once the headers are written, the server may act on the request
+		// even if the connection fails afterwards.
+		var sent int32
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			WroteHeaders: func() {
+				atomic.StoreInt32(&sent, 1)
+			},
+		}))
+
+		resp, err := client.httpClient.Do(req)
+		if !client.retry.shouldRetry(attempt, req, atomic.LoadInt32(&sent) == 1, resp, err) {
+			if attempt > 1 && (err != nil || retryableStatus(resp.StatusCode)) {
+				timeStep(timing, fmt.Sprintf("failed after %d attempts", attempt))
+			}
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+		}
+
+		delay := client.retry.delay(attempt, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
 
-	return client.httpClient.Do(req)
+		util.Debugf("%s %s failed (%s), retrying in %s\n", req.Method, req.URL, reason, delay)
+		timeStep(timing, fmt.Sprintf("retry %d, %s", attempt, reason))
+		client.sleep(delay)
+	}
 }
 
-func (client *clientImpl) get(url string, body io.Reader) (*http.Response, error) {
-	req, err := client.newAuthRequest(http.MethodGet, url, body)
-	if err != nil {
-		return nil, err
+func bodyReader(body []byte) io.Reader {
+	if body == nil {
+		return nil
 	}
+	return bytes.NewReader(body)
+}
 
-	return client.httpClient.Do(req)
+func (client *clientImpl) send(method, url string, body []byte) (*http.Response, error) {
+	return client.do(nil, func() (*http.Request, error) {
+		return client.newAuthRequest(method, url, bodyReader(body), nil)
+	})
 }
 
-func (client *clientImpl) delete(url string, body io.Reader) (*http.Response, error) {
-	req, err := client.newAuthRequest(http.MethodDelete, url, body)
-	if err != nil {
-		return nil, err
-	}
+func (client *clientImpl) post(url string, body []byte) (*http.Response, error) {
+	return client.send(http.MethodPost, url, body)
+}
+
+func (client *clientImpl) get(url string, body []byte) (*http.Response, error) {
+	return client.send(http.MethodGet, url, body)
+}
 
-	return client.httpClient.Do(req)
+func (client *clientImpl) delete(url string, body []byte) (*http.Response, error) {
+	return client.send(http.MethodDelete, url, body)
 }
 
 func MakeClient(context *config.Context) Client {
 	return &clientImpl{
 		context:    context,
 		httpClient: http.DefaultClient,
+		retry:      NewRetryPolicy(context.GetRetries()),
+		sleep:      time.Sleep,
+		gzip:       context.UseGzip(),
 	}
 }
 
+// UseGzip overrides whether scenario data is compressed, which otherwise
+// depends on the context.
+func (client *clientImpl) UseGzip(enabled bool) {
+	client.gzip = enabled
+}
+
+func (client *clientImpl) GzipEnabled() bool {
+	return client.gzip
+}
+
 func (client *clientImpl) BuildUrl(paths ...interface{}) string {
 	numPaths := len(paths)
 	path := client.context.GetURL()
@@ -206,7 +324,7 @@ func (client *clientImpl) CreateMapSet(mapset *MapSet) (*CreateMapSetResponse, e
 	}
 
 	url := client.BuildUrl("api", "mapsets")
-	resp, err := client.post(url, bytes.NewReader(data))
+	resp, err := client.post(url, data)
 	if err != nil {
 		return nil, err
 	}
@@ -218,7 +336,7 @@ func (client *clientImpl) CreateMapSet(mapset *MapSet) (*CreateMapSetResponse, e
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("%s, got status %d:\n%s", url, resp.StatusCode, string(body))
+		return nil, &HttpError{Status: resp.StatusCode, URL: url, Body: string(body)}
 	}
 
 	responseObj := &CreateMapSetResponse{}
@@ -229,22 +347,52 @@ func (client *clientImpl) CreateMapSet(mapset *MapSet) (*CreateMapSetResponse, e
 	return responseObj, nil
 }
 
+// Reopener is implemented by scenario data which can be read again from the
+// start, allowing CreateScenario to retry a failed upload. Data which
+// implements io.Seeker can be retried as well.
+type Reopener interface {
+	Reopen() error
+}
+
+func rewind(r io.Reader) error {
+	switch v := r.(type) {
+	case Reopener:
+		return v.Reopen()
+	case io.Seeker:
+		_, err := v.Seek(0, io.SeekStart)
+		return err
+	}
+	return fmt.Errorf("scenario data can't be read again")
+}
+
+// message is a multipart message which is written as it's being read, so
+// that the scenario data is streamed rather than buffered.
 type message struct {
-	bytes.Buffer
+	*io.PipeReader
 	contentType string
+	done        chan struct{}
+
+	// Only to be read once the message is closed
+	dataSize       int64
+	compressedSize int64
 }
 
-func scenarioMessage(scenarioData io.Reader, metadata []byte, mapsetId uint64) (*message, error) {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
+// Close stops writing the message and waits until the scenario data is no
+// longer being read from.
+func (m *message) Close() error {
+	m.PipeReader.Close()
+	<-m.done
+	return nil
+}
 
+func (m *message) writeScenario(w *multipart.Writer, scenarioData io.Reader, metadata []byte, mapsetId uint64, compress bool) error {
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Type", "application/json")
 	h.Set("Content-Disposition", "inline; name=\"metadata\"")
 
 	p, err := w.CreatePart(h)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	p.Write(metadata)
 
@@ -255,7 +403,7 @@ func scenarioMessage(scenarioData io.Reader, metadata []byte, mapsetId uint64) (
 
 		p, err := w.CreatePart(h)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		p.Write([]byte(strconv.FormatUint(mapsetId, 10)))
 	}
@@ -263,43 +411,86 @@ func scenarioMessage(scenarioData io.Reader, metadata []byte, mapsetId uint64) (
 	h = make(textproto.MIMEHeader)
 	h.Set("Content-Type", "application/json")
 	h.Set("Content-Disposition", "attachment; filename=\"data\"")
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+	}
 	p, err = w.CreatePart(h)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	_, err = io.Copy(p, scenarioData)
-	if err != nil {
-		return nil, err
+	data := &countingReader{Reader: scenarioData}
+	if compress {
+		compressed := &countingWriter{Writer: p}
+		gz := gzip.NewWriter(compressed)
+		if _, err := io.Copy(gz, data); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		m.compressedSize = compressed.count
+	} else {
+		if _, err := io.Copy(p, data); err != nil {
+			return err
+		}
 	}
+	m.dataSize = data.count
 
-	err = w.Close()
-	if err != nil {
-		return nil, err
+	return w.Close()
+}
+
+func scenarioMessage(scenarioData io.Reader, metadata []byte, mapsetId uint64, compress bool) *message {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	m := &message{
+		PipeReader:  pr,
+		contentType: "multipart/mixed; boundary=\"" + w.Boundary() + "\"",
+		done:        make(chan struct{}),
 	}
 
-	ctype := "multipart/mixed; boundary=\"" + w.Boundary() + "\""
+	go func() {
+		defer close(m.done)
+		pw.CloseWithError(m.writeScenario(w, scenarioData, metadata, mapsetId, compress))
+	}()
 
-	return &message{buf, ctype}, nil
+	return m
 }
 
-func (client *clientImpl) CreateScenario(app string, mapsetId uint64, scenarioData io.Reader) (*ScenarioResponse, error) {
+// CreateScenario uploads scenarioData. The steps of the upload are recorded
+// in timing, or in the current timing if it's nil.
+func (client *clientImpl) CreateScenario(app string, mapsetId uint64, scenarioData io.Reader, timing util.Timing) (*ScenarioResponse, error) {
 	metadata := []byte(fmt.Sprintf(`{ "app": "%s" }`, app))
-	util.Time("generating multipart")
-	message, err := scenarioMessage(scenarioData, metadata, mapsetId)
-	if err != nil {
-		return nil, err
-	}
 
-	util.Time("posting")
+	timeStep(timing, "posting")
 	url := client.BuildUrl("api", "scenarios")
-	req, err := client.newAuthRequest(http.MethodPost, url, message)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", message.contentType)
 
-	resp, err := client.httpClient.Do(req)
+	var message *message
+	defer func() {
+		if message != nil {
+			message.Close()
+		}
+	}()
+
+	resp, err := client.do(timing, func() (*http.Request, error) {
+		if message != nil {
+			// Retrying, the previous attempt must be done reading before the
+			// data can be read again.
+			message.Close()
+			if err := rewind(scenarioData); err != nil {
+				return nil, err
+			}
+		}
+
+		message = scenarioMessage(scenarioData, metadata, mapsetId, client.gzip)
+		req, err := client.newAuthRequest(http.MethodPost, url, message, timing)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", message.contentType)
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -312,7 +503,7 @@ func (client *clientImpl) CreateScenario(app string, mapsetId uint64, scenarioDa
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("%s, got status %d:\n%s", url, resp.StatusCode, string(body))
+		return nil, &HttpError{Status: resp.StatusCode, URL: url, Body: string(body)}
 	}
 
 	responseObj := &ScenarioResponse{}
@@ -320,6 +511,10 @@ func (client *clientImpl) CreateScenario(app string, mapsetId uint64, scenarioDa
 		return nil, err
 	}
 
+	message.Close()
+	responseObj.DataSize = message.dataSize
+	responseObj.CompressedSize = message.compressedSize
+
 	return responseObj, nil
 }
 
@@ -337,7 +532,7 @@ func (client *clientImpl) GetScenario(id int) (*ScenarioResponse, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		httpError := &HttpError{resp.StatusCode}
+		httpError := &HttpError{Status: resp.StatusCode}
 		return nil, fmt.Errorf("GetScenario failed, %w", httpError)
 	}
 
@@ -369,15 +564,16 @@ func (client *clientImpl) Login(login string, password string) error {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(requestData))
-	if err != nil {
-		return err
-	}
-
-	req.SetBasicAuth(login, password)
-	req.Header.Add("Content-Type", "application/json")
+	resp, err := client.do(nil, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(requestData))
+		if err != nil {
+			return nil, err
+		}
 
-	resp, err := client.httpClient.Do(req)
+		req.SetBasicAuth(login, password)
+		req.Header.Add("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
@@ -431,7 +627,7 @@ func (client *clientImpl) TestAPIKey(apiKey string) (bool, error) {
 	// id. If the response is NotFound, the API key is valid. If the
 	// response is Unauthorized, the API key is invalid. Any other
 	// response is an error.
-	testContext := &config.Context{client.context.URL, apiKey}
+	testContext := &config.Context{URL: client.context.URL, APIKey: apiKey, Retries: client.context.Retries}
 	testApi := MakeClient(testContext)
 
 	_, err := testApi.GetScenario(0)
@@ -2,6 +2,7 @@ package appland
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -233,7 +234,7 @@ func TestCreateScenario(t *testing.T) {
 		JSON(map[string]string{"uuid": scenarioUUID})
 
 	client := MakeTestClient()
-	res, err := client.CreateScenario("myapp", 123, strings.NewReader("{}"))
+	res, err := client.CreateScenario("myapp", 123, strings.NewReader("{}"), nil)
 	if err != nil {
 		fmt.Errorf("Error: %s", err)
 	}
@@ -264,7 +265,7 @@ func TestCreateScenarioNilMapset(t *testing.T) {
 		JSON(map[string]string{"uuid": scenarioUUID})
 
 	client := MakeTestClient()
-	res, err := client.CreateScenario("myapp", 0, strings.NewReader("{}"))
+	res, err := client.CreateScenario("myapp", 0, strings.NewReader("{}"), nil)
 	if err != nil {
 		fmt.Errorf("Error: %s", err)
 	}
@@ -306,3 +307,44 @@ func TestCreateMapSet(t *testing.T) {
 	assert.Equal(t, uint32(12345), res.ID)
 	assert.Equal(t, uint32(67890), res.AppID)
 }
+
+func TestCreateScenarioGzip(t *testing.T) {
+	defer gock.Off()
+
+	scenarioUUID := "100582f6-27ba-4a04-a9d6-a634c742076c"
+	scenarioData := `{"events":[` + strings.Repeat(`{"event":"call"},`, 100) + `{}]}`
+
+	matcher := newMultipartMatcher()
+	matcher.Add(func(req *http.Request, _ *gock.Request) (bool, error) {
+		for _, part := range matcher.parts {
+			if part.header.Get("Content-Encoding") != "gzip" {
+				continue
+			}
+
+			gz, err := gzip.NewReader(strings.NewReader(part.body))
+			if err != nil {
+				return false, err
+			}
+			data, err := ioutil.ReadAll(gz)
+			if err != nil {
+				return false, err
+			}
+			return string(data) == scenarioData, nil
+		}
+		return false, nil
+	})
+
+	gock.New(url).
+		Post("/api/scenarios").
+		SetMatcher(matcher).
+		Reply(201).
+		JSON(map[string]string{"uuid": scenarioUUID})
+
+	client := MakeTestClient()
+	client.UseGzip(true)
+	res, err := client.CreateScenario("myapp", 0, strings.NewReader(scenarioData), nil)
+	require.Nil(t, err)
+	assert.Equal(t, scenarioUUID, res.UUID)
+	assert.Equal(t, int64(len(scenarioData)), res.DataSize)
+	assert.True(t, res.CompressedSize > 0 && res.CompressedSize < res.DataSize)
+}
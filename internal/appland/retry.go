@@ -0,0 +1,138 @@
+package appland
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// RetryPolicy describes how many times a failed request is retried and how
+// long to wait between attempts. Delays grow exponentially from BaseDelay
+// with random jitter, and never exceed MaxDelay. A Retry-After header sent by
+// the server takes precedence over the computed delay.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func NewRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: maxRetries,
+		BaseDelay:  defaultRetryBaseDelay,
+		MaxDelay:   defaultRetryMaxDelay,
+	}
+}
+
+// retryableStatus reports whether a response with the given status is likely
+// to succeed if the request is sent again.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// idempotentMethod reports whether sending a request with the given method
+// twice has the same effect as sending it once.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether the outcome of a request warrants another
+// attempt. attempt is the number of requests made so far, sent whether the
+// request reached the server before it failed.
+//
+// Requests which aren't idempotent, such as creating a scenario, may have
+// been carried out even though they failed, so they're only retried if they
+// were never sent, or if the server asks for them to be sent again later.
+func (policy RetryPolicy) shouldRetry(attempt int, req *http.Request, sent bool, resp *http.Response, err error) bool {
+	if attempt > policy.MaxRetries {
+		return false
+	}
+
+	if idempotentMethod(req.Method) {
+		return err != nil || retryableStatus(resp.StatusCode)
+	}
+
+	if err != nil {
+		return !sent
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		_, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return ok
+	}
+	return false
+}
+
+// delay returns how long to wait before making the next attempt.
+func (policy RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return policy.cap(d)
+		}
+	}
+
+	backoff := policy.BaseDelay << uint(attempt-1)
+	if backoff <= 0 {
+		// overflow
+		return policy.MaxDelay
+	}
+	backoff = policy.cap(backoff)
+
+	// Wait at least half of the backoff, the rest is random so that
+	// concurrent clients don't retry in lockstep.
+	half := backoff / 2
+	if half == 0 {
+		return backoff
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func (policy RetryPolicy) cap(d time.Duration) time.Duration {
+	if policy.MaxDelay > 0 && d > policy.MaxDelay {
+		return policy.MaxDelay
+	}
+	return d
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	d := date.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
@@ -0,0 +1,187 @@
+package appland
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
+)
+
+func makeRetryTestClient(maxRetries int, delays *[]time.Duration) Client {
+	client := makeTestClient().(*clientImpl)
+	client.retry = NewRetryPolicy(maxRetries)
+	client.sleep = func(d time.Duration) {
+		*delays = append(*delays, d)
+	}
+	return client
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 11, 11, 10, 0, 0, 0, time.UTC)
+
+	d, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Second, d)
+
+	d, ok = parseRetryAfter("Wed, 11 Nov 2020 10:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d := policy.delay(attempt+1, nil)
+		assert.True(t, d >= max/2 && d <= max, "attempt %d: %s not in [%s, %s]", attempt+1, d, max/2, max)
+	}
+}
+
+func TestCreateScenarioRetriesWithRetryAfter(t *testing.T) {
+	defer gock.Off()
+
+	scenarioUUID := "100582f6-27ba-4a04-a9d6-a634c742076c"
+
+	gock.New(url).
+		Post("/api/scenarios").
+		Reply(http.StatusServiceUnavailable).
+		SetHeader("Retry-After", "7")
+
+	gock.New(url).
+		Post("/api/scenarios").
+		Reply(http.StatusTooManyRequests).
+		SetHeader("Retry-After", "1")
+
+	// The multipart body must be sent in full on the final attempt
+	matcher := newMultipartMatcher()
+	matcher.matchPart(textproto.MIMEHeader{
+		"Content-Disposition": {"attachment; filename=\"data\""},
+	}, "{}")
+	gock.New(url).
+		Post("/api/scenarios").
+		SetMatcher(matcher).
+		MatchHeader("Authorization", "Bearer "+api_key).
+		Reply(201).
+		JSON(map[string]string{"uuid": scenarioUUID})
+
+	delays := []time.Duration{}
+	client := makeRetryTestClient(3, &delays)
+	res, err := client.CreateScenario("myapp", 0, strings.NewReader("{}"), nil)
+	require.Nil(t, err)
+	assert.Equal(t, scenarioUUID, res.UUID)
+	assert.True(t, gock.IsDone())
+
+	assert.Equal(t, []time.Duration{7 * time.Second, time.Second}, delays)
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	defer gock.Off()
+
+	gock.New(url).
+		Get("/api/scenarios/0").
+		Times(3).
+		Reply(http.StatusBadGateway)
+
+	delays := []time.Duration{}
+	client := makeRetryTestClient(2, &delays)
+	_, err := client.GetScenario(0)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, &HttpError{Status: http.StatusBadGateway}))
+	assert.Len(t, delays, 2)
+	assert.True(t, gock.IsDone())
+}
+
+func TestNoRetryOfSentPost(t *testing.T) {
+	defer gock.Off()
+
+	// The mapset may have been created, only the server knows if sending it
+	// again is safe
+	gock.New(url).
+		Post("/api/mapsets").
+		Reply(http.StatusBadGateway)
+	gock.New(url).
+		Post("/api/mapsets").
+		Reply(http.StatusTooManyRequests)
+
+	delays := []time.Duration{}
+	client := makeRetryTestClient(3, &delays)
+	for _, status := range []int{http.StatusBadGateway, http.StatusTooManyRequests} {
+		_, err := client.CreateMapSet(BuildMapSet("myorg/myapp", []string{}))
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), fmt.Sprintf("got status %d", status))
+	}
+	assert.Empty(t, delays)
+	assert.True(t, gock.IsDone())
+}
+
+func TestRetryConnectionFailures(t *testing.T) {
+	// The connection is dropped once the request has been read
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.Nil(t, err)
+		conn.Close()
+	}))
+	defer server.Close()
+
+	makeClient := func(url string, delays *[]time.Duration) Client {
+		client := MakeClient(&config.Context{APIKey: api_key, URL: url}).(*clientImpl)
+		client.retry = NewRetryPolicy(2)
+		client.sleep = func(d time.Duration) {
+			*delays = append(*delays, d)
+		}
+		return client
+	}
+
+	delays := []time.Duration{}
+	client := makeClient(server.URL, &delays)
+	_, err := client.CreateMapSet(BuildMapSet("myorg/myapp", []string{}))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, delays)
+
+	// Idempotent requests are retried
+	_, err = client.GetScenario(0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, requests)
+	assert.Len(t, delays, 2)
+
+	// Requests which were never sent are retried too
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	delays = []time.Duration{}
+	client = makeClient(closed.URL, &delays)
+	_, err = client.CreateMapSet(BuildMapSet("myorg/myapp", []string{}))
+	assert.NotNil(t, err)
+	assert.Len(t, delays, 2)
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	defer gock.Off()
+
+	gock.New(url).
+		Post("/api/mapsets").
+		Reply(http.StatusUnprocessableEntity)
+
+	delays := []time.Duration{}
+	client := makeRetryTestClient(3, &delays)
+	_, err := client.CreateMapSet(BuildMapSet("myorg/myapp", []string{}))
+	require.NotNil(t, err)
+	assert.Empty(t, delays)
+}
@@ -0,0 +1,224 @@
+// Package appmap is a model of the AppMap format, see
+// https://github.com/applandinc/appmap.
+//
+// Fields which aren't part of the model are kept in the Extra field of each
+// type, so that an AppMap which is decoded and encoded again loses nothing.
+package appmap
+
+// AppMap is a recording of the code executed by a program.
+type AppMap struct {
+	Version  string          `json:"version,omitempty"`
+	Metadata Metadata        `json:"metadata"`
+	ClassMap []ClassMapEntry `json:"classMap"`
+	Events   []Event         `json:"events"`
+	Extra    Extra           `json:"-"`
+}
+
+// Metadata describes how and where an AppMap was recorded.
+type Metadata struct {
+	Name         string        `json:"name,omitempty"`
+	App          string        `json:"app,omitempty"`
+	Labels       []string      `json:"labels,omitempty"`
+	Feature      string        `json:"feature,omitempty"`
+	FeatureGroup string        `json:"feature_group,omitempty"`
+	Language     *Language     `json:"language,omitempty"`
+	Frameworks   []Framework   `json:"frameworks,omitempty"`
+	Client       *Client       `json:"client,omitempty"`
+	Recorder     *Recorder     `json:"recorder,omitempty"`
+	Git          *Git          `json:"git,omitempty"`
+	Exception    *Exception    `json:"exception,omitempty"`
+	TestStatus   string        `json:"test_status,omitempty"`
+	Fingerprints []Fingerprint `json:"fingerprints,omitempty"`
+	Extra        Extra         `json:"-"`
+}
+
+type Language struct {
+	Name    string `json:"name"`
+	Engine  string `json:"engine,omitempty"`
+	Version string `json:"version,omitempty"`
+	Extra   Extra  `json:"-"`
+}
+
+type Framework struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Extra   Extra  `json:"-"`
+}
+
+// Client is the agent which made the recording.
+type Client struct {
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`
+	Version string `json:"version,omitempty"`
+	Extra   Extra  `json:"-"`
+}
+
+type Recorder struct {
+	Name  string `json:"name"`
+	Type  string `json:"type,omitempty"`
+	Extra Extra  `json:"-"`
+}
+
+type Git struct {
+	Repository   string   `json:"repository,omitempty"`
+	Branch       string   `json:"branch,omitempty"`
+	Commit       string   `json:"commit,omitempty"`
+	Status       []string `json:"status,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	AnnotatedTag string   `json:"annotated_tag,omitempty"`
+	Extra        Extra    `json:"-"`
+}
+
+type Fingerprint struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+	Extra     Extra  `json:"-"`
+}
+
+// ClassMapEntry is a node of the class map, a tree of the code recorded in
+// the AppMap. Packages contain classes and other packages, classes contain
+// functions.
+type ClassMapEntry struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Location string          `json:"location,omitempty"`
+	Static   bool            `json:"static,omitempty"`
+	Labels   []string        `json:"labels,omitempty"`
+	Comment  string          `json:"comment,omitempty"`
+	Source   string          `json:"source,omitempty"`
+	Children []ClassMapEntry `json:"children,omitempty"`
+	Extra    Extra           `json:"-"`
+}
+
+// ClassMap entry types
+const (
+	PackageType  = "package"
+	ClassType    = "class"
+	FunctionType = "function"
+	HTTPType     = "http"
+	RouteType    = "route"
+	DatabaseType = "database"
+	QueryType    = "query"
+)
+
+// Event kinds
+const (
+	CallEvent   = "call"
+	ReturnEvent = "return"
+)
+
+// Event is a call or a return. Calls are either function calls, identified
+// by DefinedClass and MethodID, or calls of another kind, such as an HTTP
+// request or an SQL query. Returns refer to their call with ParentID.
+type Event struct {
+	ID       int    `json:"id"`
+	Event    string `json:"event"`
+	ThreadID int64  `json:"thread_id,omitempty"`
+
+	DefinedClass string      `json:"defined_class,omitempty"`
+	MethodID     string      `json:"method_id,omitempty"`
+	Path         string      `json:"path,omitempty"`
+	Lineno       int         `json:"lineno,omitempty"`
+	Static       bool        `json:"static,omitempty"`
+	Receiver     *Parameter  `json:"receiver,omitempty"`
+	Parameters   []Parameter `json:"parameters,omitempty"`
+	Message      []Parameter `json:"message,omitempty"`
+
+	HTTPServerRequest *HTTPServerRequest `json:"http_server_request,omitempty"`
+	HTTPClientRequest *HTTPClientRequest `json:"http_client_request,omitempty"`
+	SQLQuery          *SQLQuery          `json:"sql_query,omitempty"`
+
+	ParentID           int                 `json:"parent_id,omitempty"`
+	Elapsed            *float64            `json:"elapsed,omitempty"`
+	ReturnValue        *Parameter          `json:"return_value,omitempty"`
+	Exceptions         []Exception         `json:"exceptions,omitempty"`
+	HTTPServerResponse *HTTPServerResponse `json:"http_server_response,omitempty"`
+	HTTPClientResponse *HTTPClientResponse `json:"http_client_response,omitempty"`
+
+	Extra Extra `json:"-"`
+}
+
+func (e *Event) IsCall() bool {
+	return e.Event == CallEvent
+}
+
+func (e *Event) IsReturn() bool {
+	return e.Event == ReturnEvent
+}
+
+// IsFunctionCall reports whether the event is a call of a function in the
+// class map, as opposed to e.g. an HTTP request or an SQL query.
+func (e *Event) IsFunctionCall() bool {
+	return e.IsCall() && e.DefinedClass != ""
+}
+
+// FunctionName identifies the function called, e.g. Class#method, or
+// Class.method if it's static.
+func (e *Event) FunctionName() string {
+	sep := "#"
+	if e.Static {
+		sep = "."
+	}
+	return e.DefinedClass + sep + e.MethodID
+}
+
+// Parameter is a value passed to or returned from a call. Value is a string
+// representation of the object, usually a string, though some agents record
+// other JSON values.
+type Parameter struct {
+	Name       string      `json:"name,omitempty"`
+	Class      string      `json:"class,omitempty"`
+	Value      interface{} `json:"value"`
+	ObjectID   int64       `json:"object_id,omitempty"`
+	Kind       string      `json:"kind,omitempty"`
+	Size       *int        `json:"size,omitempty"`
+	Properties []Parameter `json:"properties,omitempty"`
+	Extra      Extra       `json:"-"`
+}
+
+type HTTPServerRequest struct {
+	RequestMethod      string            `json:"request_method"`
+	PathInfo           string            `json:"path_info"`
+	NormalizedPathInfo string            `json:"normalized_path_info,omitempty"`
+	Protocol           string            `json:"protocol,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	Extra              Extra             `json:"-"`
+}
+
+type HTTPServerResponse struct {
+	Status   int               `json:"status,omitempty"`
+	MimeType string            `json:"mime_type,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Extra    Extra             `json:"-"`
+}
+
+type HTTPClientRequest struct {
+	RequestMethod string            `json:"request_method"`
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Extra         Extra             `json:"-"`
+}
+
+type HTTPClientResponse struct {
+	Status   int               `json:"status,omitempty"`
+	MimeType string            `json:"mime_type,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Extra    Extra             `json:"-"`
+}
+
+type SQLQuery struct {
+	SQL           string      `json:"sql"`
+	DatabaseType  string      `json:"database_type,omitempty"`
+	ExplainSQL    string      `json:"explain_sql,omitempty"`
+	ServerVersion interface{} `json:"server_version,omitempty"`
+	Extra         Extra       `json:"-"`
+}
+
+type Exception struct {
+	Class    string `json:"class"`
+	Message  string `json:"message,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Lineno   int    `json:"lineno,omitempty"`
+	ObjectID int64  `json:"object_id,omitempty"`
+	Extra    Extra  `json:"-"`
+}
@@ -0,0 +1,202 @@
+package appmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeEncode(t *testing.T) {
+	data, err := ioutil.ReadFile("../../cmd/testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	appmap, err := Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	assert.Equal(t, "appland/AppLand", appmap.Metadata.App)
+	assert.Equal(t, "ruby", appmap.Metadata.Language.Name)
+	assert.Len(t, appmap.Events, 142)
+
+	request := appmap.Events[0]
+	for _, e := range appmap.Events {
+		if e.HTTPServerRequest != nil {
+			request = e
+		}
+	}
+	assert.Equal(t, "/user", request.HTTPServerRequest.PathInfo)
+
+	// Nothing is lost when encoding the AppMap again
+	var buf bytes.Buffer
+	require.Nil(t, Encode(&buf, appmap))
+
+	var expected, actual interface{}
+	require.Nil(t, json.Unmarshal(data, &expected))
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &actual))
+	assert.True(t, reflect.DeepEqual(expected, actual))
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name, appmap string
+		path         string
+		eventID      int
+	}{
+		{"truncated", `{"events":[{"id":1,"event":"call"`, "", 0},
+		{"trailing data", `{"events":[]} {}`, "", 0},
+		{"wrong type", `{"events":[{"id":1,"event":"call","sql_query":{"sql":"SELECT 1"}},{"id":2,"event":"return","parent_id":"1"}]}`, "events[1].parent_id", 2},
+		{"orphaned return", `{"events":[{"id":1,"event":"return","parent_id":7}]}`, "events[0].parent_id", 1},
+		{"duplicate return", `{"events":[{"id":1,"event":"call","sql_query":{"sql":"SELECT 1"}},{"id":2,"event":"return","parent_id":1},{"id":3,"event":"return","parent_id":1}]}`, "events[2].parent_id", 3},
+		{"duplicate id", `{"events":[{"id":1,"event":"call","defined_class":"A","method_id":"a"},{"id":1,"event":"call","defined_class":"A","method_id":"a"}]}`, "events[1].id", 1},
+		{"unknown call", `{"events":[{"id":1,"event":"call"}]}`, "events[0]", 1},
+		{"bad class map", `{"events":[],"classMap":[{"name":"app","type":"package","children":[{"name":"A","type":"klass"}]}]}`, "classMap[0].children[0].type", 0},
+		{"missing events", `{"classMap":[]}`, "events", 0},
+		{"null events", `{"events":null}`, "events", 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(test.appmap))
+			require.NotNil(t, err)
+
+			errs, ok := err.(ValidationErrors)
+			require.True(t, ok, "%v", err)
+			require.Len(t, errs, 1)
+			assert.Equal(t, test.path, errs[0].Path)
+			assert.Equal(t, test.eventID, errs[0].EventID)
+
+			// The same problems are found when streaming
+			_, err = ValidateStream(strings.NewReader(test.appmap))
+			require.NotNil(t, err)
+
+			errs, ok = err.(ValidationErrors)
+			require.True(t, ok, "%v", err)
+			require.Len(t, errs, 1)
+			assert.Equal(t, test.path, errs[0].Path)
+		})
+	}
+
+	_, err := ValidateStream(strings.NewReader(`{"events":[]}`))
+	assert.Nil(t, err)
+}
+
+func TestStream(t *testing.T) {
+	data, err := ioutil.ReadFile("../../cmd/testdata/test.appmap.json")
+	require.Nil(t, err)
+
+	decoded, err := Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	var events []Event
+	appmap, err := Stream(bytes.NewReader(data), func(e *Event) error {
+		events = append(events, *e)
+		return nil
+	})
+	require.Nil(t, err)
+
+	// The events are streamed rather than kept, the rest is the same
+	assert.Nil(t, appmap.Events)
+	assert.True(t, reflect.DeepEqual(decoded.Events, events))
+	decoded.Events = nil
+	assert.True(t, reflect.DeepEqual(decoded, appmap))
+
+	stop := errors.New("stop")
+	count := 0
+	_, err = Stream(bytes.NewReader(data), func(e *Event) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, count)
+}
+
+// callRecorder records the calls and returns notified by CallStacks.
+type callRecorder struct {
+	calls   []string
+	returns []string
+}
+
+func (r *callRecorder) Call(e *Event, stack []Frame) interface{} {
+	caller := "top"
+	if len(stack) > 0 {
+		caller = stack[len(stack)-1].Value.(string)
+	}
+	r.calls = append(r.calls, caller+">"+e.MethodID)
+	return e.MethodID
+}
+
+func (r *callRecorder) Return(ret *Event, call *Frame) {
+	returned := call.Value.(string)
+	if ret == nil {
+		returned += " (no return)"
+	} else if ret.Elapsed != nil {
+		returned += fmt.Sprintf(" %g self %g", *ret.Elapsed, call.SelfTime(*ret.Elapsed))
+	}
+	r.returns = append(r.returns, returned)
+}
+
+func TestCallStacks(t *testing.T) {
+	r := &callRecorder{}
+	_, err := StreamCalls(strings.NewReader(`{"events":[
+		{"id":1,"event":"call","thread_id":1,"method_id":"a"},
+		{"id":2,"event":"call","thread_id":2,"method_id":"b"},
+		{"id":3,"event":"call","thread_id":1,"method_id":"c"},
+		{"id":4,"event":"call","thread_id":1,"method_id":"d"},
+		{"id":5,"event":"return","thread_id":1,"parent_id":4,"elapsed":0.5},
+		{"id":6,"event":"call","thread_id":1,"method_id":"e"},
+		{"id":7,"event":"return","thread_id":1,"parent_id":3,"elapsed":2},
+		{"id":8,"event":"return","thread_id":1,"parent_id":99,"elapsed":1},
+		{"id":9,"event":"call","thread_id":1,"method_id":"f"},
+		{"id":10,"event":"return","thread_id":2,"parent_id":2,"elapsed":0.25}
+	]}`), r)
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{"top>a", "top>b", "a>c", "c>d", "c>e", "a>f"}, r.calls)
+	assert.Equal(t, []string{
+		"d 0.5 self 0.5",
+		// e is missing its return, it's unwound when c returns
+		"e (no return)",
+		"c 2 self 1.5",
+		"b 0.25 self 0.25",
+		// Calls still open at the end, by thread and innermost first
+		"f (no return)",
+		"a (no return)",
+	}, r.returns)
+
+	// Calls don't carry over to the next AppMap
+	r = &callRecorder{}
+	s := NewCallStacks(r)
+	s.Add(&Event{ID: 1, Event: CallEvent, ThreadID: 1, MethodID: "a"})
+	s.Finish()
+	s.Add(&Event{ID: 1, Event: CallEvent, ThreadID: 1, MethodID: "b"})
+	assert.Equal(t, []string{"top>a", "top>b"}, r.calls)
+	assert.Equal(t, []string{"a (no return)"}, r.returns)
+}
+
+func TestStreamInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name, appmap string
+		path         string
+	}{
+		{"truncated", `{"events":[{"id":1,"event":"call"`, ""},
+		{"trailing data", `{"events":[]} {}`, ""},
+		{"not an object", `[]`, ""},
+		{"events not an array", `{"events":{}}`, "events"},
+		{"wrong type", `{"events":[{"id":1,"event":"call"},{"id":2,"event":"return","parent_id":"1"}]}`, "events[1].parent_id"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Stream(strings.NewReader(test.appmap), func(e *Event) error { return nil })
+			require.NotNil(t, err)
+
+			errs, ok := err.(ValidationErrors)
+			require.True(t, ok, "%v", err)
+			require.Len(t, errs, 1)
+			assert.Equal(t, test.path, errs[0].Path)
+		})
+	}
+}
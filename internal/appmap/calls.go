@@ -0,0 +1,116 @@
+package appmap
+
+import (
+	"io"
+	"sort"
+)
+
+// Frame is a call which hasn't returned yet, on the stack of its thread.
+type Frame struct {
+	// ID is the id of the call event.
+	ID int
+	// Value is what the CallVisitor returned for the call.
+	Value interface{}
+	// ChildTime is the elapsed time of the calls made by this one which have
+	// returned so far, in seconds.
+	ChildTime float64
+}
+
+// SelfTime is the time spent in the call itself if it took elapsed seconds,
+// excluding the calls it made. Clocks aren't precise enough for children to
+// never appear to take longer than their caller, so it's never negative.
+func (f *Frame) SelfTime(elapsed float64) float64 {
+	if self := elapsed - f.ChildTime; self > 0 {
+		return self
+	}
+	return 0
+}
+
+// CallVisitor is notified of the calls and returns of AppMaps by CallStacks.
+type CallVisitor interface {
+	// Call is notified of a call made by the innermost call of stack, or at
+	// the top of its thread if stack is empty, and returns the Value of its
+	// frame. The frames may be modified, but stack mustn't be kept.
+	Call(e *Event, stack []Frame) interface{}
+	// Return is notified of the return of a call. Calls left without a
+	// return are notified with a nil ret, once a call they were made beneath
+	// returns or the AppMap ends.
+	Return(ret *Event, call *Frame)
+}
+
+// CallStacks pairs the calls of AppMaps with their returns as the events are
+// read, so that they needn't be held in memory. Only the calls which haven't
+// returned yet are kept, on a stack per thread.
+type CallStacks struct {
+	visitor CallVisitor
+	stacks  map[int64][]Frame
+}
+
+func NewCallStacks(visitor CallVisitor) *CallStacks {
+	return &CallStacks{visitor: visitor, stacks: make(map[int64][]Frame)}
+}
+
+// Add adds the next event of an AppMap.
+func (s *CallStacks) Add(e *Event) {
+	stack := s.stacks[e.ThreadID]
+
+	if e.IsCall() {
+		value := s.visitor.Call(e, stack)
+		s.stacks[e.ThreadID] = append(stack, Frame{ID: e.ID, Value: value})
+		return
+	}
+	if !e.IsReturn() {
+		return
+	}
+
+	// Unwind to the call being returned from, in case some calls are missing
+	// their returns.
+	for j := len(stack) - 1; j >= 0; j-- {
+		if stack[j].ID != e.ParentID {
+			continue
+		}
+
+		for k := len(stack) - 1; k > j; k-- {
+			s.visitor.Return(nil, &stack[k])
+		}
+		s.visitor.Return(e, &stack[j])
+		if e.Elapsed != nil && j > 0 {
+			stack[j-1].ChildTime += *e.Elapsed
+		}
+		s.stacks[e.ThreadID] = stack[:j]
+		return
+	}
+}
+
+// Finish ends an AppMap, notifying the calls which haven't returned, by
+// thread and innermost first. Calls don't carry over to the next AppMap.
+func (s *CallStacks) Finish() {
+	threads := make([]int64, 0, len(s.stacks))
+	for thread := range s.stacks {
+		threads = append(threads, thread)
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i] < threads[j] })
+
+	for _, thread := range threads {
+		stack := s.stacks[thread]
+		for k := len(stack) - 1; k >= 0; k-- {
+			s.visitor.Return(nil, &stack[k])
+		}
+	}
+	s.stacks = make(map[int64][]Frame)
+}
+
+// StreamCalls streams the events of the AppMap read from r like Stream,
+// notifying visitor of its calls and returns.
+func StreamCalls(r io.Reader, visitor CallVisitor) (*AppMap, error) {
+	s := NewCallStacks(visitor)
+	m, err := Stream(r, func(e *Event) error {
+		s.Add(e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Finish()
+	return m, nil
+}
@@ -0,0 +1,249 @@
+package appmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ValidationError is a structural problem with an AppMap. Path is the JSON
+// path of the offending value, e.g. events[12].parent_id. EventID is the id
+// of the event concerned, if any.
+type ValidationError struct {
+	Path    string `json:"path"`
+	EventID int    `json:"event_id,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.EventID != 0 {
+		return fmt.Sprintf("%s (event %d): %s", e.Path, e.EventID, e.Message)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return e.Message
+}
+
+// ValidationErrors are all the problems found in an AppMap.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", errs[0].Error(), len(errs)-1)
+}
+
+// Decode reads an AppMap from r and validates it. If the AppMap could be
+// decoded but isn't valid, it's returned along with ValidationErrors, so
+// that lenient callers can still make use of it.
+func Decode(r io.Reader) (*AppMap, error) {
+	// The decoder would buffer the whole AppMap anyway, having it at hand
+	// allows locating type errors.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	appmap := &AppMap{}
+	if err := dec.Decode(appmap); err != nil {
+		return nil, decodeError(data, err)
+	}
+
+	// Only whitespace may follow the AppMap.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ValidationErrors{{Message: fmt.Sprintf("unexpected data after the AppMap at offset %d", dec.InputOffset())}}
+	}
+
+	if errs := appmap.Validate(); len(errs) > 0 {
+		return appmap, errs
+	}
+
+	return appmap, nil
+}
+
+// decodeError describes a JSON error in terms of the AppMap.
+func decodeError(data []byte, err error) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF:
+		return ValidationErrors{{Message: "unexpected end of file, the AppMap is truncated"}}
+	case errors.As(err, &syntaxErr):
+		return ValidationErrors{{Message: fmt.Sprintf("invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}}
+	case errors.As(err, &typeErr):
+		path, eventID := locateTypeError(data, typeErr.Field)
+		return ValidationErrors{{
+			Path:    path,
+			EventID: eventID,
+			Message: fmt.Sprintf("expected %s, found %s", typeErr.Type, typeErr.Value),
+		}}
+	}
+
+	return err
+}
+
+// locateTypeError finds the event or class map entry a type error occurred
+// in. The error itself only knows the field within the object being decoded,
+// because each object is decoded on its own.
+func locateTypeError(data []byte, field string) (string, int) {
+	var doc map[string]json.RawMessage
+	if json.Unmarshal(data, &doc) != nil {
+		return field, 0
+	}
+
+	var events []json.RawMessage
+	if json.Unmarshal(doc["events"], &events) == nil {
+		for i, data := range events {
+			if json.Unmarshal(data, &Event{}) != nil {
+				var id struct {
+					ID int `json:"id"`
+				}
+				json.Unmarshal(data, &id)
+				return fmt.Sprintf("events[%d].%s", i, field), id.ID
+			}
+		}
+	}
+
+	var classMap []json.RawMessage
+	if json.Unmarshal(doc["classMap"], &classMap) == nil {
+		for i, data := range classMap {
+			if json.Unmarshal(data, &ClassMapEntry{}) != nil {
+				return fmt.Sprintf("classMap[%d].%s", i, field), 0
+			}
+		}
+	}
+
+	if json.Unmarshal(doc["metadata"], &Metadata{}) != nil {
+		return "metadata." + field, 0
+	}
+
+	return field, 0
+}
+
+// Validate checks the structure of the AppMap: that events have unique ids,
+// that each return refers to an earlier call which hasn't already returned,
+// that calls say what was called, and that class map entries are well
+// formed.
+func (a *AppMap) Validate() ValidationErrors {
+	v := newValidator()
+	for i := range a.Events {
+		v.add(&a.Events[i])
+	}
+	return v.finish(a, a.Events != nil)
+}
+
+// validator validates the events of an AppMap one at a time, so that they
+// needn't all be held in memory. Only their ids are kept.
+type validator struct {
+	errs     ValidationErrors
+	index    int
+	calls    map[int]bool
+	returned map[int]bool
+	seen     map[int]bool
+}
+
+func newValidator() *validator {
+	return &validator{calls: map[int]bool{}, returned: map[int]bool{}, seen: map[int]bool{}}
+}
+
+func (v *validator) error(path string, eventID int, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{Path: path, EventID: eventID, Message: fmt.Sprintf(format, args...)})
+}
+
+// add validates the next event.
+func (v *validator) add(e *Event) {
+	path := fmt.Sprintf("events[%d]", v.index)
+	v.index++
+
+	if e.ID <= 0 {
+		v.error(path+".id", e.ID, "must be a positive integer")
+	} else if v.seen[e.ID] {
+		v.error(path+".id", e.ID, "duplicate id")
+	}
+	v.seen[e.ID] = true
+
+	switch e.Event {
+	case CallEvent:
+		v.calls[e.ID] = true
+		if e.DefinedClass == "" && e.HTTPServerRequest == nil && e.HTTPClientRequest == nil && e.SQLQuery == nil {
+			v.error(path, e.ID, "call has neither defined_class, http_server_request, http_client_request nor sql_query")
+		} else if e.DefinedClass != "" && e.MethodID == "" {
+			v.error(path+".method_id", e.ID, "missing")
+		}
+	case ReturnEvent:
+		switch {
+		case e.ParentID == 0:
+			v.error(path+".parent_id", e.ID, "missing")
+		case !v.calls[e.ParentID]:
+			v.error(path+".parent_id", e.ID, "no call with id %d precedes this return", e.ParentID)
+		case v.returned[e.ParentID]:
+			v.error(path+".parent_id", e.ID, "call %d has already returned", e.ParentID)
+		}
+		v.returned[e.ParentID] = true
+	default:
+		v.error(path+".event", e.ID, "expected call or return, found %q", e.Event)
+	}
+}
+
+// finish validates the rest of the AppMap once its events have been added,
+// returning all of the problems found, or nil if there are none.
+func (v *validator) finish(a *AppMap, hasEvents bool) ValidationErrors {
+	errs := ValidationErrors{}
+	if !hasEvents {
+		errs = append(errs, &ValidationError{Path: "events", Message: "missing"})
+	}
+	errs = append(errs, v.errs...)
+
+	validateClassMap(a.ClassMap, "classMap", &errs)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateClassMap(entries []ClassMapEntry, path string, errs *ValidationErrors) {
+	for i := range entries {
+		entry := &entries[i]
+		entryPath := fmt.Sprintf("%s[%d]", path, i)
+
+		if entry.Name == "" {
+			*errs = append(*errs, &ValidationError{Path: entryPath + ".name", Message: "missing"})
+		}
+
+		switch entry.Type {
+		case PackageType, ClassType, HTTPType, RouteType, DatabaseType, QueryType:
+		case FunctionType:
+			if len(entry.Children) > 0 {
+				*errs = append(*errs, &ValidationError{Path: entryPath + ".children", Message: "functions can't have children"})
+			}
+		default:
+			*errs = append(*errs, &ValidationError{Path: entryPath + ".type", Message: fmt.Sprintf("unknown type %q", entry.Type)})
+		}
+
+		validateClassMap(entry.Children, entryPath+".children", errs)
+	}
+}
+
+// Encode writes an AppMap to w as compact JSON.
+func Encode(w io.Writer, appmap *AppMap) error {
+	data, err := appmap.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
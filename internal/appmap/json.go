@@ -0,0 +1,325 @@
+package appmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Extra holds the fields of a JSON object which aren't part of the model.
+type Extra map[string]json.RawMessage
+
+// knownFields caches the JSON field names of each type.
+var knownFields sync.Map
+
+func fieldNames(t reflect.Type) map[string]bool {
+	if names, ok := knownFields.Load(t); ok {
+		return names.(map[string]bool)
+	}
+
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names[name] = true
+	}
+
+	knownFields.Store(t, names)
+	return names
+}
+
+// unmarshal decodes an object into v, a pointer to a struct without
+// json.Unmarshaler methods, and returns the fields v doesn't know about.
+// Numbers in untyped fields are decoded as json.Number, so they're encoded
+// again exactly as they were.
+func unmarshal(data []byte, v interface{}) (Extra, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	known := fieldNames(reflect.TypeOf(v).Elem())
+	var extra Extra
+	for name, value := range fields {
+		if known[name] {
+			continue
+		}
+		if extra == nil {
+			extra = Extra{}
+		}
+		extra[name] = value
+	}
+
+	return extra, nil
+}
+
+// marshal encodes v, a struct without json.Marshaler methods, adding the
+// extra fields after the known ones.
+func marshal(v interface{}, extra Extra) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if len(extra) == 0 {
+		return data, nil
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Drop the closing brace, and add the extra fields.
+	data = data[:len(data)-1]
+	for _, name := range names {
+		if len(data) > 1 {
+			data = append(data, ',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, key...)
+		data = append(data, ':')
+		data = append(data, extra[name]...)
+	}
+
+	return append(data, '}'), nil
+}
+
+// withField returns a copy of extra with an additional field, for required
+// fields which would otherwise be omitted because they're empty.
+func withField(extra Extra, name string, value string) Extra {
+	fields := Extra{name: json.RawMessage(value)}
+	for name, value := range extra {
+		fields[name] = value
+	}
+	return fields
+}
+
+func (a *AppMap) UnmarshalJSON(data []byte) (err error) {
+	type plain AppMap
+	a.Extra, err = unmarshal(data, (*plain)(a))
+	return
+}
+
+func (a AppMap) MarshalJSON() ([]byte, error) {
+	type plain AppMap
+	return marshal(plain(a), a.Extra)
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) (err error) {
+	type plain Metadata
+	m.Extra, err = unmarshal(data, (*plain)(m))
+	return
+}
+
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	type plain Metadata
+	return marshal(plain(m), m.Extra)
+}
+
+func (l *Language) UnmarshalJSON(data []byte) (err error) {
+	type plain Language
+	l.Extra, err = unmarshal(data, (*plain)(l))
+	return
+}
+
+func (l Language) MarshalJSON() ([]byte, error) {
+	type plain Language
+	return marshal(plain(l), l.Extra)
+}
+
+func (f *Framework) UnmarshalJSON(data []byte) (err error) {
+	type plain Framework
+	f.Extra, err = unmarshal(data, (*plain)(f))
+	return
+}
+
+func (f Framework) MarshalJSON() ([]byte, error) {
+	type plain Framework
+	return marshal(plain(f), f.Extra)
+}
+
+func (c *Client) UnmarshalJSON(data []byte) (err error) {
+	type plain Client
+	c.Extra, err = unmarshal(data, (*plain)(c))
+	return
+}
+
+func (c Client) MarshalJSON() ([]byte, error) {
+	type plain Client
+	return marshal(plain(c), c.Extra)
+}
+
+func (r *Recorder) UnmarshalJSON(data []byte) (err error) {
+	type plain Recorder
+	r.Extra, err = unmarshal(data, (*plain)(r))
+	return
+}
+
+func (r Recorder) MarshalJSON() ([]byte, error) {
+	type plain Recorder
+	return marshal(plain(r), r.Extra)
+}
+
+func (g *Git) UnmarshalJSON(data []byte) (err error) {
+	type plain Git
+	g.Extra, err = unmarshal(data, (*plain)(g))
+	return
+}
+
+func (g Git) MarshalJSON() ([]byte, error) {
+	type plain Git
+	return marshal(plain(g), g.Extra)
+}
+
+func (f *Fingerprint) UnmarshalJSON(data []byte) (err error) {
+	type plain Fingerprint
+	f.Extra, err = unmarshal(data, (*plain)(f))
+	return
+}
+
+func (f Fingerprint) MarshalJSON() ([]byte, error) {
+	type plain Fingerprint
+	return marshal(plain(f), f.Extra)
+}
+
+func (c *ClassMapEntry) UnmarshalJSON(data []byte) (err error) {
+	type plain ClassMapEntry
+	c.Extra, err = unmarshal(data, (*plain)(c))
+	return
+}
+
+func (c ClassMapEntry) MarshalJSON() ([]byte, error) {
+	type plain ClassMapEntry
+
+	// static is required for functions, even when it's false.
+	extra := c.Extra
+	if c.Type == FunctionType && !c.Static {
+		extra = withField(c.Extra, "static", "false")
+	}
+
+	return marshal(plain(c), extra)
+}
+
+func (e *Event) UnmarshalJSON(data []byte) (err error) {
+	type plain Event
+	e.Extra, err = unmarshal(data, (*plain)(e))
+	return
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+
+	// static and parameters are required for function calls, even when
+	// they're empty.
+	extra := e.Extra
+	if e.IsFunctionCall() {
+		if !e.Static {
+			extra = withField(extra, "static", "false")
+		}
+		if len(e.Parameters) == 0 {
+			extra = withField(extra, "parameters", "[]")
+		}
+	}
+
+	return marshal(plain(e), extra)
+}
+
+func (p *Parameter) UnmarshalJSON(data []byte) (err error) {
+	type plain Parameter
+	p.Extra, err = unmarshal(data, (*plain)(p))
+	return
+}
+
+func (p Parameter) MarshalJSON() ([]byte, error) {
+	type plain Parameter
+	return marshal(plain(p), p.Extra)
+}
+
+func (r *HTTPServerRequest) UnmarshalJSON(data []byte) (err error) {
+	type plain HTTPServerRequest
+	r.Extra, err = unmarshal(data, (*plain)(r))
+	return
+}
+
+func (r HTTPServerRequest) MarshalJSON() ([]byte, error) {
+	type plain HTTPServerRequest
+	return marshal(plain(r), r.Extra)
+}
+
+func (r *HTTPServerResponse) UnmarshalJSON(data []byte) (err error) {
+	type plain HTTPServerResponse
+	r.Extra, err = unmarshal(data, (*plain)(r))
+	return
+}
+
+func (r HTTPServerResponse) MarshalJSON() ([]byte, error) {
+	type plain HTTPServerResponse
+	return marshal(plain(r), r.Extra)
+}
+
+func (r *HTTPClientRequest) UnmarshalJSON(data []byte) (err error) {
+	type plain HTTPClientRequest
+	r.Extra, err = unmarshal(data, (*plain)(r))
+	return
+}
+
+func (r HTTPClientRequest) MarshalJSON() ([]byte, error) {
+	type plain HTTPClientRequest
+	return marshal(plain(r), r.Extra)
+}
+
+func (r *HTTPClientResponse) UnmarshalJSON(data []byte) (err error) {
+	type plain HTTPClientResponse
+	r.Extra, err = unmarshal(data, (*plain)(r))
+	return
+}
+
+func (r HTTPClientResponse) MarshalJSON() ([]byte, error) {
+	type plain HTTPClientResponse
+	return marshal(plain(r), r.Extra)
+}
+
+func (q *SQLQuery) UnmarshalJSON(data []byte) (err error) {
+	type plain SQLQuery
+	q.Extra, err = unmarshal(data, (*plain)(q))
+	return
+}
+
+func (q SQLQuery) MarshalJSON() ([]byte, error) {
+	type plain SQLQuery
+	return marshal(plain(q), q.Extra)
+}
+
+func (e *Exception) UnmarshalJSON(data []byte) (err error) {
+	type plain Exception
+	e.Extra, err = unmarshal(data, (*plain)(e))
+	return
+}
+
+func (e Exception) MarshalJSON() ([]byte, error) {
+	type plain Exception
+	return marshal(plain(e), e.Extra)
+}
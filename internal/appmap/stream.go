@@ -0,0 +1,168 @@
+package appmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stream reads an AppMap from r, calling fn with each of its events in turn
+// rather than holding them all in memory. The AppMap is returned without its
+// events once they've all been read. Streaming stops at the first error
+// returned by fn, which is returned as is.
+//
+// Unlike Decode, Stream doesn't validate the AppMap, see ValidateStream.
+func Stream(r io.Reader, fn func(e *Event) error) (*AppMap, error) {
+	appmap, _, err := stream(r, fn)
+	return appmap, err
+}
+
+// ValidateStream reads an AppMap from r and validates it like Decode, one
+// event at a time. The AppMap is returned without its events, along with
+// ValidationErrors if it could be read but isn't valid.
+func ValidateStream(r io.Reader) (*AppMap, error) {
+	v := newValidator()
+	appmap, hasEvents, err := stream(r, func(e *Event) error {
+		v.add(e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := v.finish(appmap, hasEvents); len(errs) > 0 {
+		return appmap, errs
+	}
+	return appmap, nil
+}
+
+// stream implements Stream, also returning whether the AppMap has events,
+// even if there are none.
+func stream(r io.Reader, fn func(e *Event) error) (*AppMap, bool, error) {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, false, streamError(err, "", -1)
+	}
+
+	// The other fields are small in comparison, they're decoded together once
+	// the events have been streamed.
+	var (
+		rest      bytes.Buffer
+		hasEvents bool
+	)
+	rest.WriteByte('{')
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, false, streamError(err, "", -1)
+		}
+		key, _ := token.(string)
+
+		if key == "events" {
+			var err error
+			if hasEvents, err = streamEvents(dec, fn); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false, streamError(err, key, -1)
+		}
+		if rest.Len() > 1 {
+			rest.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		rest.Write(name)
+		rest.WriteByte(':')
+		rest.Write(value)
+	}
+	rest.WriteByte('}')
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, false, streamError(err, "", -1)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false, ValidationErrors{{Message: fmt.Sprintf("unexpected data after the AppMap at offset %d", dec.InputOffset())}}
+	}
+
+	appmap := &AppMap{}
+	if err := json.Unmarshal(rest.Bytes(), appmap); err != nil {
+		return nil, false, decodeError(rest.Bytes(), err)
+	}
+	return appmap, hasEvents, nil
+}
+
+// streamEvents decodes the elements of the events array one at a time,
+// returning whether there is an array, rather than null.
+func streamEvents(dec *json.Decoder, fn func(e *Event) error) (bool, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return false, streamError(err, "events", -1)
+	}
+	if token == nil {
+		return false, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return false, ValidationErrors{{Path: "events", Message: fmt.Sprintf("expected an array, found %v", token)}}
+	}
+
+	for i := 0; dec.More(); i++ {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			return false, streamError(err, "events", i)
+		}
+		if err := fn(&e); err != nil {
+			return false, err
+		}
+	}
+
+	if err := expectDelim(dec, ']'); err != nil {
+		return false, streamError(err, "events", -1)
+	}
+	return true, nil
+}
+
+func expectDelim(dec *json.Decoder, expected json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return ValidationErrors{{Message: fmt.Sprintf("invalid JSON at offset %d: expected %v, found %v", dec.InputOffset(), expected, token)}}
+	}
+	return nil
+}
+
+// streamError describes a JSON error met while streaming, within the field
+// at path, and the event at index if it's not negative.
+func streamError(err error, path string, index int) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF:
+		return ValidationErrors{{Message: "unexpected end of file, the AppMap is truncated"}}
+	case errors.As(err, &syntaxErr):
+		return ValidationErrors{{Message: fmt.Sprintf("invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error())}}
+	case errors.As(err, &typeErr):
+		if index >= 0 {
+			path = fmt.Sprintf("%s[%d]", path, index)
+		}
+		if typeErr.Field != "" {
+			path += "." + typeErr.Field
+		}
+		return ValidationErrors{{
+			Path:    path,
+			Message: fmt.Sprintf("expected %s, found %s", typeErr.Type, typeErr.Value),
+		}}
+	}
+
+	return err
+}
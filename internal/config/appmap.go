@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path"
@@ -8,6 +9,7 @@ import (
 	util "github.com/applandinc/appland-cli/internal/util"
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 const appmapYaml = "appmap.yml"
@@ -15,6 +17,10 @@ const appmapYaml = "appmap.yml"
 type AppMapConfig struct {
 	Application string          `yaml:"name"`
 	Packages    []AppMapPackage `yaml:"packages"`
+	Rules       []AppMapRule    `yaml:"rules"`
+	Scan        AppMapScan      `yaml:"scan"`
+	Transform   []Transform     `yaml:"transform"`
+	path        string
 }
 
 type AppMapPackage struct {
@@ -22,6 +28,65 @@ type AppMapPackage struct {
 	Exclude []string `yaml:"exclude"`
 }
 
+// AppMapRule forbids code from calling other code, SQL queries or HTTP
+// requests. Caller and Callee are matched like the paths of packages, or are
+// sql or http.
+type AppMapRule struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Caller      string `yaml:"caller"`
+	Callee      string `yaml:"callee"`
+	// Transitive forbids the callee from being called anywhere beneath the
+	// caller, rather than by the caller itself.
+	Transitive bool `yaml:"transitive"`
+}
+
+// AppMapScan configures the scanning of AppMaps for secrets and personal data,
+// in addition to the built-in rules.
+type AppMapScan struct {
+	// Action is what upload does with AppMaps containing secrets, block or
+	// redact.
+	Action string           `yaml:"action"`
+	Rules  []AppMapScanRule `yaml:"rules"`
+	// Enable lists the built-in rules finding personal data, such as email
+	// addresses and card numbers, which are applied. They're off by default.
+	Enable []string `yaml:"enable"`
+	// Disable lists the built-in rules which aren't applied.
+	Disable []string `yaml:"disable"`
+	// Allowlist is regular expressions matching values which aren't secret,
+	// even though a rule matches them.
+	Allowlist []string `yaml:"allowlist"`
+}
+
+// AppMapScanRule finds secrets with regular expressions. Value matches the
+// secrets within values, Name matches the names of parameters and headers
+// whose value is secret. If both are set, both must match.
+type AppMapScanRule struct {
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	Value       string `yaml:"value"`
+	Name        string `yaml:"name"`
+}
+
+// Transform configures one of the transformers AppMaps are passed through
+// when they're uploaded: redact, hash, drop-headers or strip-paths.
+type Transform struct {
+	Type string `yaml:"type"`
+	// Class and Name are regular expressions selecting the parameters and
+	// return values redacted or hashed by their class and name. If both are
+	// set, both must match.
+	Class string `yaml:"class,omitempty"`
+	Name  string `yaml:"name,omitempty"`
+	// Salt is mixed into hashes, so they can't be reversed by hashing likely
+	// values. It may name an environment variable, e.g. $APPMAP_SALT.
+	Salt string `yaml:"salt,omitempty"`
+	// Headers are the HTTP request headers dropped, or all of them if there
+	// are none.
+	Headers []string `yaml:"headers,omitempty"`
+	// Prefix is the path prefix stripped, the working directory by default.
+	Prefix string `yaml:"prefix,omitempty"`
+}
+
 func loadAppmapConfig(path string) (*AppMapConfig, error) {
 	data, err := afero.ReadFile(GetFS(), path)
 	if err != nil {
@@ -33,6 +98,7 @@ func loadAppmapConfig(path string) (*AppMapConfig, error) {
 		return nil, err
 	}
 
+	appmapConfig.path = path
 	return appmapConfig, nil
 }
 
@@ -69,3 +135,105 @@ func LoadAppmapConfig(overridePath string, fallbackPath string) (*AppMapConfig,
 
 	return nil, fmt.Errorf("could not locate %s", appmapYaml)
 }
+
+// Path returns the location of the file the config was loaded from.
+func (c *AppMapConfig) Path() string {
+	return c.path
+}
+
+// SaveExcludes writes the exclude lists of the packages back to the file the
+// config was loaded from. Everything else in the file, including comments and
+// the order of keys, is kept.
+func (c *AppMapConfig) SaveExcludes() error {
+	fs := GetFS()
+	info, err := fs.Stat(c.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := afero.ReadFile(fs, c.path)
+	if err != nil {
+		return err
+	}
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return fmt.Errorf("%s: expected a mapping", c.path)
+	}
+
+	packages := mappingValue(doc.Content[0], "packages")
+	if packages == nil || packages.Kind != yamlv3.SequenceNode {
+		return fmt.Errorf("%s: no packages", c.path)
+	}
+
+	// The packages were decoded in order, so they match the nodes by index.
+	for i, node := range packages.Content {
+		if i >= len(c.Packages) {
+			break
+		}
+		if node.Kind == yamlv3.MappingNode {
+			setExcludes(node, c.Packages[i].Exclude)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	return afero.WriteFile(fs, c.path, buf.Bytes(), info.Mode())
+}
+
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setExcludes replaces the exclude list of a package node. Entries which are
+// kept retain their comments.
+func setExcludes(node *yamlv3.Node, excludes []string) {
+	existing := mappingValue(node, "exclude")
+	if existing == nil && len(excludes) == 0 {
+		return
+	}
+
+	entries := map[string]*yamlv3.Node{}
+	if existing != nil {
+		for _, entry := range existing.Content {
+			entries[entry.Value] = entry
+		}
+	}
+
+	seq := &yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+	for _, exclude := range excludes {
+		entry, ok := entries[exclude]
+		if !ok {
+			entry = &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: exclude}
+		}
+		seq.Content = append(seq.Content, entry)
+	}
+
+	if existing != nil {
+		seq.HeadComment = existing.HeadComment
+		seq.LineComment = existing.LineComment
+		seq.FootComment = existing.FootComment
+		*existing = *seq
+		return
+	}
+
+	key := &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: "exclude"}
+	node.Content = append(node.Content, key, seq)
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sampleAppmapConfigData = []byte(`# Recorded by the functional tests
+name: Jenkins
+packages:
+  - path: hudson
+    exclude:
+      - hudson.util.Iterators # very noisy
+  # Security
+  - path: org.acegisecurity.context
+  - path: jenkins
+language: java
+`)
+
+func TestSaveExcludes(t *testing.T) {
+	SetFileSystem(afero.NewMemMapFs())
+	require.Nil(t, afero.WriteFile(fs, "appmap.yml", sampleAppmapConfigData, 0644))
+
+	appmapConfig, err := LoadAppmapConfig("appmap.yml", "")
+	require.Nil(t, err)
+	assert.Equal(t, "appmap.yml", appmapConfig.Path())
+
+	appmapConfig.Packages[0].Exclude = append(appmapConfig.Packages[0].Exclude, "hudson.util.AdaptedIterator")
+	appmapConfig.Packages[2].Exclude = []string{"jenkins.model.Jenkins"}
+	require.Nil(t, appmapConfig.SaveExcludes())
+
+	data, err := afero.ReadFile(fs, "appmap.yml")
+	require.Nil(t, err)
+
+	assert.Equal(t, `# Recorded by the functional tests
+name: Jenkins
+packages:
+  - path: hudson
+    exclude:
+      - hudson.util.Iterators # very noisy
+      - hudson.util.AdaptedIterator
+  # Security
+  - path: org.acegisecurity.context
+  - path: jenkins
+    exclude:
+      - jenkins.model.Jenkins
+language: java
+`, string(data))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
@@ -16,13 +17,19 @@ type Config struct {
 }
 
 type Context struct {
-	URL    string `yaml:"url"`
-	APIKey string `yaml:"api_key"`
+	URL     string `yaml:"url"`
+	APIKey  string `yaml:"api_key"`
+	Retries *int   `yaml:"retries,omitempty"`
+	Gzip    bool   `yaml:"gzip,omitempty"`
+	// Transform is applied to AppMaps uploaded with the context, after the
+	// transformers of appmap.yml.
+	Transform []Transform `yaml:"transform,omitempty"`
 }
 
 const (
 	applandFilename    string = ".appland"
 	defaultContextName string = "default"
+	defaultRetries     int    = 3
 )
 
 var (
@@ -227,6 +234,40 @@ func (context *Context) GetURL() string {
 	return ResolveValue(context.URL)
 }
 
+// GetRetries returns how many times a failed API request should be retried.
+func (context *Context) GetRetries() int {
+	if retries := os.Getenv("APPLAND_RETRIES"); retries != "" {
+		if n, err := strconv.Atoi(retries); err == nil && n >= 0 {
+			return n
+		}
+		fmt.Fprintf(os.Stderr, "warn: ignoring invalid APPLAND_RETRIES value '%s'\n", retries)
+	}
+
+	if context.Retries == nil {
+		return defaultRetries
+	}
+
+	return *context.Retries
+}
+
+// UseGzip reports whether AppMaps should be compressed when they're
+// uploaded.
+func (context *Context) UseGzip() bool {
+	return context.Gzip
+}
+
+func (context *Context) SetGzip(enabled bool) {
+	context.Gzip = enabled
+
+	makeDirty()
+}
+
+func (context *Context) SetRetries(retries int) {
+	context.Retries = &retries
+
+	makeDirty()
+}
+
 func (context *Context) SetAPIKey(apiKey string) {
 	if IsEnvironmentVariable(context.APIKey) {
 		return
@@ -267,6 +308,18 @@ func (context *Context) SetVariable(key, value string) error {
 		context.SetURL(value)
 	case "api_key":
 		context.SetAPIKey(key)
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("retries must be a non-negative integer")
+		}
+		context.SetRetries(retries)
+	case "gzip":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("gzip must be true or false")
+		}
+		context.SetGzip(enabled)
 	case "name":
 		name, err := context.GetName()
 		if err != nil {
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+const uploadJournalFilename = ".appland-upload-journal"
+
+// MapSetParameters are the options an upload was started with, kept so that
+// a resumed upload creates the same mapset.
+type MapSetParameters struct {
+	Application string `json:"app"`
+	MapsetID    uint64 `json:"mapset_id,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Environment string `json:"environment,omitempty"`
+}
+
+// JournalEntry records a scenario which has been created from a file.
+type JournalEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	UUID string `json:"uuid"`
+}
+
+// JournalMapSet records the mapset created once the scenarios were uploaded.
+type JournalMapSet struct {
+	ID    uint32 `json:"id"`
+	AppID uint32 `json:"app_id"`
+}
+
+// journalLine is any of the lines following the MapSetParameters.
+type journalLine struct {
+	JournalEntry
+	MapSet *JournalMapSet `json:"mapset,omitempty"`
+}
+
+// UploadJournal keeps track of the scenarios created by an upload, so that an
+// interrupted upload can be resumed. Each upload has its own journal, stored
+// next to the CLI config as JSON lines: the first line holds the
+// MapSetParameters, each of the following lines a JournalEntry, or the
+// JournalMapSet once it's created. It's only ever appended to, so an entry is
+// either written in full or (if the process is killed mid-write) ignored.
+type UploadJournal struct {
+	Parameters MapSetParameters
+	// MapSet is the mapset created by the upload being resumed, if it was
+	// interrupted after creating it.
+	MapSet  *JournalMapSet
+	key     string
+	entries map[string]JournalEntry
+	file    afero.File
+	mutex   sync.Mutex
+}
+
+// UploadJournalKey identifies the journal of an upload of paths to an
+// application, whatever the order of the paths, so that uploads of other
+// AppMaps, or to other applications, don't discard each other's journals.
+func UploadJournalKey(application string, paths []string) string {
+	cleaned := make([]string, len(paths))
+	for i, p := range paths {
+		cleaned[i] = filepath.Clean(p)
+	}
+	sort.Strings(cleaned)
+
+	// Encoded as JSON, so that the key can't be made up of other paths
+	data, _ := json.Marshal(append([]string{application}, cleaned...))
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%x", hash[:8])
+}
+
+// UploadJournalPath returns the location of the journal of the upload
+// identified by key.
+func UploadJournalPath(key string) string {
+	return path.Join(path.Dir(configPath), uploadJournalFilename+"-"+key)
+}
+
+// CreateUploadJournal starts a new journal for the upload identified by key.
+// The journal is only written once there is something to record, replacing
+// any previous one, so that uploads which fail early leave nothing behind.
+func CreateUploadJournal(key string, parameters MapSetParameters) *UploadJournal {
+	return &UploadJournal{
+		Parameters: parameters,
+		key:        key,
+		entries:    map[string]JournalEntry{},
+	}
+}
+
+// ResumeUploadJournal opens the journal left behind by the interrupted upload
+// identified by key.
+func ResumeUploadJournal(key string) (*UploadJournal, error) {
+	journalPath := UploadJournalPath(key)
+	data, err := afero.ReadFile(GetFS(), journalPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("there is no interrupted upload of these AppMaps to this application to resume")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading upload journal: %w", err)
+	}
+
+	journal := &UploadJournal{
+		key:     key,
+		entries: map[string]JournalEntry{},
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("upload journal %s is empty", journalPath)
+	}
+
+	if err := json.Unmarshal(scanner.Bytes(), &journal.Parameters); err != nil {
+		return nil, fmt.Errorf("failed reading upload journal %s: %w", journalPath, err)
+	}
+
+	for scanner.Scan() {
+		var line journalLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			// A partially written entry, the scenario will be uploaded again.
+			continue
+		}
+		if line.MapSet != nil {
+			journal.MapSet = line.MapSet
+			continue
+		}
+		journal.entries[line.Path] = line.JournalEntry
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading upload journal %s: %w", journalPath, err)
+	}
+
+	journal.file, err = GetFS().OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening upload journal: %w", err)
+	}
+
+	// Make sure a partially written entry doesn't swallow the next one.
+	if data[len(data)-1] != '\n' {
+		if _, err := journal.file.Write([]byte{'\n'}); err != nil {
+			journal.file.Close()
+			return nil, fmt.Errorf("failed writing upload journal: %w", err)
+		}
+	}
+
+	return journal, nil
+}
+
+// RemoveUploadJournal deletes the journal of the upload identified by key,
+// once it has completed.
+func RemoveUploadJournal(key string) error {
+	err := GetFS().Remove(UploadJournalPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeLine appends v to the journal, creating it first if need be. It must
+// be called with journal.mutex held.
+func (journal *UploadJournal) writeLine(v interface{}) error {
+	if journal.file == nil {
+		file, err := GetFS().OpenFile(UploadJournalPath(journal.key), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed creating upload journal: %w", err)
+		}
+		journal.file = file
+
+		if err := journal.writeLine(journal.Parameters); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := journal.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed writing upload journal: %w", err)
+	}
+
+	return journal.file.Sync()
+}
+
+// Lookup returns the UUID of the scenario created from the file at path, if
+// the file's content hasn't changed since.
+func (journal *UploadJournal) Lookup(path, hash string) (string, bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry, ok := journal.entries[path]
+	if !ok || entry.Hash != hash {
+		return "", false
+	}
+
+	return entry.UUID, true
+}
+
+// Record adds a created scenario to the journal. It's safe for concurrent
+// use.
+func (journal *UploadJournal) Record(path, hash, uuid string) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	entry := JournalEntry{Path: path, Hash: hash, UUID: uuid}
+	journal.entries[path] = entry
+
+	return journal.writeLine(entry)
+}
+
+// RecordMapSet adds the mapset created once the scenarios were uploaded to
+// the journal, so that resuming the upload doesn't create it again.
+func (journal *UploadJournal) RecordMapSet(id, appID uint32) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.MapSet = &JournalMapSet{ID: id, AppID: appID}
+	return journal.writeLine(struct {
+		MapSet *JournalMapSet `json:"mapset"`
+	}{journal.MapSet})
+}
+
+func (journal *UploadJournal) Close() error {
+	if journal.file == nil {
+		return nil
+	}
+	return journal.file.Close()
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeUploadJournal(t *testing.T) {
+	SetFileSystem(afero.NewMemMapFs())
+	configPath = ".appland"
+
+	params := MapSetParameters{Application: "myorg/myapp", Branch: "master"}
+	key := UploadJournalKey(params.Application, []string{"tmp/appmap"})
+	journal := CreateUploadJournal(key, params)
+	require.Nil(t, journal.Record("a.appmap.json", "hash-a", "uuid-a"))
+	require.Nil(t, journal.Record("b.appmap.json", "hash-b", "uuid-b"))
+	journal.Close()
+
+	// An entry cut short by an interrupted write is ignored
+	f, err := fs.OpenFile(UploadJournalPath(key), os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	f.Write([]byte(`{"path":"c.appmap.json","ha`))
+	f.Close()
+
+	// Another upload doesn't discard the journal, nor does a new one of the
+	// same AppMaps until it records something
+	other := CreateUploadJournal(UploadJournalKey("myorg/other", []string{"tmp/appmap"}), MapSetParameters{Application: "myorg/other"})
+	require.Nil(t, other.Record("a.appmap.json", "hash-a", "uuid-other"))
+	other.Close()
+	require.Nil(t, CreateUploadJournal(key, params).Close())
+
+	journal, err = ResumeUploadJournal(key)
+	require.Nil(t, err)
+	defer journal.Close()
+
+	assert := assert.New(t)
+	assert.Equal(params, journal.Parameters)
+
+	uuid, ok := journal.Lookup("a.appmap.json", "hash-a")
+	assert.True(ok)
+	assert.Equal("uuid-a", uuid)
+
+	_, ok = journal.Lookup("b.appmap.json", "changed")
+	assert.False(ok)
+
+	_, ok = journal.Lookup("c.appmap.json", "hash-c")
+	assert.False(ok)
+	assert.Nil(journal.MapSet)
+
+	// The mapset is recorded once it's created
+	require.Nil(t, journal.RecordMapSet(2, 1))
+	journal.Close()
+	journal, err = ResumeUploadJournal(key)
+	require.Nil(t, err)
+	assert.Equal(&JournalMapSet{ID: 2, AppID: 1}, journal.MapSet)
+	_, ok = journal.Lookup("b.appmap.json", "hash-b")
+	assert.True(ok)
+}
+
+func TestResumeWithoutUploadJournal(t *testing.T) {
+	SetFileSystem(afero.NewMemMapFs())
+	configPath = ".appland"
+
+	_, err := ResumeUploadJournal(UploadJournalKey("myorg/myapp", []string{"tmp/appmap"}))
+	assert.NotNil(t, err)
+}
+
+func TestUploadJournalKey(t *testing.T) {
+	key := UploadJournalKey("myorg/myapp", []string{"a", "tmp/appmap/"})
+	assert.Equal(t, key, UploadJournalKey("myorg/myapp", []string{"./tmp/appmap", "a"}))
+	assert.NotEqual(t, key, UploadJournalKey("myorg/other", []string{"a", "tmp/appmap"}))
+	assert.NotEqual(t, key, UploadJournalKey("myorg/myapp", []string{"a"}))
+	assert.NotEqual(t, key, UploadJournalKey("myorg/myapp", []string{"a\ntmp/appmap"}))
+}
@@ -0,0 +1,510 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+)
+
+// AppMaps in archives, and read from stdin, are found at virtual paths made
+// of the path of the archive, "!" and the path of the entry, e.g.
+// appmaps.tar.gz!/tmp/appmap/login.appmap.json. A single AppMap read from
+// stdin is found at <stdin>. Only the entries' location is held in memory,
+// they're read from the archive each time they're opened. Entries which can't
+// be read back from where they came from, because they're compressed as a
+// whole or read from stdin, are spooled to a temporary file until Cleanup.
+const (
+	// StdinPath is the path which reads from stdin.
+	StdinPath = "-"
+
+	stdinName         = "<stdin>"
+	archiveSeparator  = "!"
+	virtualSeparator  = archiveSeparator + "/"
+	tarMagicOffset    = 257
+	appmapSuffix      = ".appmap.json"
+	maxStdinPeekBytes = tarMagicOffset + 5
+	spoolPattern      = "appland-archive-"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+	tarMagic  = []byte("ustar")
+)
+
+// Stdin is read when StdinPath is given to FindAppMaps.
+var Stdin io.Reader = os.Stdin
+
+var (
+	// archives holds the directories of the archives which have been read,
+	// their ignore files, and an empty placeholder for each of their AppMaps.
+	archives = afero.NewMemMapFs()
+	// archiveEntries are the AppMaps in archives, by virtual path.
+	archiveEntries = map[string]*archiveEntry{}
+	// spools are the temporary files entries have been copied to, by the
+	// virtual directory of their archive.
+	spools = map[string]string{}
+)
+
+// archiveEntry is where the data of an AppMap in an archive is found.
+type archiveEntry struct {
+	// source is the archive, or the spool, the data is in.
+	source string
+	offset int64
+	// size is the size of the data in source, which is compressed if method
+	// is zip.Deflate.
+	size   int64
+	method uint16
+	info   entryInfo
+}
+
+// entryInfo describes an AppMap in an archive, in place of its placeholder.
+type entryInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi entryInfo) Name() string       { return fi.name }
+func (fi entryInfo) Size() int64        { return fi.size }
+func (fi entryInfo) Mode() os.FileMode  { return 0644 }
+func (fi entryInfo) ModTime() time.Time { return fi.modTime }
+func (fi entryInfo) IsDir() bool        { return false }
+func (fi entryInfo) Sys() interface{}   { return nil }
+
+// entryReader reads an entry, closing the archive it's read from with it.
+type entryReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *entryReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (e *archiveEntry) open() (io.ReadCloser, error) {
+	f, err := config.GetFS().Open(e.source)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &entryReader{Reader: io.NewSectionReader(f, e.offset, e.size), closers: []io.Closer{f}}
+	if e.method == zip.Deflate {
+		fr := flate.NewReader(r.Reader)
+		r.Reader = fr
+		r.closers = append([]io.Closer{fr}, r.closers...)
+	}
+	return r, nil
+}
+
+// countingReader counts the bytes read, to locate the entries of a tar.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Cleanup removes the temporary files entries were spooled to. AppMaps in
+// archives can't be opened afterwards.
+func Cleanup() error {
+	for root := range spools {
+		if err := removeArchive(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeArchive forgets the entries of an archive which has been read before,
+// removing their spool.
+func removeArchive(root string) error {
+	if err := archives.RemoveAll(root); err != nil {
+		return err
+	}
+	for name := range archiveEntries {
+		if name == root || strings.HasPrefix(name, root+"/") {
+			delete(archiveEntries, name)
+		}
+	}
+
+	spool, ok := spools[root]
+	if !ok {
+		return nil
+	}
+	delete(spools, root)
+	if err := config.GetFS().Remove(spool); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// newSpool creates the temporary file the entries of the archive at the
+// virtual path root are copied to.
+func newSpool(root string) (afero.File, error) {
+	spool, err := afero.TempFile(config.GetFS(), "", spoolPattern)
+	if err != nil {
+		return nil, err
+	}
+	spools[root] = spool.Name()
+	return spool, nil
+}
+
+// isArchive reports whether path is an archive AppMaps can be read from,
+// judging by its extension.
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitVirtual splits a virtual path into the path of the archive and the
+// path of the entry within it.
+func splitVirtual(name string) (archive string, entry string, ok bool) {
+	if name == stdinName {
+		return stdinName, "", true
+	}
+
+	i := strings.Index(name, virtualSeparator)
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+len(virtualSeparator):], true
+}
+
+// Origin returns the path on disk an AppMap found by FindAppMaps was read
+// from: the archive for an AppMap in an archive, or the current directory for
+// one read from stdin. Other paths are returned as is, even if they look like
+// virtual paths.
+func Origin(name string) string {
+	if _, ok := archiveEntries[name]; !ok {
+		return name
+	}
+
+	archive, _, _ := splitVirtual(name)
+	if archive == stdinName {
+		return "."
+	}
+	return archive
+}
+
+// Open opens an AppMap found by FindAppMaps, which may be in an archive.
+func Open(name string) (io.ReadCloser, error) {
+	if e, ok := archiveEntries[name]; ok {
+		return e.open()
+	}
+	return config.GetFS().Open(name)
+}
+
+// Stat describes an AppMap found by FindAppMaps, which may be in an archive.
+func Stat(name string) (os.FileInfo, error) {
+	if e, ok := archiveEntries[name]; ok {
+		return e.info, nil
+	}
+	return config.GetFS().Stat(name)
+}
+
+// ReadFile reads an AppMap found by FindAppMaps, which may be in an archive.
+func ReadFile(name string) ([]byte, error) {
+	f, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// entryPath returns the virtual path of an archive entry, if it's an AppMap
+// or an ignore file.
+func entryPath(root string, name string) (string, bool) {
+	// Entries can't escape the root of the archive
+	name = path.Clean("/" + filepath.ToSlash(name))
+
+	base := path.Base(name)
+	if !strings.HasSuffix(base, appmapSuffix) && base != ignoreFilename {
+		return "", false
+	}
+	return root + archiveSeparator + name, true
+}
+
+// addEntry lists an archive entry. Ignore files are read from r and held in
+// memory, AppMaps are left where e locates them. Each of its parents is
+// created explicitly, so that they're all listed as directories.
+func addEntry(name string, e *archiveEntry, r io.Reader) error {
+	root, entry, _ := splitVirtual(name)
+	dir := root + archiveSeparator
+	for _, part := range strings.Split(path.Dir("/"+entry), "/") {
+		dir = path.Join(dir, part)
+		if err := archives.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	if path.Base(name) == ignoreFilename {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	} else {
+		archiveEntries[name] = e
+	}
+
+	if err := afero.WriteFile(archives, name, data, 0644); err != nil {
+		return err
+	}
+	return archives.Chtimes(name, e.info.modTime, e.info.modTime)
+}
+
+// readTar lists the entries of the tar read from r, which is the file at
+// source. If spool isn't nil, r can't be read again, so the AppMaps are
+// copied to spool instead.
+func readTar(root string, source string, r io.Reader, spool afero.File) error {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	var spooled int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name, ok := entryPath(root, header.Name)
+		if !ok {
+			continue
+		}
+
+		e := &archiveEntry{
+			source: source,
+			offset: cr.n,
+			size:   header.Size,
+			info:   entryInfo{name: path.Base(name), size: header.Size, modTime: header.ModTime},
+		}
+		if spool != nil && path.Base(name) != ignoreFilename {
+			e.source, e.offset = spool.Name(), spooled
+			if _, err := io.Copy(spool, tr); err != nil {
+				return err
+			}
+			spooled += header.Size
+		}
+
+		if err := addEntry(name, e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip lists the entries of the zip at source. Their data is read back
+// from source, so only entries which are stored or deflated are supported.
+func readZip(root string, source string, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		name, ok := entryPath(root, file.Name)
+		if !ok {
+			continue
+		}
+		if file.Method != zip.Store && file.Method != zip.Deflate {
+			return fmt.Errorf("%s: %w", file.Name, zip.ErrAlgorithm)
+		}
+
+		offset, err := file.DataOffset()
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			source: source,
+			offset: offset,
+			size:   int64(file.CompressedSize64),
+			method: file.Method,
+			info:   entryInfo{name: path.Base(name), size: int64(file.UncompressedSize64), modTime: file.Modified},
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = addEntry(name, e, entry)
+		entry.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArchiveFile lists the entries of the archive at path, returning the
+// virtual directory they're found in.
+func readArchiveFile(name string) (string, error) {
+	f, err := config.GetFS().Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	root := filepath.Clean(name)
+	if err := removeArchive(root + archiveSeparator); err != nil {
+		return "", err
+	}
+	if err := archives.MkdirAll(root+archiveSeparator, 0755); err != nil {
+		return "", err
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		err = readZip(root, name, f, fi.Size())
+	case strings.HasSuffix(lower, ".tar"):
+		err = readTar(root, name, f, nil)
+	default:
+		err = spoolTar(root, f)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed reading %s: %w", name, err)
+	}
+	return root + archiveSeparator, nil
+}
+
+// spoolTar lists the entries of the gzipped tar read from r, spooling its
+// AppMaps.
+func spoolTar(root string, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	spool, err := newSpool(root + archiveSeparator)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	return readTar(root, spool.Name(), gz, spool)
+}
+
+// readStdin reads an archive or a single AppMap from Stdin, telling them apart
+// by their content. It returns the virtual path of the AppMap, or of the
+// directory the entries of the archive are found in.
+func readStdin() (string, error) {
+	if err := removeArchive(stdinName); err != nil {
+		return "", err
+	}
+	if err := removeArchive(stdinName + archiveSeparator); err != nil {
+		return "", err
+	}
+
+	br := bufio.NewReaderSize(Stdin, maxStdinPeekBytes)
+	if magic, _ := br.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		// zip needs random access, so the whole archive is spooled
+		if err := archives.MkdirAll(stdinName+archiveSeparator, 0755); err != nil {
+			return "", err
+		}
+		if err := spoolZip(br); err != nil {
+			return "", fmt.Errorf("failed reading stdin: %w", err)
+		}
+		return stdinName + archiveSeparator, nil
+	}
+
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", fmt.Errorf("failed reading stdin: %w", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReaderSize(gz, maxStdinPeekBytes)
+	}
+
+	if magic, _ := br.Peek(maxStdinPeekBytes); len(magic) == maxStdinPeekBytes && bytes.Equal(magic[tarMagicOffset:], tarMagic) {
+		if err := archives.MkdirAll(stdinName+archiveSeparator, 0755); err != nil {
+			return "", err
+		}
+		spool, err := newSpool(stdinName + archiveSeparator)
+		if err != nil {
+			return "", err
+		}
+		defer spool.Close()
+
+		if err := readTar(stdinName, spool.Name(), br, spool); err != nil {
+			return "", fmt.Errorf("failed reading stdin: %w", err)
+		}
+		return stdinName + archiveSeparator, nil
+	}
+
+	spool, err := newSpool(stdinName)
+	if err != nil {
+		return "", err
+	}
+	defer spool.Close()
+
+	size, err := io.Copy(spool, br)
+	if err != nil {
+		return "", fmt.Errorf("failed reading stdin: %w", err)
+	}
+	e := &archiveEntry{source: spool.Name(), size: size, info: entryInfo{name: stdinName, size: size, modTime: time.Now()}}
+	archiveEntries[stdinName] = e
+	if err := afero.WriteFile(archives, stdinName, nil, 0644); err != nil {
+		return "", err
+	}
+	return stdinName, nil
+}
+
+// spoolZip lists the entries of the zip read from r, once it's been spooled.
+func spoolZip(r io.Reader) error {
+	spool, err := newSpool(stdinName + archiveSeparator)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+	return readZip(stdinName, spool.Name(), spool, size)
+}
@@ -1,6 +1,8 @@
 package files
 
 import (
+	"bufio"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,8 +11,20 @@ import (
 	"github.com/spf13/afero"
 )
 
+const ignoreFilename = ".applandignore"
+
 type Validator func(fi os.FileInfo) bool
 
+// Filter selects the AppMaps found in directories. Patterns are globs
+// matched against the path of a file relative to the directory given to
+// FindAppMaps. A pattern without a slash matches the file name at any depth,
+// and ** matches any number of directories. Exclude patterns which match a
+// directory skip it entirely. Files given explicitly aren't filtered.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
 func validateFile(fi os.FileInfo, validators []Validator) (valid bool) {
 	valid = true
 	for _, v := range validators {
@@ -21,41 +35,266 @@ func validateFile(fi os.FileInfo, validators []Validator) (valid bool) {
 	return
 }
 
-func loadDirectory(dirName string, scenarioFiles []string, validators []Validator) ([]string, error) {
-	files, err := afero.ReadDir(config.GetFS(), dirName)
+// finder walks directories looking for AppMaps.
+type finder struct {
+	fs         afero.Fs
+	include    []*pattern
+	exclude    []*pattern
+	validators []Validator
+	visited    map[string]bool
+	files      []string
+}
+
+// realPath resolves symlinks, so that a directory reached through different
+// paths is only visited once. Only the OS file system has symlinks.
+func (f *finder) realPath(path string) string {
+	if _, ok := f.fs.(*afero.OsFs); !ok {
+		return filepath.Clean(path)
+	}
+
+	real, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		return nil, err
+		return filepath.Clean(path)
+	}
+	if abs, err := filepath.Abs(real); err == nil {
+		return abs
 	}
+	return real
+}
+
+func matchAny(patterns []*pattern, relPath string, isDir bool) bool {
+	for _, p := range patterns {
+		if p.match(relPath, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDirectory adds the AppMaps in dirName and its subdirectories. relDir
+// is the path of dirName relative to the directory the search started from,
+// ignores are the .applandignore rules of the parent directories.
+func (f *finder) loadDirectory(dirName string, relDir string, ignores []*pattern) error {
+	real := f.realPath(dirName)
+	if f.visited[real] {
+		// Either a symlink loop, or a directory which has already been
+		// searched through another path.
+		return nil
+	}
+	f.visited[real] = true
+
+	ignores, err := f.loadIgnores(dirName, relDir, ignores)
+	if err != nil {
+		return err
+	}
+
+	entries, err := afero.ReadDir(f.fs, dirName)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		path := filepath.Join(dirName, fi.Name())
+		relPath := filepath.ToSlash(filepath.Join(relDir, fi.Name()))
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = f.fs.Stat(path); err != nil {
+				// A dangling symlink
+				continue
+			}
+		}
+
+		if fi.IsDir() {
+			if matchAny(ignores, relPath, true) || matchAny(f.exclude, relPath, true) {
+				continue
+			}
+			if err := f.loadDirectory(path, relPath, ignores); err != nil {
+				return err
+			}
+			continue
+		}
 
-	for _, fi := range files {
 		if !fi.Mode().IsRegular() {
 			continue
 		}
-		if !strings.HasSuffix(fi.Name(), ".appmap.json") {
+		if e, ok := archiveEntries[path]; ok && f.fs == archives {
+			// The placeholder of an AppMap in an archive
+			fi = e.info
+		}
+		if !strings.HasSuffix(fi.Name(), appmapSuffix) {
+			continue
+		}
+		if matchAny(ignores, relPath, false) || matchAny(f.exclude, relPath, false) {
+			continue
+		}
+		if len(f.include) > 0 && !matchAny(f.include, relPath, false) {
 			continue
 		}
 
-		if !validateFile(fi, validators) {
+		if !validateFile(fi, f.validators) {
 			continue
 		}
 
-		scenarioFiles = append(scenarioFiles, filepath.Join(dirName, fi.Name()))
+		f.files = append(f.files, path)
 	}
-	return scenarioFiles, nil
+	return nil
 }
 
+// loadIgnores adds the rules of the .applandignore file in dirName, if there
+// is one, to those of its parents. Each line is a pattern relative to the
+// directory of the file, lines starting with # are comments.
+func (f *finder) loadIgnores(dirName string, relDir string, ignores []*pattern) ([]*pattern, error) {
+	file, err := f.fs.Open(filepath.Join(dirName, ignoreFilename))
+	if os.IsNotExist(err) {
+		return ignores, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Copy, so that siblings don't see each other's rules
+	ignores = append([]*pattern{}, ignores...)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := compilePattern(line, relDir)
+		if err != nil {
+			return nil, err
+		}
+		ignores = append(ignores, p)
+	}
+
+	return ignores, scanner.Err()
+}
+
+func compilePatterns(globs []string) ([]*pattern, error) {
+	patterns := make([]*pattern, 0, len(globs))
+	for _, glob := range globs {
+		p, err := compilePattern(glob, "")
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// loadArchive adds the AppMaps in an archive, or read from stdin, searching
+// it as if it were a directory.
+func (f *finder) loadArchive(path string) error {
+	var (
+		root string
+		err  error
+	)
+	if path == StdinPath {
+		root, err = readStdin()
+	} else {
+		root, err = readArchiveFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fs := f.fs
+	f.fs = archives
+	defer func() { f.fs = fs }()
+
+	fi, err := f.fs.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		// A single AppMap read from stdin
+		if fi, err = Stat(root); err != nil {
+			return err
+		}
+		if validateFile(fi, f.validators) {
+			f.files = append(f.files, root)
+		}
+		return nil
+	}
+	return f.loadDirectory(root, "", nil)
+}
+
+// loadArchiveEntry adds the AppMap at the virtual path name, in archive.
+func (f *finder) loadArchiveEntry(archive string, name string) error {
+	root, err := readArchiveFile(archive)
+	if err != nil {
+		return err
+	}
+
+	_, entry, _ := splitVirtual(name)
+	name, _ = entryPath(strings.TrimSuffix(root, archiveSeparator), entry)
+	e, ok := archiveEntries[name]
+	if !ok {
+		return fmt.Errorf("there is no AppMap %s in %s", entry, archive)
+	}
+	if validateFile(e.info, f.validators) {
+		f.files = append(f.files, name)
+	}
+	return nil
+}
+
+// FindAppMaps returns the AppMaps in paths, searching directories
+// recursively. Paths may also be .tar, .tar.gz or .zip archives, the virtual
+// paths of AppMaps in them, or - to read an archive or a single AppMap from
+// stdin; use Open to read the AppMaps found in them. Files which any of the validators reject are left out.
 func FindAppMaps(paths []string, validators ...Validator) ([]string, error) {
-	scenarioFiles := make([]string, 0, 10)
+	return Find(paths, Filter{}, validators...)
+}
+
+// Find is FindAppMaps, with the AppMaps found in directories and archives
+// selected by filter.
+func Find(paths []string, filter Filter, validators ...Validator) ([]string, error) {
+	f := &finder{
+		fs:         config.GetFS(),
+		validators: validators,
+		visited:    map[string]bool{},
+		files:      make([]string, 0, 10),
+	}
+
+	var err error
+	if f.include, err = compilePatterns(filter.Include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(filter.Exclude); err != nil {
+		return nil, err
+	}
+
 	for _, path := range paths {
-		fi, err := config.GetFS().Stat(path)
+		if path == StdinPath {
+			if err := f.loadArchive(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		fi, err := f.fs.Stat(path)
+		if os.IsNotExist(err) {
+			if archive, _, ok := splitVirtual(path); ok && archive != stdinName && isArchive(archive) {
+				if err := f.loadArchiveEntry(archive, path); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		switch mode := fi.Mode(); {
+		case mode.IsRegular() && isArchive(path):
+			if err := f.loadArchive(path); err != nil {
+				return nil, err
+			}
 		case mode.IsDir():
-			scenarioFiles, err = loadDirectory(path, scenarioFiles, validators)
-			if err != nil {
+			if err := f.loadDirectory(path, "", nil); err != nil {
 				return nil, err
 			}
 		case mode.IsRegular():
@@ -63,8 +302,8 @@ func FindAppMaps(paths []string, validators ...Validator) ([]string, error) {
 				continue
 			}
 
-			scenarioFiles = append(scenarioFiles, path)
+			f.files = append(f.files, path)
 		}
 	}
-	return scenarioFiles, nil
+	return f.files, nil
 }
@@ -0,0 +1,368 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/applandinc/appland-cli/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles creates each directory explicitly, since MemMapFs doesn't mark
+// parents which are created implicitly as directories.
+func writeFiles(t *testing.T, fs afero.Fs, files map[string]string) {
+	for name := range files {
+		parts := strings.Split(filepath.Dir(name), "/")
+		for i := range parts {
+			require.Nil(t, fs.MkdirAll(filepath.Join(parts[:i+1]...), 0755))
+		}
+	}
+	for name, content := range files {
+		require.Nil(t, afero.WriteFile(fs, name, []byte(content), 0644))
+	}
+}
+
+func TestFindRecursive(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	writeFiles(t, fs, map[string]string{
+		"tmp/appmap/root.appmap.json":               "{}",
+		"tmp/appmap/minitest/a.appmap.json":         "{}",
+		"tmp/appmap/rspec/b.appmap.json":            "{}",
+		"tmp/appmap/rspec/nested/c.appmap.json":     "{}",
+		"tmp/appmap/rspec/nested/notes.txt":         "",
+		"tmp/appmap/rspec/nested/large.appmap.json": "{\"large\": true}",
+	})
+
+	small := func(fi os.FileInfo) bool { return fi.Size() < 10 }
+	found, err := FindAppMaps([]string{"tmp/appmap"}, small)
+	require.Nil(t, err)
+
+	assert.ElementsMatch(t, []string{
+		"tmp/appmap/root.appmap.json",
+		"tmp/appmap/minitest/a.appmap.json",
+		"tmp/appmap/rspec/b.appmap.json",
+		"tmp/appmap/rspec/nested/c.appmap.json",
+	}, found)
+}
+
+func TestFindFilter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	writeFiles(t, fs, map[string]string{
+		"tmp/appmap/minitest/a.appmap.json":     "{}",
+		"tmp/appmap/minitest/b.appmap.json":     "{}",
+		"tmp/appmap/rspec/a.appmap.json":        "{}",
+		"tmp/appmap/rspec/nested/a.appmap.json": "{}",
+		"tmp/appmap/single.appmap.json":         "{}",
+	})
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{
+			name:   "include by name",
+			filter: Filter{Include: []string{"a.*"}},
+			expected: []string{
+				"tmp/appmap/minitest/a.appmap.json",
+				"tmp/appmap/rspec/a.appmap.json",
+				"tmp/appmap/rspec/nested/a.appmap.json",
+			},
+		},
+		{
+			name:   "include by path",
+			filter: Filter{Include: []string{"rspec/**/*.appmap.json"}},
+			expected: []string{
+				"tmp/appmap/rspec/a.appmap.json",
+				"tmp/appmap/rspec/nested/a.appmap.json",
+			},
+		},
+		{
+			name:   "exclude directory",
+			filter: Filter{Exclude: []string{"rspec"}},
+			expected: []string{
+				"tmp/appmap/minitest/a.appmap.json",
+				"tmp/appmap/minitest/b.appmap.json",
+				"tmp/appmap/single.appmap.json",
+			},
+		},
+		{
+			name:   "include and exclude",
+			filter: Filter{Include: []string{"**/a.appmap.json"}, Exclude: []string{"rspec/nested/"}},
+			expected: []string{
+				"tmp/appmap/minitest/a.appmap.json",
+				"tmp/appmap/rspec/a.appmap.json",
+			},
+		},
+		{
+			name:   "character class",
+			filter: Filter{Include: []string{"minitest/[!a].appmap.json"}},
+			expected: []string{
+				"tmp/appmap/minitest/b.appmap.json",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := Find([]string{"tmp/appmap"}, test.filter)
+			require.Nil(t, err)
+			assert.ElementsMatch(t, test.expected, found)
+		})
+	}
+
+	// Files given explicitly aren't filtered
+	found, err := Find([]string{"tmp/appmap/single.appmap.json"}, Filter{Exclude: []string{"*"}})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"tmp/appmap/single.appmap.json"}, found)
+
+	_, err = Find([]string{"tmp/appmap"}, Filter{Include: []string{"[a"}})
+	assert.NotNil(t, err)
+}
+
+func TestFindIgnoreFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	writeFiles(t, fs, map[string]string{
+		"tmp/appmap/.applandignore":               "# generated\n\nscratch/\n*_slow.appmap.json\n",
+		"tmp/appmap/a.appmap.json":                "{}",
+		"tmp/appmap/a_slow.appmap.json":           "{}",
+		"tmp/appmap/scratch/b.appmap.json":        "{}",
+		"tmp/appmap/rspec/.applandignore":         "/c.appmap.json\n",
+		"tmp/appmap/rspec/c.appmap.json":          "{}",
+		"tmp/appmap/rspec/d.appmap.json":          "{}",
+		"tmp/appmap/rspec/d_slow.appmap.json":     "{}",
+		"tmp/appmap/minitest/c.appmap.json":       "{}",
+		"tmp/appmap/rspec/nested/c.appmap.json":   "{}",
+		"tmp/appmap/rspec/nested/scratch.appmap":  "{}",
+		"tmp/appmap/minitest/scratch/e.appmap.js": "{}",
+	})
+
+	found, err := FindAppMaps([]string{"tmp/appmap"})
+	require.Nil(t, err)
+
+	assert.ElementsMatch(t, []string{
+		"tmp/appmap/a.appmap.json",
+		"tmp/appmap/rspec/d.appmap.json",
+		"tmp/appmap/minitest/c.appmap.json",
+		"tmp/appmap/rspec/nested/c.appmap.json",
+	}, found)
+}
+
+func TestFindSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appland-files")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer config.SetFileSystem(config.GetFS())
+	config.SetFileSystem(afero.NewOsFs())
+
+	appmaps := filepath.Join(dir, "appmap")
+	require.Nil(t, os.MkdirAll(filepath.Join(appmaps, "rspec"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(appmaps, "rspec", "a.appmap.json"), []byte("{}"), 0644))
+
+	// A loop back to the parent, and a second path to the same directory
+	require.Nil(t, os.Symlink(appmaps, filepath.Join(appmaps, "rspec", "loop")))
+	require.Nil(t, os.Symlink(filepath.Join(appmaps, "rspec"), filepath.Join(appmaps, "alias")))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(appmaps, "dangling")))
+
+	found, err := FindAppMaps([]string{appmaps})
+	require.Nil(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "a.appmap.json", filepath.Base(found[0]))
+}
+
+func tarArchive(t *testing.T, compress bool, entries map[string]string) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	w := io.Writer(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	for name, content := range entries {
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	if gz != nil {
+		require.Nil(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		require.Nil(t, err)
+		_, err = w.Write([]byte(content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestFindArchives(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	entries := map[string]string{
+		"tmp/appmap/.applandignore":            "scratch/\n",
+		"tmp/appmap/minitest/a.appmap.json":    `{"events":[]}`,
+		"./tmp/appmap/rspec/b.appmap.json":     "{}",
+		"tmp/appmap/scratch/c.appmap.json":     "{}",
+		"tmp/appmap/rspec/notes.txt":           "",
+		"../../tmp/appmap/rspec/d.appmap.json": "{}",
+	}
+
+	writeFiles(t, fs, map[string]string{
+		"ci/appmaps.tar":    string(tarArchive(t, false, entries)),
+		"ci/appmaps.tar.gz": string(tarArchive(t, true, entries)),
+		"ci/appmaps.zip":    string(zipArchive(t, entries)),
+	})
+
+	for _, archive := range []string{"ci/appmaps.tar", "ci/appmaps.tar.gz", "ci/appmaps.zip"} {
+		t.Run(archive, func(t *testing.T) {
+			found, err := Find([]string{archive}, Filter{Exclude: []string{"minitest"}})
+			require.Nil(t, err)
+			assert.ElementsMatch(t, []string{
+				archive + "!/tmp/appmap/rspec/b.appmap.json",
+				archive + "!/tmp/appmap/rspec/d.appmap.json",
+			}, found)
+
+			assert.Equal(t, archive, Origin(found[0]))
+
+			data, err := ReadFile(archive + "!/tmp/appmap/minitest/a.appmap.json")
+			require.Nil(t, err)
+			assert.Equal(t, `{"events":[]}`, string(data))
+		})
+	}
+
+	_, err := ReadFile("ci/appmaps.zip!/tmp/appmap/missing.appmap.json")
+	assert.NotNil(t, err)
+
+	// AppMaps are also found by their virtual path
+	for _, archive := range []string{"ci/appmaps.tar.gz", "ci/appmaps.zip"} {
+		found, err := Find([]string{archive + "!/tmp/appmap/minitest/a.appmap.json"}, Filter{})
+		require.Nil(t, err)
+		assert.Equal(t, []string{archive + "!/tmp/appmap/minitest/a.appmap.json"}, found)
+		data, err := ReadFile(found[0])
+		require.Nil(t, err)
+		assert.Equal(t, `{"events":[]}`, string(data))
+	}
+	_, err = Find([]string{"ci/appmaps.zip!/tmp/appmap/missing.appmap.json"}, Filter{})
+	assert.NotNil(t, err)
+
+	// Paths on disk which only look like virtual paths are left alone
+	assert.Equal(t, "ci/appmaps.zip!/tmp/appmap/missing.appmap.json", Origin("ci/appmaps.zip!/tmp/appmap/missing.appmap.json"))
+	writeFiles(t, fs, map[string]string{"tmp/a!/b.appmap.json": "{}"})
+	found, err := Find([]string{"tmp"}, Filter{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"tmp/a!/b.appmap.json"}, found)
+	assert.Equal(t, "tmp/a!/b.appmap.json", Origin(found[0]))
+	data, err := ReadFile(found[0])
+	require.Nil(t, err)
+	assert.Equal(t, "{}", string(data))
+}
+
+func TestArchiveEntries(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	config.SetFileSystem(fs)
+
+	content := strings.Repeat(`{"events":[]}`, 100)
+	entries := map[string]string{"a.appmap.json": content, ".applandignore": "b.appmap.json\n", "b.appmap.json": "{}"}
+	writeFiles(t, fs, map[string]string{
+		"appmaps.tar":    string(tarArchive(t, false, entries)),
+		"appmaps.tar.gz": string(tarArchive(t, true, entries)),
+		"appmaps.zip":    string(zipArchive(t, entries)),
+	})
+
+	var sizes []int64
+	size := func(fi os.FileInfo) bool {
+		sizes = append(sizes, fi.Size())
+		return true
+	}
+	found, err := FindAppMaps([]string{"appmaps.tar", "appmaps.tar.gz", "appmaps.zip"}, size)
+	require.Nil(t, err)
+	require.Len(t, found, 3)
+
+	// Validators are given the size of the AppMaps, which are read from the
+	// archives rather than held in memory
+	assert.Equal(t, []int64{1300, 1300, 1300}, sizes)
+	for _, name := range found {
+		placeholder, err := afero.ReadFile(archives, name)
+		require.Nil(t, err)
+		assert.Empty(t, placeholder)
+
+		fi, err := Stat(name)
+		require.Nil(t, err)
+		assert.Equal(t, int64(1300), fi.Size())
+
+		data, err := ReadFile(name)
+		require.Nil(t, err)
+		assert.Equal(t, content, string(data))
+	}
+
+	// Only the gzipped archive is spooled, until it's cleaned up
+	spooled, err := afero.Glob(fs, filepath.Join(os.TempDir(), spoolPattern+"*"))
+	require.Nil(t, err)
+	assert.Len(t, spooled, 1)
+
+	require.Nil(t, Cleanup())
+	spooled, err = afero.Glob(fs, filepath.Join(os.TempDir(), spoolPattern+"*"))
+	require.Nil(t, err)
+	assert.Empty(t, spooled)
+	_, err = ReadFile("appmaps.tar.gz!/a.appmap.json")
+	assert.NotNil(t, err)
+}
+
+func TestFindStdin(t *testing.T) {
+	defer func() { Stdin = os.Stdin }()
+
+	entries := map[string]string{"tmp/appmap/a.appmap.json": "{}"}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{"tar", tarArchive(t, false, entries), "<stdin>!/tmp/appmap/a.appmap.json"},
+		{"tar.gz", tarArchive(t, true, entries), "<stdin>!/tmp/appmap/a.appmap.json"},
+		{"zip", zipArchive(t, entries), "<stdin>!/tmp/appmap/a.appmap.json"},
+		{"appmap", []byte(`{"events":[]}`), "<stdin>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Stdin = bytes.NewReader(test.input)
+
+			found, err := FindAppMaps([]string{"-"})
+			require.Nil(t, err)
+			assert.Equal(t, []string{test.expected}, found)
+			assert.Equal(t, ".", Origin(found[0]))
+
+			_, err = ReadFile(found[0])
+			assert.Nil(t, err)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pattern is a compiled glob. Besides the usual *, ? and [...], ** matches
+// any number of directories.
+type pattern struct {
+	re *regexp.Regexp
+	// dirOnly patterns end with a slash, and only match directories.
+	dirOnly bool
+}
+
+// compilePattern compiles a glob relative to base, a slash separated
+// directory.
+func compilePattern(glob string, base string) (*pattern, error) {
+	p := &pattern{}
+
+	if strings.HasSuffix(glob, "/") {
+		p.dirOnly = true
+		glob = strings.TrimSuffix(glob, "/")
+	}
+
+	// Patterns without a slash match a name at any depth.
+	anchored := strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if base != "" && base != "." {
+		re.WriteString(regexp.QuoteMeta(path.Clean(base)) + "/")
+	}
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern %q: unterminated [", glob)
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	// A pattern matching a directory also matches everything beneath it.
+	re.WriteString("(?:/.*)?$")
+
+	var err error
+	if p.re, err = regexp.Compile(re.String()); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", glob, err)
+	}
+	return p, nil
+}
+
+// match reports whether a slash separated path matches the pattern.
+func (p *pattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		// The file may still be beneath a matching directory.
+		dir := path.Dir(relPath)
+		return dir != "." && p.re.MatchString(dir)
+	}
+	return p.re.MatchString(relPath)
+}
@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/applandinc/appland-cli/internal/util"
 	jsonpatch "github.com/evanphx/json-patch"
@@ -141,7 +142,10 @@ type Git struct {
 	Tag        string   `json:"annotated_tag,omitempty"`
 }
 
+// GitProvider caches Git metadata per repository. It's safe for concurrent
+// use.
 type GitProvider struct {
+	mutex sync.Mutex
 	cache map[string]*Git
 }
 
@@ -157,15 +161,25 @@ func (provider *GitProvider) Get(path string) (Metadata, error) {
 		return nil, err
 	}
 
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
 	existingMetadata := provider.cache[info.Path]
 	if existingMetadata != nil {
-		return existingMetadata, nil
+		return existingMetadata.copy(), nil
 	}
 
 	gitMetadata := collectGitMetadata(info.Repository).Build()
 	provider.cache[info.Path] = gitMetadata
 
-	return gitMetadata, nil
+	return gitMetadata.copy(), nil
+}
+
+// copy returns a shallow copy of git, so callers can override fields without
+// affecting the cached value.
+func (git *Git) copy() *Git {
+	c := *git
+	return &c
 }
 
 func (git *Git) AsPatch() (*jsonpatch.Patch, error) {
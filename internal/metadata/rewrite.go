@@ -0,0 +1,431 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// Rewrite copies the AppMap read from r to w, applying patches to its
+// metadata object, class map and events along the way. Only the metadata
+// object, the class map if it's patched and the events being patched are held
+// in memory, everything else is copied through as is, so memory use doesn't
+// depend on the number of events.
+//
+// Patches address the metadata, class map and events as they would in the
+// full document, e.g. /metadata/git, /classMap/0/children/0/location or
+// /events/12/parameters/0/value. If the AppMap has no metadata, it's patched
+// as an empty object and added at the end. Without any patches, r is copied as
+// is.
+func Rewrite(r io.Reader, w io.Writer, patches []*jsonpatch.Patch) error {
+	if len(patches) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	metadataPatches, classMapPatches, eventPatches, err := splitPatches(patches)
+	if err != nil {
+		return err
+	}
+
+	s := &rewriter{
+		r:               bufio.NewReader(r),
+		w:               bufio.NewWriter(w),
+		classMapPatches: classMapPatches,
+		eventPatches:    eventPatches,
+	}
+
+	if err := s.rewrite(metadataPatches); err != nil {
+		return err
+	}
+
+	return s.w.Flush()
+}
+
+// splitPatches separates the operations addressing the class map and events
+// from the others, which address the metadata. The operations of each event
+// address it as the root of the document.
+func splitPatches(patches []*jsonpatch.Patch) ([]*jsonpatch.Patch, []*jsonpatch.Patch, map[int]jsonpatch.Patch, error) {
+	var (
+		metadataPatches []*jsonpatch.Patch
+		classMapPatches []*jsonpatch.Patch
+		eventPatches    = map[int]jsonpatch.Patch{}
+	)
+	for _, patch := range patches {
+		var metadataPatch, classMapPatch jsonpatch.Patch
+		for _, op := range *patch {
+			path, err := op.Path()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if path == "/classMap" || strings.HasPrefix(path, "/classMap/") {
+				if _, ok := op["from"]; ok {
+					return nil, nil, nil, fmt.Errorf("unsupported %s of %s, the class map can't be moved or copied from", op.Kind(), path)
+				}
+				classMapPatch = append(classMapPatch, op)
+				continue
+			}
+			if !strings.HasPrefix(path, "/events/") {
+				metadataPatch = append(metadataPatch, op)
+				continue
+			}
+
+			parts := strings.SplitN(strings.TrimPrefix(path, "/events/"), "/", 2)
+			index, err := strconv.Atoi(parts[0])
+			if err != nil || len(parts) < 2 {
+				return nil, nil, nil, fmt.Errorf("unsupported patch of %s, only the fields of events can be patched", path)
+			}
+			if _, ok := op["from"]; ok {
+				return nil, nil, nil, fmt.Errorf("unsupported %s of %s, events can't be moved or copied from", op.Kind(), path)
+			}
+
+			eventPath, err := json.Marshal("/" + parts[1])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			eventOp := jsonpatch.Operation{}
+			for k, v := range op {
+				eventOp[k] = v
+			}
+			eventOp["path"] = (*json.RawMessage)(&eventPath)
+			eventPatches[index] = append(eventPatches[index], eventOp)
+		}
+
+		if len(metadataPatch) > 0 {
+			metadataPatches = append(metadataPatches, &metadataPatch)
+		}
+		if len(classMapPatch) > 0 {
+			classMapPatches = append(classMapPatches, &classMapPatch)
+		}
+	}
+	return metadataPatches, classMapPatches, eventPatches, nil
+}
+
+type rewriter struct {
+	r               *bufio.Reader
+	w               *bufio.Writer
+	classMapPatches []*jsonpatch.Patch
+	eventPatches    map[int]jsonpatch.Patch
+}
+
+func (s *rewriter) rewrite(patches []*jsonpatch.Patch) error {
+	c, err := s.skipWhitespace()
+	if err != nil {
+		return err
+	}
+	if c != '{' {
+		return fmt.Errorf("expected an object, found '%c'", c)
+	}
+	s.w.WriteByte(c)
+
+	sawMetadata := false
+	first := true
+	for {
+		c, err := s.skipWhitespace()
+		if err != nil {
+			return err
+		}
+
+		if c == '}' {
+			if !sawMetadata && len(patches) > 0 {
+				if err := s.writeMetadata(!first, []byte("{}"), patches); err != nil {
+					return err
+				}
+			}
+			s.w.WriteByte(c)
+			break
+		}
+
+		if !first {
+			if c != ',' {
+				return fmt.Errorf("expected ',' or '}', found '%c'", c)
+			}
+			if c, err = s.skipWhitespace(); err != nil {
+				return err
+			}
+		}
+
+		if c != '"' {
+			return fmt.Errorf("expected a key, found '%c'", c)
+		}
+
+		var key bytes.Buffer
+		key.WriteByte(c)
+		if err := s.copyString(&key); err != nil {
+			return err
+		}
+
+		var name string
+		if err := json.Unmarshal(key.Bytes(), &name); err != nil {
+			return err
+		}
+
+		if c, err = s.skipWhitespace(); err != nil {
+			return err
+		}
+		if c != ':' {
+			return fmt.Errorf("expected ':', found '%c'", c)
+		}
+
+		switch {
+		case name == "metadata" && !sawMetadata && len(patches) > 0:
+			var value bytes.Buffer
+			if err := s.copyValue(&value); err != nil {
+				return err
+			}
+			if err := s.writeMetadata(!first, value.Bytes(), patches); err != nil {
+				return err
+			}
+			sawMetadata = true
+		case name == "classMap" && len(s.classMapPatches) > 0:
+			var value bytes.Buffer
+			if err := s.copyValue(&value); err != nil {
+				return err
+			}
+			patched, err := patchField(name, value.Bytes(), s.classMapPatches)
+			if err != nil {
+				return fmt.Errorf("failed patching classMap: %w", err)
+			}
+			if !first {
+				s.w.WriteByte(',')
+			}
+			s.w.Write(key.Bytes())
+			s.w.WriteByte(':')
+			s.w.Write(patched)
+			s.classMapPatches = nil
+		case name == "events" && len(s.eventPatches) > 0:
+			if !first {
+				s.w.WriteByte(',')
+			}
+			s.w.Write(key.Bytes())
+			s.w.WriteByte(':')
+			if err := s.rewriteEvents(); err != nil {
+				return err
+			}
+		default:
+			if !first {
+				s.w.WriteByte(',')
+			}
+			s.w.Write(key.Bytes())
+			s.w.WriteByte(':')
+			if err := s.copyValue(s.w); err != nil {
+				return err
+			}
+		}
+
+		first = false
+	}
+
+	if len(s.classMapPatches) > 0 {
+		return fmt.Errorf("failed patching classMap: no classMap")
+	}
+
+	if len(s.eventPatches) > 0 {
+		missing := -1
+		for index := range s.eventPatches {
+			if missing < 0 || index < missing {
+				missing = index
+			}
+		}
+		return fmt.Errorf("failed patching event %d: no such event", missing)
+	}
+
+	// Copy anything trailing the document, usually just a newline.
+	_, err = io.Copy(s.w, s.r)
+	return err
+}
+
+func (s *rewriter) writeMetadata(comma bool, value []byte, patches []*jsonpatch.Patch) error {
+	patched, err := patchField("metadata", value, patches)
+	if err != nil {
+		return err
+	}
+
+	if comma {
+		s.w.WriteByte(',')
+	}
+	s.w.WriteString(`"metadata":`)
+	s.w.Write(patched)
+	return nil
+}
+
+// patchField applies patches to the value of a field of the AppMap, which they
+// address as they would in the full document.
+func patchField(name string, value []byte, patches []*jsonpatch.Patch) ([]byte, error) {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	doc := append(append(append(append([]byte("{"), key...), ':'), value...), '}')
+
+	for _, patch := range patches {
+		doc, err = patch.Apply(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var patched map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &patched); err != nil {
+		return nil, err
+	}
+	return patched[name], nil
+}
+
+// rewriteEvents copies the events array, applying the patches of each event.
+func (s *rewriter) rewriteEvents() error {
+	c, err := s.skipWhitespace()
+	if err != nil {
+		return err
+	}
+	if c != '[' {
+		return fmt.Errorf("expected an array of events, found '%c'", c)
+	}
+	s.w.WriteByte(c)
+
+	for index := 0; ; index++ {
+		c, err := s.skipWhitespace()
+		if err != nil {
+			return err
+		}
+		if c == ']' {
+			s.w.WriteByte(c)
+			return nil
+		}
+
+		if index > 0 {
+			if c != ',' {
+				return fmt.Errorf("expected ',' or ']', found '%c'", c)
+			}
+			s.w.WriteByte(c)
+		} else if err := s.r.UnreadByte(); err != nil {
+			return err
+		}
+
+		patch, ok := s.eventPatches[index]
+		if !ok {
+			if err := s.copyValue(s.w); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var event bytes.Buffer
+		if err := s.copyValue(&event); err != nil {
+			return err
+		}
+		patched, err := patch.Apply(event.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed patching event %d: %w", index, err)
+		}
+		s.w.Write(patched)
+		delete(s.eventPatches, index)
+	}
+}
+
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// skipWhitespace returns the next byte which isn't whitespace.
+func (s *rewriter) skipWhitespace() (byte, error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+
+		if !isWhitespace(c) {
+			return c, nil
+		}
+	}
+}
+
+// copyString copies the remainder of a string whose opening quote has
+// already been read.
+func (s *rewriter) copyString(w io.ByteWriter) error {
+	escaped := false
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		w.WriteByte(c)
+
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return nil
+		}
+	}
+}
+
+// copyValue copies a single JSON value, without validating it beyond what's
+// necessary to find where it ends.
+func (s *rewriter) copyValue(w io.ByteWriter) error {
+	c, err := s.skipWhitespace()
+	if err != nil {
+		return err
+	}
+
+	switch c {
+	case '"':
+		w.WriteByte(c)
+		return s.copyString(w)
+	case '{', '[':
+		w.WriteByte(c)
+		depth := 1
+		for depth > 0 {
+			c, err := s.r.ReadByte()
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			} else if err != nil {
+				return err
+			}
+
+			w.WriteByte(c)
+
+			switch c {
+			case '"':
+				if err := s.copyString(w); err != nil {
+					return err
+				}
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		return nil
+	}
+
+	// A number, true, false or null
+	for {
+		if c == ',' || c == '}' || c == ']' || isWhitespace(c) {
+			return s.r.UnreadByte()
+		}
+
+		w.WriteByte(c)
+
+		c, err = s.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
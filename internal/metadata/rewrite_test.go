@@ -0,0 +1,102 @@
+package metadata
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rewrite(t *testing.T, appmap string, git *Git) string {
+	patch, err := git.AsPatch()
+	require.Nil(t, err)
+
+	var out bytes.Buffer
+	require.Nil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{patch}))
+	return out.String()
+}
+
+func TestRewrite(t *testing.T) {
+	git := &Git{Branch: "master", Commit: "76c0ae55"}
+	appmap := `{
+  "events": [{"id": 1, "event": "call", "defined_class": "A\"}", "static": false, "lineno": 12}],
+  "metadata": {"name": "test", "git": {"branch": "old"}},
+  "classMap": []
+}
+`
+
+	assert.Equal(t, `{"events":[{"id": 1, "event": "call", "defined_class": "A\"}", "static": false, "lineno": 12}],"metadata":{"git":{"branch":"master","commit":"76c0ae55"},"name":"test"},"classMap":[]}
+`, rewrite(t, appmap, git))
+}
+
+func TestRewriteWithoutMetadata(t *testing.T) {
+	git := &Git{Branch: "master"}
+
+	assert.Equal(t, `{"version":1.2,"metadata":{"git":{"branch":"master"}}}`, rewrite(t, `{"version": 1.2}`, git))
+	assert.Equal(t, `{"metadata":{"git":{"branch":"master"}}}`, rewrite(t, `{}`, git))
+}
+
+func TestRewriteInvalid(t *testing.T) {
+	git := &Git{Branch: "master"}
+	patch, err := git.AsPatch()
+	require.Nil(t, err)
+
+	for _, appmap := range []string{`[]`, `{"events": [`, `{"events" []}`, `this is not json`} {
+		var out bytes.Buffer
+		assert.NotNil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{patch}), appmap)
+	}
+}
+
+func TestRewriteEvents(t *testing.T) {
+	metadataPatch, err := (&Git{Branch: "master"}).AsPatch()
+	require.Nil(t, err)
+	eventPatch, err := jsonpatch.DecodePatch([]byte(`[
+		{"op": "replace", "path": "/events/1/parameters/0/value", "value": "[REDACTED]"},
+		{"op": "remove", "path": "/events/2/http_server_request/headers/Authorization"}
+	]`))
+	require.Nil(t, err)
+
+	appmap := `{"events": [
+		{"id": 1, "event": "call"},
+		{"id": 2, "event": "call", "parameters": [{"name": "password", "value": "hunter2"}]},
+		{"id": 3, "event": "call", "http_server_request": {"headers": {"Authorization": "Bearer x", "Accept": "*/*"}}}
+	], "metadata": {"name": "test"}}`
+
+	// Events which aren't patched are copied as is, and so is the metadata
+	// unless it's patched
+	var out bytes.Buffer
+	require.Nil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{&eventPatch}))
+	assert.Equal(t, `{"events":[{"id": 1, "event": "call"},{"event":"call","id":2,"parameters":[{"name":"password","value":"[REDACTED]"}]},{"event":"call","http_server_request":{"headers":{"Accept":"*/*"}},"id":3}],"metadata":{"name": "test"}}`, out.String())
+
+	out.Reset()
+	require.Nil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{metadataPatch, &eventPatch}))
+	assert.Contains(t, out.String(), `"metadata":{"git":{"branch":"master"},"name":"test"}`)
+	assert.Contains(t, out.String(), `"value":"[REDACTED]"`)
+
+	missing, err := jsonpatch.DecodePatch([]byte(`[{"op": "remove", "path": "/events/3/parameters"}]`))
+	require.Nil(t, err)
+	assert.EqualError(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{&missing}), "failed patching event 3: no such event")
+
+	whole, err := jsonpatch.DecodePatch([]byte(`[{"op": "remove", "path": "/events/0"}]`))
+	require.Nil(t, err)
+	assert.NotNil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{&whole}))
+}
+
+func TestRewriteClassMap(t *testing.T) {
+	patch, err := jsonpatch.DecodePatch([]byte(`[
+		{"op": "replace", "path": "/classMap/0/children/0/location", "value": "app/user.rb:3"},
+		{"op": "replace", "path": "/metadata/name", "value": "renamed"}
+	]`))
+	require.Nil(t, err)
+
+	appmap := `{"classMap": [{"name": "app", "type": "package", "children": [{"name": "User", "type": "class", "location": "/src/app/user.rb:3"}]}], "events": [{"id": 1, "event": "call"}], "metadata": {"name": "test"}}`
+
+	var out bytes.Buffer
+	require.Nil(t, Rewrite(strings.NewReader(appmap), &out, []*jsonpatch.Patch{&patch}))
+	assert.Equal(t, `{"classMap":[{"children":[{"location":"app/user.rb:3","name":"User","type":"class"}],"name":"app","type":"package"}],"events":[{"id": 1, "event": "call"}],"metadata":{"name":"renamed"}}`, out.String())
+
+	assert.EqualError(t, Rewrite(strings.NewReader(`{"events": []}`), &out, []*jsonpatch.Patch{&patch}), "failed patching classMap: no classMap")
+}
@@ -0,0 +1,320 @@
+package metadata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/applandinc/appland-cli/internal/appmap"
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// Transformer patches the events of AppMaps, e.g. to redact the values
+// recorded in them. Transform returns the operations patching an event, which
+// address the event as the root of the document.
+type Transformer interface {
+	Transform(e *appmap.Event) (jsonpatch.Patch, error)
+}
+
+// DocumentTransformer is a Transformer which also patches the rest of the
+// AppMap, once its events have been streamed. TransformDocument returns
+// operations addressing the metadata or class map as they would in the full
+// document, e.g. /classMap/0/children/0/location.
+type DocumentTransformer interface {
+	Transformer
+	TransformDocument(m *appmap.AppMap) (jsonpatch.Patch, error)
+}
+
+// Transform streams the AppMap read from r through the transformers, and
+// returns the patch for Rewrite, or nil if nothing was patched. Transformers
+// see the AppMap as it was recorded, if more than one of them patches the same
+// value, the last one wins.
+func Transform(r io.Reader, transformers []Transformer) (*jsonpatch.Patch, error) {
+	var (
+		patch jsonpatch.Patch
+		index int
+	)
+	m, err := appmap.Stream(r, func(e *appmap.Event) error {
+		for _, transformer := range transformers {
+			ops, err := transformer.Transform(e)
+			if err != nil {
+				return fmt.Errorf("failed transforming event %d: %w", e.ID, err)
+			}
+
+			for _, op := range ops {
+				path, err := op.Path()
+				if err != nil {
+					return err
+				}
+				eventPath, err := json.Marshal(fmt.Sprintf("/events/%d%s", index, path))
+				if err != nil {
+					return err
+				}
+
+				eventOp := jsonpatch.Operation{}
+				for k, v := range op {
+					eventOp[k] = v
+				}
+				eventOp["path"] = (*json.RawMessage)(&eventPath)
+				patch = append(patch, eventOp)
+			}
+		}
+		index++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, transformer := range transformers {
+		if dt, ok := transformer.(DocumentTransformer); ok {
+			ops, err := dt.TransformDocument(m)
+			if err != nil {
+				return nil, err
+			}
+			patch = append(patch, ops...)
+		}
+	}
+
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	return &patch, nil
+}
+
+// Operation builds a patch operation. The value is left out of remove
+// operations.
+func Operation(kind string, path string, value interface{}) (jsonpatch.Operation, error) {
+	fields := map[string]interface{}{"op": kind, "path": path}
+	if kind != "remove" {
+		fields["value"] = value
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var op jsonpatch.Operation
+	err = json.Unmarshal(data, &op)
+	return op, err
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// EscapePointer escapes a key of an object to be used in a JSON pointer.
+func EscapePointer(key string) string {
+	return pointerEscaper.Replace(key)
+}
+
+// ParameterSelector selects the receivers, parameters and return values of
+// events by their class and name. Either may be nil to select any.
+type ParameterSelector struct {
+	Class *regexp.Regexp
+	Name  *regexp.Regexp
+}
+
+func (s ParameterSelector) matches(p *appmap.Parameter) bool {
+	if p.Value == nil {
+		return false
+	}
+	return (s.Class == nil || s.Class.MatchString(p.Class)) && (s.Name == nil || s.Name.MatchString(p.Name))
+}
+
+// replaceValues patches the values of the parameters of an event it selects
+// with the result of replace.
+func (s ParameterSelector) replaceValues(e *appmap.Event, replace func(value interface{}) interface{}) (jsonpatch.Patch, error) {
+	var patch jsonpatch.Patch
+	add := func(path string, p *appmap.Parameter) error {
+		if !s.matches(p) {
+			return nil
+		}
+		op, err := Operation("replace", path, replace(p.Value))
+		if err != nil {
+			return err
+		}
+		patch = append(patch, op)
+		return nil
+	}
+
+	if e.Receiver != nil {
+		if err := add("/receiver/value", e.Receiver); err != nil {
+			return nil, err
+		}
+	}
+	for i := range e.Parameters {
+		if err := add(fmt.Sprintf("/parameters/%d/value", i), &e.Parameters[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range e.Message {
+		if err := add(fmt.Sprintf("/message/%d/value", i), &e.Message[i]); err != nil {
+			return nil, err
+		}
+	}
+	if e.ReturnValue != nil {
+		if err := add("/return_value/value", e.ReturnValue); err != nil {
+			return nil, err
+		}
+	}
+	return patch, nil
+}
+
+// ValueRedactor replaces the values it selects by [REDACTED].
+type ValueRedactor struct {
+	ParameterSelector
+}
+
+func (r *ValueRedactor) Transform(e *appmap.Event) (jsonpatch.Patch, error) {
+	return r.replaceValues(e, func(interface{}) interface{} {
+		return "[REDACTED]"
+	})
+}
+
+// ValueHasher replaces the values it selects by their HMAC-SHA256 keyed with
+// Salt. Equal values have equal hashes, in every AppMap hashed with the same
+// salt, so they can still be told apart and followed from call to call.
+type ValueHasher struct {
+	ParameterSelector
+	Salt []byte
+}
+
+func (h *ValueHasher) Transform(e *appmap.Event) (jsonpatch.Patch, error) {
+	return h.replaceValues(e, func(value interface{}) interface{} {
+		text, ok := value.(string)
+		if !ok {
+			data, _ := json.Marshal(value)
+			text = string(data)
+		}
+
+		mac := hmac.New(sha256.New, h.Salt)
+		mac.Write([]byte(text))
+		return fmt.Sprintf("sha256:%x", mac.Sum(nil))
+	})
+}
+
+// HeaderDropper removes the HTTP server request headers named in Headers,
+// regardless of case, or all of them if there are none.
+type HeaderDropper struct {
+	Headers []string
+}
+
+func (d *HeaderDropper) Transform(e *appmap.Event) (jsonpatch.Patch, error) {
+	if e.HTTPServerRequest == nil || len(e.HTTPServerRequest.Headers) == 0 {
+		return nil, nil
+	}
+
+	if len(d.Headers) == 0 {
+		op, err := Operation("remove", "/http_server_request/headers", nil)
+		if err != nil {
+			return nil, err
+		}
+		return jsonpatch.Patch{op}, nil
+	}
+
+	names := make([]string, 0, len(e.HTTPServerRequest.Headers))
+	for name := range e.HTTPServerRequest.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var patch jsonpatch.Patch
+	for _, name := range names {
+		for _, header := range d.Headers {
+			if !strings.EqualFold(name, header) {
+				continue
+			}
+			op, err := Operation("remove", "/http_server_request/headers/"+EscapePointer(name), nil)
+			if err != nil {
+				return nil, err
+			}
+			patch = append(patch, op)
+			break
+		}
+	}
+	return patch, nil
+}
+
+// PathStripper makes the source paths which start with Prefix relative to it:
+// those of events and their exceptions, the locations of the class map, and
+// the source location and exception of the metadata.
+type PathStripper struct {
+	Prefix string
+}
+
+// pathPatch collects the operations of a PathStripper.
+type pathPatch struct {
+	prefix string
+	patch  jsonpatch.Patch
+}
+
+func (p *PathStripper) newPatch() *pathPatch {
+	return &pathPatch{prefix: strings.TrimSuffix(p.Prefix, "/") + "/"}
+}
+
+func (p *pathPatch) strip(pointer string, path string) error {
+	if !strings.HasPrefix(path, p.prefix) {
+		return nil
+	}
+	op, err := Operation("replace", pointer, strings.TrimPrefix(path, p.prefix))
+	if err != nil {
+		return err
+	}
+	p.patch = append(p.patch, op)
+	return nil
+}
+
+func (p *PathStripper) Transform(e *appmap.Event) (jsonpatch.Patch, error) {
+	patch := p.newPatch()
+	if err := patch.strip("/path", e.Path); err != nil {
+		return nil, err
+	}
+	for i, exception := range e.Exceptions {
+		if err := patch.strip(fmt.Sprintf("/exceptions/%d/path", i), exception.Path); err != nil {
+			return nil, err
+		}
+	}
+	return patch.patch, nil
+}
+
+func (p *PathStripper) TransformDocument(m *appmap.AppMap) (jsonpatch.Patch, error) {
+	patch := p.newPatch()
+
+	if m.Metadata.Exception != nil {
+		if err := patch.strip("/metadata/exception/path", m.Metadata.Exception.Path); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := m.Metadata.Extra["source_location"]; ok {
+		var location string
+		if json.Unmarshal(raw, &location) == nil {
+			if err := patch.strip("/metadata/source_location", location); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var walk func(pointer string, entries []appmap.ClassMapEntry) error
+	walk = func(pointer string, entries []appmap.ClassMapEntry) error {
+		for i, entry := range entries {
+			entryPointer := fmt.Sprintf("%s/%d", pointer, i)
+			if err := patch.strip(entryPointer+"/location", entry.Location); err != nil {
+				return err
+			}
+			if err := walk(entryPointer+"/children", entry.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("/classMap", m.ClassMap); err != nil {
+		return nil, err
+	}
+
+	return patch.patch, nil
+}
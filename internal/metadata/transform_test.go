@@ -0,0 +1,97 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const transformAppmap = `{"events":[
+	{"id":1,"event":"call","http_server_request":{"request_method":"POST","path_info":"/login","headers":{"Authorization":"Bearer abc","Cookie":"session=1","Accept":"*/*"}}},
+	{"id":2,"event":"call","defined_class":"Session","method_id":"create","path":"/home/ci/app/models/session.rb","lineno":3,"static":true,"parameters":[{"name":"email","class":"String","value":"jane@example.com"},{"name":"password","class":"String","value":"hunter2"},{"name":"remember","class":"Boolean","value":true}]},
+	{"id":3,"event":"return","parent_id":2,"return_value":{"class":"User","value":"#<User jane>"},"exceptions":[{"class":"Error","path":"/home/ci/app/models/user.rb"}]},
+	{"id":4,"event":"return","parent_id":1}
+],"metadata":{"name":"login","source_location":"/home/ci/app/test/login_test.rb","exception":{"class":"Error","path":"/home/ci/app/models/user.rb"}},
+"classMap":[{"name":"app","type":"package","children":[{"name":"Session","type":"class","children":[
+	{"name":"create","type":"function","location":"/home/ci/app/models/session.rb:3","static":true},
+	{"name":"destroy","type":"function","location":"lib/session.rb:9","static":false}
+]}]}]}`
+
+func transform(t *testing.T, transformers ...Transformer) map[string]interface{} {
+	patch, err := Transform(strings.NewReader(transformAppmap), transformers)
+	require.Nil(t, err)
+	require.NotNil(t, patch)
+
+	var out bytes.Buffer
+	require.Nil(t, Rewrite(strings.NewReader(transformAppmap), &out, []*jsonpatch.Patch{patch}))
+
+	var doc map[string]interface{}
+	require.Nil(t, json.Unmarshal(out.Bytes(), &doc))
+	return doc
+}
+
+// field looks up a field of an event by the keys and indexes leading to it.
+func field(doc map[string]interface{}, index int, path ...interface{}) interface{} {
+	var value interface{} = doc["events"].([]interface{})[index]
+	for _, key := range path {
+		switch k := key.(type) {
+		case string:
+			value = value.(map[string]interface{})[k]
+		case int:
+			value = value.([]interface{})[k]
+		}
+	}
+	return value
+}
+
+func TestTransformRedactAndHash(t *testing.T) {
+	doc := transform(t,
+		&ValueRedactor{ParameterSelector{Name: regexp.MustCompile(`^password$`)}},
+		&ValueHasher{ParameterSelector: ParameterSelector{Class: regexp.MustCompile(`^(String|User)$`), Name: regexp.MustCompile(`email|^$`)}, Salt: []byte("salt")},
+	)
+
+	assert.Equal(t, "[REDACTED]", field(doc, 1, "parameters", 1, "value"))
+	assert.Equal(t, true, field(doc, 1, "parameters", 2, "value"))
+
+	// Hashes are deterministic
+	hash := field(doc, 1, "parameters", 0, "value").(string)
+	assert.Regexp(t, `^sha256:[0-9a-f]{64}$`, hash)
+	again := transform(t, &ValueHasher{ParameterSelector: ParameterSelector{Name: regexp.MustCompile(`email`)}, Salt: []byte("salt")})
+	assert.Equal(t, hash, field(again, 1, "parameters", 0, "value"))
+	assert.NotEqual(t, hash, field(transform(t, &ValueHasher{ParameterSelector: ParameterSelector{Name: regexp.MustCompile(`email`)}}), 1, "parameters", 0, "value"))
+
+	assert.Regexp(t, `^sha256:`, field(doc, 2, "return_value", "value"))
+	assert.Equal(t, "/home/ci/app/test/login_test.rb", doc["metadata"].(map[string]interface{})["source_location"])
+}
+
+func TestTransformHeadersAndPaths(t *testing.T) {
+	doc := transform(t, &HeaderDropper{Headers: []string{"authorization", "COOKIE"}}, &PathStripper{Prefix: "/home/ci/app"})
+	assert.Equal(t, map[string]interface{}{"Accept": "*/*"}, field(doc, 0, "http_server_request", "headers"))
+	assert.Equal(t, "models/session.rb", field(doc, 1, "path"))
+	assert.Equal(t, "models/user.rb", field(doc, 2, "exceptions", 0, "path"))
+
+	// The class map and metadata are stripped too
+	metadata := doc["metadata"].(map[string]interface{})
+	assert.Equal(t, "test/login_test.rb", metadata["source_location"])
+	assert.Equal(t, "models/user.rb", metadata["exception"].(map[string]interface{})["path"])
+	functions := doc["classMap"].([]interface{})[0].(map[string]interface{})["children"].([]interface{})[0].(map[string]interface{})["children"].([]interface{})
+	assert.Equal(t, "models/session.rb:3", functions[0].(map[string]interface{})["location"])
+	assert.Equal(t, "lib/session.rb:9", functions[1].(map[string]interface{})["location"])
+
+	doc = transform(t, &HeaderDropper{})
+	assert.Nil(t, field(doc, 0, "http_server_request", "headers"))
+	assert.Equal(t, "/login", field(doc, 0, "http_server_request", "path_info"))
+
+	patch, err := Transform(strings.NewReader(transformAppmap), []Transformer{&PathStripper{Prefix: "/home/ci/app/models/session.rb:3"}})
+	assert.Nil(t, err)
+	assert.Nil(t, patch)
+
+	_, err = Transform(strings.NewReader(`{"events":[{"id":1`), []Transformer{&HeaderDropper{}})
+	assert.NotNil(t, err)
+}
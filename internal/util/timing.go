@@ -2,58 +2,112 @@ package util
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
-var currentTiming Timing
+var (
+	currentTiming      Timing
+	currentTimingMutex sync.Mutex
+)
 
 // Timing allows measuring time spent in code. Each Start() starts a new
 // step and returns a Timing which can be used in turn to measure substeps.
 // Last started Timing is also available to timing-ignorant code through util.Time().
+//
+// Fork() starts a step which runs alongside its siblings instead of finishing
+// them. Forked timings (and their substeps) are safe to use from separate
+// goroutines, but are never made available through util.Time(), since there
+// is no single "current" step when several run at once.
 type Timing interface {
 	Start(name string) Timing
+	Fork(name string) Timing
 	Finish()
 	Print()
 }
 
 type timing struct {
+	mutex     sync.Mutex
 	startTime time.Time
 	duration  time.Duration
 	name      string
 	steps     []*timing
+	// detached timings are never made current, they're forked or beneath a
+	// forked timing.
+	detached bool
+	// forked timings run alongside their siblings, so starting a sibling
+	// doesn't finish them.
+	forked bool
+}
+
+func setCurrentTiming(t Timing) {
+	currentTimingMutex.Lock()
+	currentTiming = t
+	currentTimingMutex.Unlock()
+}
+
+func getCurrentTiming() Timing {
+	currentTimingMutex.Lock()
+	defer currentTimingMutex.Unlock()
+	return currentTiming
 }
 
 func (t *timing) Start(name string) Timing {
+	nt := newTiming(name)
+	nt.detached = t.detached
+
+	t.mutex.Lock()
 	t.finishCurrentStep()
+	t.steps = append(t.steps, nt)
+	t.mutex.Unlock()
+
+	if !nt.detached {
+		setCurrentTiming(nt)
+	}
+	return nt
+}
+
+func (t *timing) Fork(name string) Timing {
 	nt := newTiming(name)
+	nt.detached = true
+	nt.forked = true
+
+	t.mutex.Lock()
 	t.steps = append(t.steps, nt)
-	currentTiming = nt
+	t.mutex.Unlock()
+
 	return nt
 }
 
+// finishCurrentStep must be called with t.mutex held.
 func (t *timing) finishCurrentStep() {
-	if l := len(t.steps); l > 0 {
+	if l := len(t.steps); l > 0 && !t.steps[l-1].forked {
 		t.steps[l-1].Finish()
 	}
 }
 
 func (t *timing) Finish() {
+	t.mutex.Lock()
 	if t.duration == 0 {
 		t.finishCurrentStep()
 		t.duration = time.Since(t.startTime)
-		if currentTiming == t {
-			currentTiming = nil
-		}
 	}
+	t.mutex.Unlock()
+
+	currentTimingMutex.Lock()
+	if currentTiming == t {
+		currentTiming = nil
+	}
+	currentTimingMutex.Unlock()
 }
 
 // Time allows code which doesn't want to deal with timing explicitly
 // to nonetheless allow timing events if the calling code requests.
 // It uses a hidden global reference to the last explicitly Start()ed Timing.
 func Time(name string) {
-	if t := currentTiming; t != nil {
+	if t := getCurrentTiming(); t != nil {
 		t.Start(name)
-		currentTiming = t
+		setCurrentTiming(t)
 	}
 }
 
@@ -76,8 +130,13 @@ func (t *timing) Print() {
 
 func (t *timing) print(prefix string) {
 	t.Finish()
+
+	t.mutex.Lock()
+	steps := t.steps
+	t.mutex.Unlock()
+
 	fmt.Printf("%s%s: %s\n", prefix, t.name, t.duration)
-	for _, step := range t.steps {
+	for _, step := range steps {
 		step.print(prefix + "  ")
 	}
 }
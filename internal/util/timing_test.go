@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingFork(t *testing.T) {
+	root := NewTiming("total").(*timing)
+
+	a := root.Fork("a")
+	b := root.Fork("b")
+	a.Start("reading")
+	time.Sleep(10 * time.Millisecond)
+	a.Start("uploading")
+	// Steps within a fork finish each other
+	assert.NotEqual(t, time.Duration(0), a.(*timing).steps[0].duration)
+	time.Sleep(10 * time.Millisecond)
+	a.Finish()
+
+	// Starting a sibling step doesn't finish the forks
+	root.Start("reporting")
+	assert.Equal(t, time.Duration(0), b.(*timing).duration)
+	b.Finish()
+	root.Finish()
+
+	require.Len(t, root.steps, 3)
+	fa, fb := root.steps[0], root.steps[1]
+	require.Len(t, fa.steps, 2)
+
+	reading, uploading := fa.steps[0], fa.steps[1]
+	assert.True(t, reading.duration >= 10*time.Millisecond, "reading took %s", reading.duration)
+	assert.True(t, uploading.duration >= 10*time.Millisecond, "uploading took %s", uploading.duration)
+	assert.True(t, fa.duration >= reading.duration+uploading.duration, "a took %s", fa.duration)
+
+	// Forks run alongside each other
+	assert.True(t, fb.startTime.Before(fa.startTime.Add(fa.duration)))
+	assert.True(t, fb.startTime.Add(fb.duration).After(fa.startTime.Add(fa.duration)))
+	assert.Nil(t, getCurrentTiming())
+}
+
+func TestTimingStart(t *testing.T) {
+	root := NewTiming("total").(*timing)
+
+	first := root.Start("first")
+	assert.Equal(t, first, getCurrentTiming())
+	time.Sleep(10 * time.Millisecond)
+	second := root.Start("second")
+	assert.Equal(t, second, getCurrentTiming())
+
+	// Starting a step finishes the one before it
+	assert.True(t, first.(*timing).duration >= 10*time.Millisecond, "first took %s", first.(*timing).duration)
+	assert.Equal(t, time.Duration(0), second.(*timing).duration)
+	root.Finish()
+	assert.NotEqual(t, time.Duration(0), second.(*timing).duration)
+	assert.Nil(t, getCurrentTiming())
+}